@@ -2,17 +2,14 @@ package anna
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
+	"slices"
 	"strings"
+	"unicode"
 
 	"encoding/json"
 	"errors"
-	"io"
 	"net/http"
-	"net/smtp"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
@@ -25,9 +22,13 @@ import (
 // (ANNAS_BASE_URLS env override). The old hardcoded annas-archive.li endpoints
 // were removed because that domain is now parked.
 
-// Supported formats and languages
+// Supported formats and languages. searchFormats are the book formats
+// Anna's lists in a search result's metadata line; the search scraper
+// matches them as whole words, since the images and HTML detectFileFormat
+// also knows would turn up in cover URLs and words like "document".
 var (
-	supportedFormats   = []string{"epub", "pdf", "mobi", "azw", "azw3"}
+	supportedFormats   = []string{"epub", "pdf", "mobi", "azw", "azw3", "docx", "doc", "rtf", "html", "txt", "fb2", "djvu", "cbz", "cbr", "jpg", "png", "gif", "bmp"}
+	searchFormats      = []string{"epub", "pdf", "mobi", "azw", "azw3", "docx", "doc", "rtf", "txt", "fb2", "djvu", "cbz", "cbr"}
 	supportedLanguages = []string{"english", "spanish", "french", "german", "italian", "portuguese", "russian", "chinese", "japanese", "korean", "arabic", "dutch", "polish", "turkish"}
 	languageMap        = map[string]string{
 		"english": "English", "spanish": "Spanish", "french": "French",
@@ -51,6 +52,32 @@ func getMimeType(format string) string {
 		return "application/x-mobipocket-ebook"
 	case "azw", "azw3":
 		return "application/vnd.amazon.ebook"
+	case "docx":
+		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case "doc":
+		return "application/msword"
+	case "rtf":
+		return "application/rtf"
+	case "html":
+		return "text/html"
+	case "txt":
+		return "text/plain"
+	case "fb2":
+		return "application/x-fictionbook+xml"
+	case "djvu":
+		return "image/vnd.djvu"
+	case "cbz":
+		return "application/vnd.comicbook+zip"
+	case "cbr":
+		return "application/vnd.comicbook-rar"
+	case "jpg", "jpeg":
+		return "image/jpeg"
+	case "png":
+		return "image/png"
+	case "gif":
+		return "image/gif"
+	case "bmp":
+		return "image/bmp"
 	default:
 		return "application/octet-stream"
 	}
@@ -66,6 +93,19 @@ func containsAny(s string, substrs []string) bool {
 	return false
 }
 
+// mentionsFormat reports whether text names one of searchFormats as a word.
+func mentionsFormat(text string) bool {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if slices.Contains(searchFormats, w) {
+			return true
+		}
+	}
+	return false
+}
+
 // cleanTitle removes file paths and cleans up a book title
 func cleanTitle(title string) string {
 	if title == "" {
@@ -108,15 +148,45 @@ func cleanTitle(title string) string {
 }
 
 // SendFileToKindle sends file data to Kindle email address (exported for test email command)
-func SendFileToKindle(fileData []byte, filename, mimeType, subject, smtpHost, smtpPort, smtpUser, smtpPassword, fromEmail, kindleEmail string) error {
+func SendFileToKindle(fileData []byte, filename, mimeType, subject string, mail MailConfig, to Recipient) error {
+	return sendFileToKindle(fileData, filename, mimeType, subject, mail, to, &DeliveryReport{})
+}
+
+// sendFileToKindle is SendFileToKindle recording its decisions in report,
+// which callers may pre-fill with their own (PDF conversion, volumes). In
+// capture mode the report becomes the .eml's sidecar.
+func sendFileToKindle(fileData []byte, filename, mimeType, subject string, mail MailConfig, to Recipient, report *DeliveryReport) error {
 	l := logger.GetLogger()
+	kindleEmail := to.Email
+	report.Recipient = to.String()
+	report.Filename = filename
+	report.MimeType = mimeType
+	report.OriginalBytes = int64(len(fileData))
+
+	sender, err := NewSender(mail)
+	if err != nil {
+		return err
+	}
+	// Hold the recipient's slot for the whole attempt; it is given back
+	// unless the book goes out or into the outbox.
+	release, err := reserveRecipient(to)
+	if err != nil {
+		return err
+	}
+	sent := false
+	defer func() {
+		if !sent {
+			release()
+		}
+	}()
 
 	// Sanitize EPUBs before sending. Many Anna's Archive EPUBs were round-tripped
 	// out of Amazon's ecosystem and carry invalid data-Amzn* XHTML attributes that
 	// make Amazon's own Send-to-Kindle converter fail with "E999 - Send to Kindle
 	// Internal Error". Stripping them yields a spec-compliant (epubcheck-clean)
 	// EPUB that Amazon converts normally. No-op for non-EPUB or already-clean files.
-	if mimeType == "application/epub+zip" || strings.HasSuffix(strings.ToLower(filename), ".epub") {
+	isEPUB := mimeType == "application/epub+zip" || strings.HasSuffix(strings.ToLower(filename), ".epub")
+	if isEPUB {
 		if cleaned, stripped, err := SanitizeEPUB(fileData); err != nil {
 			l.Warn("EPUB sanitize failed; sending original", zap.Error(err))
 		} else if stripped > 0 {
@@ -127,76 +197,130 @@ func SendFileToKindle(fileData []byte, filename, mimeType, subject, smtpHost, sm
 				zap.Int("bytes_after", len(cleaned)),
 			)
 			fileData = cleaned
-		}
-		// Validate the (now-sanitized) EPUB. Reject DRM / structurally broken
-		// files up front with a clear reason, so the user can pick another edition
-		// instead of getting a silent E999 from Amazon hours later.
-		if err := ValidateEPUB(fileData); err != nil {
+			report.SanitizedAttrs = stripped
+		}
+		// Strip scripts, embeds and remote resources; the book came from an
+		// unknown source.
+		if hardened, hr, err := HardenEPUB(fileData); err != nil {
+			l.Warn("EPUB hardening failed; sending without it", zap.String("filename", filename), zap.Error(err))
+		} else if hr.Total() > 0 {
+			l.Info("Removed active content from EPUB",
+				zap.String("filename", filename),
+				zap.Int("scripts", hr.Scripts),
+				zap.Int("event_handlers", hr.EventHandlers),
+				zap.Int("embeds", hr.Embeds),
+				zap.Int("remote_refs", hr.RemoteRefs),
+			)
+			fileData = hardened
+			report.Hardened = &hr
+		}
+		// Repair what can be repaired mechanically (see RepairEPUB) rather
+		// than reject the edition over it.
+		if repaired, repairs, err := RepairEPUB(fileData); err != nil {
+			l.Warn("EPUB repair failed; validating as is", zap.String("filename", filename), zap.Error(err))
+		} else if len(repairs) > 0 {
+			l.Info("Repaired EPUB before sending to Kindle",
+				zap.String("filename", filename),
+				zap.Stringers("repairs", repairs),
+			)
+			fileData = repaired
+			report.Repairs = repairs
+		}
+		// Validate the (now-sanitized and repaired) EPUB. Reject DRM /
+		// structurally broken files up front with a clear reason, so the user
+		// can pick another edition instead of getting a silent E999 from Amazon
+		// hours later. Lesser problems are logged and recorded, not fatal.
+		check := CheckEPUB(fileData)
+		if err := check.Err(); err != nil {
 			return fmt.Errorf("this EPUB can't be sent to Kindle: %w", err)
 		}
+		report.Validated = true
+		if len(check.Findings) > 0 {
+			report.Validation = check
+			l.Warn("EPUB has structural problems",
+				zap.String("filename", filename),
+				zap.String("summary", check.Summary()),
+				zap.Stringers("findings", check.Findings[:min(len(check.Findings), 5)]),
+			)
+		}
 	}
 
-	// Gmail has a 25MB attachment limit. Base64 encoding increases size by ~33%,
-	// so we need to check if the original file is under ~19MB (19MB * 1.33 ≈ 25MB)
-	// Adding some overhead for email headers, we'll use 18MB as the limit
-	const maxFileSizeForEmail = 18 * 1024 * 1024 // 18MB
-
+	// The limit depends on the transport (and Amazon's 50 MB cap) and the
+	// profile, see sizelimit.go. An oversized EPUB gets one shrink attempt.
+	limit, target, reason := mail.sizeLimitFor(to)
+	report.SizeLimit, report.SizeLimitReason = limit, reason
 	fileSize := int64(len(fileData))
-	if fileSize > maxFileSizeForEmail {
-		return fmt.Errorf("file too large for email: %d bytes (%.2f MB). Gmail has a 25MB attachment limit. Files larger than ~18MB cannot be sent via email. Consider downloading directly instead",
-			fileSize, float64(fileSize)/(1024*1024))
-	}
-
-	// Create email message
-	var emailBody bytes.Buffer
-	emailBody.WriteString(fmt.Sprintf("From: %s\r\n", fromEmail))
-	emailBody.WriteString(fmt.Sprintf("To: %s\r\n", kindleEmail))
-	emailBody.WriteString(fmt.Sprintf("Subject: %s\r\n", filename))
-	emailBody.WriteString("MIME-Version: 1.0\r\n")
-	emailBody.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=boundary123\r\n\r\n"))
-
-	// Email body
-	emailBody.WriteString("--boundary123\r\n")
-	emailBody.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
-	emailBody.WriteString(fmt.Sprintf("%s\r\n", subject))
-	emailBody.WriteString("\r\n")
-
-	// Attachment
-	emailBody.WriteString("--boundary123\r\n")
-	emailBody.WriteString(fmt.Sprintf("Content-Type: %s; name=\"%s\"\r\n", mimeType, filename))
-	emailBody.WriteString("Content-Transfer-Encoding: base64\r\n")
-	emailBody.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", filename))
-
-	// Encode file as base64
-	encoded := base64.StdEncoding.EncodeToString(fileData)
-	// Split into lines of 76 characters (RFC 2045)
-	for i := 0; i < len(encoded); i += 76 {
-		end := i + 76
-		if end > len(encoded) {
-			end = len(encoded)
+	if fileSize > limit && isEPUB {
+		shrunk, sr, err := ShrinkEPUB(fileData, limit)
+		if err != nil {
+			l.Warn("EPUB shrink failed", zap.String("filename", filename), zap.Error(err))
+		} else {
+			l.Info("Shrank oversized EPUB",
+				zap.String("filename", filename),
+				zap.Int64("limit_bytes", limit),
+				zap.Int64("bytes_before", sr.Before),
+				zap.Int64("bytes_after", sr.After),
+				zap.Int("images_recompressed", sr.ImagesRecompressed),
+				zap.Strings("fonts_removed", sr.FontsRemoved),
+			)
+			fileData, fileSize, report.Shrink = shrunk, sr.After, &sr
 		}
-		emailBody.WriteString(encoded[i:end] + "\r\n")
 	}
+	if fileSize > limit {
+		return &TooLargeError{Target: target, Size: fileSize, Limit: limit, Reason: reason, Shrink: report.Shrink}
+	}
+	report.AttachmentBytes = fileSize
 
-	emailBody.WriteString("\r\n--boundary123--\r\n")
-
-	// Send email via SMTP
-	addr := fmt.Sprintf("%s:%s", smtpHost, smtpPort)
-	auth := smtp.PlainAuth("", smtpUser, smtpPassword, smtpHost)
+	msg, err := newKindleMessage(mail.FromEmail, kindleEmail, filename, subject, filename, mimeType, fileData)
+	if err != nil {
+		return fmt.Errorf("failed to compose email: %w", err)
+	}
 
 	l.Info("Sending file to Kindle",
 		zap.String("filename", filename),
 		zap.String("kindle_email", kindleEmail),
 		zap.Int64("file_size_bytes", fileSize),
 		zap.Float64("file_size_mb", float64(fileSize)/(1024*1024)),
+		zap.String("message_id", msg.MessageID),
+		zap.String("transport", mail.Describe()),
 	)
 
-	err := smtp.SendMail(addr, auth, fromEmail, []string{kindleEmail}, emailBody.Bytes())
+	report.MessageID = msg.MessageID
+	report.Subject = filename
+	envelope := Envelope{From: mail.FromEmail, To: []string{kindleEmail}}
+	if capture, ok := sender.(*CaptureSender); ok {
+		if err := capture.Capture(envelope, msg, report); err != nil {
+			return fmt.Errorf("failed to capture email: %w", err)
+		}
+		l.Info("Captured email instead of sending (MAIL_CAPTURE_DIR)",
+			zap.String("filename", filename),
+			zap.String("dir", capture.Dir),
+		)
+		return nil
+	}
+
+	err = sender.Send(envelope, msg)
 	if err != nil {
+		// A transient failure (4xx, dropped connection) isn't the book's fault:
+		// park it in the outbox for the background worker instead of failing.
+		if mail.OutboxDir != "" && isTransientSendError(err) {
+			qerr := queueForRetry(mail, msg, err)
+			if errors.Is(qerr, ErrQueued) {
+				sent = true
+				l.Warn("Send failed transiently; queued in outbox",
+					zap.String("filename", filename),
+					zap.String("kindle_email", kindleEmail),
+					zap.Error(qerr),
+				)
+				return qerr
+			}
+			l.Error("Could not queue failed send in outbox", zap.Error(qerr))
+		}
+
 		// Check if error is related to file size
 		errStr := err.Error()
 		if strings.Contains(errStr, "exceeded") || strings.Contains(errStr, "size limit") || strings.Contains(errStr, "552") {
-			return fmt.Errorf("file too large for Gmail (25MB limit): %w. Original file size: %d bytes (%.2f MB). Consider downloading directly instead",
+			return fmt.Errorf("file too large for the mail server (set MAIL_MAX_MESSAGE_MB to its real limit): %w. File size: %d bytes (%.2f MB). Consider downloading directly instead",
 				err, fileSize, float64(fileSize)/(1024*1024))
 		}
 		if strings.Contains(errStr, "broken pipe") {
@@ -211,6 +335,8 @@ func SendFileToKindle(fileData []byte, filename, mimeType, subject, smtpHost, sm
 		zap.String("kindle_email", kindleEmail),
 		zap.Int64("file_size_bytes", fileSize),
 	)
+	sent = true
+	recordSend(mail, msg, strings.TrimPrefix(subject, "Book: "))
 
 	return nil
 }
@@ -245,7 +371,12 @@ func detectFileFormat(contentType string, fileData []byte) (format string, mimeT
 	if contentType != "" {
 		ct := strings.ToLower(contentType)
 		for _, fmt := range supportedFormats {
-			if strings.Contains(ct, fmt) {
+			// Error pages come as text/html or text/plain too, so those
+			// are left to the content checks below.
+			if fmt == "html" || fmt == "txt" {
+				continue
+			}
+			if strings.Contains(ct, fmt) || strings.HasPrefix(ct, getMimeType(fmt)) {
 				return fmt, getMimeType(fmt)
 			}
 		}
@@ -258,8 +389,10 @@ func detectFileFormat(contentType string, fileData []byte) (format string, mimeT
 	if len(fileData) >= 2 && string(fileData[0:2]) == "PK" {
 		// A zip that starts with PK is only an EPUB if it actually contains EPUB
 		// structure; CBZ/DOCX/ODT also start with PK and Amazon rejects them.
-		if isEPUBZip(fileData) {
-			return "epub", getMimeType("epub")
+		if z, err := openZip(fileData); err == nil {
+			if f := zipFormat(z); f != "unknown" {
+				return f, getMimeType(f)
+			}
 		}
 		return "unknown", "application/octet-stream"
 	}
@@ -273,6 +406,36 @@ func detectFileFormat(contentType string, fileData []byte) (format string, mimeT
 		}
 		return "azw3", getMimeType("azw3")
 	}
+	if isWordDoc(fileData) {
+		return "doc", getMimeType("doc")
+	}
+	if bytes.HasPrefix(fileData, []byte(`{\rtf`)) {
+		return "rtf", getMimeType("rtf")
+	}
+	if bytes.HasPrefix(fileData, []byte("Rar!\x1a\x07")) {
+		// Comics are the only RAR archives anyone shares as books.
+		return "cbr", getMimeType("cbr")
+	}
+	if isDjVu(fileData) {
+		return "djvu", getMimeType("djvu")
+	}
+	if ext, mediaType := sniffImage(fileData); ext != "" {
+		return ext[1:], mediaType
+	}
+	if isBMP(fileData) {
+		return "bmp", getMimeType("bmp")
+	}
+	// The text formats last, most specific first: FB2 is XML, and anything
+	// that is neither it nor HTML may still be plain text.
+	if isFB2(fileData) {
+		return "fb2", getMimeType("fb2")
+	}
+	if isHTMLDoc(fileData) {
+		return "html", getMimeType("html")
+	}
+	if isPlainText(fileData) {
+		return "txt", getMimeType("txt")
+	}
 
 	return "unknown", "application/octet-stream"
 }
@@ -297,8 +460,7 @@ func extractMetaInformation(meta string) (language, format, size string) {
 		// Look for format in the parts
 		for _, part := range parts {
 			partLower := strings.ToLower(strings.TrimSpace(part))
-			if partLower == "epub" || partLower == "pdf" || partLower == "mobi" ||
-				partLower == "azw" || partLower == "azw3" || partLower == "zip" {
+			if slices.Contains(supportedFormats, partLower) || partLower == "zip" {
 				format = partLower
 				break
 			}
@@ -354,13 +516,21 @@ func extractMetaInformation(meta string) (language, format, size string) {
 	return language, format, size
 }
 
-// downloadFileData downloads a file from Anna's Archive using the API.
-// It tries multiple download servers and returns the file data.
-func downloadFileData(hash, secretKey string) ([]byte, error) {
+// downloadFile downloads a file from Anna's Archive using the API. It tries
+// multiple download servers, streaming to a Spool (see spool.go) that is
+// checked against hash (see checksum.go). The caller closes the Spool.
+func downloadFile(hash, secretKey string, opts DownloadOptions) (*Spool, error) {
 	l := logger.GetLogger()
 
-	var fileData []byte
-	var lastErr error
+	hash, ok := normalizeMD5(hash)
+	if !ok {
+		return nil, fmt.Errorf("%q is not an MD5 hash; use the hash from the search results", hash)
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = maxDownloadBytes()
+	}
+
+	var lastErr, mismatchErr error
 
 	// Try each mirror, then each download server (domain_index), until one works.
 	for _, base := range annasBases() {
@@ -404,69 +574,71 @@ func downloadFileData(hash, secretKey string) ([]byte, error) {
 				continue
 			}
 
-			// Create HTTP client with timeout
-			client := &http.Client{Timeout: 60 * time.Second}
-			downloadResp, err := client.Get(apiResp.DownloadURL)
+			spool, err := spoolDownload(apiResp.DownloadURL, opts)
+			if errors.Is(err, ErrDownloadTooLarge) {
+				// Every server has the same file.
+				return nil, err
+			}
 			if err != nil {
 				l.Warn("Download server failed, trying next",
 					zap.Int("domainIndex", domainIndex),
 					zap.Error(err),
 				)
-				lastErr = fmt.Errorf("failed to download file: %w", err)
-				continue
-			}
-
-			if downloadResp.StatusCode != http.StatusOK {
-				downloadResp.Body.Close()
-				l.Warn("Download server returned non-200, trying next",
-					zap.Int("domainIndex", domainIndex),
-					zap.Int("status", downloadResp.StatusCode),
-				)
-				lastErr = fmt.Errorf("download server returned status %d", downloadResp.StatusCode)
-				continue
-			}
-
-			// Successfully connected, read the file
-			fileData, err = io.ReadAll(downloadResp.Body)
-			downloadResp.Body.Close()
-			if err != nil {
-				lastErr = fmt.Errorf("failed to read file: %w", err)
-				fileData = nil
+				lastErr = err
 				continue
 			}
 
-			// Guard against HTML interstitials / captcha pages / truncated bodies
-			// being saved or emailed as a book. detectFileFormat returns "unknown"
-			// for anything that isn't a recognized ebook (PDF/EPUB/MOBI/AZW3).
-			if detectedFormat, _ := detectFileFormat("", fileData); detectedFormat == "unknown" {
-				l.Warn("Download returned a non-book response; trying next server",
+			// A truncated body or a different file entirely: try another server.
+			if spool.MD5() != hash {
+				err := &HashMismatchError{Want: hash, Got: spool.MD5(), Size: spool.Size()}
+				spool.Close()
+				l.Warn("Download does not match the requested MD5; trying next server",
 					zap.Int("domainIndex", domainIndex),
-					zap.Int("size", len(fileData)),
+					zap.Int64("size", err.Size),
+					zap.Error(err),
 				)
-				lastErr = fmt.Errorf("download returned a non-book response (%d bytes)", len(fileData))
-				fileData = nil
+				lastErr, mismatchErr = err, err
 				continue
 			}
 
+			// These are the very bytes asked for, so an HTML book or a short
+			// text is taken as it is: interstitial and captcha pages fail the
+			// MD5 check above.
 			l.Info("Successfully downloaded from server",
 				zap.Int("domainIndex", domainIndex),
-				zap.Int("size", len(fileData)),
+				zap.Int64("size", spool.Size()),
 			)
-			break
-		}
-		if len(fileData) > 0 {
-			break
+			return spool, nil
 		}
 	}
 
-	if len(fileData) == 0 {
-		if lastErr != nil {
-			return nil, fmt.Errorf("all download servers/mirrors failed: %w", lastErr)
-		}
-		return nil, errors.New("failed to download file from any server")
+	// A server serving the wrong file says more than the ones after it that
+	// served nothing.
+	if mismatchErr != nil {
+		lastErr = mismatchErr
 	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("all download servers/mirrors failed: %w", lastErr)
+	}
+	return nil, errors.New("failed to download file from any server")
+}
 
-	return fileData, nil
+// downloadLogger returns a Progress callback that logs a download's
+// progress every few seconds.
+func downloadLogger(hash string) func(Progress) {
+	var last time.Time
+	return func(p Progress) {
+		if time.Since(last) < 5*time.Second && p.Done != p.Total {
+			return
+		}
+		last = time.Now()
+		logger.GetLogger().Info("Downloading",
+			zap.String("hash", hash),
+			zap.Int64("done", p.Done),
+			zap.Int64("total", p.Total),
+			zap.Int("resumes", p.Resumes),
+		)
+	}
 }
 
 func FindBook(query string) ([]*Book, error) {
@@ -550,10 +722,10 @@ func FindBookWithFormat(query, preferredFormat string) ([]*Book, error) {
 		sizeIndicators := []string{"mb", "kb", "gb", "bytes"}
 
 		// Look for format indicators in the container text
-		if containsAny(containerText, supportedFormats) {
+		if mentionsFormat(containerText) {
 			container.Find("div, span").Each(func(i int, s *goquery.Selection) {
 				text := strings.ToLower(strings.TrimSpace(s.Text()))
-				if (containsAny(text, supportedFormats) || containsAny(text, supportedLanguages) || containsAny(text, sizeIndicators)) && len(text) < 500 {
+				if (mentionsFormat(text) || containsAny(text, supportedLanguages) || containsAny(text, sizeIndicators)) && len(text) < 500 {
 					if metaText == "" || (len(text) < len(metaText) && strings.Contains(text, ",")) {
 						metaText = strings.TrimSpace(s.Text())
 					}
@@ -689,6 +861,12 @@ func FindBookWithFormat(query, preferredFormat string) ([]*Book, error) {
 }
 
 func (b *Book) Download(secretKey, folderPath string) error {
+	return b.DownloadWithProgress(secretKey, folderPath, nil)
+}
+
+// DownloadWithProgress is Download, calling progress as the file arrives
+// (see DownloadOptions). It is not called on the relay path.
+func (b *Book) DownloadWithProgress(secretKey, folderPath string, progress func(Progress)) error {
 	l := logger.GetLogger()
 	l.Info("Download function called",
 		zap.String("hash", b.Hash),
@@ -700,44 +878,32 @@ func (b *Book) Download(secretKey, folderPath string) error {
 	// Relay path: Pi performs the download itself. We don't get the
 	// file bytes back (Fly has no persistent storage for them anyway).
 	if _, _, ok := relay.Config(); ok {
-		return downloadViaRelay(b.Hash, b.Title, b.Format, b.Authors, "")
+		return downloadViaRelay(b.Hash, b.Title, b.Format, b.Authors, Recipient{})
 	}
 
 	// Download file using shared helper
-	fileData, err := downloadFileData(b.Hash, secretKey)
+	if progress == nil {
+		progress = downloadLogger(b.Hash)
+	}
+	spool, err := downloadFile(b.Hash, secretKey, DownloadOptions{Progress: progress})
 	if err != nil {
 		return err
 	}
-
-	// Detect actual file format from file content
-	actualFormat, _ := detectFileFormat("", fileData)
+	defer spool.Close()
 
 	// Use detected format if available, otherwise fall back to search result format
-	format := actualFormat
+	format := spool.Format()
 	if format == "unknown" {
 		format = b.Format
 	}
 
-	filename := sanitizeFilename(b.Title) + "." + format
-	filePath := filepath.Join(folderPath, filename)
-
-	// Check if file already exists to avoid duplicates
-	if _, err := os.Stat(filePath); err == nil {
-		l.Info("File already exists, skipping save",
-			zap.String("path", filePath),
-		)
-	} else {
-		if err := os.WriteFile(filePath, fileData, 0644); err != nil {
-			// Log but don't fail if we can't save to disk
-			l.Warn("Failed to save file to disk", zap.Error(err))
-		}
-	}
-
+	// Saved with its verified MD5 alongside; an existing copy is kept.
+	saveBackup(folderPath, b.Title, format, spool)
 	return nil
 }
 
 // EmailToKindle sends the book file to the Kindle email address
-func (b *Book) EmailToKindle(secretKey, smtpHost, smtpPort, smtpUser, smtpPassword, fromEmail, kindleEmail string) error {
+func (b *Book) EmailToKindle(secretKey string, mail MailConfig, to Recipient) error {
 	l := logger.GetLogger()
 
 	l.Info("EmailToKindle function called",
@@ -750,23 +916,31 @@ func (b *Book) EmailToKindle(secretKey, smtpHost, smtpPort, smtpUser, smtpPasswo
 	// auto-fallback below) itself, so we just forward the request (incl. author
 	// so the Pi can safely match alternate editions).
 	if _, _, ok := relay.Config(); ok {
-		if kindleEmail == "" {
+		if to.relayTarget() == "" {
 			return errors.New("kindle_email required for EmailToKindle via relay")
 		}
-		return downloadViaRelay(b.Hash, b.Title, b.Format, b.Authors, kindleEmail)
+		return downloadViaRelay(b.Hash, b.Title, b.Format, b.Authors, to)
 	}
 
 	// Check if email is configured
-	if smtpHost == "" || smtpUser == "" || smtpPassword == "" || fromEmail == "" {
-		return errors.New("email configuration incomplete: SMTP_HOST, SMTP_USER, SMTP_PASSWORD, and FROM_EMAIL must be set")
+	if err := mail.Validate(); err != nil {
+		return err
+	}
+	// Refuse disallowed/over-quota recipients before downloading anything.
+	if err := checkRecipient(to); err != nil {
+		return err
 	}
 
 	// Try the requested edition first.
-	firstErr := sendOneEdition(b, secretKey, smtpHost, smtpPort, smtpUser, smtpPassword, fromEmail, kindleEmail)
+	firstErr := sendOneEdition(b, secretKey, mail, to)
+	if errors.Is(firstErr, ErrQueued) {
+		// The file was fine; the mail server wasn't. The outbox will deliver it.
+		return firstErr
+	}
 	if firstErr == nil {
 		l.Info("Book sent to Kindle successfully",
 			zap.String("title", b.Title),
-			zap.String("kindle_email", kindleEmail),
+			zap.String("kindle_email", to.Email),
 		)
 		return nil
 	}
@@ -779,10 +953,13 @@ func (b *Book) EmailToKindle(secretKey, smtpHost, smtpPort, smtpUser, smtpPasswo
 	// different book that merely shares the title.
 	if strings.TrimSpace(b.Authors) != "" {
 		for _, alt := range findAlternateEditions(b.Title, b.Authors, b.Hash) {
-			if err := sendOneEdition(alt, secretKey, smtpHost, smtpPort, smtpUser, smtpPassword, fromEmail, kindleEmail); err == nil {
+			alt.Goodreads = b.Goodreads
+			if err := sendOneEdition(alt, secretKey, mail, to); err == nil {
 				l.Info("Delivered an alternate edition after the requested one failed",
 					zap.String("title", b.Title), zap.String("alt_hash", alt.Hash))
 				return nil
+			} else if errors.Is(err, ErrQueued) {
+				return err
 			} else {
 				l.Warn("Alternate edition also failed",
 					zap.String("alt_hash", alt.Hash), zap.Error(err))
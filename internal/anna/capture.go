@@ -0,0 +1,116 @@
+package anna
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Capture mode is a dry run for debugging delivery: with MAIL_CAPTURE_DIR
+// set (or `test-email --capture DIR`) nothing is mailed. Each message is
+// written to the directory as a complete RFC 5322 .eml file, next to a .json
+// sidecar (a DeliveryReport) recording what the pipeline decided — sanitizing,
+// size limit, shrinking, volumes. Size limits still come from the configured
+// transport, so a capture shows exactly what would have gone out. Captured
+// messages don't count against the daily send limit and aren't added to the
+// send log.
+
+// DeliveryReport describes how SendFileToKindle prepared one message. It is
+// the sidecar written next to each captured .eml.
+type DeliveryReport struct {
+	MessageID  string    `json:"message_id,omitempty"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Recipient  string    `json:"recipient,omitempty"` // profile or address as given
+	Subject    string    `json:"subject,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	MimeType   string    `json:"mime_type,omitempty"`
+	Transport  string    `json:"transport"` // what would have delivered it
+	CapturedAt time.Time `json:"captured_at"`
+
+	// ConvertedFrom is the original format when the book was converted
+	// before sending (e.g. "pdf").
+	ConvertedFrom string `json:"converted_from,omitempty"`
+	// Volume is "i of N" for one volume of a split book.
+	Volume string `json:"volume,omitempty"`
+	// MetadataRewritten is set when the EPUB's title, authors, ... were
+	// rewritten from the search result or Goodreads (see RewriteEPUBMetadata).
+	MetadataRewritten bool `json:"metadata_rewritten,omitempty"`
+	// CoverAdded says where the cover given to a coverless EPUB came from:
+	// "book" (an undeclared image in it), "local" or "goodreads".
+	CoverAdded string `json:"cover_added,omitempty"`
+
+	OriginalBytes   int64         `json:"original_bytes,omitempty"`
+	SanitizedAttrs  int           `json:"sanitized_attrs,omitempty"`
+	Hardened        *HardenReport `json:"hardened,omitempty"` // what HardenEPUB removed
+	Repairs         []EPUBRepair  `json:"repairs,omitempty"`  // what RepairEPUB fixed
+	Validated       bool          `json:"epub_validated,omitempty"`
+	Validation      *EPUBReport   `json:"validation,omitempty"` // CheckEPUB's findings, if any
+	SizeLimit       int64         `json:"size_limit_bytes,omitempty"`
+	SizeLimitReason string        `json:"size_limit_reason,omitempty"`
+	Shrink          *ShrinkReport `json:"shrink,omitempty"`
+	AttachmentBytes int64         `json:"attachment_bytes,omitempty"`
+	MessageBytes    int64         `json:"message_bytes"`
+}
+
+// CaptureSender writes messages to Dir instead of delivering them.
+type CaptureSender struct {
+	Dir string
+	// Transport describes the transport being stood in for.
+	Transport string
+}
+
+var captureSeq atomic.Uint64
+
+func (s *CaptureSender) Send(env Envelope, msg io.WriterTo) error {
+	return s.Capture(env, msg, &DeliveryReport{})
+}
+
+// Capture writes msg as an .eml and report (completed with the envelope) as
+// its JSON sidecar.
+func (s *CaptureSender) Capture(env Envelope, msg io.WriterTo, report *DeliveryReport) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return fmt.Errorf("create capture dir: %w", err)
+	}
+	now := time.Now().UTC()
+	stem := strings.TrimSuffix(report.Filename, filepath.Ext(report.Filename))
+	if stem = sanitizeFilename(stem); stem == "" {
+		stem = "message"
+	}
+	if len(stem) > 60 {
+		stem = stem[:60]
+	}
+	base := filepath.Join(s.Dir, fmt.Sprintf("%s-%06d-%s", now.Format("20060102T150405"), captureSeq.Add(1), stem))
+
+	f, err := os.OpenFile(base+".eml", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("create capture file: %w", err)
+	}
+	n, werr := msg.WriteTo(f)
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		os.Remove(base + ".eml")
+		return fmt.Errorf("write capture file: %w", werr)
+	}
+
+	report.From = env.From
+	report.To = env.To
+	report.Transport = s.Transport
+	report.CapturedAt = now
+	report.MessageBytes = n
+	sidecar, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".json", append(sidecar, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write capture sidecar: %w", err)
+	}
+	return nil
+}
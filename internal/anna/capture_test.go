@@ -0,0 +1,125 @@
+package anna
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// captured is one message written by a CaptureSender.
+type captured struct {
+	Raw        []byte
+	Report     DeliveryReport
+	Attachment []byte
+}
+
+// readCaptured loads every .eml (with its sidecar) in dir, oldest first.
+func readCaptured(t *testing.T, dir string) []captured {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	var out []captured
+	for _, p := range paths {
+		var c captured
+		if c.Raw, err = os.ReadFile(p); err != nil {
+			t.Fatal(err)
+		}
+		sidecar, err := os.ReadFile(strings.TrimSuffix(p, ".eml") + ".json")
+		if err != nil {
+			t.Fatalf("missing sidecar for %s: %v", p, err)
+		}
+		if err := json.Unmarshal(sidecar, &c.Report); err != nil {
+			t.Fatalf("bad sidecar for %s: %v", p, err)
+		}
+		m, err := mail.ReadMessage(bytes.NewReader(c.Raw))
+		if err != nil {
+			t.Fatalf("%s is not an RFC 5322 message: %v", p, err)
+		}
+		_, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		mr := multipart.NewReader(m.Body, params["boundary"])
+		mr.NextPart() // text body
+		att, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("%s has no attachment: %v", p, err)
+		}
+		if c.Attachment, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, att)); err != nil {
+			t.Fatalf("decode attachment of %s: %v", p, err)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func TestSendFileToKindle_CaptureWritesEMLAndSidecar(t *testing.T) {
+	usePolicy(t, NewRecipientPolicy([]string{"@kindle.com"}, 1))
+	dir := t.TempDir()
+	cfg := MailConfig{Host: "smtp.gmail.com", FromEmail: "reader@example.com", CaptureDir: dir}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("capture mode needs no SMTP credentials: %v", err)
+	}
+	if !strings.Contains(cfg.Describe(), "instead of smtp smtp.gmail.com") {
+		t.Errorf("Describe should name the transport being stood in for: %q", cfg.Describe())
+	}
+
+	entries := validEPUBEntries()
+	entries["OEBPS/Text/01.xhtml"] = `<html><body><p data-AmznRemoved="a1">hi</p></body></html>`
+	dirty := makeZip(t, entries)
+	to := Recipient{Email: "a@kindle.com"}
+	for i := 0; i < 2; i++ {
+		// Twice: captures must not count against the daily limit of 1.
+		if err := SendFileToKindle(dirty, "Dune.epub", "application/epub+zip", "Book: Dune", cfg, to); err != nil {
+			t.Fatalf("capture %d: %v", i+1, err)
+		}
+	}
+
+	msgs := readCaptured(t, dir)
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 captured messages, got %d", len(msgs))
+	}
+	r := msgs[0].Report
+	if r.From != "reader@example.com" || len(r.To) != 1 || r.To[0] != "a@kindle.com" {
+		t.Errorf("sidecar envelope wrong: %+v", r)
+	}
+	if r.Filename != "Dune.epub" || r.MessageID == "" || !bytes.Contains(msgs[0].Raw, []byte(r.MessageID)) {
+		t.Errorf("sidecar should describe the captured message: %+v", r)
+	}
+	if r.SanitizedAttrs != 1 || !r.Validated || r.SizeLimit != cfg.AttachmentLimit() || !strings.Contains(r.SizeLimitReason, "smtp.gmail.com") {
+		t.Errorf("sidecar should record the pipeline decisions: %+v", r)
+	}
+	if r.MessageBytes != int64(len(msgs[0].Raw)) || r.AttachmentBytes != int64(len(msgs[0].Attachment)) {
+		t.Errorf("sidecar sizes don't match the .eml: %+v", r)
+	}
+	if bytes.Contains(readEntry(t, msgs[0].Attachment, "OEBPS/Text/01.xhtml"), []byte("data-Amzn")) {
+		t.Error("the captured attachment should be the sanitized EPUB")
+	}
+}
+
+func TestSendInVolumes_CaptureRecordsVolumes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := MailConfig{FromEmail: "reader@example.com", CaptureDir: dir}
+	if err := sendInVolumes(&Book{Title: "Omnibus"}, omnibusEPUB(t), 800*1024, cfg, Recipient{Email: "a@kindle.com"}, "pdf"); err != nil {
+		t.Fatalf("sendInVolumes: %v", err)
+	}
+	msgs := readCaptured(t, dir)
+	if len(msgs) < 2 {
+		t.Fatalf("expected several volumes, got %d", len(msgs))
+	}
+	for i, m := range msgs {
+		if m.Report.Volume == "" || !strings.HasPrefix(m.Report.Volume, fmt.Sprintf("%d of ", i+1)) || m.Report.ConvertedFrom != "pdf" {
+			t.Errorf("volume %d sidecar: %+v", i+1, m.Report)
+		}
+	}
+}
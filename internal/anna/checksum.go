@@ -0,0 +1,71 @@
+package anna
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+)
+
+// Anna's Archive names every file by the MD5 of its bytes, and that is the
+// hash we ask fast_download.json for. A download server that hands back a
+// truncated body, a different edition or somebody else's file is caught by
+// hashing what arrived: downloadFile treats a mismatch like a dead server and
+// tries the next one, so a bad file never reaches SMTP.
+
+// ErrHashMismatch means downloaded bytes don't hash to the MD5 requested.
+var ErrHashMismatch = errors.New("downloaded file does not match its MD5")
+
+// HashMismatchError describes a download whose MD5 is not the one asked for.
+type HashMismatchError struct {
+	Want, Got string
+	Size      int64
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("downloaded file does not match its MD5: got %s (%d bytes), want %s; it is truncated or a different file", e.Got, e.Size, e.Want)
+}
+
+func (e *HashMismatchError) Is(target error) bool { return target == ErrHashMismatch }
+
+// normalizeMD5 lowercases an MD5 given in hex, reporting whether it is one.
+func normalizeMD5(hash string) (string, bool) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if len(hash) != 2*md5.Size {
+		return hash, false
+	}
+	_, err := hex.DecodeString(hash)
+	return hash, err == nil
+}
+
+// saveBackup copies a verified download to dir as "<title>.<format>", with
+// its MD5 in a "<title>.<format>.md5" sidecar in md5sum's format, so
+// `md5sum -c` re-checks it and the file can be traced back to Anna's. An
+// existing backup of the same name is left alone. Best-effort: failures are
+// logged, never returned.
+func saveBackup(dir, title, format string, spool *Spool) {
+	l := logger.GetLogger()
+	name := sanitizeFilename(title) + "." + format
+	if strings.TrimSuffix(name, "."+format) == "" {
+		name = spool.MD5() + "." + format
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		l.Info("File already exists, skipping save", zap.String("path", path))
+		return
+	}
+	if err := spool.SaveCopy(path); err != nil {
+		l.Warn("Failed to save backup copy", zap.String("path", path), zap.Error(err))
+		return
+	}
+	if err := os.WriteFile(path+".md5", []byte(spool.MD5()+"  "+name+"\n"), 0644); err != nil {
+		l.Warn("Failed to save backup checksum", zap.String("path", path), zap.Error(err))
+	}
+}
@@ -0,0 +1,150 @@
+package anna
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// mirrorServer is an Anna's Archive mirror whose download servers, by
+// domain_index, serve files[i]; an index without a file has no server.
+func mirrorServer(t *testing.T, files ...[]byte) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var downloads atomic.Int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/dyn/api/fast_download.json":
+			i, _ := strconv.Atoi(r.URL.Query().Get("domain_index"))
+			if i >= len(files) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(fastDownloadResponse{Error: "Invalid domain_index"})
+				return
+			}
+			json.NewEncoder(w).Encode(fastDownloadResponse{DownloadURL: srv.URL + "/file/" + strconv.Itoa(i)})
+		case strings.HasPrefix(r.URL.Path, "/file/"):
+			downloads.Add(1)
+			i, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/file/"))
+			w.Write(files[i])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &downloads
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownloadFile_VerifiesMD5(t *testing.T) {
+	good := makeMinimalEPUB(t)
+	truncated := good[:len(good)-10]
+	padded := append(append([]byte{}, good...), "junk"...)
+
+	// The first mirror serves a truncated file and a different one; the
+	// second has the real thing.
+	bad, badDownloads := mirrorServer(t, truncated, padded)
+	ok, okDownloads := mirrorServer(t, good)
+	t.Setenv("ANNAS_BASE_URLS", bad.URL+","+ok.URL)
+
+	spool, err := downloadFile(strings.ToUpper(md5Hex(good)), "key", DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if data, _ := spool.Bytes(); string(data) != string(good) || spool.MD5() != md5Hex(good) {
+		t.Error("got the wrong file")
+	}
+	if badDownloads.Load() != 2 || okDownloads.Load() != 1 {
+		t.Errorf("downloads: %d from the bad mirror, %d from the good one", badDownloads.Load(), okDownloads.Load())
+	}
+
+	// Nothing matches anywhere.
+	t.Setenv("ANNAS_BASE_URLS", bad.URL)
+	_, err = downloadFile(md5Hex(good), "key", DownloadOptions{})
+	var mismatch *HashMismatchError
+	if !errors.Is(err, ErrHashMismatch) || !errors.As(err, &mismatch) {
+		t.Fatalf("err = %v, want a HashMismatchError", err)
+	}
+	if mismatch.Want != md5Hex(good) || mismatch.Got != md5Hex(padded) || mismatch.Size != int64(len(padded)) {
+		t.Errorf("mismatch = %+v", mismatch)
+	}
+}
+
+func TestDownloadFile_KeepsVerifiedHTMLAndText(t *testing.T) {
+	for _, book := range [][]byte{
+		[]byte("<!DOCTYPE html><html><head><title>A Story</title></head><body><p>Once.</p></body></html>"),
+		[]byte("A very short story."),
+	} {
+		srv, downloads := mirrorServer(t, book, book)
+		t.Setenv("ANNAS_BASE_URLS", srv.URL)
+		spool, err := downloadFile(md5Hex(book), "key", DownloadOptions{})
+		if err != nil {
+			t.Fatalf("%q: %v", book, err)
+		}
+		spool.Close()
+		if downloads.Load() != 1 {
+			t.Errorf("%q: downloaded %d times; a file matching its MD5 is the book", book, downloads.Load())
+		}
+	}
+}
+
+func TestDownloadFile_RejectsNonMD5(t *testing.T) {
+	_, downloads := mirrorServer(t, makeMinimalEPUB(t))
+	for _, hash := range []string{"", "abc123", strings.Repeat("g", 32), "../" + strings.Repeat("a", 29)} {
+		if _, err := downloadFile(hash, "key", DownloadOptions{}); err == nil || !strings.Contains(err.Error(), "not an MD5") {
+			t.Errorf("%q: err = %v", hash, err)
+		}
+	}
+	if downloads.Load() != 0 {
+		t.Error("nothing should be fetched for a malformed hash")
+	}
+}
+
+func TestSaveBackup(t *testing.T) {
+	dir := t.TempDir()
+	data := makeMinimalEPUB(t)
+	hash := md5Hex(data)
+	saveBackup(dir, "Dune: Messiah", "epub", testSpool(t, data))
+
+	name := sanitizeFilename("Dune: Messiah") + ".epub"
+	saved, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil || string(saved) != string(data) {
+		t.Fatalf("backup not saved: %v", err)
+	}
+	sidecar, err := os.ReadFile(filepath.Join(dir, name+".md5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := hash + "  " + name + "\n"; string(sidecar) != want {
+		t.Errorf("sidecar = %q, want %q (md5sum format)", sidecar, want)
+	}
+
+	// An existing backup is kept, sidecar and all.
+	saveBackup(dir, "Dune: Messiah", "epub", testSpool(t, []byte("other")))
+	if saved, _ := os.ReadFile(filepath.Join(dir, name)); string(saved) != string(data) {
+		t.Error("an existing backup should not be overwritten")
+	}
+	if again, _ := os.ReadFile(filepath.Join(dir, name+".md5")); string(again) != string(sidecar) {
+		t.Error("an existing sidecar should not be overwritten")
+	}
+
+	// No usable title: name it by hash.
+	pdf := []byte("%PDF-1.4")
+	saveBackup(dir, "???", "pdf", testSpool(t, pdf))
+	if _, err := os.Stat(filepath.Join(dir, md5Hex(pdf)+".pdf.md5")); err != nil {
+		t.Errorf("untitled backup: %v", err)
+	}
+}
@@ -0,0 +1,497 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // page formats, for image.Decode
+	"image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/epub"
+)
+
+// Comics and manga come as archives of page images: CBZ (a zip) or CBR (a
+// RAR). ConvertComicToEPUB turns one into a fixed-layout EPUB 3, one XHTML
+// page per image with a viewport of the image's size, which Kindle shows as
+// a comic: a page per screen, panel view, and right-to-left page turns for
+// manga. Pages are ordered naturally ("page2" before "page10"), can be
+// scaled down to the reader's screen and, for two-page spreads, cut in two.
+// CBRs are unpacked with bsdtar, an optional external tool.
+
+// ComicOptions controls ConvertComicToEPUB.
+type ComicOptions struct {
+	// Direction is "rtl" for manga, "ltr" for western comics, or "" to go
+	// by the archive's ComicInfo.xml and default to left to right.
+	Direction string
+	// SplitSpreads cuts landscape pages (two-page spreads) into two pages,
+	// in reading order.
+	SplitSpreads bool
+	// Width and Height are the screen pages are scaled down to fit; zero
+	// keeps pages at their own size.
+	Width, Height int
+}
+
+// comicScreens are the screen sizes COMIC_DEVICE can name, in pixels.
+var comicScreens = map[string][2]int{
+	"kindle":     {600, 800},   // basic Kindles up to the 10th generation
+	"basic":      {1072, 1448}, // Kindle (2022 and later)
+	"paperwhite": {1236, 1648}, // Paperwhite (2021 and later)
+	"oasis":      {1264, 1680},
+	"colorsoft":  {1264, 1680},
+	"scribe":     {1860, 2480},
+}
+
+// defaultComicScreen is the screen pages are sized for when COMIC_DEVICE is
+// unset.
+const defaultComicScreen = "paperwhite"
+
+// ComicOptionsFromEnv reads the comic conversion settings: COMIC_DEVICE (a
+// name from comicScreens, "WIDTHxHEIGHT", or "original" to keep page sizes),
+// COMIC_READING_DIRECTION ("rtl" or "ltr") and COMIC_SPLIT_SPREADS.
+func ComicOptionsFromEnv() ComicOptions {
+	var opts ComicOptions
+	opts.Width, opts.Height, _ = ParseComicScreen(os.Getenv("COMIC_DEVICE"))
+	switch d := strings.ToLower(strings.TrimSpace(os.Getenv("COMIC_READING_DIRECTION"))); d {
+	case "rtl", "ltr":
+		opts.Direction = d
+	}
+	opts.SplitSpreads, _ = strconv.ParseBool(os.Getenv("COMIC_SPLIT_SPREADS"))
+	return opts
+}
+
+// ParseComicScreen resolves a device name or "WIDTHxHEIGHT" to a screen
+// size. Empty means the default device; "original" is 0×0. An unknown value
+// returns the default with an error.
+func ParseComicScreen(s string) (width, height int, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "":
+		s = defaultComicScreen
+	case "original", "none":
+		return 0, 0, nil
+	}
+	if wh, ok := comicScreens[s]; ok {
+		return wh[0], wh[1], nil
+	}
+	if w, h, ok := strings.Cut(s, "x"); ok {
+		width, werr := strconv.Atoi(w)
+		height, herr := strconv.Atoi(h)
+		if werr == nil && herr == nil && width > 0 && height > 0 {
+			return width, height, nil
+		}
+	}
+	def := comicScreens[defaultComicScreen]
+	return def[0], def[1], fmt.Errorf("unknown comic screen %q", s)
+}
+
+// ErrNoComicPages means an archive holds no page images we can read.
+var ErrNoComicPages = errors.New("the archive holds no readable page images")
+
+// comicImageExts are the page image extensions we read.
+var comicImageExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+// isComicEntry reports whether a zip entry may be a page: an image outside
+// macOS resource forks and hidden files.
+func isComicEntry(name string) bool {
+	if strings.HasPrefix(name, "__MACOSX/") {
+		return false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return false
+		}
+	}
+	return comicImageExts[strings.ToLower(path.Ext(name))]
+}
+
+// comicPage is one page of the converted book.
+type comicPage struct {
+	data          []byte
+	ext           string
+	mediaType     string
+	width, height int
+	chapter       string // the archive folder the page came from
+}
+
+// comicInfo is the part of a ComicInfo.xml we use.
+type comicInfo struct {
+	Title       string `xml:"Title"`
+	Series      string `xml:"Series"`
+	Number      string `xml:"Number"`
+	Writer      string `xml:"Writer"`
+	LanguageISO string `xml:"LanguageISO"`
+	Manga       string `xml:"Manga"`
+}
+
+// ConvertComicToEPUB converts a CBZ to a fixed-layout EPUB.
+func ConvertComicToEPUB(data []byte, opts ComicOptions) ([]byte, error) {
+	return convertComicToEPUB(context.Background(), data, opts)
+}
+
+// convertComicToEPUB is ConvertComicToEPUB, giving up with ctx's error
+// between pages once ctx is done.
+func convertComicToEPUB(ctx context.Context, data []byte, opts ComicOptions) ([]byte, error) {
+	z, err := openZip(data)
+	if err != nil {
+		return nil, err
+	}
+	var info comicInfo
+	var files []*zip.File
+	for _, f := range z.files() {
+		if strings.EqualFold(path.Base(f.Name), "ComicInfo.xml") {
+			if b, err := z.readFile(f); err == nil {
+				xml.Unmarshal(b, &info)
+			}
+			continue
+		}
+		if !f.FileInfo().IsDir() && isComicEntry(f.Name) {
+			files = append(files, f)
+		}
+	}
+	slices.SortFunc(files, func(a, b *zip.File) int { return naturalCompare(a.Name, b.Name) })
+
+	rtl := opts.Direction == "rtl" || opts.Direction == "" && info.Manga == "YesAndRightToLeft"
+	var pages []comicPage
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		b, err := z.readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		chapter := path.Dir(f.Name)
+		if chapter == "." {
+			chapter = ""
+		}
+		ps, err := comicPages(b, opts, rtl)
+		if err != nil {
+			continue // not an image after all, or one we can't decode
+		}
+		for i := range ps {
+			ps[i].chapter = chapter
+		}
+		pages = append(pages, ps...)
+	}
+	if len(pages) == 0 {
+		return nil, ErrNoComicPages
+	}
+	return comicEPUB(pages, info, rtl)
+}
+
+// comicPages turns one archive image into one page, or two for a split
+// spread, scaled to fit opts' screen. Images that need no change are kept
+// byte for byte.
+func comicPages(b []byte, opts ComicOptions, rtl bool) ([]comicPage, error) {
+	ext, mediaType := sniffImage(b)
+	if ext == "" {
+		return nil, errors.New("not a page image")
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxDecodePixels {
+		return nil, fmt.Errorf("page is %dx%d, too large to decode", cfg.Width, cfg.Height)
+	}
+	split := opts.SplitSpreads && cfg.Width > cfg.Height
+	if !split && fitsScreen(cfg.Width, cfg.Height, opts) {
+		return []comicPage{{data: b, ext: ext, mediaType: mediaType, width: cfg.Width, height: cfg.Height}}, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	halves := []image.Image{img}
+	if split {
+		r := img.Bounds()
+		mid := r.Min.X + r.Dx()/2
+		sub, ok := img.(interface {
+			SubImage(image.Rectangle) image.Image
+		})
+		if ok {
+			left := sub.SubImage(image.Rect(r.Min.X, r.Min.Y, mid, r.Max.Y))
+			right := sub.SubImage(image.Rect(mid, r.Min.Y, r.Max.X, r.Max.Y))
+			halves = []image.Image{left, right}
+			if rtl {
+				halves = []image.Image{right, left}
+			}
+		}
+	}
+	var pages []comicPage
+	for _, h := range halves {
+		h = fitScreen(h, opts)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, h, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+		pages = append(pages, comicPage{data: buf.Bytes(), ext: ".jpg", mediaType: "image/jpeg", width: h.Bounds().Dx(), height: h.Bounds().Dy()})
+	}
+	return pages, nil
+}
+
+func fitsScreen(w, h int, opts ComicOptions) bool {
+	return opts.Width <= 0 || opts.Height <= 0 || (w <= opts.Width && h <= opts.Height)
+}
+
+// fitScreen scales img down to fit opts' screen, keeping its aspect ratio.
+func fitScreen(img image.Image, opts ComicOptions) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if fitsScreen(w, h, opts) {
+		return img
+	}
+	scale := min(float64(opts.Width)/float64(w), float64(opts.Height)/float64(h))
+	return downscale(img, int(float64(max(w, h))*scale))
+}
+
+// naturalCompare orders names the way people number pages: runs of digits
+// compare by value, everything else case-insensitively.
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		ca, cb := rune(a[0]), rune(b[0])
+		if unicode.IsDigit(ca) && unicode.IsDigit(cb) {
+			na, ra := leadingDigits(a)
+			nb, rb := leadingDigits(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if c := len(ta) - len(tb); c != 0 {
+				return c
+			}
+			if c := strings.Compare(ta, tb); c != 0 {
+				return c
+			}
+			a, b = ra, rb
+			continue
+		}
+		la, lb := unicode.ToLower(ca), unicode.ToLower(cb)
+		if la != lb {
+			return int(la) - int(lb)
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+func leadingDigits(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+const comicCSS = `html, body { margin: 0; padding: 0; }
+div.page { margin: 0; padding: 0; text-align: center; }
+div.page img { display: block; margin: 0; padding: 0; width: 100%; height: 100%; }
+`
+
+// comicEPUB packs pages as a fixed-layout EPUB 3 with the metadata Kindle
+// looks for in comics.
+func comicEPUB(pages []comicPage, info comicInfo, rtl bool) ([]byte, error) {
+	const cssPath = "OEBPS/Styles/comic.css"
+	title := info.Title
+	if title == "" && info.Series != "" {
+		title = strings.TrimSpace(info.Series + " " + info.Number)
+	}
+	if title == "" {
+		title = "Comic"
+	}
+	lang := info.LanguageISO
+	if !langTagRe.MatchString(lang) {
+		lang = "und"
+	}
+
+	p := &epub.Package{
+		Metadata: epub.Metadata{
+			Title:       title,
+			Authors:     strings.Split(info.Writer, ","),
+			Language:    lang,
+			Series:      info.Series,
+			SeriesIndex: info.Number,
+		},
+		Direction: "ltr",
+	}
+	p.AddFile(cssPath, "text/css", []byte(comicCSS))
+	var maxW, maxH int
+	for i, pg := range pages {
+		n := i + 1
+		imgPath := fmt.Sprintf("OEBPS/Images/page%04d%s", n, pg.ext)
+		docPath := fmt.Sprintf("OEBPS/Text/page%04d.xhtml", n)
+		if i == 0 {
+			p.Cover = imgPath
+		}
+		p.AddFile(imgPath, pg.mediaType, pg.data)
+		p.AddDocument(docPath, []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>Page %d</title><meta name="viewport" content="width=%d, height=%d"/><link rel="stylesheet" type="text/css" href="%s"/></head>
+<body><div class="page"><img src="%s" alt="Page %d"/></div></body>
+</html>
+`, n, pg.width, pg.height, xmlEscape(relativeHref(docPath, cssPath)), xmlEscape(relativeHref(docPath, imgPath)), n)), "")
+		maxW, maxH = max(maxW, pg.width), max(maxH, pg.height)
+
+		// A folder per chapter is the usual layout; each gets a TOC entry.
+		if pg.chapter != "" && (i == 0 || pages[i-1].chapter != pg.chapter) {
+			p.TOC = append(p.TOC, epub.NavPoint{Label: path.Base(pg.chapter), Path: docPath})
+		}
+	}
+	if len(p.TOC) < 2 {
+		p.TOC = nil // the first page, under the title
+	}
+
+	writingMode := "horizontal-lr"
+	if rtl {
+		p.Direction, writingMode = "rtl", "horizontal-rl"
+	}
+	p.Meta = []epub.Meta{
+		{Property: "rendition:layout", Content: "pre-paginated"},
+		{Property: "rendition:orientation", Content: "portrait"},
+		{Property: "rendition:spread", Content: "none"},
+		// Kindle's own fixed-layout metadata.
+		{Name: "fixed-layout", Content: "true"},
+		{Name: "book-type", Content: "comic"},
+		{Name: "orientation-lock", Content: "portrait"},
+		{Name: "original-resolution", Content: fmt.Sprintf("%dx%d", maxW, maxH)},
+		{Name: "primary-writing-mode", Content: writingMode},
+	}
+	return p.Bytes()
+}
+
+// bsdtarCmd is libarchive's bsdtar, which unpacks RAR archives; a package
+// var so tests can point it at a stub.
+//
+// Install on the Pi (Debian/Raspberry Pi OS):  sudo apt install -y libarchive-tools
+var bsdtarCmd = "bsdtar"
+
+// cbrConvertTimeout bounds unpacking and converting a CBR; comics run to
+// hundreds of megabytes of images.
+const cbrConvertTimeout = 2 * time.Minute
+
+// cbrConverter converts CBRs: bsdtar unpacks the pages, which are then
+// converted like a CBZ.
+type cbrConverter struct{}
+
+func (cbrConverter) Name() string { return "bsdtar" }
+
+func (cbrConverter) Routes() []ConversionRoute {
+	return []ConversionRoute{{From: "cbr", To: "epub"}}
+}
+
+func (cbrConverter) Available() bool {
+	_, err := exec.LookPath(bsdtarCmd)
+	return err == nil
+}
+
+func (cbrConverter) Timeout() time.Duration { return cbrConvertTimeout }
+
+func (cbrConverter) Convert(ctx context.Context, data []byte, route ConversionRoute) ([]byte, error) {
+	if route != (ConversionRoute{From: "cbr", To: "epub"}) {
+		return nil, fmt.Errorf("bsdtar can't convert %s", route)
+	}
+	return ConvertCBRToEPUB(ctx, data, ComicOptionsFromEnv())
+}
+
+func (cbrConverter) ConvertFile(ctx context.Context, path string, route ConversionRoute) ([]byte, error) {
+	if route != (ConversionRoute{From: "cbr", To: "epub"}) {
+		return nil, fmt.Errorf("bsdtar can't convert %s", route)
+	}
+	cbz, err := unpackCBR(ctx, fileInput(path))
+	if err != nil {
+		return nil, err
+	}
+	return ConvertComicToEPUB(cbz, ComicOptionsFromEnv())
+}
+
+// ConvertCBRToEPUB converts a CBR to a fixed-layout EPUB, unpacking it with
+// bsdtar.
+func ConvertCBRToEPUB(ctx context.Context, data []byte, opts ComicOptions) ([]byte, error) {
+	cbz, err := unpackCBR(ctx, dataInput(data))
+	if err != nil {
+		return nil, err
+	}
+	return ConvertComicToEPUB(cbz, opts)
+}
+
+// unpackCBR extracts a CBR's page images with bsdtar and repacks them as a
+// zip, within activeZipLimits.
+func unpackCBR(ctx context.Context, cbr toolInput) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp("", "pib-cbr-")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	in, out := filepath.Join(tmpDir, "in.cbr"), filepath.Join(tmpDir, "pages")
+	if err := cbr(in); err != nil {
+		return nil, fmt.Errorf("write temp cbr: %w", err)
+	}
+	if err := os.Mkdir(out, 0700); err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bsdtarCmd, "-x", "-f", in, "-C", out)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("bsdtar failed: %w (%s)", err, truncate(stderr.String(), 300))
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	var total int64
+	limits := activeZipLimits()
+	err = filepath.WalkDir(out, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(out, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !isComicEntry(name) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if total += fi.Size(); total > limits.MaxTotalBytes {
+			return &ZipError{Err: ErrZipTooLarge, Detail: sizeDetail(uint64(total), limits.MaxTotalBytes)}
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
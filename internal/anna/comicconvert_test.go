@@ -0,0 +1,230 @@
+package anna
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// pageImage is a w×h PNG; a spread is black on its left half and white on
+// its right, so split halves can be told apart.
+func pageImage(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := w / 2; x < w; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// comicArchive is a two-chapter manga CBZ, pages named out of order, with a
+// ComicInfo.xml and macOS junk.
+func comicArchive(t *testing.T) []byte {
+	return makeZip(t, map[string]string{
+		"Vol 1/Ch 1/page10.png":        string(pageImage(t, 60, 80)),
+		"Vol 1/Ch 1/page2.png":         string(pageImage(t, 60, 80)),
+		"Vol 1/Ch 1/Page1.png":         string(pageImage(t, 300, 400)),
+		"Vol 1/Ch 2/001.jpg":           string(noisyJPEG(t, 60, 80)),
+		"Vol 1/Ch 2/002.png":           string(pageImage(t, 120, 80)), // a spread
+		"Vol 1/Ch 2/notes.txt":         "scanned by someone",
+		"__MACOSX/Vol 1/Ch 1/._p1.png": "junk",
+		"ComicInfo.xml": `<?xml version="1.0"?><ComicInfo><Title>Akira</Title><Series>Akira</Series><Number>1</Number>
+<Writer>Katsuhiro Otomo</Writer><LanguageISO>ja</LanguageISO><Manga>YesAndRightToLeft</Manga></ComicInfo>`,
+	})
+}
+
+func TestConvertComicToEPUB(t *testing.T) {
+	out, err := ConvertComicToEPUB(comicArchive(t), ComicOptions{Width: 150, Height: 200, SplitSpreads: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("converted comic should check clean:\n%s", r)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "Akira" || book.pkg.Metadata.Creators[0] != "Katsuhiro Otomo" || book.pkg.Metadata.Languages[0] != "ja" {
+		t.Errorf("metadata = %q %q %q", book.title(), book.pkg.Metadata.Creators, book.pkg.Metadata.Languages)
+	}
+	if n := len(book.pkg.Spine.ItemRefs); n != 6 {
+		t.Fatalf("spine has %d pages, want 6 (5 images, one a split spread)", n)
+	}
+	opf := string(book.opf())
+	for _, want := range []string{
+		`<spine toc="ncx" page-progression-direction="rtl">`,
+		`<meta property="rendition:layout">pre-paginated</meta>`,
+		`<meta name="fixed-layout" content="true"/>`,
+		`<meta name="book-type" content="comic"/>`,
+		`<meta name="primary-writing-mode" content="horizontal-rl"/>`,
+		`<meta name="original-resolution" content="150x200"/>`,
+		`<item id="cover-image" href="Images/page0001.jpg" media-type="image/jpeg" properties="cover-image"/>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("OPF lacks %s:\n%s", want, opf)
+		}
+	}
+
+	// Page1 (natural order first) was scaled down to the screen; page2 and
+	// page10 follow untouched.
+	first := string(readEntry(t, out, "OEBPS/Text/page0001.xhtml"))
+	if !strings.Contains(first, `<meta name="viewport" content="width=150, height=200"/>`) || !strings.Contains(first, `src="../Images/page0001.jpg"`) {
+		t.Errorf("first page:\n%s", first)
+	}
+	if !bytes.Equal(readEntry(t, out, "OEBPS/Images/page0002.png"), pageImage(t, 60, 80)) {
+		t.Error("a page that fits the screen should be kept byte for byte")
+	}
+	if !strings.Contains(string(readEntry(t, out, "OEBPS/Text/page0003.xhtml")), `content="width=60, height=80"`) {
+		t.Error("page10 should come third")
+	}
+
+	// Right to left, the spread's right (white) half is read first.
+	shade := func(name string) uint8 {
+		img, err := jpeg.Decode(bytes.NewReader(readEntry(t, out, name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _, _, _ := img.At(img.Bounds().Dx()/2, img.Bounds().Dy()/2).RGBA()
+		return uint8(r >> 8)
+	}
+	if shade("OEBPS/Images/page0005.jpg") < 200 || shade("OEBPS/Images/page0006.jpg") > 50 {
+		t.Error("split spread halves are not in right-to-left order")
+	}
+
+	nav := string(readEntry(t, out, "OEBPS/nav.xhtml"))
+	if !strings.Contains(nav, `<a href="Text/page0001.xhtml">Ch 1</a>`) || !strings.Contains(nav, `<a href="Text/page0004.xhtml">Ch 2</a>`) {
+		t.Errorf("nav should list the chapter folders:\n%s", nav)
+	}
+}
+
+func TestConvertComicToEPUB_Options(t *testing.T) {
+	cbz := comicArchive(t)
+	out, err := ConvertComicToEPUB(cbz, ComicOptions{Direction: "ltr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(book.pkg.Spine.ItemRefs); n != 5 {
+		t.Errorf("without splitting there are %d pages, want 5", n)
+	}
+	if opf := string(book.opf()); !strings.Contains(opf, `page-progression-direction="ltr"`) || !strings.Contains(opf, `content="300x400"`) {
+		t.Errorf("ltr at original size:\n%s", opf)
+	}
+
+	if _, err := ConvertComicToEPUB(makeZip(t, map[string]string{"a.jpg": "not an image"}), ComicOptions{}); err != ErrNoComicPages {
+		t.Errorf("err = %v, want ErrNoComicPages", err)
+	}
+}
+
+func TestNaturalCompare(t *testing.T) {
+	names := []string{"p10.jpg", "P2.jpg", "p1.jpg", "p01a.jpg", "ch2/p1.jpg", "ch10/p1.jpg", "p100.jpg"}
+	slices.SortFunc(names, naturalCompare)
+	want := []string{"ch2/p1.jpg", "ch10/p1.jpg", "p1.jpg", "p01a.jpg", "P2.jpg", "p10.jpg", "p100.jpg"}
+	if !slices.Equal(names, want) {
+		t.Errorf("sorted = %q, want %q", names, want)
+	}
+}
+
+func TestComicOptionsFromEnv(t *testing.T) {
+	t.Setenv("COMIC_DEVICE", "")
+	t.Setenv("COMIC_READING_DIRECTION", "")
+	t.Setenv("COMIC_SPLIT_SPREADS", "")
+	if o := ComicOptionsFromEnv(); o != (ComicOptions{Width: 1236, Height: 1648}) {
+		t.Errorf("defaults = %+v", o)
+	}
+	t.Setenv("COMIC_DEVICE", "800x600")
+	t.Setenv("COMIC_READING_DIRECTION", "RTL")
+	t.Setenv("COMIC_SPLIT_SPREADS", "true")
+	if o := ComicOptionsFromEnv(); o != (ComicOptions{Direction: "rtl", SplitSpreads: true, Width: 800, Height: 600}) {
+		t.Errorf("options = %+v", o)
+	}
+	if w, h, err := ParseComicScreen("original"); w != 0 || h != 0 || err != nil {
+		t.Errorf("original = %d %d %v", w, h, err)
+	}
+	if _, _, err := ParseComicScreen("kobo"); err == nil {
+		t.Error("an unknown device should be an error")
+	}
+}
+
+func TestDetectFileFormat_Comics(t *testing.T) {
+	if f, _ := detectFileFormat("", comicArchive(t)); f != "cbz" {
+		t.Errorf("comic zip detected as %q", f)
+	}
+	if f, mt := detectFileFormat("", []byte("Rar!\x1a\x07\x01\x00rest")); f != "cbr" || mt != "application/vnd.comicbook-rar" {
+		t.Errorf("RAR detected as %q (%s)", f, mt)
+	}
+	// Mostly not images: not a comic.
+	mixed := makeZip(t, map[string]string{"a.png": string(tinyPNG(t)), "b.xml": "x", "c.xml": "x"})
+	if f, _ := detectFileFormat("", mixed); f != "unknown" {
+		t.Errorf("mixed zip detected as %q", f)
+	}
+}
+
+func TestCBRConverter(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "page.png")
+	if err := os.WriteFile(page, pageImage(t, 60, 80), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Mimics `bsdtar -x -f IN -C OUT`, including a symlink out of the
+	// archive that must not be followed.
+	script := filepath.Join(dir, "bsdtar-stub")
+	sh := "#!/bin/sh\n[ \"$1\" = -x ] || exit 3\nmkdir -p \"$5/Ch 1\"\ncp \"" + page + "\" \"$5/Ch 1/2.png\"\ncp \"" + page + "\" \"$5/Ch 1/10.png\"\nln -s \"" + page + "\" \"$5/link.png\"\n"
+	if err := os.WriteFile(script, []byte(sh), 0700); err != nil {
+		t.Fatal(err)
+	}
+	orig := bsdtarCmd
+	t.Cleanup(func() { bsdtarCmd = orig })
+	bsdtarCmd = script
+
+	if !(cbrConverter{}).Available() {
+		t.Fatal("stub bsdtar should be available")
+	}
+	conv, err := NewConverterRegistry(cbrConverter{}).Convert([]byte("Rar!\x1a\x07\x00"), "cbr", "epub")
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	book, err := parseEPUB(conv.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(book.pkg.Spine.ItemRefs); n != 2 {
+		t.Errorf("spine has %d pages, want the 2 regular files", n)
+	}
+
+	bsdtarCmd = filepath.Join(dir, "missing")
+	if (cbrConverter{}).Available() {
+		t.Error("a missing bsdtar should be unavailable")
+	}
+	if _, err := ConvertCBRToEPUB(context.Background(), []byte("Rar!"), ComicOptions{}); err == nil {
+		t.Error("a missing bsdtar should fail")
+	}
+}
+
+func TestDefaultConverters_Comics(t *testing.T) {
+	plans := converterRegistry.Plans("cbz", "epub")
+	if len(plans) == 0 || plans[0][0].Converter.Name() != "native" {
+		t.Fatalf("cbz should convert natively first: %+v", plans)
+	}
+	if !slices.ContainsFunc(converterRegistry.Converters(), func(c Converter) bool { return c.Name() == "bsdtar" }) {
+		t.Error("the CBR backend should be registered")
+	}
+}
@@ -0,0 +1,398 @@
+package anna
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Amazon's Send-to-Kindle email only takes a handful of formats, and of those
+// EPUB is the one that reads well everywhere. Anything else we download (a
+// PDF, a MOBI, ...) is converted before it is sent. Conversions come from
+// pluggable backends: Calibre and pandoc are optional external tools, while
+// some formats are converted natively in Go. Each backend declares which
+// (from, to) conversions it performs, whether it is usable right now and how
+// long it may run; the registry picks the best route across them.
+
+// ConversionRoute is a single conversion between two formats, named the way
+// detectFileFormat names them ("pdf", "epub", ...).
+type ConversionRoute struct {
+	From, To string
+}
+
+func (r ConversionRoute) String() string { return r.From + "→" + r.To }
+
+// Converter is a conversion backend.
+type Converter interface {
+	// Name identifies the backend in logs and the CLI.
+	Name() string
+	// Routes lists the conversions the backend can perform.
+	Routes() []ConversionRoute
+	// Available reports whether the backend can run here (e.g. its external
+	// tool is installed).
+	Available() bool
+	// Timeout bounds a single conversion.
+	Timeout() time.Duration
+	// Convert performs route, one of Routes(). It should give up when ctx is
+	// done.
+	Convert(ctx context.Context, data []byte, route ConversionRoute) ([]byte, error)
+}
+
+// FileConverter is a Converter that can read its input straight from a
+// file, as the external tools do. ConverterRegistry.ConvertFile hands such a
+// backend the file itself instead of reading it into memory first.
+type FileConverter interface {
+	Converter
+	// ConvertFile performs route on the file at path, which it must leave
+	// as it is.
+	ConvertFile(ctx context.Context, path string, route ConversionRoute) ([]byte, error)
+}
+
+// ErrNoConversionRoute means no available backend can turn a format into any
+// of the wanted ones.
+var ErrNoConversionRoute = errors.New("no converter available")
+
+// maxConversionHops caps how many conversions are chained to reach a target.
+const maxConversionHops = 2
+
+// ConversionStep is one hop of a conversion plan.
+type ConversionStep struct {
+	Converter Converter
+	Route     ConversionRoute
+}
+
+// Conversion is the result of ConverterRegistry.Convert.
+type Conversion struct {
+	Data  []byte
+	From  string
+	To    string
+	Steps []ConversionStep
+}
+
+// Via names the backends that produced the conversion, e.g. "calibre".
+func (c *Conversion) Via() string {
+	names := make([]string, len(c.Steps))
+	for i, s := range c.Steps {
+		names[i] = s.Converter.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+// ConverterRegistry holds the conversion backends, in order of preference.
+type ConverterRegistry struct {
+	converters []Converter
+}
+
+// NewConverterRegistry returns a registry of cs, most preferred first.
+func NewConverterRegistry(cs ...Converter) *ConverterRegistry {
+	r := &ConverterRegistry{}
+	for _, c := range cs {
+		r.Register(c)
+	}
+	return r
+}
+
+// Register adds c after the backends already registered, so it is only used
+// for a conversion when no earlier backend offers an equally short route.
+func (r *ConverterRegistry) Register(c Converter) {
+	r.converters = append(r.converters, c)
+}
+
+// Converters returns the registered backends, most preferred first.
+func (r *ConverterRegistry) Converters() []Converter {
+	return slices.Clone(r.converters)
+}
+
+// Plans returns every way the available backends can turn from into one of
+// targets, best first: fewer hops, then earlier targets, then earlier
+// registered backends.
+func (r *ConverterRegistry) Plans(from string, targets ...string) [][]ConversionStep {
+	var avail []Converter
+	for _, c := range r.converters {
+		if c.Available() {
+			avail = append(avail, c)
+		}
+	}
+
+	var plans [][]ConversionStep
+	var walk func(format string, path []ConversionStep, seen []string)
+	walk = func(format string, path []ConversionStep, seen []string) {
+		if len(path) == maxConversionHops {
+			return
+		}
+		for _, c := range avail {
+			for _, route := range c.Routes() {
+				if route.From != format || slices.Contains(seen, route.To) {
+					continue
+				}
+				next := append(slices.Clip(path), ConversionStep{Converter: c, Route: route})
+				if slices.Contains(targets, route.To) {
+					plans = append(plans, next)
+					continue
+				}
+				walk(route.To, next, append(slices.Clip(seen), route.To))
+			}
+		}
+	}
+	walk(from, nil, []string{from})
+
+	slices.SortStableFunc(plans, func(a, b []ConversionStep) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return slices.Index(targets, a[len(a)-1].Route.To) - slices.Index(targets, b[len(b)-1].Route.To)
+	})
+	return plans
+}
+
+// Convert turns data, in format from, into the first of targets it can,
+// trying each plan in turn until one succeeds. An EPUB result must be a real
+// EPUB zip. It returns ErrNoConversionRoute (wrapped) when no backend offers
+// a route, otherwise every plan's failure.
+func (r *ConverterRegistry) Convert(data []byte, from string, targets ...string) (*Conversion, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty %s data", from)
+	}
+	return r.convert(conversionInput{data: data}, from, targets)
+}
+
+// ConvertFile is Convert for the file at path, such as a spooled download.
+// A first step done by a FileConverter reads the file itself; the file is
+// only read into memory for a first step that needs it there.
+func (r *ConverterRegistry) ConvertFile(path, from string, targets ...string) (*Conversion, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, fmt.Errorf("empty %s data", from)
+	}
+	return r.convert(conversionInput{path: path}, from, targets)
+}
+
+// conversionInput is what a conversion starts from: data in memory, or the
+// file at path, read by loadData when a step needs it in memory.
+type conversionInput struct {
+	data []byte
+	path string
+}
+
+func (in *conversionInput) loadData() ([]byte, error) {
+	if in.data == nil {
+		data, err := os.ReadFile(in.path)
+		if err != nil {
+			return nil, err
+		}
+		in.data = data
+	}
+	return in.data, nil
+}
+
+func (r *ConverterRegistry) convert(in conversionInput, from string, targets []string) (*Conversion, error) {
+	plans := r.Plans(from, targets...)
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("%w for %s to %s", ErrNoConversionRoute, from, strings.Join(targets, "/"))
+	}
+
+	// Plans that share their first hops reuse those hops' output.
+	done := map[string][]byte{}
+	var errs []error
+plans:
+	for _, plan := range plans {
+		var out []byte
+		key := ""
+		for i, step := range plan {
+			key += step.Converter.Name() + ":" + step.Route.String() + ";"
+			if cached, ok := done[key]; ok {
+				out = cached
+				continue
+			}
+			stepIn := conversionInput{data: out}
+			if i == 0 {
+				if _, ok := step.Converter.(FileConverter); !ok {
+					if _, err := in.loadData(); err != nil {
+						return nil, fmt.Errorf("read %s: %w", from, err)
+					}
+				}
+				stepIn = in
+			}
+			var err error
+			if out, err = runConversion(step, stepIn); err != nil {
+				errs = append(errs, fmt.Errorf("%s %s: %w", step.Converter.Name(), step.Route, err))
+				continue plans
+			}
+			done[key] = out
+		}
+		return &Conversion{Data: out, From: from, To: plan[len(plan)-1].Route.To, Steps: plan}, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// runConversion runs one step under its backend's timeout and sanity-checks
+// the output. An input with a path goes to the backend's ConvertFile.
+func runConversion(step ConversionStep, in conversionInput) ([]byte, error) {
+	timeout := step.Converter.Timeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var out []byte
+	var err error
+	if fc, ok := step.Converter.(FileConverter); ok && in.path != "" {
+		out, err = fc.ConvertFile(ctx, in.path, step.Route)
+	} else {
+		out, err = step.Converter.Convert(ctx, in.data, step.Route)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errors.New("conversion produced no output")
+	}
+	if step.Route.To == "epub" && !isEPUBZip(out) {
+		return nil, errors.New("conversion output is not a valid epub")
+	}
+	return out, nil
+}
+
+// kindleFormats are the formats Send-to-Kindle accepts, which sendOneEdition
+// emails as they are (PDFs aside, see sendOneEdition). Anything else must be
+// converted first.
+var kindleFormats = []string{"epub", "pdf", "docx", "doc", "rtf", "html", "txt", "jpg", "png", "gif", "bmp"}
+
+// kindleAccepts reports whether format can be emailed without converting.
+func kindleAccepts(format string) bool {
+	return slices.Contains(kindleFormats, format)
+}
+
+// converterRegistry is the registry sendOneEdition converts with; a package
+// var so tests can swap in stub backends.
+var converterRegistry = NewConverterRegistry(
+	nativeConverter{},
+	cbrConverter{},
+	calibreConverter{},
+	pandocConverter{},
+)
+
+// DefaultConverters returns the conversion backends used for deliveries, most
+// preferred first.
+func DefaultConverters() []Converter {
+	return converterRegistry.Converters()
+}
+
+// nativeConversions are the conversions done in-process, without any
+// external tool.
+var nativeConversions = map[ConversionRoute]func(context.Context, []byte) ([]byte, error){
+	{From: "mobi", To: "epub"}: convertMOBIToEPUB,
+	{From: "azw", To: "epub"}:  convertMOBIToEPUB,
+	{From: "azw3", To: "epub"}: convertMOBIToEPUB,
+	{From: "fb2", To: "epub"}:  convertFB2ToEPUB,
+	{From: "cbz", To: "epub"}: func(ctx context.Context, data []byte) ([]byte, error) {
+		return convertComicToEPUB(ctx, data, ComicOptionsFromEnv())
+	},
+	{From: "txt", To: "epub"}: func(ctx context.Context, data []byte) ([]byte, error) {
+		out, _, _, err := convertText(ctx, data, TextOptions{})
+		return out, err
+	},
+	{From: "md", To: "epub"}: func(ctx context.Context, data []byte) ([]byte, error) {
+		out, _, _, err := convertText(ctx, data, TextOptions{Format: "md"})
+		return out, err
+	},
+}
+
+// nativeConvertTimeout bounds an in-process conversion. They are CPU-bound
+// and quick on a Pi; the bound only stops a pathological file from holding up
+// the send. The converters check the context between records, sections and
+// pages, so a conversion that times out stops rather than running on.
+const nativeConvertTimeout = 30 * time.Second
+
+// nativeConverter runs the Go converters in nativeConversions. It is always
+// available and preferred over the external tools.
+type nativeConverter struct{}
+
+func (nativeConverter) Name() string { return "native" }
+
+func (nativeConverter) Routes() []ConversionRoute {
+	routes := make([]ConversionRoute, 0, len(nativeConversions))
+	for r := range nativeConversions {
+		routes = append(routes, r)
+	}
+	slices.SortFunc(routes, func(a, b ConversionRoute) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return routes
+}
+
+func (nativeConverter) Available() bool { return true }
+
+func (nativeConverter) Timeout() time.Duration { return nativeConvertTimeout }
+
+func (nativeConverter) Convert(ctx context.Context, data []byte, route ConversionRoute) ([]byte, error) {
+	convert, ok := nativeConversions[route]
+	if !ok {
+		return nil, fmt.Errorf("no native %s conversion", route)
+	}
+	return convert(ctx, data)
+}
+
+// toolInput puts an external tool's input file at inPath.
+type toolInput func(inPath string) error
+
+// dataInput writes data out for the tool.
+func dataInput(data []byte) toolInput {
+	return func(inPath string) error { return os.WriteFile(inPath, data, 0600) }
+}
+
+// fileInput links the file at path for the tool, so a spooled download is
+// neither copied nor read into memory.
+func fileInput(path string) toolInput {
+	return func(inPath string) error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(abs, inPath)
+	}
+}
+
+// runConverterTool converts a file with an external tool: it puts the input
+// in a temp dir under a name ending in route.From, which the tools go by,
+// runs name with the arguments args returns for the input and output paths,
+// and reads back the output.
+func runConverterTool(ctx context.Context, name string, in toolInput, route ConversionRoute, args func(in, out string) []string) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp("", "pib-convert-")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inPath := filepath.Join(tmpDir, "in."+route.From)
+	outPath := filepath.Join(tmpDir, "out."+route.To)
+	if err := in(inPath); err != nil {
+		return nil, fmt.Errorf("write temp %s: %w", route.From, err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args(inPath, outPath)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%s failed: %w (%s)", filepath.Base(name), err, truncate(stderr.String(), 300))
+	}
+
+	out, err := os.ReadFile(outPath)
+	if err != nil {
+		return nil, fmt.Errorf("read converted %s: %w", route.To, err)
+	}
+	return out, nil
+}
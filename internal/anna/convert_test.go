@@ -0,0 +1,295 @@
+package anna
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubConverter is a Converter whose routes, availability and output are set
+// by the test. It records the inputs it was given.
+type stubConverter struct {
+	name    string
+	routes  []ConversionRoute
+	down    bool
+	timeout time.Duration
+	convert func(ctx context.Context, data []byte, route ConversionRoute) ([]byte, error)
+	calls   []string
+}
+
+func (s *stubConverter) Name() string              { return s.name }
+func (s *stubConverter) Routes() []ConversionRoute { return s.routes }
+func (s *stubConverter) Available() bool           { return !s.down }
+
+func (s *stubConverter) Timeout() time.Duration {
+	if s.timeout == 0 {
+		return time.Second
+	}
+	return s.timeout
+}
+
+func (s *stubConverter) Convert(ctx context.Context, data []byte, route ConversionRoute) ([]byte, error) {
+	s.calls = append(s.calls, route.String()+":"+string(data))
+	return s.convert(ctx, data, route)
+}
+
+// returning makes a stub convert function that always returns out.
+func returning(out []byte) func(context.Context, []byte, ConversionRoute) ([]byte, error) {
+	return func(context.Context, []byte, ConversionRoute) ([]byte, error) { return out, nil }
+}
+
+func failing(msg string) func(context.Context, []byte, ConversionRoute) ([]byte, error) {
+	return func(context.Context, []byte, ConversionRoute) ([]byte, error) { return nil, errors.New(msg) }
+}
+
+func TestConverterRegistry_PlansOrder(t *testing.T) {
+	direct := &stubConverter{name: "direct", routes: []ConversionRoute{{"docx", "epub"}}}
+	hop := &stubConverter{name: "hop", routes: []ConversionRoute{{"docx", "html"}, {"html", "epub"}}}
+	down := &stubConverter{name: "down", routes: []ConversionRoute{{"docx", "epub"}}, down: true}
+	second := &stubConverter{name: "second", routes: []ConversionRoute{{"docx", "epub"}}}
+	r := NewConverterRegistry(hop, down, direct, second)
+
+	plans := r.Plans("docx", "epub")
+	var got []string
+	for _, p := range plans {
+		var names []string
+		for _, s := range p {
+			names = append(names, s.Converter.Name()+" "+s.Route.String())
+		}
+		got = append(got, strings.Join(names, ", "))
+	}
+	want := []string{"direct docx→epub", "second docx→epub", "hop docx→html, hop html→epub"}
+	if strings.Join(got, " | ") != strings.Join(want, " | ") {
+		t.Errorf("plans = %q, want %q", got, want)
+	}
+	if len(r.Plans("pdf", "epub")) != 0 {
+		t.Error("no backend converts pdf")
+	}
+}
+
+func TestConverterRegistry_PrefersEarlierTargets(t *testing.T) {
+	c := &stubConverter{name: "c", routes: []ConversionRoute{{"cbz", "pdf"}, {"cbz", "epub"}}}
+	plans := NewConverterRegistry(c).Plans("cbz", "epub", "pdf")
+	if len(plans) != 2 || plans[0][0].Route.To != "epub" {
+		t.Errorf("epub should be tried before pdf: %+v", plans)
+	}
+}
+
+func TestConverterRegistry_ConvertFallsBack(t *testing.T) {
+	epub := makeMinimalEPUB(t)
+	broken := &stubConverter{name: "broken", routes: []ConversionRoute{{"mobi", "epub"}}, convert: failing("bad header")}
+	garbage := &stubConverter{name: "garbage", routes: []ConversionRoute{{"mobi", "epub"}}, convert: returning([]byte("not a zip"))}
+	works := &stubConverter{name: "works", routes: []ConversionRoute{{"mobi", "epub"}}, convert: returning(epub)}
+
+	conv, err := NewConverterRegistry(broken, garbage, works).Convert([]byte("book"), "mobi", "epub")
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if conv.Via() != "works" || conv.From != "mobi" || conv.To != "epub" || string(conv.Data) != string(epub) {
+		t.Errorf("unexpected conversion: via %s, %s→%s", conv.Via(), conv.From, conv.To)
+	}
+	if len(broken.calls) != 1 || len(garbage.calls) != 1 {
+		t.Errorf("each backend should be tried once: %v %v", broken.calls, garbage.calls)
+	}
+}
+
+func TestConverterRegistry_ConvertChainsAndReusesHops(t *testing.T) {
+	first := &stubConverter{name: "first", routes: []ConversionRoute{{"cbr", "cbz"}}, convert: returning([]byte("zip"))}
+	bad := &stubConverter{name: "bad", routes: []ConversionRoute{{"cbz", "epub"}}, convert: failing("nope")}
+	good := &stubConverter{name: "good", routes: []ConversionRoute{{"cbz", "epub"}}, convert: returning(makeMinimalEPUB(t))}
+
+	conv, err := NewConverterRegistry(first, bad, good).Convert([]byte("rar"), "cbr", "epub")
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if conv.Via() != "first+good" {
+		t.Errorf("via = %s, want first+good", conv.Via())
+	}
+	if len(first.calls) != 1 {
+		t.Errorf("the shared first hop should run once, ran %v", first.calls)
+	}
+	if len(good.calls) != 1 || good.calls[0] != "cbz→epub:zip" {
+		t.Errorf("the second hop should get the first hop's output: %v", good.calls)
+	}
+}
+
+// fileStub is a stubConverter that can also read its input from a file.
+type fileStub struct{ *stubConverter }
+
+func (s fileStub) ConvertFile(ctx context.Context, path string, route ConversionRoute) ([]byte, error) {
+	s.calls = append(s.calls, route.String()+":file:"+path)
+	return s.convert(ctx, nil, route)
+}
+
+func TestConverterRegistry_ConvertFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "download")
+	if err := os.WriteFile(path, []byte("pdf bytes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	epub := makeMinimalEPUB(t)
+
+	reader := fileStub{&stubConverter{name: "reader", routes: []ConversionRoute{{"pdf", "epub"}}, convert: returning(epub)}}
+	if _, err := NewConverterRegistry(reader).ConvertFile(path, "pdf", "epub"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reader.calls) != 1 || reader.calls[0] != "pdf→epub:file:"+path {
+		t.Errorf("a FileConverter should be handed the file: %v", reader.calls)
+	}
+
+	plain := &stubConverter{name: "plain", routes: []ConversionRoute{{"pdf", "epub"}}, convert: returning(epub)}
+	if _, err := NewConverterRegistry(plain).ConvertFile(path, "pdf", "epub"); err != nil {
+		t.Fatal(err)
+	}
+	if len(plain.calls) != 1 || plain.calls[0] != "pdf→epub:pdf bytes" {
+		t.Errorf("any other backend should get the file's bytes: %v", plain.calls)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty")
+	os.WriteFile(empty, nil, 0600)
+	if _, err := NewConverterRegistry(reader).ConvertFile(empty, "pdf", "epub"); err == nil {
+		t.Error("an empty file should fail")
+	}
+}
+
+func TestCalibreConverter_ConvertFileLinksTheInput(t *testing.T) {
+	dir := t.TempDir()
+	fixture := filepath.Join(dir, "fixture.epub")
+	if err := os.WriteFile(fixture, makeMinimalEPUB(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The input must be a link to the spooled file, named for its format.
+	script := filepath.Join(dir, "ebook-convert-stub")
+	sh := "#!/bin/sh\n[ -L \"$1\" ] || exit 3\ncase \"$1\" in *.pdf) ;; *) exit 4 ;; esac\ncp \"" + fixture + "\" \"$2\"\n"
+	if err := os.WriteFile(script, []byte(sh), 0700); err != nil {
+		t.Fatal(err)
+	}
+	orig := pdfConverterCmd
+	t.Cleanup(func() { pdfConverterCmd = orig })
+	pdfConverterCmd = script
+
+	spool := testSpool(t, []byte("%PDF-1.4"))
+	conv, err := NewConverterRegistry(calibreConverter{}).ConvertFile(spool.Path(), "pdf", "epub")
+	if err != nil {
+		t.Fatalf("ConvertFile: %v", err)
+	}
+	if !isEPUBZip(conv.Data) {
+		t.Error("expected the stub's EPUB")
+	}
+	if data, _ := spool.Bytes(); string(data) != "%PDF-1.4" {
+		t.Error("the spooled file should be left as it is")
+	}
+}
+
+func TestConverterRegistry_ConvertErrors(t *testing.T) {
+	if _, err := NewConverterRegistry().Convert([]byte("x"), "pdf", "epub"); !errors.Is(err, ErrNoConversionRoute) {
+		t.Errorf("want ErrNoConversionRoute, got %v", err)
+	}
+	if _, err := NewConverterRegistry().Convert(nil, "pdf", "epub"); err == nil {
+		t.Error("empty input should fail")
+	}
+
+	a := &stubConverter{name: "a", routes: []ConversionRoute{{"pdf", "epub"}}, convert: failing("first reason")}
+	b := &stubConverter{name: "b", routes: []ConversionRoute{{"pdf", "epub"}}, convert: failing("second reason")}
+	_, err := NewConverterRegistry(a, b).Convert([]byte("x"), "pdf", "epub")
+	if err == nil || !strings.Contains(err.Error(), "first reason") || !strings.Contains(err.Error(), "second reason") {
+		t.Errorf("error should report every backend's failure: %v", err)
+	}
+}
+
+func TestConverterRegistry_ConvertTimesOut(t *testing.T) {
+	slow := &stubConverter{
+		name:    "slow",
+		routes:  []ConversionRoute{{"pdf", "epub"}},
+		timeout: 20 * time.Millisecond,
+		convert: func(ctx context.Context, _ []byte, _ ConversionRoute) ([]byte, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	_, err := NewConverterRegistry(slow).Convert([]byte("x"), "pdf", "epub")
+	if err == nil || !strings.Contains(err.Error(), "timed out after 20ms") {
+		t.Errorf("want a timeout error, got %v", err)
+	}
+}
+
+func TestDefaultConverters_PreferNativeMOBI(t *testing.T) {
+	plans := converterRegistry.Plans("azw3", "epub")
+	if len(plans) == 0 || plans[0][0].Converter.Name() != "native" {
+		t.Fatalf("azw3 should convert natively first: %+v", plans)
+	}
+	names := map[string]bool{}
+	for _, c := range DefaultConverters() {
+		names[c.Name()] = true
+	}
+	if !names["native"] || !names["calibre"] || !names["pandoc"] {
+		t.Errorf("default backends = %v", names)
+	}
+}
+
+func TestCalibreConverter_OtherFormats(t *testing.T) {
+	orig := pdfConverterCmd
+	t.Cleanup(func() { pdfConverterCmd = orig })
+	pdfConverterCmd = writeStubConverter(t, makeMinimalEPUB(t))
+
+	conv, err := NewConverterRegistry(calibreConverter{}).Convert([]byte("{\\rtf1}"), "rtf", "epub")
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if conv.Via() != "calibre" || !isEPUBZip(conv.Data) {
+		t.Errorf("unexpected conversion via %s", conv.Via())
+	}
+}
+
+func TestPandocConverter(t *testing.T) {
+	dir := t.TempDir()
+	fixture := filepath.Join(dir, "fixture.epub")
+	if err := os.WriteFile(fixture, makeMinimalEPUB(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Mimics `pandoc --from R --to epub3 --output OUT IN`, checking the reader.
+	script := filepath.Join(dir, "pandoc-stub")
+	sh := "#!/bin/sh\n[ \"$2\" = markdown ] || exit 3\ncp \"" + fixture + "\" \"$6\"\n"
+	if err := os.WriteFile(script, []byte(sh), 0700); err != nil {
+		t.Fatal(err)
+	}
+	orig := pandocCmd
+	t.Cleanup(func() { pandocCmd = orig })
+	pandocCmd = script
+
+	if !(pandocConverter{}).Available() {
+		t.Fatal("stub pandoc should be available")
+	}
+	conv, err := NewConverterRegistry(pandocConverter{}).Convert([]byte("# Dune"), "md", "epub")
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if !isEPUBZip(conv.Data) {
+		t.Error("expected the stub's EPUB")
+	}
+	if _, err := NewConverterRegistry(pandocConverter{}).Convert([]byte("<p>x</p>"), "html", "epub"); err == nil || !strings.Contains(err.Error(), "pandoc-stub failed") {
+		t.Errorf("a failing run should report the tool: %v", err)
+	}
+}
+
+func TestNativeConversions_StopWhenCancelled(t *testing.T) {
+	kf7, _ := kf7Book(t)
+	for route, data := range map[ConversionRoute][]byte{
+		{"mobi", "epub"}: kf7,
+		{"fb2", "epub"}:  []byte(fb2Book(t)),
+		{"cbz", "epub"}:  comicArchive(t),
+		{"txt", "epub"}:  []byte(gutenbergSample),
+	} {
+		if _, err := (nativeConverter{}).Convert(context.Background(), data, route); err != nil {
+			t.Fatalf("%s: fixture does not convert: %v", route, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := (nativeConverter{}).Convert(ctx, data, route); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: err = %v, want the conversion to stop with context.Canceled", route, err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// epubBook is an EPUB unpacked into memory for the stages that rewrite books
+// (shrinking, splitting, ...): every zip entry in its original order, plus
+// the parsed OPF package. Edits to the OPF are made on its text (see
+// removeManifestItem) so everything we don't model — metadata refinements,
+// guide, bindings — survives untouched.
+type epubBook struct {
+	entries []*epubEntry
+	opfPath string
+	pkg     opfPackage
+}
+
+type epubEntry struct {
+	Name string
+	Data []byte
+}
+
+// opfPackage is the subset of the OPF package document the rewriting stages
+// need. Tags without a namespace match both OPF and Dublin Core elements.
+type opfPackage struct {
+	Version  string `xml:"version,attr"`
+	Metadata struct {
+		Titles    []string `xml:"title"`
+		Creators  []string `xml:"creator"`
+		Languages []string `xml:"language"`
+	} `xml:"metadata"`
+	Manifest []opfItem `xml:"manifest>item"`
+	Spine    struct {
+		Toc      string       `xml:"toc,attr"`
+		ItemRefs []opfItemRef `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+type opfItem struct {
+	ID         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+type opfItemRef struct {
+	IDRef  string `xml:"idref,attr"`
+	Linear string `xml:"linear,attr"`
+}
+
+// parseEPUB unpacks data and parses its OPF. It fails on anything that isn't
+// a structurally sound EPUB.
+func parseEPUB(data []byte) (*epubBook, error) {
+	z, err := openZip(data)
+	var zerr *ZipError
+	switch {
+	case errors.As(err, &zerr):
+		return nil, err
+	case err != nil:
+		return nil, fmt.Errorf("not a valid EPUB (corrupt or truncated zip): %w", err)
+	}
+	b := &epubBook{}
+	for _, f := range z.files() {
+		if strings.HasSuffix(f.Name, "/") {
+			continue // directory entries are implied by file paths
+		}
+		body, err := z.readFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", f.Name, err)
+		}
+		b.entries = append(b.entries, &epubEntry{Name: f.Name, Data: body})
+	}
+
+	container := b.file("META-INF/container.xml")
+	if container == nil {
+		return nil, errors.New("missing META-INF/container.xml")
+	}
+	var c struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(container.Data, &c); err != nil {
+		return nil, fmt.Errorf("container.xml is malformed XML: %w", err)
+	}
+	if len(c.Rootfiles) == 0 || c.Rootfiles[0].FullPath == "" {
+		return nil, errors.New("container.xml does not reference an OPF package file")
+	}
+	b.opfPath = c.Rootfiles[0].FullPath
+	if b.file(b.opfPath) == nil {
+		return nil, fmt.Errorf("OPF package file %q is missing", b.opfPath)
+	}
+	if err := b.reparseOPF(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *epubBook) reparseOPF() error {
+	var pkg opfPackage
+	if err := xml.Unmarshal(b.file(b.opfPath).Data, &pkg); err != nil {
+		return fmt.Errorf("OPF package file %q is malformed XML: %w", b.opfPath, err)
+	}
+	b.pkg = pkg
+	return nil
+}
+
+// file returns the entry called name, or nil.
+func (b *epubBook) file(name string) *epubEntry {
+	for _, e := range b.entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// opf returns the OPF document text.
+func (b *epubBook) opf() []byte { return b.file(b.opfPath).Data }
+
+// setOPF replaces the OPF text and re-parses it.
+func (b *epubBook) setOPF(data []byte) error {
+	b.file(b.opfPath).Data = data
+	return b.reparseOPF()
+}
+
+// itemPath is the zip path of a manifest item.
+func (b *epubBook) itemPath(it opfItem) string {
+	return resolveHref(b.opfPath, it.Href)
+}
+
+// itemByID returns the manifest item with the given id.
+func (b *epubBook) itemByID(id string) (opfItem, bool) {
+	for _, it := range b.pkg.Manifest {
+		if it.ID == id {
+			return it, true
+		}
+	}
+	return opfItem{}, false
+}
+
+// title is the first dc:title, or "".
+func (b *epubBook) title() string {
+	if len(b.pkg.Metadata.Titles) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(b.pkg.Metadata.Titles[0])
+}
+
+// removeEntry drops a zip entry.
+func (b *epubBook) removeEntry(name string) {
+	out := b.entries[:0]
+	for _, e := range b.entries {
+		if e.Name != name {
+			out = append(out, e)
+		}
+	}
+	b.entries = out
+}
+
+// bytes re-packs the book: mimetype first and stored (as the spec requires),
+// everything else deflated at the given level.
+func (b *epubBook) bytes(level int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+	write := func(e *epubEntry, method uint16) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.Name, Method: method})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(e.Data)
+		return err
+	}
+	if m := b.file("mimetype"); m != nil {
+		if err := write(m, zip.Store); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range b.entries {
+		if e.Name == "mimetype" {
+			continue
+		}
+		if err := write(e, zip.Deflate); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resolveHref resolves an href found in the document at fromPath into a zip
+// path: relative to fromPath's directory, URL-unescaped, fragment dropped.
+func resolveHref(fromPath, href string) string {
+	if i := strings.IndexByte(href, '#'); i >= 0 {
+		href = href[:i]
+	}
+	if u, err := url.PathUnescape(href); err == nil {
+		href = u
+	}
+	if strings.HasPrefix(href, "/") {
+		return strings.TrimPrefix(path.Clean(href), "/")
+	}
+	return path.Clean(path.Join(path.Dir(fromPath), href))
+}
+
+// removeManifestItem deletes the <item> with the given id from OPF text.
+func removeManifestItem(opf []byte, id string) []byte {
+	re := regexp.MustCompile(`(?s)[ \t]*<(?:opf:)?item\b[^>]*\bid\s*=\s*["']` + regexp.QuoteMeta(id) + `["'][^>]*?(?:/>|>\s*</(?:opf:)?item>)[ \t]*\r?\n?`)
+	return re.ReplaceAll(opf, nil)
+}
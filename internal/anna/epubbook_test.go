@@ -0,0 +1,63 @@
+package anna
+
+import (
+	"compress/flate"
+	"strings"
+	"testing"
+)
+
+func TestParseEPUB_RoundTrip(t *testing.T) {
+	entries := validEPUBEntries()
+	entries["OEBPS/content.opf"] = `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">x</dc:identifier><dc:title> Dune </dc:title></metadata>
+  <manifest>
+    <item id="ch1" href="Text/01.xhtml" media-type="application/xhtml+xml"/>
+    <item id="img" href="Images/a%20b.png" media-type="image/png"></item>
+  </manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>`
+	book, err := parseEPUB(makeZip(t, entries))
+	if err != nil {
+		t.Fatalf("parseEPUB: %v", err)
+	}
+	if book.title() != "Dune" || book.pkg.Version != "3.0" || len(book.pkg.Spine.ItemRefs) != 1 {
+		t.Errorf("unexpected package %+v", book.pkg)
+	}
+	img, ok := book.itemByID("img")
+	if !ok || book.itemPath(img) != "OEBPS/Images/a b.png" {
+		t.Errorf("itemPath should resolve and unescape hrefs, got %q", book.itemPath(img))
+	}
+
+	if err := book.setOPF(removeManifestItem(book.opf(), "img")); err != nil {
+		t.Fatalf("setOPF: %v", err)
+	}
+	if _, ok := book.itemByID("img"); ok || strings.Contains(string(book.opf()), "a%20b.png") {
+		t.Error("removeManifestItem should drop the item element")
+	}
+	if _, ok := book.itemByID("ch1"); !ok {
+		t.Error("other items must survive")
+	}
+
+	out, err := book.bytes(flate.BestCompression)
+	if err != nil {
+		t.Fatalf("bytes: %v", err)
+	}
+	if err := ValidateEPUB(out); err != nil {
+		t.Errorf("repacked EPUB should validate: %v", err)
+	}
+}
+
+func TestResolveHref(t *testing.T) {
+	cases := map[[2]string]string{
+		{"OEBPS/content.opf", "Text/01.xhtml#ch"}:    "OEBPS/Text/01.xhtml",
+		{"OEBPS/Styles/s.css", "../Fonts/A%20B.ttf"}: "OEBPS/Fonts/A B.ttf",
+		{"content.opf", "x.xhtml"}:                   "x.xhtml",
+		{"OEBPS/Text/1.xhtml", "/OEBPS/img.png"}:     "OEBPS/img.png",
+	}
+	for in, want := range cases {
+		if got := resolveHref(in[0], in[1]); got != want {
+			t.Errorf("resolveHref(%q, %q) = %q, want %q", in[0], in[1], got, want)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/relay"
+)
+
+// ValidateEPUB only rejects what makes a file unsendable. Amazon's converter
+// also fails (E999, or a book missing chapters) on EPUBs that are broken
+// further in: manifest entries without a file, spine items that don't exist,
+// chapters that aren't well-formed XHTML, table-of-contents links to nowhere.
+// CheckEPUB walks the whole package the way epubcheck does and reports every
+// such problem, graded by severity, so the send pipeline, the CLI and the MCP
+// tool can all show what is wrong with a book.
+
+// Severity grades an EPUBFinding.
+type Severity string
+
+const (
+	// SeverityFatal: not a sendable EPUB at all; ValidateEPUB rejects it.
+	SeverityFatal Severity = "fatal"
+	// SeverityError: breaks the EPUB spec in a way Amazon's converter may
+	// reject or render wrongly.
+	SeverityError Severity = "error"
+	// SeverityWarning: sloppy but harmless on a Kindle.
+	SeverityWarning Severity = "warning"
+)
+
+// EPUBFinding is one problem found by CheckEPUB.
+type EPUBFinding struct {
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`           // e.g. "MANIFEST_MISSING_FILE"
+	Path     string   `json:"path,omitempty"` // the zip entry it concerns
+	Message  string   `json:"message"`
+	Cause    error    `json:"-"` // the error behind it, if any
+}
+
+func (f EPUBFinding) String() string {
+	if f.Path == "" {
+		return fmt.Sprintf("%s %s: %s", f.Severity, f.Code, f.Message)
+	}
+	return fmt.Sprintf("%s %s %s: %s", f.Severity, f.Code, f.Path, f.Message)
+}
+
+// EPUBReport is the result of CheckEPUB.
+type EPUBReport struct {
+	Version  string        `json:"version,omitempty"` // the OPF package version
+	Findings []EPUBFinding `json:"findings"`
+
+	perCode map[string]int
+}
+
+// maxFindingsPerCode caps how many findings of one kind are listed, so a book
+// with a thousand broken anchors doesn't bury everything else.
+const maxFindingsPerCode = 20
+
+func (r *EPUBReport) add(sev Severity, code, p, format string, args ...any) {
+	if r.perCode == nil {
+		r.perCode = map[string]int{}
+	}
+	r.perCode[code]++
+	if r.perCode[code] > maxFindingsPerCode {
+		return
+	}
+	f := EPUBFinding{Severity: sev, Code: code, Path: p, Message: fmt.Sprintf(format, args...)}
+	for _, a := range args {
+		if err, ok := a.(error); ok {
+			f.Cause = err // an error among args is what went wrong
+			break
+		}
+	}
+	if !slices.Contains(r.Findings, f) {
+		r.Findings = append(r.Findings, f)
+	}
+}
+
+// finish notes the findings left out by maxFindingsPerCode.
+func (r *EPUBReport) finish() {
+	for _, f := range slices.Clone(r.Findings) {
+		if n := r.perCode[f.Code]; n > maxFindingsPerCode {
+			r.Findings = append(r.Findings, EPUBFinding{Severity: f.Severity, Code: f.Code,
+				Message: fmt.Sprintf("%d more like this not listed", n-maxFindingsPerCode)})
+			r.perCode[f.Code] = maxFindingsPerCode
+		}
+	}
+}
+
+// Count returns how many findings have the given severity.
+func (r *EPUBReport) Count(sev Severity) int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Severity == sev {
+			n++
+		}
+	}
+	return n
+}
+
+// Err returns the first fatal finding as an error, or nil if the book can be
+// sent. The error unwraps to the finding's cause, so errors.Is still sees,
+// say, ErrZipTooLarge.
+func (r *EPUBReport) Err() error {
+	for _, f := range r.Findings {
+		if f.Severity == SeverityFatal {
+			return &findingError{msg: f.Message, cause: f.Cause}
+		}
+	}
+	return nil
+}
+
+// findingError is a fatal finding as an error.
+type findingError struct {
+	msg   string
+	cause error
+}
+
+func (e *findingError) Error() string { return e.msg }
+func (e *findingError) Unwrap() error { return e.cause }
+
+// Clean reports whether there are no fatal findings or errors.
+func (r *EPUBReport) Clean() bool {
+	return r.Count(SeverityFatal) == 0 && r.Count(SeverityError) == 0
+}
+
+// Summary counts the findings, e.g. "2 errors, 1 warning".
+func (r *EPUBReport) Summary() string {
+	var parts []string
+	for _, s := range []struct {
+		sev  Severity
+		name string
+	}{{SeverityFatal, "fatal"}, {SeverityError, "error"}, {SeverityWarning, "warning"}} {
+		switch n := r.Count(s.sev); {
+		case n == 1:
+			parts = append(parts, "1 "+s.name)
+		case n > 1 && s.sev == SeverityFatal:
+			parts = append(parts, fmt.Sprintf("%d fatal", n))
+		case n > 1:
+			parts = append(parts, fmt.Sprintf("%d %ss", n, s.name))
+		}
+	}
+	if len(parts) == 0 {
+		return "no problems"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// String lists the findings under the summary.
+func (r *EPUBReport) String() string {
+	var b strings.Builder
+	b.WriteString(r.Summary())
+	for _, f := range r.Findings {
+		b.WriteString("\n  " + f.String())
+	}
+	return b.String()
+}
+
+// CheckEPUB validates an EPUB's container, package document, manifest,
+// spine, content documents and tables of contents.
+func CheckEPUB(data []byte) *EPUBReport {
+	r := &EPUBReport{Findings: []EPUBFinding{}}
+	defer r.finish()
+	if !checkEPUBContainer(r, data) {
+		return r
+	}
+	book, err := parseEPUB(data)
+	if err != nil {
+		r.add(SeverityFatal, "OPF_MALFORMED", "", "%v", err)
+		return r
+	}
+	r.Version = book.pkg.Version
+	c := &epubChecker{r: r, book: book, ids: map[string]map[string]bool{}}
+	c.checkPackage()
+	c.checkManifest()
+	c.checkSpine()
+	c.checkContent()
+	c.checkNCX()
+	c.checkNav()
+	return r
+}
+
+// checkEPUBContainer checks what ValidateEPUB requires, with its messages,
+// plus the mimetype entry's form. It reports whether the package document
+// can be read.
+func checkEPUBContainer(r *EPUBReport, data []byte) bool {
+	z, err := openZip(data)
+	var zerr *ZipError
+	switch {
+	case errors.As(err, &zerr):
+		r.add(SeverityFatal, "ZIP_UNSAFE", zerr.Name, "%v", err)
+		return false
+	case err != nil:
+		r.add(SeverityFatal, "ZIP_INVALID", "", "not a valid EPUB (corrupt or truncated zip): %v", err)
+		return false
+	}
+
+	var hasMimetype, hasContainer bool
+	for i, f := range z.files() {
+		switch f.Name {
+		case "META-INF/encryption.xml":
+			r.add(SeverityFatal, "DRM", f.Name, "the file is DRM-protected (encryption.xml present); Amazon cannot convert it")
+			return false
+		case "mimetype":
+			hasMimetype = true
+			if i != 0 || f.Method != zip.Store {
+				r.add(SeverityError, "MIMETYPE_NOT_FIRST", f.Name, "mimetype must be the first entry in the zip, stored uncompressed")
+			}
+			if b, err := z.readFile(f); err == nil && string(b) != "application/epub+zip" {
+				r.add(SeverityError, "MIMETYPE_CONTENT", f.Name, "mimetype contains %q instead of application/epub+zip", truncate(string(b), 40))
+			}
+		case "META-INF/container.xml":
+			hasContainer = true
+		}
+	}
+	if !hasMimetype {
+		r.add(SeverityFatal, "MIMETYPE_MISSING", "", "missing the required mimetype entry")
+		return false
+	}
+	if !hasContainer {
+		r.add(SeverityFatal, "CONTAINER_MISSING", "", "missing META-INF/container.xml")
+		return false
+	}
+
+	containerBytes, err := z.readNamed("META-INF/container.xml")
+	if err != nil {
+		r.add(SeverityFatal, "CONTAINER_MISSING", "META-INF/container.xml", "cannot read META-INF/container.xml: %v", err)
+		return false
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(containerBytes, &container); err != nil {
+		r.add(SeverityFatal, "CONTAINER_MALFORMED", "META-INF/container.xml", "container.xml is malformed XML: %v", err)
+		return false
+	}
+	if len(container.Rootfiles) == 0 || container.Rootfiles[0].FullPath == "" {
+		r.add(SeverityFatal, "OPF_MISSING", "META-INF/container.xml", "container.xml does not reference an OPF package file")
+		return false
+	}
+
+	opfPath := container.Rootfiles[0].FullPath
+	opfBytes, err := z.readNamed(opfPath)
+	if err != nil {
+		r.add(SeverityFatal, "OPF_MISSING", opfPath, "OPF package file %q is missing: %v", opfPath, err)
+		return false
+	}
+	if err := wellFormedXML(opfBytes); err != nil {
+		r.add(SeverityFatal, "OPF_MALFORMED", opfPath, "OPF package file %q is malformed XML: %v", opfPath, err)
+		return false
+	}
+	return true
+}
+
+// epubChecker runs the checks that need the parsed package.
+type epubChecker struct {
+	r    *EPUBReport
+	book *epubBook
+	ids  map[string]map[string]bool // anchors per content document
+}
+
+var (
+	opfUniqueIDAttrRe = regexp.MustCompile(`<(?:\w+:)?package\b[^>]*\bunique-identifier\s*=\s*["']([^"']*)["']`)
+	dcIdentifierIDRe  = regexp.MustCompile(`<(?:\w+:)?identifier\b[^>]*\bid\s*=\s*["']([^"']*)["']`)
+	anchorIDRe        = regexp.MustCompile(`\s(?:id|name)\s*=\s*["']([^"']*)["']`)
+	ncxSrcRe          = regexp.MustCompile(`<(?:\w+:)?content\b[^>]*\bsrc\s*=\s*["']([^"']+)["']`)
+	uriSchemeRe       = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+)
+
+func (c *epubChecker) epub3() bool { return strings.HasPrefix(c.book.pkg.Version, "3") }
+
+func (c *epubChecker) checkPackage() {
+	opfPath, opf := c.book.opfPath, c.book.opf()
+	if c.book.pkg.Version == "" {
+		c.r.add(SeverityWarning, "PACKAGE_VERSION", opfPath, "the package has no version attribute")
+	}
+	if m := opfUniqueIDAttrRe.FindSubmatch(opf); m == nil {
+		c.r.add(SeverityError, "PACKAGE_UNIQUE_ID", opfPath, "the package has no unique-identifier attribute")
+	} else {
+		found := false
+		for _, id := range dcIdentifierIDRe.FindAllSubmatch(opf, -1) {
+			found = found || bytes.Equal(id[1], m[1])
+		}
+		if !found {
+			c.r.add(SeverityError, "PACKAGE_UNIQUE_ID", opfPath, "unique-identifier %q names no dc:identifier", m[1])
+		}
+	}
+	if c.book.title() == "" {
+		c.r.add(SeverityError, "METADATA_TITLE", opfPath, "the book has no dc:title")
+	}
+	if len(c.book.pkg.Metadata.Languages) == 0 {
+		c.r.add(SeverityError, "METADATA_LANGUAGE", opfPath, "the book has no dc:language")
+	}
+}
+
+func (c *epubChecker) checkManifest() {
+	opfPath := c.book.opfPath
+	seenIDs, seenPaths := map[string]bool{}, map[string]bool{}
+	for _, it := range c.book.pkg.Manifest {
+		if it.ID == "" || it.Href == "" || it.MediaType == "" {
+			c.r.add(SeverityError, "MANIFEST_ITEM_INVALID", opfPath, "manifest item %q (%s) lacks an id, href or media-type", it.ID, it.Href)
+			continue
+		}
+		if seenIDs[it.ID] {
+			c.r.add(SeverityError, "MANIFEST_DUPLICATE_ID", opfPath, "manifest id %q is used twice", it.ID)
+		}
+		seenIDs[it.ID] = true
+		if uriSchemeRe.MatchString(it.Href) {
+			continue // a remote resource
+		}
+		p := c.book.itemPath(it)
+		if seenPaths[p] {
+			c.r.add(SeverityWarning, "MANIFEST_DUPLICATE_HREF", p, "the file is in the manifest twice")
+		}
+		seenPaths[p] = true
+		if c.book.file(p) == nil {
+			c.r.add(SeverityError, "MANIFEST_MISSING_FILE", p, "manifest item %q points at a file that isn't in the book", it.ID)
+		}
+	}
+	for _, e := range c.book.entries {
+		if e.Name == "mimetype" || e.Name == opfPath || strings.HasPrefix(e.Name, "META-INF/") || seenPaths[e.Name] {
+			continue
+		}
+		c.r.add(SeverityWarning, "FILE_NOT_IN_MANIFEST", e.Name, "the file is not in the manifest")
+	}
+}
+
+// isContentDocument reports whether a media type may be in the spine.
+func isContentDocument(mediaType string) bool {
+	switch mediaType {
+	case "application/xhtml+xml", "image/svg+xml", "application/x-dtbook+xml", "text/x-oeb1-document":
+		return true
+	}
+	return false
+}
+
+func (c *epubChecker) checkSpine() {
+	opfPath := c.book.opfPath
+	spine := c.book.pkg.Spine
+	if len(spine.ItemRefs) == 0 {
+		c.r.add(SeverityError, "SPINE_EMPTY", opfPath, "the spine lists no content, so the book has no pages")
+	}
+	seen := map[string]bool{}
+	for _, ref := range spine.ItemRefs {
+		it, ok := c.book.itemByID(ref.IDRef)
+		switch {
+		case !ok:
+			c.r.add(SeverityError, "SPINE_UNKNOWN_ITEM", opfPath, "spine itemref %q names no manifest item", ref.IDRef)
+		case seen[ref.IDRef]:
+			c.r.add(SeverityError, "SPINE_DUPLICATE", opfPath, "spine lists %q twice", ref.IDRef)
+		case !isContentDocument(it.MediaType):
+			c.r.add(SeverityError, "SPINE_NOT_CONTENT", c.book.itemPath(it), "spine item %q is %s, not a content document", ref.IDRef, it.MediaType)
+		}
+		seen[ref.IDRef] = true
+	}
+	switch {
+	case spine.Toc != "":
+		if it, ok := c.book.itemByID(spine.Toc); !ok || it.MediaType != "application/x-dtbncx+xml" {
+			c.r.add(SeverityError, "NCX_MISSING", opfPath, "the spine's toc %q is not an NCX in the manifest", spine.Toc)
+		}
+	case !c.epub3():
+		c.r.add(SeverityError, "NCX_MISSING", opfPath, "an EPUB 2 spine must name its NCX table of contents")
+	}
+}
+
+func (c *epubChecker) checkContent() {
+	for _, it := range c.book.pkg.Manifest {
+		if it.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		p := c.book.itemPath(it)
+		e := c.book.file(p)
+		if e == nil {
+			continue // MANIFEST_MISSING_FILE
+		}
+		if err := wellFormedXML(e.Data); err != nil {
+			c.r.add(SeverityError, "CONTENT_MALFORMED", p, "not well-formed XHTML: %v", err)
+			continue
+		}
+		code := "CONTENT_BROKEN_LINK"
+		if hasProperty(it.Properties, "nav") {
+			code = "NAV_BROKEN_LINK"
+		}
+		for _, m := range refAttrRe.FindAllSubmatch(e.Data, -1) {
+			c.checkLink(p, strings.ReplaceAll(string(m[1]), "&amp;", "&"), code)
+		}
+	}
+}
+
+// checkLink checks that href, found in the document at from, points at a
+// file in the book and, with a fragment, at an anchor in it.
+func (c *epubChecker) checkLink(from, href, code string) {
+	if href == "" || uriSchemeRe.MatchString(href) {
+		return
+	}
+	target := from
+	if !strings.HasPrefix(href, "#") {
+		target = resolveHref(from, href)
+	}
+	e := c.book.file(target)
+	if e == nil {
+		c.r.add(SeverityError, code, from, "%q points at %s, which isn't in the book", href, target)
+		return
+	}
+	frag := ""
+	if i := strings.IndexByte(href, '#'); i >= 0 {
+		frag = href[i+1:]
+	}
+	if frag == "" || path.Ext(target) == ".css" {
+		return
+	}
+	ids, ok := c.ids[target]
+	if !ok {
+		ids = map[string]bool{}
+		for _, m := range anchorIDRe.FindAllSubmatch(e.Data, -1) {
+			ids[string(m[1])] = true
+		}
+		c.ids[target] = ids
+	}
+	if !ids[frag] {
+		c.r.add(SeverityWarning, "LINK_MISSING_ANCHOR", from, "%q points at an anchor that %s doesn't have", href, target)
+	}
+}
+
+func (c *epubChecker) checkNCX() {
+	for _, it := range c.book.pkg.Manifest {
+		if it.MediaType != "application/x-dtbncx+xml" {
+			continue
+		}
+		p := c.book.itemPath(it)
+		e := c.book.file(p)
+		if e == nil {
+			continue
+		}
+		if err := wellFormedXML(e.Data); err != nil {
+			c.r.add(SeverityError, "NCX_MALFORMED", p, "the NCX is malformed XML: %v", err)
+			continue
+		}
+		for _, m := range ncxSrcRe.FindAllSubmatch(e.Data, -1) {
+			c.checkLink(p, strings.ReplaceAll(string(m[1]), "&amp;", "&"), "NCX_BROKEN_LINK")
+		}
+	}
+}
+
+func (c *epubChecker) checkNav() {
+	if !c.epub3() {
+		return
+	}
+	for _, it := range c.book.pkg.Manifest {
+		if hasProperty(it.Properties, "nav") {
+			return // its links were checked with the other content
+		}
+	}
+	c.r.add(SeverityError, "NAV_MISSING", c.book.opfPath, "an EPUB 3 book must have a navigation document (a manifest item with properties=\"nav\")")
+}
+
+// CheckEdition downloads the edition with the given hash and checks it
+// without sending it anywhere. The relay has no tool that returns the file,
+// so in relay mode it fails with ErrRelayUnsupported.
+func CheckEdition(hash, secretKey string) (*EPUBReport, error) {
+	if _, _, ok := relay.Config(); ok {
+		return nil, fmt.Errorf("checking an edition: %w", ErrRelayUnsupported)
+	}
+	spool, err := downloadFile(hash, secretKey, DownloadOptions{Progress: downloadLogger(hash)})
+	if err != nil {
+		return nil, err
+	}
+	defer spool.Close()
+	if format := spool.Format(); format != "epub" {
+		return nil, fmt.Errorf("this edition is not an EPUB (detected: %s)", format)
+	}
+	data, err := spool.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return CheckEPUB(data), nil
+}
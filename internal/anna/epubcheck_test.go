@@ -0,0 +1,157 @@
+package anna
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// checkedEPUB is a well-formed EPUB 2 book with a chapter, a notes page and
+// an NCX, with entries in extra replacing or adding to its files.
+func checkedEPUB(t testing.TB, extra map[string]string) []byte {
+	t.Helper()
+	opf := opfFixture{
+		Metadata: fixtureMetadata + `    <dc:language>en</dc:language>
+`,
+		Manifest: `    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="c1" href="Text/01.xhtml" media-type="application/xhtml+xml"/>
+    <item id="notes" href="Text/notes.xhtml" media-type="application/xhtml+xml"/>
+`,
+		Spine: `    <itemref idref="c1"/>
+    <itemref idref="notes"/>
+`,
+		TOC: "ncx",
+	}
+	entries := map[string]string{
+		"OEBPS/toc.ncx": `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1"><navMap>
+  <navPoint id="n1"><navLabel><text>One</text></navLabel><content src="Text/01.xhtml"/></navPoint>
+  <navPoint id="n2"><navLabel><text>Notes</text></navLabel><content src="Text/notes.xhtml#n1"/></navPoint>
+</navMap></ncx>`,
+		"OEBPS/Text/01.xhtml":    `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Sand<a href="notes.xhtml#n1">1</a></p><a href="https://example.com/">web</a></body></html>`,
+		"OEBPS/Text/notes.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p id="n1">A note.</p></body></html>`,
+	}
+	for name, body := range extra {
+		entries[name] = body
+	}
+	return fixtureEPUB(t, opf, entries)
+}
+
+// codes lists the findings' codes.
+func codes(r *EPUBReport) string {
+	var cs []string
+	for _, f := range r.Findings {
+		cs = append(cs, f.Code)
+	}
+	return strings.Join(cs, " ")
+}
+
+func TestCheckEPUB_Clean(t *testing.T) {
+	r := CheckEPUB(checkedEPUB(t, nil))
+	if len(r.Findings) != 0 || !r.Clean() || r.Err() != nil {
+		t.Fatalf("a sound book should have no findings:\n%s", r)
+	}
+	if r.Version != "2.0" || r.Summary() != "no problems" {
+		t.Errorf("version %q, summary %q", r.Version, r.Summary())
+	}
+}
+
+func TestCheckEPUB_BrokenReferences(t *testing.T) {
+	opf := strings.NewReplacer(
+		`<item id="notes"`, `<item id="gone" href="Text/gone.xhtml" media-type="application/xhtml+xml"/>
+    <item id="notes"`,
+		`<itemref idref="notes"/>`, `<itemref idref="notes"/>
+    <itemref idref="nope"/>
+    <itemref idref="c1"/>`,
+	).Replace(string(readEntry(t, checkedEPUB(t, nil), "OEBPS/content.opf")))
+	r := CheckEPUB(checkedEPUB(t, map[string]string{
+		"OEBPS/content.opf":      opf,
+		"OEBPS/toc.ncx":          `<ncx><navMap><navPoint><content src="Text/02.xhtml"/></navPoint></navMap></ncx>`,
+		"OEBPS/Text/01.xhtml":    `<html><body><p>Sand<a href="notes.xhtml#n2">1</a><img src="../Images/x.png"/></p></body></html>`,
+		"OEBPS/Text/notes.xhtml": `<html><body><p>unclosed</body></html>`,
+		"OEBPS/stray.css":        "p {}",
+	}))
+	if r.Err() != nil {
+		t.Fatalf("nothing here is fatal: %v", r.Err())
+	}
+	want := map[string]Severity{
+		"MANIFEST_MISSING_FILE": SeverityError,
+		"FILE_NOT_IN_MANIFEST":  SeverityWarning,
+		"SPINE_UNKNOWN_ITEM":    SeverityError,
+		"SPINE_DUPLICATE":       SeverityError,
+		"CONTENT_MALFORMED":     SeverityError,
+		"CONTENT_BROKEN_LINK":   SeverityError,
+		"NCX_BROKEN_LINK":       SeverityError,
+	}
+	for _, f := range r.Findings {
+		if sev, ok := want[f.Code]; ok {
+			if f.Severity != sev {
+				t.Errorf("%s has severity %s, want %s", f.Code, f.Severity, sev)
+			}
+			delete(want, f.Code)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("missing findings %v in:\n%s", want, r)
+	}
+	if r.Clean() || !strings.Contains(r.Summary(), "errors") {
+		t.Errorf("summary = %q", r.Summary())
+	}
+}
+
+func TestCheckEPUB_MissingAnchorAndNav(t *testing.T) {
+	opf := strings.NewReplacer(`version="2.0"`, `version="3.0"`, `<spine toc="ncx">`, `<spine>`).
+		Replace(string(readEntry(t, checkedEPUB(t, nil), "OEBPS/content.opf")))
+	r := CheckEPUB(checkedEPUB(t, map[string]string{
+		"OEBPS/content.opf":   opf,
+		"OEBPS/Text/01.xhtml": `<html><body><a href="notes.xhtml#n9">1</a><a href="#top">top</a></body></html>`,
+	}))
+	if got := codes(r); got != "LINK_MISSING_ANCHOR LINK_MISSING_ANCHOR NAV_MISSING" {
+		t.Errorf("codes = %q:\n%s", got, r)
+	}
+}
+
+func TestCheckEPUB_FatalKeepsValidateMessages(t *testing.T) {
+	entries := validEPUBEntries()
+	entries["META-INF/encryption.xml"] = "<encryption/>"
+	r := CheckEPUB(makeZip(t, entries))
+	if err := r.Err(); err == nil || !strings.Contains(err.Error(), "DRM") {
+		t.Errorf("Err = %v", err)
+	}
+	if err := ValidateEPUB(makeZip(t, entries)); err == nil || err.Error() != r.Err().Error() {
+		t.Errorf("ValidateEPUB and CheckEPUB disagree: %v", err)
+	}
+	if r := CheckEPUB([]byte("not a zip")); r.Count(SeverityFatal) != 1 || r.Findings[0].Code != "ZIP_INVALID" {
+		t.Errorf("not a zip:\n%s", r)
+	}
+}
+
+func TestCheckEPUB_ErrKeepsTheCause(t *testing.T) {
+	withZipLimits(t, 100, 1<<20, 5000)
+	big := fixtureEPUB(t, opfFixture{}, map[string]string{"a.xhtml": strings.Repeat("x", 3000), "b.xhtml": strings.Repeat("y", 3000)})
+	err := ValidateEPUB(big)
+	var zerr *ZipError
+	if !errors.Is(err, ErrZipTooLarge) || !errors.As(err, &zerr) {
+		t.Fatalf("err = %v, want it to unwrap to the ZipError", err)
+	}
+	if err.Error() != CheckEPUB(big).Findings[0].Message {
+		t.Errorf("the message should be the finding's: %v", err)
+	}
+}
+
+func TestCheckEPUB_CapsFindingsPerCode(t *testing.T) {
+	var links strings.Builder
+	for i := range maxFindingsPerCode + 5 {
+		fmt.Fprintf(&links, `<a href="missing-%d.xhtml">x</a>`, i)
+	}
+	r := CheckEPUB(checkedEPUB(t, map[string]string{
+		"OEBPS/Text/01.xhtml": `<html><body>` + links.String() + `</body></html>`,
+	}))
+	if n := r.Count(SeverityError); n != maxFindingsPerCode+1 {
+		t.Fatalf("%d errors listed, want %d:\n%s", n, maxFindingsPerCode+1, r)
+	}
+	if last := r.Findings[len(r.Findings)-1]; last.Message != "5 more like this not listed" {
+		t.Errorf("last finding = %s", last)
+	}
+}
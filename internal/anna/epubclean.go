@@ -3,7 +3,8 @@ package anna
 import (
 	"archive/zip"
 	"bytes"
-	"io"
+	"compress/flate"
+	"fmt"
 	"regexp"
 	"strings"
 )
@@ -33,9 +34,10 @@ func isXHTMLName(name string) bool {
 //   - If nothing needs cleaning, the original bytes are returned unchanged so
 //     the operation is idempotent and byte-stable for already-clean files.
 func SanitizeEPUB(data []byte) ([]byte, int, error) {
-	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	z, err := openZip(data)
 	if err != nil {
-		// Not a zip (or corrupt) — leave the attachment untouched.
+		// Not a zip (or corrupt, or over the limits) — leave the attachment
+		// untouched; validation will reject it if it's meant to be an EPUB.
 		return data, 0, nil
 	}
 
@@ -43,19 +45,14 @@ func SanitizeEPUB(data []byte) ([]byte, int, error) {
 		name string
 		body []byte
 	}
-	entries := make([]entry, 0, len(zr.File))
+	entries := make([]entry, 0, len(z.files()))
 	stripped := 0
 
-	for _, f := range zr.File {
+	for _, f := range z.files() {
 		if strings.HasSuffix(f.Name, "/") {
 			continue // skip directory entries; they are reconstructed implicitly
 		}
-		rc, err := f.Open()
-		if err != nil {
-			return data, 0, nil
-		}
-		body, err := io.ReadAll(rc)
-		rc.Close()
+		body, err := z.readFile(f)
 		if err != nil {
 			return data, 0, nil
 		}
@@ -113,3 +110,126 @@ func SanitizeEPUB(data []byte) ([]byte, int, error) {
 
 	return buf.Bytes(), stripped, nil
 }
+
+// Books come from unknown sources, so before sending we also take out
+// anything active or that phones home: scripts, inline event handlers,
+// embedded frames and objects, and resources loaded from the web. A Kindle
+// doesn't run or fetch any of it, but a reader app that opens the file might,
+// and Amazon's converter is happier without it.
+
+// HardenReport counts what HardenEPUB removed.
+type HardenReport struct {
+	Scripts       int `json:"scripts,omitempty"`        // <script> elements, javascript: links and script files
+	EventHandlers int `json:"event_handlers,omitempty"` // onclick=, onload=, ...
+	Embeds        int `json:"embeds,omitempty"`         // <iframe>, <object> and <embed> elements
+	RemoteRefs    int `json:"remote_refs,omitempty"`    // http(s) resources in XHTML, CSS and the manifest
+}
+
+// Total is the number of things removed.
+func (r HardenReport) Total() int {
+	return r.Scripts + r.EventHandlers + r.Embeds + r.RemoteRefs
+}
+
+var (
+	scriptElemRe   = regexp.MustCompile(`(?is)<(?:\w+:)?script\b[^>]*?(?:/>|>.*?</(?:\w+:)?script\s*>)`)
+	embedElemRe    = regexp.MustCompile(`(?is)<(?:iframe\b[^>]*?(?:/>|>.*?</iframe\s*>)|object\b[^>]*?(?:/>|>.*?</object\s*>)|embed\b[^>]*?(?:/>|>(?:\s*</embed\s*>)?))`)
+	startTagRe     = regexp.MustCompile(`<([A-Za-z][\w:.-]*)\b[^>]*>`)
+	eventAttrRe    = regexp.MustCompile(`(?i)\s+on[a-z]+\s*=\s*(?:"[^"]*"|'[^']*')`)
+	jsURLAttrRe    = regexp.MustCompile(`(?i)\s+(?:href|src|xlink:href|action)\s*=\s*(?:"\s*javascript:[^"]*"|'\s*javascript:[^']*')`)
+	remoteAttrRe   = regexp.MustCompile(`(?i)\s+(?:src|href|xlink:href|poster|data|srcset)\s*=\s*(?:"\s*(?:https?:)?//[^"]*"|'\s*(?:https?:)?//[^']*')`)
+	remoteHrefRe   = regexp.MustCompile(`(?i)^\s*(?:https?:)?//`)
+	remoteImportRe = regexp.MustCompile(`(?i)@import\s+(?:url\(\s*)?["']?\s*(?:https?:)?//[^;]*;?`)
+	remoteURLRe    = regexp.MustCompile(`(?i)url\(\s*["']?\s*(?:https?:)?//[^)]*\)`)
+)
+
+// scriptMediaTypes are the manifest media types of script files.
+var scriptMediaTypes = map[string]bool{
+	"application/javascript": true, "text/javascript": true,
+	"application/ecmascript": true, "application/x-javascript": true,
+}
+
+// HardenEPUB removes active content and remote references from an EPUB:
+// <script>, <iframe>, <object> and <embed> elements, inline event handlers
+// and javascript: links in its XHTML; http(s) resources in its XHTML and CSS
+// (hyperlinks to the web stay); and script files and remote items from its
+// manifest. The manifest's scripted and remote-resources properties are
+// dropped to match.
+//
+// Like SanitizeEPUB it is safe on any attachment: a file that isn't an EPUB,
+// or that has nothing to remove, comes back unchanged.
+func HardenEPUB(data []byte) ([]byte, HardenReport, error) {
+	var r HardenReport
+	book, err := parseEPUB(data)
+	if err != nil {
+		return data, r, nil
+	}
+
+	opf := book.opf()
+	for _, it := range book.pkg.Manifest {
+		p := book.itemPath(it)
+		switch {
+		case remoteHrefRe.MatchString(it.Href):
+			r.RemoteRefs++
+		case scriptMediaTypes[strings.ToLower(it.MediaType)]:
+			r.Scripts++
+			book.removeEntry(p)
+		default:
+			if e := book.file(p); e != nil {
+				switch {
+				case it.MediaType == "application/xhtml+xml" || it.MediaType == "image/svg+xml":
+					e.Data = hardenXHTML(e.Data, &r)
+				case it.MediaType == "text/css":
+					e.Data = hardenCSS(e.Data, &r)
+				}
+			}
+			for _, prop := range []string{"scripted", "remote-resources"} {
+				if hasProperty(it.Properties, prop) {
+					opf = []byte(removeItemProperty(string(opf), it.ID, prop))
+				}
+			}
+			continue
+		}
+		opf = removeManifestItem(opf, it.ID)
+		opf = removeSpineItemRef(opf, it.ID)
+	}
+	if r.Total() == 0 {
+		return data, r, nil
+	}
+	if err := book.setOPF(opf); err != nil {
+		return data, HardenReport{}, fmt.Errorf("hardened OPF: %w", err)
+	}
+	out, err := book.bytes(flate.DefaultCompression)
+	if err != nil {
+		return data, HardenReport{}, err
+	}
+	return out, r, nil
+}
+
+// hardenXHTML strips active content and remote resources from a document.
+func hardenXHTML(doc []byte, r *HardenReport) []byte {
+	doc = scriptElemRe.ReplaceAllFunc(doc, func([]byte) []byte { r.Scripts++; return nil })
+	doc = embedElemRe.ReplaceAllFunc(doc, func([]byte) []byte { r.Embeds++; return nil })
+	doc = startTagRe.ReplaceAllFunc(doc, func(tag []byte) []byte {
+		tag = eventAttrRe.ReplaceAllFunc(tag, func([]byte) []byte { r.EventHandlers++; return nil })
+		tag = jsURLAttrRe.ReplaceAllFunc(tag, func([]byte) []byte { r.Scripts++; return nil })
+		name := strings.ToLower(string(startTagRe.FindSubmatch(tag)[1]))
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name = name[i+1:]
+		}
+		if name == "a" || name == "area" || !remoteAttrRe.Match(tag) {
+			return tag // links to the web are fine; only loading from it isn't
+		}
+		r.RemoteRefs++
+		if bytes.HasSuffix(tag, []byte("/>")) {
+			return nil // an <img/> or <link/> with nothing left to show
+		}
+		return remoteAttrRe.ReplaceAll(tag, nil)
+	})
+	return hardenCSS(doc, r) // style elements and attributes
+}
+
+// hardenCSS drops @imports of and url()s pointing at remote resources.
+func hardenCSS(css []byte, r *HardenReport) []byte {
+	css = remoteImportRe.ReplaceAllFunc(css, func([]byte) []byte { r.RemoteRefs++; return nil })
+	return remoteURLRe.ReplaceAllFunc(css, func([]byte) []byte { r.RemoteRefs++; return []byte("none") })
+}
@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"bytes"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -129,3 +130,81 @@ func TestSanitizeEPUB_NonZipReturnedAsIs(t *testing.T) {
 		t.Fatalf("non-zip input must be returned untouched (n=%d, equal=%v)", n, bytes.Equal(in, out))
 	}
 }
+
+func TestHardenEPUB(t *testing.T) {
+	opf := strings.NewReplacer(
+		`version="2.0"`, `version="3.0"`,
+		`<item id="c1" href="Text/01.xhtml" media-type="application/xhtml+xml"/>`,
+		`<item id="c1" href="Text/01.xhtml" media-type="application/xhtml+xml" properties="scripted remote-resources svg"/>
+    <item id="js" href="app.js" media-type="text/javascript"/>
+    <item id="css" href="style.css" media-type="text/css"/>
+    <item id="web" href="https://example.com/font.woff" media-type="font/woff"/>`,
+	).Replace(string(readEntry(t, checkedEPUB(t, nil), "OEBPS/content.opf")))
+	in := checkedEPUB(t, map[string]string{
+		"OEBPS/content.opf": opf,
+		"OEBPS/app.js":      "alert(1)",
+		"OEBPS/style.css":   `@import url("https://example.com/a.css"); p { background: url('//cdn.example.com/bg.png') no-repeat; } h1 { background: url(../Images/ok.png); }`,
+		"OEBPS/Text/01.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head>
+<script type="text/javascript">if (a < b) { steal(); }</script>
+<script src="../app.js"/>
+<link rel="stylesheet" href="https://example.com/x.css"/>
+</head><body onload="go()">
+<p onclick='x()' class="a">Sand <a href="https://example.com/" onmouseover="y()">web</a> <a href="javascript:void(0)">js</a></p>
+<img src="http://tracker.example.com/pixel.gif" alt=""/>
+<img src="../Images/local.png" alt=""/>
+<iframe src="https://example.com/"></iframe>
+<object data="movie.swf"><embed src="movie.swf"/></object>
+<embed src="x.swf"/>
+<p style="background: url(https://example.com/bg.png)">styled</p>
+</body></html>`,
+	})
+
+	out, r, err := HardenEPUB(in)
+	if err != nil {
+		t.Fatalf("HardenEPUB: %v", err)
+	}
+	want := HardenReport{Scripts: 4, EventHandlers: 3, Embeds: 3, RemoteRefs: 6}
+	if r != want {
+		t.Errorf("report = %+v, want %+v", r, want)
+	}
+	doc := string(readEntry(t, out, "OEBPS/Text/01.xhtml"))
+	for _, gone := range []string{"<script", "onload", "onclick", "onmouseover", "javascript:", "tracker", "<iframe", "<object", "<embed", "x.css", "example.com/bg.png"} {
+		if strings.Contains(doc, gone) {
+			t.Errorf("document still has %q:\n%s", gone, doc)
+		}
+	}
+	for _, kept := range []string{`<a href="https://example.com/">web</a>`, `<img src="../Images/local.png" alt=""/>`, `<p class="a">`, `<body>`} {
+		if !strings.Contains(doc, kept) {
+			t.Errorf("document lost %s:\n%s", kept, doc)
+		}
+	}
+	if err := wellFormedXML([]byte(doc)); err != nil {
+		t.Errorf("hardened document is not well-formed: %v", err)
+	}
+	if css := string(readEntry(t, out, "OEBPS/style.css")); strings.Contains(css, "example.com") || !strings.Contains(css, "url(../Images/ok.png)") {
+		t.Errorf("stylesheet = %s", css)
+	}
+
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.file("OEBPS/app.js") != nil {
+		t.Error("the script file should be gone")
+	}
+	o := string(book.opf())
+	if strings.Contains(o, "app.js") || strings.Contains(o, "font.woff") || !strings.Contains(o, `properties="svg"`) {
+		t.Errorf("manifest not updated:\n%s", o)
+	}
+}
+
+func TestHardenEPUB_NothingToRemove(t *testing.T) {
+	in := checkedEPUB(t, nil)
+	out, r, err := HardenEPUB(in)
+	if err != nil || r.Total() != 0 || !bytes.Equal(in, out) {
+		t.Errorf("a clean book should come back unchanged: %+v %v", r, err)
+	}
+	if out, _, err := HardenEPUB([]byte("not a zip")); err != nil || string(out) != "not a zip" {
+		t.Error("a non-EPUB should come back as-is")
+	}
+}
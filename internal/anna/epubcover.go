@@ -0,0 +1,334 @@
+package anna
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // cover images may be GIFs
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Many archive EPUBs have no cover, so they sit in the Kindle library as a
+// grey tile. Before sending we give such a book one: an image in the book
+// that is plainly its cover but was never declared as one, a file from the
+// local cover directory (ANNAS_COVER_DIR), or the cover of its Goodreads
+// shelf entry.
+
+// coverHTTPClient fetches remote covers; a package var so tests can point it
+// at a local server.
+var coverHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// maxCoverBytes caps a cover image. Real covers are a few hundred KB.
+const maxCoverBytes = 5 << 20
+
+// ErrNoCover means no cover could be found for a book.
+var ErrNoCover = errors.New("no cover found")
+
+// coverDir is the local cover directory, or "".
+func coverDir() string {
+	return strings.TrimSpace(os.Getenv("ANNAS_COVER_DIR"))
+}
+
+// findCover looks for b's cover: in the local cover directory, named by the
+// book's hash, ISBN or title (e.g. "Dune.jpg"), then at its Goodreads cover
+// URL. It returns the image and where it came from.
+func findCover(b *Book) ([]byte, string, error) {
+	if dir := coverDir(); dir != "" {
+		names := []string{b.Hash}
+		if b.Goodreads != nil {
+			names = append(names, normalizeISBN(b.Goodreads.ISBN))
+		}
+		names = append(names, sanitizeFilename(b.Title))
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			for _, ext := range []string{".jpg", ".jpeg", ".png", ".gif"} {
+				img, err := os.ReadFile(filepath.Join(dir, name+ext))
+				if err == nil && checkCoverImage(img) == nil {
+					return img, "local", nil
+				}
+			}
+		}
+	}
+	if b.Goodreads != nil && b.Goodreads.CoverURL != "" && ShelfBookMatches(b, *b.Goodreads) {
+		img, err := fetchCover(b.Goodreads.CoverURL)
+		if err != nil {
+			return nil, "", err
+		}
+		return img, "goodreads", nil
+	}
+	return nil, "", ErrNoCover
+}
+
+// goodreadsSizeRe matches the size suffix of a Goodreads image URL
+// ("..._SY75_.jpg"); without it the full-size image is served.
+var goodreadsSizeRe = regexp.MustCompile(`\._S[XY]\d+_(\.\w+)$`)
+
+// fetchCover downloads a cover image.
+func fetchCover(url string) ([]byte, error) {
+	if strings.Contains(url, "nophoto") {
+		return nil, ErrNoCover // Goodreads' placeholder
+	}
+	url = goodreadsSizeRe.ReplaceAllString(url, "$1")
+	resp, err := coverHTTPClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch cover: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch cover: HTTP %d", resp.StatusCode)
+	}
+	img, err := io.ReadAll(io.LimitReader(resp.Body, maxCoverBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetch cover: %w", err)
+	}
+	if len(img) > maxCoverBytes {
+		return nil, fmt.Errorf("cover is larger than %d MB", maxCoverBytes>>20)
+	}
+	if err := checkCoverImage(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// checkCoverImage makes sure img is a JPEG, PNG or GIF that decodes, not an
+// error page.
+func checkCoverImage(img []byte) error {
+	if _, mt := sniffImage(img); mt == "" {
+		return errors.New("cover is not a JPEG, PNG or GIF image")
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(img)); err != nil {
+		return fmt.Errorf("cover image is corrupt: %w", err)
+	}
+	return nil
+}
+
+// EPUBHasCover reports whether the EPUB declares a cover image.
+func EPUBHasCover(data []byte) (bool, error) {
+	book, err := parseEPUB(data)
+	if err != nil {
+		return false, err
+	}
+	p := coverImagePath(book)
+	return p != "" && book.file(p) != nil, nil
+}
+
+// InjectEPUBCover makes img the EPUB's cover: it is added to the manifest as
+// the cover-image (EPUB 3) and named by <meta name="cover"> (EPUB 2, and
+// Kindle reads it in EPUB 3 too). With page, a cover page showing it is put
+// first in the spine. The result is re-packed with mimetype stored first.
+func InjectEPUBCover(data, img []byte, page bool) ([]byte, error) {
+	if err := checkCoverImage(img); err != nil {
+		return nil, err
+	}
+	book, err := parseEPUB(data)
+	if err != nil {
+		return nil, err
+	}
+	ext, mediaType := sniffImage(img)
+	dir := path.Dir(book.opfPath)
+	imgPath := book.newEntryPath(dir, "cover", ext)
+	book.entries = append(book.entries, &epubEntry{Name: imgPath, Data: img})
+
+	opf := string(book.opf())
+	imgID := newManifestID(opf, "cover-image")
+	props := ""
+	if strings.HasPrefix(book.pkg.Version, "3") {
+		props = ` properties="cover-image"`
+	}
+	items := []string{fmt.Sprintf(`<item id="%s" href="%s" media-type="%s"%s/>`,
+		imgID, relativeHref(book.opfPath, imgPath), mediaType, props)}
+
+	if page {
+		pagePath := book.newEntryPath(dir, "cover", ".xhtml")
+		book.entries = append(book.entries, &epubEntry{Name: pagePath, Data: coverPage(relativeHref(pagePath, imgPath))})
+		pageID := newManifestID(opf, "cover-page")
+		pageHref := relativeHref(book.opfPath, pagePath)
+		items = append(items, fmt.Sprintf(`<item id="%s" href="%s" media-type="application/xhtml+xml"/>`, pageID, pageHref))
+		opf = prependToElement(opf, "spine", []string{fmt.Sprintf(`<itemref idref="%s"/>`, pageID)})
+		if !strings.HasPrefix(book.pkg.Version, "3") {
+			opf = addGuideReference(opf, fmt.Sprintf(`<reference type="cover" title="Cover" href="%s"/>`, pageHref))
+		}
+	}
+	opf = appendToElement(opf, "manifest", items)
+	opf = setMetaCover(opf, imgID)
+
+	if err := book.setOPF([]byte(opf)); err != nil {
+		return nil, fmt.Errorf("OPF with cover: %w", err)
+	}
+	return book.bytes(flate.DefaultCompression)
+}
+
+// coverPage is an XHTML page showing the cover image at href, scaled to fit
+// the screen.
+func coverPage(href string) []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+  <title>Cover</title>
+  <style type="text/css">body { margin: 0; padding: 0; text-align: center; } img { max-width: 100%; max-height: 100%; }</style>
+</head>
+<body>
+  <div><img src="` + xmlEscape(href) + `" alt="Cover"/></div>
+</body>
+</html>
+`)
+}
+
+// newEntryPath returns dir/base+ext, numbered if the book already has it.
+func (b *epubBook) newEntryPath(dir, base, ext string) string {
+	p := path.Join(dir, base+ext)
+	for i := 2; b.file(p) != nil; i++ {
+		p = path.Join(dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+	}
+	return p
+}
+
+// newManifestID returns an id based on base that the OPF doesn't use yet.
+func newManifestID(opf, base string) string {
+	id := base
+	for i := 2; strings.Contains(opf, `"`+id+`"`) || strings.Contains(opf, `'`+id+`'`); i++ {
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+	return id
+}
+
+// setMetaCover points <meta name="cover"> at the manifest item id, replacing
+// one that names a missing item.
+func setMetaCover(opf, id string) string {
+	e := &opfMetadataEditor{opf: opf}
+	e.remove("meta", func(attrs, _ string) bool { return !metaCoverRe.MatchString("<meta " + attrs) })
+	return appendToElement(e.opf, "metadata", []string{fmt.Sprintf(`<meta name="cover" content="%s"/>`, id)})
+}
+
+var guideCoverRe = regexp.MustCompile(`<(?:\w+:)?reference\b[^>]*\btype\s*=\s*["']cover["']`)
+
+// addGuideReference adds ref to the OPF's <guide>, creating it, unless the
+// guide already names a cover.
+func addGuideReference(opf, ref string) string {
+	if guideCoverRe.MatchString(opf) {
+		return opf
+	}
+	if regexp.MustCompile(`<(?:\w+:)?guide\b`).MatchString(opf) {
+		return appendToElement(opf, "guide", []string{ref})
+	}
+	end := regexp.MustCompile(`</(?:\w+:)?package\s*>`).FindStringIndex(opf)
+	if end == nil {
+		return opf
+	}
+	return opf[:end[0]] + "  <guide>\n    " + ref + "\n  </guide>\n" + opf[end[0]:]
+}
+
+// coverCandidateRe matches the ids and file names of images that are plainly
+// a book's cover.
+var coverCandidateRe = regexp.MustCompile(`(?i)(^|[^a-z])cover([^a-z]|$)`)
+
+// promoteCoverImage declares an image the book already has as its cover,
+// when its id or file name says it is one. It reports whether it did.
+func promoteCoverImage(data []byte) ([]byte, bool, error) {
+	book, err := parseEPUB(data)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, it := range book.pkg.Manifest {
+		if !strings.HasPrefix(it.MediaType, "image/") || it.ID == "" {
+			continue
+		}
+		if !coverCandidateRe.MatchString(it.ID) && !coverCandidateRe.MatchString(path.Base(it.Href)) {
+			continue
+		}
+		if e := book.file(book.itemPath(it)); e == nil || checkCoverImage(e.Data) != nil {
+			continue
+		}
+		opf := string(book.opf())
+		if strings.HasPrefix(book.pkg.Version, "3") {
+			opf = addItemProperty(opf, it.ID, "cover-image")
+		}
+		opf = setMetaCover(opf, it.ID)
+		if err := book.setOPF([]byte(opf)); err != nil {
+			return nil, false, fmt.Errorf("OPF with cover: %w", err)
+		}
+		out, err := book.bytes(flate.DefaultCompression)
+		return out, err == nil, err
+	}
+	return data, false, nil
+}
+
+// addItemProperty adds prop to the properties of the manifest item id.
+func addItemProperty(opf, id, prop string) string {
+	re := regexp.MustCompile(`<(?:opf:)?item\b[^>]*\bid\s*=\s*["']` + regexp.QuoteMeta(id) + `["'][^>]*?/?>`)
+	propsRe := regexp.MustCompile(`\bproperties\s*=\s*(["'])([^"']*)["']`)
+	return re.ReplaceAllStringFunc(opf, func(item string) string {
+		if sm := propsRe.FindStringSubmatchIndex(item); sm != nil {
+			return item[:sm[5]] + " " + prop + item[sm[5]:]
+		}
+		at := strings.LastIndex(item, "/>")
+		if at < 0 {
+			at = len(item) - 1
+		}
+		return item[:at] + ` properties="` + prop + `"` + item[at:]
+	})
+}
+
+// removeItemProperty drops prop from the properties of the manifest item id,
+// and the attribute with it when nothing is left.
+func removeItemProperty(opf, id, prop string) string {
+	re := regexp.MustCompile(`<(?:opf:)?item\b[^>]*\bid\s*=\s*["']` + regexp.QuoteMeta(id) + `["'][^>]*?/?>`)
+	propsRe := regexp.MustCompile(`\s+properties\s*=\s*(["'])([^"']*)["']`)
+	return re.ReplaceAllStringFunc(opf, func(item string) string {
+		sm := propsRe.FindStringSubmatchIndex(item)
+		if sm == nil {
+			return item
+		}
+		props := strings.Fields(item[sm[4]:sm[5]])
+		props = slices.DeleteFunc(props, func(p string) bool { return p == prop })
+		if len(props) == 0 {
+			return item[:sm[0]] + item[sm[1]:]
+		}
+		return item[:sm[4]] + strings.Join(props, " ") + item[sm[5]:]
+	})
+}
+
+// addMissingCover gives a coverless EPUB a cover (see findCover), with a cover
+// page. It returns the book unchanged, and where its cover came from, when
+// there is nothing to do or no cover to be had.
+func addMissingCover(b *Book, data []byte) ([]byte, string) {
+	l := logger.GetLogger()
+	if has, err := EPUBHasCover(data); err != nil || has {
+		return data, ""
+	}
+	if out, ok, err := promoteCoverImage(data); err != nil {
+		l.Warn("Cover check failed", zap.String("title", b.Title), zap.Error(err))
+		return data, ""
+	} else if ok {
+		return out, "book"
+	}
+	img, source, err := findCover(b)
+	if err != nil {
+		if !errors.Is(err, ErrNoCover) {
+			l.Warn("Cover lookup failed", zap.String("title", b.Title), zap.Error(err))
+		}
+		return data, ""
+	}
+	out, err := InjectEPUBCover(data, img, true)
+	if err != nil {
+		l.Warn("Cover injection failed", zap.String("title", b.Title), zap.Error(err))
+		return data, ""
+	}
+	return out, source
+}
@@ -0,0 +1,187 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/goodreads"
+)
+
+// coverlessEPUB is a one-chapter EPUB of the given version with no cover,
+// plus any extra entries and manifest items.
+func coverlessEPUB(t *testing.T, version string, extra map[string]string, items string) []byte {
+	t.Helper()
+	return fixtureEPUB(t, opfFixture{Version: version, Manifest: fixtureChapterItem + items}, extra)
+}
+
+func TestInjectEPUBCover_EPUB2WithPage(t *testing.T) {
+	img := noisyJPEG(t, 60, 90)
+	out, err := InjectEPUBCover(coverlessEPUB(t, "2.0", nil, ""), img, true)
+	if err != nil {
+		t.Fatalf("InjectEPUBCover: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Error("mimetype must stay the first, stored entry")
+	}
+	if err := ValidateEPUB(out); err != nil {
+		t.Errorf("EPUB with cover should validate: %v", err)
+	}
+
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := coverImagePath(book); p != "OEBPS/cover.jpg" || !bytes.Equal(book.file(p).Data, img) {
+		t.Errorf("cover image path = %q", p)
+	}
+	if refs := book.pkg.Spine.ItemRefs; len(refs) != 2 || refs[0].IDRef != "cover-page" {
+		t.Errorf("the cover page should open the spine: %+v", refs)
+	}
+	opf := string(book.opf())
+	for _, want := range []string{
+		`<item id="cover-image" href="cover.jpg" media-type="image/jpeg"/>`,
+		`<meta name="cover" content="cover-image"/>`,
+		`<reference type="cover" title="Cover" href="cover.xhtml"/>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("OPF is missing %s:\n%s", want, opf)
+		}
+	}
+	page := book.file("OEBPS/cover.xhtml")
+	if page == nil || !bytes.Contains(page.Data, []byte(`src="cover.jpg"`)) || wellFormedXML(page.Data) != nil {
+		t.Errorf("bad cover page: %s", page.Data)
+	}
+}
+
+func TestInjectEPUBCover_EPUB3(t *testing.T) {
+	// The book already uses the names a cover would get.
+	in := coverlessEPUB(t, "3.0", map[string]string{"OEBPS/cover.png": "x"}, `    <item id="cover-image" href="cover.png" media-type="image/png"/>
+    <meta name="cover" content="missing"/>
+`)
+	out, err := InjectEPUBCover(in, tinyPNG(t), false)
+	if err != nil {
+		t.Fatalf("InjectEPUBCover: %v", err)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := coverImagePath(book); p != "OEBPS/cover-2.png" {
+		t.Errorf("cover image path = %q", p)
+	}
+	opf := string(book.opf())
+	if !strings.Contains(opf, `<item id="cover-image-2" href="cover-2.png" media-type="image/png" properties="cover-image"/>`) {
+		t.Errorf("EPUB 3 cover should carry the cover-image property:\n%s", opf)
+	}
+	if strings.Contains(opf, `content="missing"`) || strings.Contains(opf, "<guide") || len(book.pkg.Spine.ItemRefs) != 1 {
+		t.Errorf("no page was asked for, and the stale cover meta should go:\n%s", opf)
+	}
+}
+
+func TestInjectEPUBCover_RejectsNonImage(t *testing.T) {
+	if _, err := InjectEPUBCover(coverlessEPUB(t, "2.0", nil, ""), []byte("<html>Not found</html>"), true); err == nil {
+		t.Error("an HTML error page is not a cover")
+	}
+}
+
+func TestAddMissingCover_PromotesUndeclaredCover(t *testing.T) {
+	in := coverlessEPUB(t, "3.0", map[string]string{"OEBPS/Images/Cover.jpg": string(noisyJPEG(t, 20, 30))},
+		`    <item id="img1" href="Images/Cover.jpg" media-type="image/jpeg"/>
+`)
+	out, source := addMissingCover(&Book{Title: "Dune"}, in)
+	if source != "book" {
+		t.Fatalf("source = %q, want book", source)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coverImagePath(book) != "OEBPS/Images/Cover.jpg" || !strings.Contains(string(book.opf()), `properties="cover-image"`) {
+		t.Errorf("the existing image should be declared the cover:\n%s", book.opf())
+	}
+
+	// A book that has a cover is left alone.
+	if again, source := addMissingCover(&Book{Title: "Dune"}, out); source != "" || !bytes.Equal(again, out) {
+		t.Error("a book with a cover should not change")
+	}
+}
+
+func TestAddMissingCover_LocalDirectory(t *testing.T) {
+	dir := t.TempDir()
+	img := noisyJPEG(t, 20, 30)
+	if err := os.WriteFile(filepath.Join(dir, "Dune_Messiah.jpg"), img, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ANNAS_COVER_DIR", dir)
+
+	out, source := addMissingCover(&Book{Title: "Dune Messiah", Hash: "abc"}, coverlessEPUB(t, "2.0", nil, ""))
+	if source != "local" {
+		t.Fatalf("source = %q, want local", source)
+	}
+	if has, err := EPUBHasCover(out); err != nil || !has {
+		t.Errorf("EPUBHasCover = %v, %v", has, err)
+	}
+	if _, source := addMissingCover(&Book{Title: "Children of Dune"}, coverlessEPUB(t, "2.0", nil, "")); source != "" {
+		t.Errorf("no cover should be found for another title, got %q", source)
+	}
+}
+
+func TestAddMissingCover_Goodreads(t *testing.T) {
+	img := noisyJPEG(t, 20, 30)
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/books/1234.jpg":
+			w.Write(img)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>rate limited</html>"))
+		}
+	}))
+	defer srv.Close()
+	orig := coverHTTPClient
+	t.Cleanup(func() { coverHTTPClient = orig })
+	coverHTTPClient = srv.Client()
+
+	b := &Book{Title: "Dune", Authors: "Frank Herbert", Goodreads: &goodreads.ShelfBook{
+		Title: "Dune (Dune Chronicles, #1)", Author: "Frank Herbert", CoverURL: srv.URL + "/books/1234._SY75_.jpg",
+	}}
+	out, source := addMissingCover(b, coverlessEPUB(t, "2.0", nil, ""))
+	if source != "goodreads" {
+		t.Fatalf("source = %q, want goodreads", source)
+	}
+	if len(paths) != 1 || paths[0] != "/books/1234.jpg" {
+		t.Errorf("the full-size cover should be fetched, got %v", paths)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(book.file(coverImagePath(book)).Data, img) {
+		t.Error("the fetched image should be the cover")
+	}
+
+	// An error page instead of an image leaves the book as it was.
+	b.Goodreads.CoverURL = srv.URL + "/books/missing.jpg"
+	in := coverlessEPUB(t, "2.0", nil, "")
+	if out, source := addMissingCover(b, in); source != "" || !bytes.Equal(out, in) {
+		t.Errorf("a bad download should not add a cover (source %q)", source)
+	}
+
+	// A shelf entry for another book is not used.
+	b.Goodreads = &goodreads.ShelfBook{Title: "Emma", Author: "Jane Austen", CoverURL: srv.URL + "/books/1234.jpg"}
+	if _, source := addMissingCover(b, in); source != "" {
+		t.Errorf("another book's cover was used (source %q)", source)
+	}
+}
@@ -0,0 +1,411 @@
+package anna
+
+import (
+	"compress/flate"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/goodreads"
+)
+
+// The Kindle titles a book from its OPF (dc:title, dc:creator, ...), not from
+// our email subject, so a file whose metadata is a scanner's file name shows
+// up in the library as "lgli_Some_File_Name". Before sending we rewrite the
+// OPF metadata from what we know about the book: the search result it was
+// picked from and, when it came off a Goodreads shelf, that shelf entry.
+//
+// Like the other rewriting stages, edits are made on the OPF text so the
+// metadata we don't touch (dates, subjects, refinements of other elements)
+// survives as it was.
+
+// EPUBMetadata is the metadata RewriteEPUBMetadata writes. Empty fields leave
+// the book's own value alone.
+type EPUBMetadata struct {
+	Title   string
+	Authors []string
+	// Language is a BCP 47 tag such as "en".
+	Language    string
+	Publisher   string
+	ISBN        string
+	Series      string
+	SeriesIndex string
+}
+
+func (m EPUBMetadata) empty() bool {
+	return m.Title == "" && len(m.Authors) == 0 && m.Language == "" && m.Publisher == "" &&
+		m.ISBN == "" && m.Series == ""
+}
+
+// Or fills m's empty fields from fallback.
+func (m EPUBMetadata) Or(fallback EPUBMetadata) EPUBMetadata {
+	if m.Title == "" {
+		m.Title = fallback.Title
+	}
+	if len(m.Authors) == 0 {
+		m.Authors = fallback.Authors
+	}
+	if m.Language == "" {
+		m.Language = fallback.Language
+	}
+	if m.Publisher == "" {
+		m.Publisher = fallback.Publisher
+	}
+	if m.ISBN == "" {
+		m.ISBN = fallback.ISBN
+	}
+	if m.Series == "" {
+		m.Series, m.SeriesIndex = fallback.Series, fallback.SeriesIndex
+	}
+	return m
+}
+
+// MetadataFromBook takes the metadata from a search result.
+func MetadataFromBook(b *Book) EPUBMetadata {
+	title, series, index := splitSeriesTitle(b.Title)
+	return EPUBMetadata{
+		Title:       title,
+		Authors:     splitAuthors(b.Authors),
+		Language:    languageTag(b.Language),
+		Publisher:   strings.TrimSpace(b.Publisher),
+		Series:      series,
+		SeriesIndex: index,
+	}
+}
+
+// MetadataFromShelfBook takes the metadata from a Goodreads shelf entry,
+// whose titles carry the series as "Title (Series, #N)".
+func MetadataFromShelfBook(sb goodreads.ShelfBook) EPUBMetadata {
+	title, series, index := splitSeriesTitle(sb.Title)
+	return EPUBMetadata{
+		Title:       title,
+		Authors:     splitAuthors(sb.Author),
+		ISBN:        normalizeISBN(sb.ISBN),
+		Series:      series,
+		SeriesIndex: index,
+	}
+}
+
+// ShelfBookMatches reports whether a Goodreads shelf entry is the book b:
+// one title is the other or starts it (editions often add a subtitle), and
+// the authors overlap when both are known.
+func ShelfBookMatches(b *Book, sb goodreads.ShelfBook) bool {
+	shelfTitle, _, _ := splitSeriesTitle(sb.Title)
+	x, y := normalizeForMatch(b.Title), normalizeForMatch(shelfTitle)
+	if x == "" || y == "" {
+		return false
+	}
+	if len(x) > len(y) {
+		x, y = y, x
+	}
+	if y != x && !strings.HasPrefix(y, x+" ") {
+		return false
+	}
+	if strings.TrimSpace(b.Authors) != "" && strings.TrimSpace(sb.Author) != "" {
+		return authorsOverlap(b.Authors, sb.Author)
+	}
+	return true
+}
+
+// bookMetadata is the metadata written into b's file: its Goodreads shelf
+// entry when that matches, with the search result filling the gaps.
+func bookMetadata(b *Book) EPUBMetadata {
+	m := MetadataFromBook(b)
+	if b.Goodreads != nil && ShelfBookMatches(b, *b.Goodreads) {
+		m = MetadataFromShelfBook(*b.Goodreads).Or(m)
+	}
+	return m
+}
+
+var seriesTitleRe = regexp.MustCompile(`^(.*\S)\s*\(([^()]+?),?\s+#(\d+(?:\.\d+)?)\)\s*$`)
+
+// splitSeriesTitle splits "Dune (Dune Chronicles, #1)" into its title, series
+// and position in the series. A title without a series is returned trimmed.
+func splitSeriesTitle(s string) (title, series, index string) {
+	s = strings.TrimSpace(s)
+	if m := seriesTitleRe.FindStringSubmatch(s); m != nil {
+		return m[1], strings.TrimSpace(m[2]), m[3]
+	}
+	return s, "", ""
+}
+
+// splitAuthors splits an author list on ";" or "&", and on commas only when
+// every part is a full name, so "Herbert, Frank" stays one author.
+func splitAuthors(s string) []string {
+	var out []string
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '&' }) {
+		names := strings.Split(part, ",")
+		for _, n := range names {
+			if !strings.Contains(strings.TrimSpace(n), " ") {
+				names = []string{part}
+				break
+			}
+		}
+		for _, n := range names {
+			if n = strings.TrimSpace(n); n != "" {
+				out = append(out, n)
+			}
+		}
+	}
+	return out
+}
+
+// languageCodes maps the language names search results use to BCP 47 tags.
+var languageCodes = map[string]string{
+	"english": "en", "spanish": "es", "french": "fr", "german": "de",
+	"italian": "it", "portuguese": "pt", "russian": "ru", "chinese": "zh",
+	"japanese": "ja", "korean": "ko", "arabic": "ar", "dutch": "nl",
+	"polish": "pl", "turkish": "tr",
+}
+
+var languageTagRe = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// languageTag turns a language name or tag into a BCP 47 tag, or "".
+func languageTag(s string) string {
+	s = strings.TrimSpace(s)
+	if code, ok := languageCodes[strings.ToLower(s)]; ok {
+		return code
+	}
+	if languageTagRe.MatchString(s) {
+		return s
+	}
+	return ""
+}
+
+// normalizeISBN strips an ISBN to its digits (and check X), or returns "" if
+// it isn't 10 or 13 characters long.
+func normalizeISBN(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if r >= '0' && r <= '9' || r == 'X' {
+			b.WriteRune(r)
+		}
+	}
+	if n := b.Len(); n != 10 && n != 13 {
+		return ""
+	}
+	return b.String()
+}
+
+// RewriteEPUBMetadata writes m into the EPUB's OPF, replacing the book's
+// titles, authors, languages, publishers, ISBNs and series with the fields m
+// sets. The package's unique identifier is never changed. The result is
+// re-packed with mimetype stored first.
+func RewriteEPUBMetadata(data []byte, m EPUBMetadata) ([]byte, error) {
+	if m.empty() {
+		return data, nil
+	}
+	book, err := parseEPUB(data)
+	if err != nil {
+		return nil, err
+	}
+	opf, err := rewriteOPFMetadata(string(book.opf()), m, strings.HasPrefix(book.pkg.Version, "3"))
+	if err != nil {
+		return nil, err
+	}
+	if err := book.setOPF([]byte(opf)); err != nil {
+		return nil, fmt.Errorf("rewritten OPF: %w", err)
+	}
+	return book.bytes(flate.DefaultCompression)
+}
+
+var (
+	opfMetadataEndRe   = regexp.MustCompile(`</(?:\w+:)?metadata\s*>`)
+	opfUniqueIDRe      = regexp.MustCompile(`\bunique-identifier\s*=\s*["']([^"']*)["']`)
+	opfPackageStartRe  = regexp.MustCompile(`<(?:\w+:)?package\b[^>]*>`)
+	opfMetadataStartRe = regexp.MustCompile(`<(?:\w+:)?metadata\b(?:[^>]*[^/>])?>`)
+	dcNamespaceRe      = regexp.MustCompile(`\bxmlns:(\w+)\s*=\s*["']http://purl\.org/dc/elements/1\.1/["']`)
+	xmlIDRe            = regexp.MustCompile(`\bid\s*=\s*["']([^"']*)["']`)
+)
+
+// opfMetadataEditor edits the elements of an OPF's <metadata>.
+type opfMetadataEditor struct {
+	opf string
+	dc  string // the Dublin Core prefix, e.g. "dc:"
+	add []string
+	ids map[string]bool
+}
+
+// elementRe matches whole elements called name (a prefixed name such as
+// "dc:title", or "meta" in the OPF namespace), with the line they sit on.
+func elementRe(name string) *regexp.Regexp {
+	n := regexp.QuoteMeta(name)
+	if name == "meta" {
+		n = `(?:opf:)?meta`
+	}
+	return regexp.MustCompile(`(?s)[ \t]*<(` + n + `)\b([^>]*?)(?:/>|>(.*?)</` + n + `\s*>)[ \t]*\r?\n?`)
+}
+
+// remove deletes the elements called name for which keep returns false, and
+// the <meta refines> elements refining them.
+func (e *opfMetadataEditor) remove(name string, keep func(attrs, text string) bool) {
+	var removed []string
+	re := elementRe(name)
+	e.opf = re.ReplaceAllStringFunc(e.opf, func(el string) string {
+		sm := re.FindStringSubmatch(el)
+		if keep != nil && keep(sm[2], sm[3]) {
+			return el
+		}
+		if id := xmlIDRe.FindStringSubmatch(sm[2]); id != nil {
+			removed = append(removed, id[1])
+		}
+		return ""
+	})
+	for _, id := range removed {
+		refines := regexp.MustCompile(`\brefines\s*=\s*["']#` + regexp.QuoteMeta(id) + `["']`)
+		e.remove("meta", func(attrs, _ string) bool { return !refines.MatchString(attrs) })
+	}
+}
+
+// newID returns an element id based on base that the OPF doesn't use yet.
+func (e *opfMetadataEditor) newID(base string) string {
+	id := base
+	for i := 2; e.ids[id] || strings.Contains(e.opf, `"`+id+`"`); i++ {
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+	e.ids[id] = true
+	return id
+}
+
+func rewriteOPFMetadata(opf string, m EPUBMetadata, epub3 bool) (string, error) {
+	if opfMetadataEndRe.FindStringIndex(opf) == nil {
+		return "", fmt.Errorf("OPF has no <metadata> element")
+	}
+	e := &opfMetadataEditor{opf: opf, dc: "dc:", ids: map[string]bool{}}
+	// The new elements need their prefixes declared on <package> or
+	// <metadata>; some books only declare dc on each element.
+	scope := opfPackageStartRe.FindString(opf) + opfMetadataStartRe.FindString(opf)
+	if sm := dcNamespaceRe.FindStringSubmatch(scope); sm != nil {
+		e.dc = sm[1] + ":"
+	} else {
+		e.opf = opfMetadataStartRe.ReplaceAllStringFunc(e.opf, func(tag string) string {
+			return strings.TrimSuffix(tag, ">") + ` xmlns:dc="http://purl.org/dc/elements/1.1/">`
+		})
+	}
+	hasOPFPrefix := strings.Contains(scope, `xmlns:opf=`)
+
+	if m.Title != "" {
+		e.remove(e.dc+"title", nil)
+		e.add = append(e.add, fmt.Sprintf(`<%stitle>%s</%stitle>`, e.dc, xmlEscape(m.Title), e.dc))
+	}
+	if len(m.Authors) > 0 {
+		e.remove(e.dc+"creator", nil)
+		for _, a := range m.Authors {
+			switch {
+			case epub3:
+				id := e.newID("creator")
+				e.add = append(e.add,
+					fmt.Sprintf(`<%screator id="%s">%s</%screator>`, e.dc, id, xmlEscape(a), e.dc),
+					fmt.Sprintf(`<meta refines="#%s" property="role" scheme="marc:relators">aut</meta>`, id))
+			case hasOPFPrefix:
+				e.add = append(e.add, fmt.Sprintf(`<%screator opf:role="aut">%s</%screator>`, e.dc, xmlEscape(a), e.dc))
+			default:
+				e.add = append(e.add, fmt.Sprintf(`<%screator>%s</%screator>`, e.dc, xmlEscape(a), e.dc))
+			}
+		}
+	}
+	if m.Language != "" {
+		e.remove(e.dc+"language", nil)
+		e.add = append(e.add, fmt.Sprintf(`<%slanguage>%s</%slanguage>`, e.dc, xmlEscape(m.Language), e.dc))
+	}
+	if m.Publisher != "" {
+		e.remove(e.dc+"publisher", nil)
+		e.add = append(e.add, fmt.Sprintf(`<%spublisher>%s</%spublisher>`, e.dc, xmlEscape(m.Publisher), e.dc))
+	}
+	if isbn := normalizeISBN(m.ISBN); isbn != "" {
+		uid := ""
+		if sm := opfUniqueIDRe.FindStringSubmatch(opf); sm != nil {
+			uid = sm[1]
+		}
+		e.remove(e.dc+"identifier", func(attrs, text string) bool {
+			if id := xmlIDRe.FindStringSubmatch(attrs); id != nil && id[1] == uid {
+				return true // the package's own identifier stays
+			}
+			return !strings.Contains(strings.ToLower(attrs+" "+text), "isbn")
+		})
+		if epub3 {
+			e.add = append(e.add, fmt.Sprintf(`<%sidentifier id="%s">urn:isbn:%s</%sidentifier>`, e.dc, e.newID("isbn"), isbn, e.dc))
+		} else if hasOPFPrefix {
+			e.add = append(e.add, fmt.Sprintf(`<%sidentifier opf:scheme="ISBN">%s</%sidentifier>`, e.dc, isbn, e.dc))
+		} else {
+			e.add = append(e.add, fmt.Sprintf(`<%sidentifier>urn:isbn:%s</%sidentifier>`, e.dc, isbn, e.dc))
+		}
+	}
+	if m.Series != "" {
+		calibreSeries := regexp.MustCompile(`\bname\s*=\s*["']calibre:series(?:_index)?["']`)
+		collection := regexp.MustCompile(`\bproperty\s*=\s*["']belongs-to-collection["']`)
+		e.remove("meta", func(attrs, _ string) bool {
+			return !calibreSeries.MatchString(attrs) && !(epub3 && collection.MatchString(attrs))
+		})
+		// Calibre's tags are what most readers (and Kindle conversions) use;
+		// EPUB 3 has its own collection metadata.
+		e.add = append(e.add, fmt.Sprintf(`<meta name="calibre:series" content="%s"/>`, xmlEscape(m.Series)))
+		if m.SeriesIndex != "" {
+			e.add = append(e.add, fmt.Sprintf(`<meta name="calibre:series_index" content="%s"/>`, xmlEscape(m.SeriesIndex)))
+		}
+		if epub3 {
+			id := e.newID("series")
+			e.add = append(e.add,
+				fmt.Sprintf(`<meta property="belongs-to-collection" id="%s">%s</meta>`, id, xmlEscape(m.Series)),
+				fmt.Sprintf(`<meta refines="#%s" property="collection-type">series</meta>`, id))
+			if m.SeriesIndex != "" {
+				e.add = append(e.add, fmt.Sprintf(`<meta refines="#%s" property="group-position">%s</meta>`, id, xmlEscape(m.SeriesIndex)))
+			}
+		}
+	}
+
+	return appendToElement(e.opf, "metadata", e.add), nil
+}
+
+// appendToElement adds lines (one element each) at the end of the first OPF
+// element called name (unprefixed, e.g. "manifest"), indented like that
+// element's children. A self-closing element is opened up.
+func appendToElement(opf, name string, lines []string) string {
+	return insertIntoElement(opf, name, lines, false)
+}
+
+// prependToElement is appendToElement adding at the start of the element.
+func prependToElement(opf, name string, lines []string) string {
+	return insertIntoElement(opf, name, lines, true)
+}
+
+func insertIntoElement(opf, name string, lines []string, first bool) string {
+	start := regexp.MustCompile(`<((?:\w+:)?` + name + `)\b((?:[^>"']|"[^"]*"|'[^']*')*?)(/?)>`)
+	loc := start.FindStringSubmatchIndex(opf)
+	if loc == nil || len(lines) == 0 {
+		return opf
+	}
+	tag := opf[loc[2]:loc[3]]
+	// The element's indentation, and its children's one step further.
+	lineStart := strings.LastIndexByte(opf[:loc[0]], '\n') + 1
+	outer := opf[lineStart:loc[0]]
+	if strings.TrimSpace(outer) != "" {
+		outer = ""
+	}
+	indent := outer + "  "
+	if sm := regexp.MustCompile(`^\s*?\n([ \t]*)<`).FindStringSubmatch(opf[loc[1]:]); sm != nil && loc[6] == loc[7] {
+		indent = sm[1]
+	}
+	var body strings.Builder
+	for _, l := range lines {
+		body.WriteString(indent + l + "\n")
+	}
+
+	if loc[6] != loc[7] { // <name/>
+		return opf[:loc[0]] + "<" + tag + opf[loc[4]:loc[5]] + ">\n" + body.String() + outer + "</" + tag + ">" + opf[loc[1]:]
+	}
+	if first {
+		return opf[:loc[1]] + "\n" + strings.TrimSuffix(body.String(), "\n") + opf[loc[1]:]
+	}
+	end := strings.Index(opf[loc[1]:], "</"+tag)
+	if end < 0 {
+		return opf
+	}
+	end += loc[1]
+	// Keep the closing tag's own indentation on its line.
+	at := strings.LastIndexByte(opf[:end], '\n') + 1
+	if at <= loc[1] || strings.TrimSpace(opf[at:end]) != "" {
+		return opf[:end] + "\n" + body.String() + outer + opf[end:]
+	}
+	return opf[:at] + body.String() + opf[at:]
+}
@@ -0,0 +1,204 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/goodreads"
+)
+
+// metadataEPUB is an EPUB whose OPF carries the kind of metadata scanned
+// uploads have, under the given package version and <metadata> body.
+func metadataEPUB(t *testing.T, version, metadata string) []byte {
+	t.Helper()
+	return fixtureEPUB(t, opfFixture{Version: version, Metadata: metadata}, nil)
+}
+
+func TestRewriteEPUBMetadata_EPUB2(t *testing.T) {
+	in := metadataEPUB(t, "2.0", `    <dc:identifier id="uid">urn:uuid:1234</dc:identifier>
+    <dc:identifier opf:scheme="ISBN">0000000000</dc:identifier>
+    <dc:title>lgli_Some_File_Name</dc:title>
+    <dc:creator opf:role="aut">Unknown</dc:creator>
+    <dc:language>und</dc:language>
+    <dc:subject>Science Fiction</dc:subject>
+    <meta name="calibre:series" content="Wrong"/>
+    <meta name="cover" content="cover-img"/>
+`)
+	out, err := RewriteEPUBMetadata(in, EPUBMetadata{
+		Title:       "Dune",
+		Authors:     []string{"Frank Herbert", "Brian Herbert"},
+		Language:    "en",
+		Publisher:   "Ace & Co",
+		ISBN:        "978-0-441-17271-9",
+		Series:      "Dune Chronicles",
+		SeriesIndex: "1",
+	})
+	if err != nil {
+		t.Fatalf("RewriteEPUBMetadata: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Error("mimetype must stay the first, stored entry")
+	}
+	if err := ValidateEPUB(out); err != nil {
+		t.Errorf("rewritten EPUB should validate: %v", err)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := book.pkg.Metadata
+	if !slices.Equal(md.Titles, []string{"Dune"}) || !slices.Equal(md.Creators, []string{"Frank Herbert", "Brian Herbert"}) || !slices.Equal(md.Languages, []string{"en"}) {
+		t.Errorf("metadata = %+v", md)
+	}
+	opf := string(book.opf())
+	for _, want := range []string{
+		`<dc:identifier id="uid">urn:uuid:1234</dc:identifier>`,
+		`<dc:identifier opf:scheme="ISBN">9780441172719</dc:identifier>`,
+		`<dc:creator opf:role="aut">Brian Herbert</dc:creator>`,
+		`<dc:publisher>Ace &amp; Co</dc:publisher>`,
+		`<dc:subject>Science Fiction</dc:subject>`,
+		`<meta name="cover" content="cover-img"/>`,
+		`<meta name="calibre:series" content="Dune Chronicles"/>`,
+		`<meta name="calibre:series_index" content="1"/>`,
+		"\n    <dc:title>Dune</dc:title>\n",
+		"\n  </metadata>",
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("OPF is missing %s:\n%s", want, opf)
+		}
+	}
+	for _, gone := range []string{"lgli_", "Unknown", "0000000000", "Wrong", "belongs-to-collection"} {
+		if strings.Contains(opf, gone) {
+			t.Errorf("OPF still has %q:\n%s", gone, opf)
+		}
+	}
+}
+
+func TestRewriteEPUBMetadata_EPUB3Refinements(t *testing.T) {
+	in := metadataEPUB(t, "3.0", `    <dc:identifier id="uid">urn:uuid:1234</dc:identifier>
+    <dc:title id="t1">lgli_file</dc:title>
+    <meta refines="#t1" property="title-type">main</meta>
+    <dc:creator id="creator">Someone</dc:creator>
+    <meta refines="#creator" property="role" scheme="marc:relators">aut</meta>
+    <meta property="dcterms:modified">2020-01-01T00:00:00Z</meta>
+`)
+	out, err := RewriteEPUBMetadata(in, EPUBMetadata{Title: "Dune", Authors: []string{"Frank Herbert"}, Series: "Dune Chronicles", SeriesIndex: "1"})
+	if err != nil {
+		t.Fatalf("RewriteEPUBMetadata: %v", err)
+	}
+	opf := readEntry(t, out, "OEBPS/content.opf")
+	if err := wellFormedXML(opf); err != nil {
+		t.Fatalf("rewritten OPF is not well-formed: %v", err)
+	}
+	for _, want := range []string{
+		`<dc:title>Dune</dc:title>`,
+		`<dc:creator id="creator">Frank Herbert</dc:creator>`,
+		`<meta refines="#creator" property="role" scheme="marc:relators">aut</meta>`,
+		`<meta property="belongs-to-collection" id="series">Dune Chronicles</meta>`,
+		`<meta refines="#series" property="group-position">1</meta>`,
+		`dcterms:modified`,
+	} {
+		if !bytes.Contains(opf, []byte(want)) {
+			t.Errorf("OPF is missing %s:\n%s", want, opf)
+		}
+	}
+	if bytes.Contains(opf, []byte("title-type")) || bytes.Contains(opf, []byte("Someone")) {
+		t.Errorf("the replaced elements' refinements should go too:\n%s", opf)
+	}
+}
+
+func TestRewriteEPUBMetadata_DeclaresDCNamespace(t *testing.T) {
+	// validEPUBEntries declares dc only on its identifier element.
+	out, err := RewriteEPUBMetadata(makeZip(t, validEPUBEntries()), EPUBMetadata{Title: "Dune"})
+	if err != nil {
+		t.Fatalf("RewriteEPUBMetadata: %v", err)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "Dune" || !bytes.Contains(book.opf(), []byte(`<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">`)) {
+		t.Errorf("dc should be declared on <metadata>:\n%s", book.opf())
+	}
+}
+
+func TestRewriteEPUBMetadata_NothingToWrite(t *testing.T) {
+	in := makeZip(t, validEPUBEntries())
+	out, err := RewriteEPUBMetadata(in, EPUBMetadata{})
+	if err != nil || !bytes.Equal(in, out) {
+		t.Errorf("empty metadata should leave the book alone (err %v)", err)
+	}
+	if _, err := RewriteEPUBMetadata([]byte("not a zip"), EPUBMetadata{Title: "x"}); err == nil {
+		t.Error("a non-EPUB should fail")
+	}
+}
+
+func TestBookMetadata(t *testing.T) {
+	b := &Book{Title: "Dune", Authors: "Frank Herbert", Language: "English", Publisher: "Ace"}
+	m := bookMetadata(b)
+	if m.Title != "Dune" || !slices.Equal(m.Authors, []string{"Frank Herbert"}) || m.Language != "en" || m.Publisher != "Ace" {
+		t.Errorf("from the search result: %+v", m)
+	}
+
+	b.Goodreads = &goodreads.ShelfBook{Title: "Dune (Dune Chronicles, #1)", Author: "Frank Herbert", ISBN: "0441172717"}
+	m = bookMetadata(b)
+	if m.Title != "Dune" || m.Series != "Dune Chronicles" || m.SeriesIndex != "1" || m.ISBN != "0441172717" || m.Publisher != "Ace" {
+		t.Errorf("Goodreads with the search result filling gaps: %+v", m)
+	}
+
+	b.Goodreads = &goodreads.ShelfBook{Title: "Children of Dune (Dune Chronicles, #3)", Author: "Frank Herbert", ISBN: "0441104029"}
+	if m = bookMetadata(b); m.ISBN != "" || m.Series != "" {
+		t.Errorf("a shelf entry for another book must be ignored: %+v", m)
+	}
+}
+
+func TestShelfBookMatches(t *testing.T) {
+	for _, tc := range []struct {
+		title, authors, shelfTitle, shelfAuthor string
+		want                                    bool
+	}{
+		{"Dune", "Frank Herbert", "Dune (Dune Chronicles, #1)", "Frank Herbert", true},
+		{"Dune: Deluxe Edition", "Herbert, Frank", "Dune", "Frank Herbert", true},
+		{"Dune", "", "Dune", "Frank Herbert", true},
+		{"Dune", "Frank Herbert", "Dune", "Someone Else", false},
+		{"Dune Messiah", "Frank Herbert", "Dune Messiah", "Frank Herbert", true},
+		{"Dunes", "Frank Herbert", "Dune", "Frank Herbert", false},
+		{"", "", "Dune", "", false},
+	} {
+		b := &Book{Title: tc.title, Authors: tc.authors}
+		if got := ShelfBookMatches(b, goodreads.ShelfBook{Title: tc.shelfTitle, Author: tc.shelfAuthor}); got != tc.want {
+			t.Errorf("ShelfBookMatches(%q, %q) = %v, want %v", tc.title, tc.shelfTitle, got, tc.want)
+		}
+	}
+}
+
+func TestSplitAuthorsAndSeries(t *testing.T) {
+	for in, want := range map[string][]string{
+		"Frank Herbert":                  {"Frank Herbert"},
+		"Herbert, Frank":                 {"Herbert, Frank"},
+		"Frank Herbert, Brian Herbert":   {"Frank Herbert", "Brian Herbert"},
+		"Herbert, Frank; Anderson, K. J": {"Herbert, Frank", "Anderson, K. J"},
+		"Gaiman & Pratchett":             {"Gaiman", "Pratchett"},
+		"  ":                             nil,
+	} {
+		if got := splitAuthors(in); !slices.Equal(got, want) {
+			t.Errorf("splitAuthors(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	title, series, index := splitSeriesTitle(" The Way of Kings (The Stormlight Archive, #1.5) ")
+	if title != "The Way of Kings" || series != "The Stormlight Archive" || index != "1.5" {
+		t.Errorf("splitSeriesTitle = %q %q %q", title, series, index)
+	}
+	if title, series, _ := splitSeriesTitle("Dune (Deluxe Edition)"); title != "Dune (Deluxe Edition)" || series != "" {
+		t.Errorf("a parenthetical without #N is not a series: %q %q", title, series)
+	}
+}
@@ -0,0 +1,324 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Most of what CheckEPUB finds in archive EPUBs is mechanical damage: a
+// chapter with one unclosed tag, a manifest entry for an image that was never
+// packed, a missing table of contents, a mimetype entry zipped in the wrong
+// place. RepairEPUB fixes those before the book is validated, so one stray
+// tag doesn't get a whole edition rejected, and says what it changed.
+
+// EPUBRepair is one change made by RepairEPUB.
+type EPUBRepair struct {
+	Code    string `json:"code"`           // e.g. "XHTML_RESERIALIZED"
+	Path    string `json:"path,omitempty"` // the zip entry it concerns
+	Message string `json:"message"`
+}
+
+func (r EPUBRepair) String() string {
+	if r.Path == "" {
+		return fmt.Sprintf("%s: %s", r.Code, r.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", r.Code, r.Path, r.Message)
+}
+
+// RepairEPUB fixes a misplaced, compressed or wrong mimetype entry, drops
+// manifest items and spine entries that point at nothing, re-serializes
+// malformed XHTML documents, and generates a missing (or rebuilds a
+// malformed) EPUB 3 navigation document or EPUB 2 NCX from the book's other
+// table of contents or its chapter headings.
+//
+// When there is nothing to repair the original bytes are returned unchanged.
+// A book that can't be parsed at all is returned as-is with the error;
+// ValidateEPUB will reject it with the reason.
+func RepairEPUB(data []byte) ([]byte, []EPUBRepair, error) {
+	book, err := parseEPUB(data)
+	if err != nil {
+		return data, nil, err
+	}
+	if book.file("META-INF/encryption.xml") != nil {
+		return data, nil, nil // DRM: nothing to be done
+	}
+	r := &epubRepairer{book: book}
+	r.fixMimetype(data)
+	for _, step := range []func() error{r.dropDanglingItems, r.reserializeXHTML, r.fixNavigation} {
+		if err := step(); err != nil {
+			return data, nil, err
+		}
+	}
+	if len(r.repairs) == 0 {
+		return data, nil, nil
+	}
+	out, err := book.bytes(flate.DefaultCompression)
+	if err != nil {
+		return data, nil, err
+	}
+	return out, r.repairs, nil
+}
+
+type epubRepairer struct {
+	book    *epubBook
+	repairs []EPUBRepair
+}
+
+func (r *epubRepairer) add(code, p, format string, args ...any) {
+	r.repairs = append(r.repairs, EPUBRepair{Code: code, Path: p, Message: fmt.Sprintf(format, args...)})
+}
+
+// fixMimetype makes sure the book has the right mimetype entry. Re-packing
+// puts it first and stores it, so that only needs noting.
+func (r *epubRepairer) fixMimetype(data []byte) {
+	const want = "application/epub+zip"
+	m := r.book.file("mimetype")
+	if m == nil {
+		r.book.entries = append([]*epubEntry{{Name: "mimetype", Data: []byte(want)}}, r.book.entries...)
+		r.add("MIMETYPE_FIXED", "mimetype", "added the missing mimetype entry")
+		return
+	}
+	if got := string(m.Data); got != want {
+		m.Data = []byte(want)
+		r.add("MIMETYPE_FIXED", "mimetype", "replaced %q with %s", truncate(got, 40), want)
+		return
+	}
+	z, err := openZip(data)
+	if err != nil {
+		return // parseEPUB read it, so this doesn't happen
+	}
+	if first := z.files()[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		r.add("MIMETYPE_FIXED", "mimetype", "moved mimetype to the start of the zip, stored uncompressed")
+	}
+}
+
+// dropDanglingItems removes manifest items whose file isn't in the book, and
+// spine entries naming no manifest item.
+func (r *epubRepairer) dropDanglingItems() error {
+	b := r.book
+	opf := b.opf()
+	changed := false
+	for _, it := range b.pkg.Manifest {
+		if it.ID == "" || it.Href == "" || uriSchemeRe.MatchString(it.Href) {
+			continue
+		}
+		if p := b.itemPath(it); b.file(p) == nil {
+			opf = removeManifestItem(opf, it.ID)
+			opf = removeSpineItemRef(opf, it.ID)
+			opf = removeGuideReference(opf, it.Href)
+			r.add("MANIFEST_ITEM_DROPPED", p, "dropped manifest item %q: the file isn't in the book", it.ID)
+			changed = true
+		}
+	}
+	for _, ref := range b.pkg.Spine.ItemRefs {
+		if _, ok := b.itemByID(ref.IDRef); !ok {
+			opf = removeSpineItemRef(opf, ref.IDRef)
+			r.add("SPINE_ITEM_DROPPED", b.opfPath, "dropped spine entry %q: it names no manifest item", ref.IDRef)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := b.setOPF(opf); err != nil {
+		return fmt.Errorf("OPF without dangling items: %w", err)
+	}
+	return nil
+}
+
+// reserializeXHTML rewrites every content document that isn't well-formed.
+// The navigation document is left to fixNavigation.
+func (r *epubRepairer) reserializeXHTML() error {
+	for _, it := range r.book.pkg.Manifest {
+		if it.MediaType != "application/xhtml+xml" || hasProperty(it.Properties, "nav") {
+			continue
+		}
+		p := r.book.itemPath(it)
+		e := r.book.file(p)
+		if e == nil {
+			continue
+		}
+		xmlErr := wellFormedXML(e.Data)
+		if xmlErr == nil {
+			continue
+		}
+		fixed, err := reserializeXHTML(e.Data, r.book.title())
+		if err != nil {
+			continue // CheckEPUB will report it
+		}
+		e.Data = fixed
+		r.add("XHTML_RESERIALIZED", p, "rewrote malformed XHTML (%v)", xmlErr)
+	}
+	return nil
+}
+
+// reserializeXHTML parses a document the way a browser would and writes it
+// back as well-formed XHTML, with the same clean-up as converted MOBI
+// documents. fallbackTitle is used when it has no <title>.
+func reserializeXHTML(data []byte, fallbackTitle string) ([]byte, error) {
+	root, err := html.Parse(bytes.NewReader(bytes.ToValidUTF8(data, []byte("\uFFFD"))))
+	if err != nil {
+		return nil, err
+	}
+	title := fallbackTitle
+	if t := findElement(root, atom.Title); t != nil && t.FirstChild != nil && strings.TrimSpace(t.FirstChild.Data) != "" {
+		title = strings.TrimSpace(t.FirstChild.Data)
+	}
+	cleanMOBIHTML(root, nil)
+	out, err := renderXHTML(root, title, headStyles(root))
+	if err != nil {
+		return nil, err
+	}
+	if err := wellFormedXML(out); err != nil {
+		return nil, fmt.Errorf("still not well-formed: %w", err)
+	}
+	return out, nil
+}
+
+// fixNavigation gives an EPUB 3 book a navigation document and an EPUB 2 book
+// an NCX named by its spine, when it lacks a usable one.
+func (r *epubRepairer) fixNavigation() error {
+	b := r.book
+	docs := r.spineDocs()
+	if len(docs) == 0 {
+		return nil // nothing a table of contents could point at
+	}
+	var nav, ncx *opfItem
+	for i, it := range b.pkg.Manifest {
+		if hasProperty(it.Properties, "nav") {
+			nav = &b.pkg.Manifest[i]
+		}
+		if it.MediaType == "application/x-dtbncx+xml" {
+			ncx = &b.pkg.Manifest[i]
+		}
+	}
+	title := b.title()
+	if title == "" {
+		title = "Untitled"
+	}
+	opf := string(b.opf())
+	dir := path.Dir(b.opfPath)
+
+	if strings.HasPrefix(b.pkg.Version, "3") {
+		switch {
+		case nav == nil:
+			p := b.newEntryPath(dir, "nav", ".xhtml")
+			toc, source := r.toc(title, docs, ncx, nil)
+			b.entries = append(b.entries, &epubEntry{Name: p, Data: buildNav(p, title, toc)})
+			opf = appendToElement(opf, "manifest", []string{fmt.Sprintf(`<item id="%s" href="%s" media-type="application/xhtml+xml" properties="nav"/>`,
+				newManifestID(opf, "nav"), relativeHref(b.opfPath, p))})
+			r.add("NAV_GENERATED", p, "added a navigation document built from %s", source)
+		case wellFormedXML(b.file(b.itemPath(*nav)).Data) != nil:
+			p := b.itemPath(*nav)
+			toc, source := r.toc(title, docs, ncx, nil)
+			b.file(p).Data = buildNav(p, title, toc)
+			r.add("NAV_GENERATED", p, "rebuilt the malformed navigation document from %s", source)
+		default:
+			return nil
+		}
+	} else {
+		switch {
+		case ncx == nil:
+			p := b.newEntryPath(dir, "toc", ".ncx")
+			toc, source := r.toc(title, docs, nil, nav)
+			b.entries = append(b.entries, &epubEntry{Name: p, Data: buildNCX(p, title, packageUID(b.opf()), toc)})
+			id := newManifestID(opf, "ncx")
+			opf = appendToElement(opf, "manifest", []string{fmt.Sprintf(`<item id="%s" href="%s" media-type="application/x-dtbncx+xml"/>`,
+				id, relativeHref(b.opfPath, p))})
+			opf = setSpineTOC(opf, id)
+			r.add("NCX_GENERATED", p, "added an NCX table of contents built from %s", source)
+		case wellFormedXML(b.file(b.itemPath(*ncx)).Data) != nil:
+			p := b.itemPath(*ncx)
+			toc, source := r.toc(title, docs, nil, nav)
+			b.file(p).Data = buildNCX(p, title, packageUID(b.opf()), toc)
+			opf = setSpineTOC(opf, ncx.ID)
+			r.add("NCX_GENERATED", p, "rebuilt the malformed NCX from %s", source)
+		case b.pkg.Spine.Toc != ncx.ID:
+			opf = setSpineTOC(opf, ncx.ID)
+			r.add("NCX_LINKED", b.itemPath(*ncx), "pointed the spine's toc attribute at the NCX")
+		default:
+			return nil
+		}
+	}
+	if err := b.setOPF([]byte(opf)); err != nil {
+		return fmt.Errorf("OPF with table of contents: %w", err)
+	}
+	return nil
+}
+
+// toc is the table of contents to generate from: the book's other one (the
+// NCX or the nav, whichever is given and well-formed) or its chapter
+// headings. It also says which it used.
+func (r *epubRepairer) toc(title string, docs []xhtmlDoc, ncx, nav *opfItem) ([]tocEntry, string) {
+	if ncx != nil {
+		p := r.book.itemPath(*ncx)
+		if e := r.book.file(p); e != nil && wellFormedXML(e.Data) == nil {
+			if toc := parseNCX(r.book, p); len(toc) > 0 {
+				return toc, "the NCX"
+			}
+		}
+	}
+	if nav != nil {
+		p := r.book.itemPath(*nav)
+		if e := r.book.file(p); e != nil && wellFormedXML(e.Data) == nil {
+			if toc := parseNav(r.book, p); len(toc) > 0 {
+				return toc, "the navigation document"
+			}
+		}
+	}
+	return headingTOC(title, docs), "the chapter headings"
+}
+
+// spineDocs returns the spine's content documents that are in the book, in
+// reading order.
+func (r *epubRepairer) spineDocs() []xhtmlDoc {
+	var docs []xhtmlDoc
+	for _, ref := range r.book.pkg.Spine.ItemRefs {
+		it, ok := r.book.itemByID(ref.IDRef)
+		if !ok || it.MediaType != "application/xhtml+xml" || hasProperty(it.Properties, "nav") {
+			continue
+		}
+		p := r.book.itemPath(it)
+		if e := r.book.file(p); e != nil {
+			docs = append(docs, xhtmlDoc{path: p, data: e.Data})
+		}
+	}
+	return docs
+}
+
+var (
+	spineStartRe = regexp.MustCompile(`<((?:\w+:)?spine)\b([^>]*?)(/?)>`)
+	tocAttrRe    = regexp.MustCompile(`\s+toc\s*=\s*["'][^"']*["']`)
+)
+
+// setSpineTOC sets the <spine>'s toc attribute to id.
+func setSpineTOC(opf, id string) string {
+	m := spineStartRe.FindStringSubmatchIndex(opf)
+	if m == nil {
+		return opf
+	}
+	attrs := tocAttrRe.ReplaceAllString(opf[m[4]:m[5]], "")
+	tag := fmt.Sprintf(`<%s%s toc="%s"%s>`, opf[m[2]:m[3]], attrs, id, opf[m[6]:m[7]])
+	return opf[:m[0]] + tag + opf[m[1]:]
+}
+
+// packageUID is the text of the package's unique identifier, or "".
+func packageUID(opf []byte) string {
+	m := opfUniqueIDAttrRe.FindSubmatch(opf)
+	if m == nil {
+		return ""
+	}
+	re := regexp.MustCompile(`(?s)<(?:\w+:)?identifier\b[^>]*\bid\s*=\s*["']` + regexp.QuoteMeta(string(m[1])) + `["'][^>]*>(.*?)</(?:\w+:)?identifier>`)
+	if id := re.FindSubmatch(opf); id != nil {
+		return strings.TrimSpace(xmlUnescape(string(id[1])))
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// repairCodes lists the repairs' codes.
+func repairCodes(repairs []EPUBRepair) string {
+	var cs []string
+	for _, r := range repairs {
+		cs = append(cs, r.Code)
+	}
+	return strings.Join(cs, " ")
+}
+
+func TestRepairEPUB_NothingToDo(t *testing.T) {
+	in := checkedEPUB(t, nil)
+	out, repairs, err := RepairEPUB(in)
+	if err != nil || len(repairs) != 0 || !bytes.Equal(in, out) {
+		t.Errorf("a sound book should be left alone: %v %v", repairs, err)
+	}
+
+	entries := validEPUBEntries()
+	entries["META-INF/encryption.xml"] = "<encryption/>"
+	drm := makeZip(t, entries)
+	if out, repairs, err := RepairEPUB(drm); err != nil || len(repairs) != 0 || !bytes.Equal(out, drm) {
+		t.Errorf("a DRM book should be left for validation to reject: %v %v", repairs, err)
+	}
+	if out, _, err := RepairEPUB([]byte("not a zip")); err == nil || string(out) != "not a zip" {
+		t.Error("an unreadable book should come back as-is with the error")
+	}
+}
+
+func TestRepairEPUB_MalformedXHTMLAndMissingFiles(t *testing.T) {
+	opf := strings.NewReplacer(
+		`<item id="notes"`, `<item id="img" href="Images/gone.jpg" media-type="image/jpeg"/>
+    <item id="notes"`,
+		`<itemref idref="notes"/>`, `<itemref idref="notes"/>
+    <itemref idref="nope"/>`,
+	).Replace(string(readEntry(t, checkedEPUB(t, nil), "OEBPS/content.opf")))
+	in := checkedEPUB(t, map[string]string{
+		"OEBPS/content.opf":   opf,
+		"OEBPS/Text/01.xhtml": `<?xml version="1.0"?><html><head><title>One</title></head><body><p>Sand &amp; spice<br><p>Worms &nbsp;<a href="notes.xhtml#n1">1</a></body>`,
+	})
+	out, repairs, err := RepairEPUB(in)
+	if err != nil {
+		t.Fatalf("RepairEPUB: %v", err)
+	}
+	if got := repairCodes(repairs); got != "MANIFEST_ITEM_DROPPED SPINE_ITEM_DROPPED XHTML_RESERIALIZED" {
+		t.Errorf("repairs = %q: %v", got, repairs)
+	}
+	if r := CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("the repaired book should check clean:\n%s", r)
+	}
+	doc := string(readEntry(t, out, "OEBPS/Text/01.xhtml"))
+	for _, want := range []string{"<title>One</title>", "Sand &amp; spice<br/>", `<a href="notes.xhtml#n1">1</a>`} {
+		if !strings.Contains(doc, want) {
+			t.Errorf("repaired chapter is missing %s:\n%s", want, doc)
+		}
+	}
+	if opf := readEntry(t, out, "OEBPS/content.opf"); bytes.Contains(opf, []byte("gone.jpg")) || bytes.Contains(opf, []byte(`"nope"`)) {
+		t.Errorf("dangling references should be gone:\n%s", opf)
+	}
+}
+
+func TestRepairEPUB_Mimetype(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/toc.ncx", "OEBPS/Text/01.xhtml", "OEBPS/Text/notes.xhtml", "mimetype"} {
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+		w.Write(readEntry(t, checkedEPUB(t, nil), name))
+	}
+	zw.Close()
+
+	out, repairs, err := RepairEPUB(buf.Bytes())
+	if err != nil || repairCodes(repairs) != "MIMETYPE_FIXED" {
+		t.Fatalf("repairs = %v, %v", repairs, err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Error("mimetype must end up the first, stored entry")
+	}
+
+	wrong := checkedEPUB(t, map[string]string{"mimetype": "application/epub+zip\n"})
+	if out, repairs, _ := RepairEPUB(wrong); len(repairs) != 1 || string(readEntry(t, out, "mimetype")) != "application/epub+zip" {
+		t.Errorf("a trailing newline should be fixed: %v", repairs)
+	}
+}
+
+func TestRepairEPUB_GeneratesNav(t *testing.T) {
+	opf := strings.NewReplacer(`version="2.0"`, `version="3.0"`).
+		Replace(string(readEntry(t, checkedEPUB(t, nil), "OEBPS/content.opf")))
+	out, repairs, err := RepairEPUB(checkedEPUB(t, map[string]string{"OEBPS/content.opf": opf}))
+	if err != nil || repairCodes(repairs) != "NAV_GENERATED" {
+		t.Fatalf("repairs = %v, %v", repairs, err)
+	}
+	if !strings.Contains(repairs[0].Message, "the NCX") {
+		t.Errorf("the nav should be built from the existing NCX: %s", repairs[0])
+	}
+	if r := CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("the repaired book should check clean:\n%s", r)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toc := parseNav(book, "OEBPS/nav.xhtml"); len(toc) != 2 || toc[1].Path != "OEBPS/Text/notes.xhtml" || toc[1].Fragment != "n1" {
+		t.Errorf("nav toc = %+v", toc)
+	}
+}
+
+func TestRepairEPUB_GeneratesNCXFromHeadings(t *testing.T) {
+	opf := strings.NewReplacer(
+		`<spine toc="ncx">`, `<spine>`,
+		`    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>`+"\n", "",
+	).Replace(string(readEntry(t, checkedEPUB(t, nil), "OEBPS/content.opf")))
+	in := makeZip(t, map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": validEPUBEntries()["META-INF/container.xml"],
+		"OEBPS/content.opf":      opf,
+		"OEBPS/Text/01.xhtml":    `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1>Chapter <em>One</em></h1></body></html>`,
+		"OEBPS/Text/notes.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h2>Notes</h2></body></html>`,
+	})
+	out, repairs, err := RepairEPUB(in)
+	if err != nil || repairCodes(repairs) != "NCX_GENERATED" || !strings.Contains(repairs[0].Message, "headings") {
+		t.Fatalf("repairs = %v, %v", repairs, err)
+	}
+	if r := CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("the repaired book should check clean:\n%s", r)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toc := parseNCX(book, "OEBPS/toc.ncx")
+	if len(toc) != 2 || toc[0].Label != "Chapter One" || toc[1].Label != "Notes" {
+		t.Errorf("NCX toc = %+v", toc)
+	}
+	if !bytes.Contains(book.opf(), []byte(`<spine toc="ncx">`)) || !bytes.Contains(readEntry(t, out, "OEBPS/toc.ncx"), []byte(`content="urn:uuid:1234"`)) {
+		t.Errorf("the spine should name the NCX, which carries the book's uid:\n%s", book.opf())
+	}
+}
@@ -0,0 +1,268 @@
+package anna
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Scanned-illustration EPUBs often carry 3000px, quality-95 JPEGs and a full
+// set of embedded fonts the stylesheet never uses. ShrinkEPUB trades that for
+// size when a book doesn't fit the email limit: it strips unused fonts, then
+// re-encodes raster images at progressively smaller sizes and lower quality
+// until the book fits (or it runs out of steps).
+
+// ShrinkReport describes what ShrinkEPUB did.
+type ShrinkReport struct {
+	Before int64 `json:"before_bytes"`
+	After  int64 `json:"after_bytes"`
+	// ImagesRecompressed counts images replaced by a smaller re-encoding.
+	ImagesRecompressed int `json:"images_recompressed"`
+	// MaxImageDim is the longest image side allowed by the final step, 0 if
+	// images were left at their original size.
+	MaxImageDim  int      `json:"max_image_dim,omitempty"`
+	FontsRemoved []string `json:"fonts_removed,omitempty"`
+}
+
+func (r ShrinkReport) String() string {
+	s := fmt.Sprintf("%.2f MB to %.2f MB", float64(r.Before)/mb, float64(r.After)/mb)
+	var notes []string
+	if r.ImagesRecompressed > 0 {
+		notes = append(notes, fmt.Sprintf("%d images recompressed", r.ImagesRecompressed))
+	}
+	if n := len(r.FontsRemoved); n > 0 {
+		notes = append(notes, fmt.Sprintf("%d unused fonts removed", n))
+	}
+	if len(notes) > 0 {
+		s += " (" + strings.Join(notes, ", ") + ")"
+	}
+	return s
+}
+
+// shrinkSteps are tried in order until the book fits. The first step is
+// lossless: unused fonts and maximum zip compression only.
+var shrinkSteps = []struct {
+	maxDim  int
+	quality int
+}{
+	{0, 0},
+	{1600, 80},
+	{1200, 70},
+	{1000, 60},
+	{800, 50},
+}
+
+// ShrinkEPUB makes data smaller than target if it can. It always returns
+// the smallest result it produced along with a report; callers compare
+// report.After with their limit. The original is returned unchanged when
+// nothing helped.
+func ShrinkEPUB(data []byte, target int64) ([]byte, ShrinkReport, error) {
+	report := ShrinkReport{Before: int64(len(data)), After: int64(len(data))}
+	book, err := parseEPUB(data)
+	if err != nil {
+		return data, report, err
+	}
+	report.FontsRemoved, err = stripUnusedFonts(book)
+	if err != nil {
+		return data, report, err
+	}
+	originals := map[string][]byte{}
+	for _, e := range book.entries {
+		originals[e.Name] = e.Data
+	}
+
+	best := data
+	for _, step := range shrinkSteps {
+		recompressed := 0
+		if step.maxDim > 0 {
+			for _, e := range book.entries {
+				orig := originals[e.Name]
+				e.Data = orig
+				if out, ok := recompressImage(e.Name, orig, step.maxDim, step.quality); ok {
+					e.Data = out
+					recompressed++
+				}
+			}
+		}
+		out, err := book.bytes(flate.BestCompression)
+		if err != nil {
+			return data, report, fmt.Errorf("repack EPUB: %w", err)
+		}
+		if len(out) < len(best) {
+			best = out
+			report.After = int64(len(out))
+			report.ImagesRecompressed = recompressed
+			report.MaxImageDim = step.maxDim
+		}
+		if int64(len(best)) <= target {
+			break
+		}
+	}
+	if len(best) == len(data) {
+		report.FontsRemoved = nil // the repack didn't win, so nothing was removed
+	}
+	return best, report, nil
+}
+
+// maxDecodePixels bounds the size of an image we decode, so a small file
+// whose header claims 30000x30000 can't make us allocate gigabytes on a Pi.
+// Real illustrations and scans are well under it.
+const maxDecodePixels = 36 << 20
+
+// recompressImage re-encodes a JPEG or PNG no larger than maxDim on its long
+// side, returning the result only if it is smaller than the original. GIFs
+// (possibly animated), SVGs and images over maxDecodePixels are left alone.
+func recompressImage(name string, data []byte, maxDim, quality int) ([]byte, bool) {
+	var isJPEG bool
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg":
+		isJPEG = true
+	case ".png":
+	default:
+		return nil, false
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height > maxDecodePixels {
+		return nil, false
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	img = downscale(img, maxDim)
+
+	var buf bytes.Buffer
+	if isJPEG {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil || buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+var (
+	fontFaceRe    = regexp.MustCompile(`(?is)@font-face\s*\{[^}]*\}`)
+	fontFamilyRe  = regexp.MustCompile(`(?i)font-family\s*:\s*([^;}]+)`)
+	cssURLRe      = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+	fontExtension = map[string]bool{".ttf": true, ".otf": true, ".woff": true, ".woff2": true}
+)
+
+func isFontItem(it opfItem) bool {
+	mt := strings.ToLower(it.MediaType)
+	return strings.HasPrefix(mt, "font/") || strings.Contains(mt, "font-") ||
+		strings.Contains(mt, "opentype") || strings.Contains(mt, "truetype") ||
+		fontExtension[strings.ToLower(path.Ext(it.Href))]
+}
+
+// stripUnusedFonts removes embedded fonts that no style uses: a font is kept
+// if an @font-face whose family appears in the book's styles points at it, or
+// if anything outside @font-face rules mentions its file name. The matching
+// is deliberately loose — keeping an unused font only costs bytes, dropping a
+// used one changes how the book looks.
+func stripUnusedFonts(book *epubBook) ([]string, error) {
+	var fonts []opfItem
+	for _, it := range book.pkg.Manifest {
+		if isFontItem(it) {
+			fonts = append(fonts, it)
+		}
+	}
+	if len(fonts) == 0 {
+		return nil, nil
+	}
+
+	type fontFace struct {
+		file   string // entry holding the rule
+		rule   string
+		family string
+		srcs   []string
+	}
+	var faces []fontFace
+	var rest strings.Builder // every style/markup text outside @font-face rules
+	for _, e := range book.entries {
+		ext := strings.ToLower(path.Ext(e.Name))
+		if ext != ".css" && ext != ".xhtml" && ext != ".html" && ext != ".htm" {
+			continue // styles and markup only: the OPF lists every font, which is not a use
+		}
+		text := string(e.Data)
+		for _, rule := range fontFaceRe.FindAllString(text, -1) {
+			f := fontFace{file: e.Name, rule: rule}
+			if m := fontFamilyRe.FindStringSubmatch(rule); m != nil {
+				f.family = normalizeFontFamily(m[1])
+			}
+			for _, u := range cssURLRe.FindAllStringSubmatch(rule, -1) {
+				f.srcs = append(f.srcs, resolveHref(e.Name, u[1]))
+			}
+			faces = append(faces, f)
+		}
+		rest.WriteString(strings.ToLower(fontFaceRe.ReplaceAllString(text, "")))
+		rest.WriteByte('\n')
+	}
+	other := rest.String()
+
+	used := map[string]bool{}
+	for _, f := range faces {
+		if f.family != "" && strings.Contains(other, f.family) {
+			for _, s := range f.srcs {
+				used[s] = true
+			}
+		}
+	}
+
+	var removed []string
+	removedSet := map[string]bool{}
+	opf := book.opf()
+	for _, it := range fonts {
+		p := book.itemPath(it)
+		if used[p] || strings.Contains(other, strings.ToLower(path.Base(p))) {
+			continue
+		}
+		book.removeEntry(p)
+		opf = removeManifestItem(opf, it.ID)
+		removed = append(removed, p)
+		removedSet[p] = true
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if err := book.setOPF(opf); err != nil {
+		return nil, err
+	}
+
+	// Drop @font-face rules left pointing only at removed files.
+	for _, f := range faces {
+		if len(f.srcs) == 0 {
+			continue
+		}
+		dead := true
+		for _, s := range f.srcs {
+			if !removedSet[s] {
+				dead = false
+			}
+		}
+		if e := book.file(f.file); dead && e != nil {
+			e.Data = bytes.Replace(e.Data, []byte(f.rule), nil, 1)
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// normalizeFontFamily lowercases a font-family value and drops its quotes,
+// keeping only the first family in a list.
+func normalizeFontFamily(v string) string {
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	v = strings.TrimSpace(strings.ReplaceAll(v, "!important", ""))
+	return strings.ToLower(strings.Trim(v, `"' `))
+}
@@ -0,0 +1,163 @@
+package anna
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// noisyJPEG returns a w×h quality-95 JPEG of random noise — the worst case
+// for compression, like a high-resolution scan.
+func noisyJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("encode jpeg: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// illustratedEPUB is a valid EPUB with one big scan, a font the stylesheet
+// uses and one it doesn't.
+func illustratedEPUB(t *testing.T) []byte {
+	t.Helper()
+	opf := opfFixture{
+		Metadata: `    <dc:identifier id="uid">x</dc:identifier>
+    <dc:title>Atlas</dc:title>
+`,
+		Manifest: fixtureChapterItem + `    <item id="css" href="Styles/style.css" media-type="text/css"/>
+    <item id="scan" href="Images/scan.jpg" media-type="image/jpeg"/>
+    <item id="body-font" href="Fonts/Body%20Serif.ttf" media-type="application/x-font-ttf"/>
+    <item id="fancy-font" href="Fonts/Fancy.otf" media-type="font/otf"/>
+`,
+	}
+	entries := map[string]string{}
+	entries["OEBPS/Styles/style.css"] = `@font-face { font-family: "Body Serif"; src: url("../Fonts/Body%20Serif.ttf"); }
+@font-face { font-family: 'Fancy'; src: url(../Fonts/Fancy.otf); }
+body { font-family: "Body Serif", serif; }`
+	entries["OEBPS/Text/01.xhtml"] = `<html><head><link rel="stylesheet" href="../Styles/style.css"/></head><body><img src="../Images/scan.jpg"/></body></html>`
+	entries["OEBPS/Images/scan.jpg"] = string(noisyJPEG(t, 2400, 1600))
+	entries["OEBPS/Fonts/Body Serif.ttf"] = strings.Repeat("body-font-glyphs", 4096)
+	entries["OEBPS/Fonts/Fancy.otf"] = strings.Repeat("fancy-font-glyph", 4096)
+	return fixtureEPUB(t, opf, entries)
+}
+
+func TestShrinkEPUB_RecompressesImagesAndDropsUnusedFonts(t *testing.T) {
+	data := illustratedEPUB(t)
+	target := int64(len(data)) / 4
+
+	out, report, err := ShrinkEPUB(data, target)
+	if err != nil {
+		t.Fatalf("ShrinkEPUB: %v", err)
+	}
+	if report.Before != int64(len(data)) || report.After != int64(len(out)) {
+		t.Errorf("report sizes %d -> %d don't match %d -> %d", report.Before, report.After, len(data), len(out))
+	}
+	if report.After > target {
+		t.Fatalf("expected the book to fit %d bytes, got %s", target, report)
+	}
+	if report.ImagesRecompressed != 1 || report.MaxImageDim == 0 {
+		t.Errorf("expected the scan to be downscaled, got %+v", report)
+	}
+	if len(report.FontsRemoved) != 1 || report.FontsRemoved[0] != "OEBPS/Fonts/Fancy.otf" {
+		t.Errorf("expected only the unused font to go, got %v", report.FontsRemoved)
+	}
+	if !strings.Contains(report.String(), "1 images recompressed, 1 unused fonts removed") {
+		t.Errorf("unexpected report text %q", report)
+	}
+
+	if err := ValidateEPUB(out); err != nil {
+		t.Fatalf("shrunk EPUB no longer validates: %v", err)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatalf("reparse: %v", err)
+	}
+	if book.file("OEBPS/Fonts/Fancy.otf") != nil || strings.Contains(string(book.opf()), "fancy-font") {
+		t.Error("unused font should be gone from the zip and the manifest")
+	}
+	if book.file("OEBPS/Fonts/Body Serif.ttf") == nil {
+		t.Error("used font must be kept")
+	}
+	css := string(book.file("OEBPS/Styles/style.css").Data)
+	if strings.Contains(css, "Fancy") || !strings.Contains(css, "Body Serif") {
+		t.Errorf("only the dead @font-face rule should be removed:\n%s", css)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(book.file("OEBPS/Images/scan.jpg").Data))
+	if err != nil {
+		t.Fatalf("decode shrunk image: %v", err)
+	}
+	if cfg.Width != report.MaxImageDim || cfg.Height != report.MaxImageDim*2/3 {
+		t.Errorf("expected the scan scaled to %d px wide keeping its aspect, got %dx%d", report.MaxImageDim, cfg.Width, cfg.Height)
+	}
+}
+
+func TestShrinkEPUB_StopsAtFirstStepThatFits(t *testing.T) {
+	data := illustratedEPUB(t)
+	out, report, err := ShrinkEPUB(data, int64(len(data)))
+	if err != nil {
+		t.Fatalf("ShrinkEPUB: %v", err)
+	}
+	if report.ImagesRecompressed != 0 || report.MaxImageDim != 0 {
+		t.Errorf("a lossless repack already fits; images should be untouched, got %+v", report)
+	}
+	if len(out) > len(data) {
+		t.Error("the result must never be larger than the input")
+	}
+}
+
+func TestShrinkEPUB_RejectsNonEPUB(t *testing.T) {
+	data := []byte("%PDF-1.4")
+	out, _, err := ShrinkEPUB(data, 1)
+	if err == nil || !bytes.Equal(out, data) {
+		t.Fatalf("expected an error and the input back, got %v", err)
+	}
+}
+
+func TestDownscale_KeepsAspectAndGray(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 300, 1200))
+	for i := range gray.Pix {
+		gray.Pix[i] = 200
+	}
+	got := downscale(gray, 400)
+	g, ok := got.(*image.Gray)
+	if !ok {
+		t.Fatalf("grayscale input should stay *image.Gray, got %T", got)
+	}
+	if b := g.Bounds(); b.Dx() != 100 || b.Dy() != 400 {
+		t.Errorf("expected 100x400, got %v", b)
+	}
+	if g.GrayAt(50, 200).Y != 200 {
+		t.Errorf("box filter should preserve a flat tone, got %d", g.GrayAt(50, 200).Y)
+	}
+	if downscale(gray, 2000) != image.Image(gray) {
+		t.Error("images within maxDim should be returned untouched")
+	}
+}
+
+func TestRecompressImage_SkipsHugeDimensions(t *testing.T) {
+	// A tiny PNG whose header claims 30000x30000 pixels.
+	data := tinyPNG(t)
+	binary.BigEndian.PutUint32(data[16:], 30000)
+	binary.BigEndian.PutUint32(data[20:], 30000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || cfg.Width != 30000 {
+		t.Fatalf("fixture header: %+v, %v", cfg, err)
+	}
+	if out, ok := recompressImage("OEBPS/huge.png", data, 1200, 60); ok || out != nil {
+		t.Error("an image over maxDecodePixels must not be decoded")
+	}
+}
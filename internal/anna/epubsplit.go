@@ -0,0 +1,618 @@
+package anna
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Omnibus editions can stay over the email limit even after ShrinkEPUB. As a
+// last resort SplitEPUB cuts such a book into volumes — "Title (Part 1 of 3)"
+// — along its spine, preferring chapter starts from the table of contents.
+// Each volume is a complete EPUB: it carries only the documents of its part
+// and the resources they reference, a regenerated NCX/nav covering its own
+// chapters, and a distinct identifier so the Kindle library doesn't merge
+// the volumes into one book.
+
+// ErrCannotSplit is returned when a book can't be cut into volumes under the
+// limit (e.g. a single chapter is bigger than the limit by itself).
+var ErrCannotSplit = errors.New("EPUB cannot be split under the size limit")
+
+// maxSplitParts keeps a pathological book from turning into a mail storm.
+const maxSplitParts = 20
+
+// tocEntry is one table-of-contents link: a label and its target zip path
+// plus fragment.
+type tocEntry struct {
+	Label    string
+	Path     string
+	Fragment string
+}
+
+// xhtmlDoc is one XHTML document of a book being built, at its zip path.
+type xhtmlDoc struct {
+	path string
+	data []byte
+}
+
+var headingRe = regexp.MustCompile(`(?is)<h[1-3]\b[^>]*>(.*?)</h[1-3]>`)
+
+// headingTOC is the fallback table of contents: each document's first
+// heading, or just the title when there are none.
+func headingTOC(title string, docs []xhtmlDoc) []tocEntry {
+	var toc []tocEntry
+	for _, d := range docs {
+		if m := headingRe.FindSubmatch(d.data); m != nil {
+			label := strings.Join(strings.Fields(xmlUnescape(tagRe.ReplaceAllString(string(m[1]), ""))), " ")
+			if label != "" {
+				toc = append(toc, tocEntry{Label: label, Path: d.path})
+			}
+		}
+	}
+	if len(toc) == 0 {
+		toc = []tocEntry{{Label: title, Path: docs[0].path}}
+	}
+	return toc
+}
+
+// SplitEPUB cuts data into volumes of at most limit bytes each. It returns a
+// single element when the book fits once rebuilt.
+func SplitEPUB(data []byte, limit int64) ([][]byte, error) {
+	book, err := parseEPUB(data)
+	if err != nil {
+		return nil, err
+	}
+	s := newSplitter(book)
+	if len(s.docs) == 0 {
+		return nil, fmt.Errorf("%w: the spine is empty", ErrCannotSplit)
+	}
+
+	// Packing works on compressed-size estimates; if a built volume still
+	// comes out too big, tighten the budget and pack again.
+	budget := limit
+	for attempt := 0; attempt < 6; attempt++ {
+		parts, err := s.pack(budget)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) > maxSplitParts {
+			return nil, fmt.Errorf("%w: it would take %d volumes (max %d)", ErrCannotSplit, len(parts), maxSplitParts)
+		}
+		out := make([][]byte, len(parts))
+		fits := true
+		for i, docs := range parts {
+			vol, err := s.build(docs, i+1, len(parts))
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(vol)) > limit {
+				fits = false
+				break
+			}
+			out[i] = vol
+		}
+		if fits {
+			return out, nil
+		}
+		budget = budget * 9 / 10
+	}
+	return nil, fmt.Errorf("%w: volumes keep coming out over %.2f MB", ErrCannotSplit, float64(limit)/mb)
+}
+
+type splitter struct {
+	book  *epubBook
+	docs  []string          // spine documents in reading order (zip paths)
+	ids   map[string]string // zip path -> manifest id
+	toc   []tocEntry
+	base  map[string]bool // paths every volume carries (nav, NCX, cover)
+	deps  map[string][]string
+	costs map[string]int64
+}
+
+func newSplitter(book *epubBook) *splitter {
+	s := &splitter{
+		book:  book,
+		ids:   map[string]string{},
+		base:  map[string]bool{},
+		deps:  map[string][]string{},
+		costs: map[string]int64{},
+	}
+	for _, it := range book.pkg.Manifest {
+		s.ids[book.itemPath(it)] = it.ID
+	}
+	navPath, ncxPath := s.tocPaths()
+	for _, ref := range book.pkg.Spine.ItemRefs {
+		it, ok := book.itemByID(ref.IDRef)
+		if !ok {
+			continue
+		}
+		if p := book.itemPath(it); p != navPath {
+			s.docs = append(s.docs, p)
+		}
+	}
+	if ncxPath != "" {
+		s.base[ncxPath] = true
+		s.toc = parseNCX(book, ncxPath)
+	}
+	if navPath != "" {
+		s.base[navPath] = true
+		if len(s.toc) == 0 {
+			s.toc = parseNav(book, navPath)
+		}
+	}
+	if cover := coverImagePath(book); cover != "" {
+		s.base[cover] = true
+	}
+	return s
+}
+
+// tocPaths returns the zip paths of the EPUB 3 nav document and the NCX.
+func (s *splitter) tocPaths() (nav, ncx string) {
+	for _, it := range s.book.pkg.Manifest {
+		if hasProperty(it.Properties, "nav") {
+			nav = s.book.itemPath(it)
+		}
+		if it.MediaType == "application/x-dtbncx+xml" || (s.book.pkg.Spine.Toc != "" && it.ID == s.book.pkg.Spine.Toc) {
+			ncx = s.book.itemPath(it)
+		}
+	}
+	return nav, ncx
+}
+
+func hasProperty(props, want string) bool {
+	for _, p := range strings.Fields(props) {
+		if p == want {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	metaCoverRe = regexp.MustCompile(`(?i)<meta\b[^>]*\bname\s*=\s*["']cover["'][^>]*\bcontent\s*=\s*["']([^"']+)["']|<meta\b[^>]*\bcontent\s*=\s*["']([^"']+)["'][^>]*\bname\s*=\s*["']cover["']`)
+	refAttrRe   = regexp.MustCompile(`(?i)\b(?:src|href|xlink:href|poster|data)\s*=\s*["']([^"']+)["']`)
+)
+
+// coverImagePath finds the cover image (EPUB 3 cover-image property, or the
+// EPUB 2 <meta name="cover">).
+func coverImagePath(book *epubBook) string {
+	for _, it := range book.pkg.Manifest {
+		if hasProperty(it.Properties, "cover-image") {
+			return book.itemPath(it)
+		}
+	}
+	if m := metaCoverRe.FindSubmatch(book.opf()); m != nil {
+		id := string(m[1])
+		if id == "" {
+			id = string(m[2])
+		}
+		if it, ok := book.itemByID(id); ok {
+			return book.itemPath(it)
+		}
+	}
+	return ""
+}
+
+// references lists the manifest resources a document or stylesheet points
+// at directly.
+func (s *splitter) references(p string) []string {
+	if refs, ok := s.deps[p]; ok {
+		return refs
+	}
+	var refs []string
+	s.deps[p] = refs // guards against reference cycles
+	e := s.book.file(p)
+	if e == nil {
+		return nil
+	}
+	var targets []string
+	switch strings.ToLower(path.Ext(p)) {
+	case ".css":
+		for _, m := range cssURLRe.FindAllStringSubmatch(string(e.Data), -1) {
+			targets = append(targets, m[1])
+		}
+	case ".xhtml", ".html", ".htm", ".svg", ".xml":
+		for _, m := range refAttrRe.FindAllStringSubmatch(string(e.Data), -1) {
+			targets = append(targets, m[1])
+		}
+		for _, m := range cssURLRe.FindAllStringSubmatch(string(e.Data), -1) {
+			targets = append(targets, m[1])
+		}
+	}
+	for _, t := range targets {
+		if strings.Contains(t, ":") {
+			continue // absolute URL, data: URI, ...
+		}
+		if r := resolveHref(p, t); s.ids[r] != "" && r != p {
+			refs = append(refs, r)
+		}
+	}
+	s.deps[p] = refs
+	return refs
+}
+
+// closure adds p and every resource it (transitively) needs to set, except
+// other spine documents, which belong to their own part.
+func (s *splitter) closure(p string, set map[string]bool, spine map[string]bool) {
+	if set[p] {
+		return
+	}
+	set[p] = true
+	for _, r := range s.references(p) {
+		if !spine[r] {
+			s.closure(r, set, spine)
+		}
+	}
+}
+
+// cost estimates an entry's compressed size inside the zip.
+func (s *splitter) cost(p string) int64 {
+	if c, ok := s.costs[p]; ok {
+		return c
+	}
+	var c int64 = 128 + 2*int64(len(p)) // local header + central directory
+	if e := s.book.file(p); e != nil {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestCompression)
+		w.Write(e.Data)
+		w.Close()
+		c += int64(buf.Len())
+	}
+	s.costs[p] = c
+	return c
+}
+
+// chunks groups spine documents into runs that each start at a TOC target,
+// the preferred places to cut.
+func (s *splitter) chunks() [][]string {
+	starts := map[string]bool{}
+	for _, t := range s.toc {
+		starts[t.Path] = true
+	}
+	var out [][]string
+	for i, d := range s.docs {
+		if i == 0 || starts[d] {
+			out = append(out, nil)
+		}
+		out[len(out)-1] = append(out[len(out)-1], d)
+	}
+	return out
+}
+
+// pack assigns spine documents to parts whose estimated size stays within
+// budget, cutting at chapter boundaries and falling back to single documents
+// for chapters too big on their own.
+func (s *splitter) pack(budget int64) ([][]string, error) {
+	spine := map[string]bool{}
+	for _, d := range s.docs {
+		spine[d] = true
+	}
+	fixed := map[string]bool{"mimetype": true, "META-INF/container.xml": true, s.book.opfPath: true}
+	for p := range s.base {
+		s.closure(p, fixed, spine)
+	}
+	var baseCost int64
+	for p := range fixed {
+		baseCost += s.cost(p)
+	}
+
+	var parts [][]string
+	var cur []string
+	set := map[string]bool{}
+	size := baseCost
+	added := func(docs []string) (map[string]bool, int64) {
+		extra := map[string]bool{}
+		var c int64
+		for _, d := range docs {
+			need := map[string]bool{}
+			s.closure(d, need, spine)
+			for p := range need {
+				if !fixed[p] && !set[p] && !extra[p] {
+					extra[p] = true
+					c += s.cost(p)
+				}
+			}
+		}
+		return extra, c
+	}
+	flush := func() {
+		if len(cur) > 0 {
+			parts = append(parts, cur)
+		}
+		cur, set, size = nil, map[string]bool{}, baseCost
+	}
+	var place func(docs []string) error
+	place = func(docs []string) error {
+		extra, c := added(docs)
+		if size+c <= budget {
+			cur = append(cur, docs...)
+			for p := range extra {
+				set[p] = true
+			}
+			size += c
+			return nil
+		}
+		if len(cur) > 0 {
+			flush()
+			return place(docs)
+		}
+		if len(docs) == 1 {
+			return fmt.Errorf("%w: %s alone is about %.2f MB", ErrCannotSplit, docs[0], float64(baseCost+c)/mb)
+		}
+		for _, d := range docs {
+			if err := place([]string{d}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, ch := range s.chunks() {
+		if err := place(ch); err != nil {
+			return nil, err
+		}
+	}
+	flush()
+	return parts, nil
+}
+
+// build writes volume n of total containing docs.
+func (s *splitter) build(docs []string, n, total int) ([]byte, error) {
+	src := s.book
+	vol := &epubBook{opfPath: src.opfPath, pkg: src.pkg}
+	for _, e := range src.entries {
+		vol.entries = append(vol.entries, &epubEntry{Name: e.Name, Data: e.Data})
+	}
+	if total == 1 {
+		return vol.bytes(flate.BestCompression)
+	}
+
+	spine := map[string]bool{}
+	for _, d := range s.docs {
+		spine[d] = true
+	}
+	keep := map[string]bool{}
+	for p := range s.base {
+		s.closure(p, keep, spine)
+	}
+	for _, d := range docs {
+		s.closure(d, keep, spine)
+	}
+
+	opf := vol.opf()
+	for _, it := range src.pkg.Manifest {
+		p := src.itemPath(it)
+		if keep[p] {
+			continue
+		}
+		opf = removeManifestItem(opf, it.ID)
+		opf = removeSpineItemRef(opf, it.ID)
+		opf = removeGuideReference(opf, it.Href)
+		vol.removeEntry(p)
+	}
+	title := src.title()
+	if title == "" {
+		title = "Untitled"
+	}
+	volTitle := fmt.Sprintf("%s (Part %d of %d)", title, n, total)
+	opf = setOPFElementText(opf, "title", volTitle)
+	opf = appendOPFIdentifier(opf, fmt.Sprintf("-part-%d", n))
+	if err := vol.setOPF(opf); err != nil {
+		return nil, fmt.Errorf("volume %d: %w", n, err)
+	}
+
+	toc := s.volumeTOC(docs, volTitle)
+	navPath, ncxPath := s.tocPaths()
+	if ncxPath != "" {
+		if e := vol.file(ncxPath); e != nil {
+			e.Data = buildNCX(ncxPath, volTitle, fmt.Sprintf("part-%d", n), toc)
+		}
+	}
+	if navPath != "" {
+		if e := vol.file(navPath); e != nil {
+			e.Data = buildNav(navPath, volTitle, toc)
+		}
+	}
+	return vol.bytes(flate.BestCompression)
+}
+
+// volumeTOC returns the TOC entries pointing into docs, led by an entry for
+// the volume's first document if the book's TOC has none there.
+func (s *splitter) volumeTOC(docs []string, volTitle string) []tocEntry {
+	in := map[string]bool{}
+	for _, d := range docs {
+		in[d] = true
+	}
+	var toc []tocEntry
+	for _, t := range s.toc {
+		if in[t.Path] {
+			toc = append(toc, t)
+		}
+	}
+	if len(toc) == 0 || toc[0].Path != docs[0] {
+		toc = append([]tocEntry{{Label: volTitle, Path: docs[0]}}, toc...)
+	}
+	return toc
+}
+
+// parseNCX flattens an NCX navMap into reading order.
+func parseNCX(book *epubBook, ncxPath string) []tocEntry {
+	e := book.file(ncxPath)
+	if e == nil {
+		return nil
+	}
+	type navPoint struct {
+		Label   string `xml:"navLabel>text"`
+		Content struct {
+			Src string `xml:"src,attr"`
+		} `xml:"content"`
+		Children []navPoint `xml:"navPoint"`
+	}
+	var doc struct {
+		Points []navPoint `xml:"navMap>navPoint"`
+	}
+	if err := xml.Unmarshal(e.Data, &doc); err != nil {
+		return nil
+	}
+	var out []tocEntry
+	var walk func([]navPoint)
+	walk = func(points []navPoint) {
+		for _, p := range points {
+			if p.Content.Src != "" {
+				out = append(out, newTOCEntry(ncxPath, p.Content.Src, p.Label))
+			}
+			walk(p.Children)
+		}
+	}
+	walk(doc.Points)
+	return out
+}
+
+var (
+	navTOCRe  = regexp.MustCompile(`(?is)<nav\b[^>]*\btoc\b[^>]*>(.*?)</nav>`)
+	navLinkRe = regexp.MustCompile(`(?is)<a\b[^>]*\bhref\s*=\s*["']([^"']+)["'][^>]*>(.*?)</a>`)
+	tagRe     = regexp.MustCompile(`<[^>]*>`)
+)
+
+// parseNav flattens the toc <nav> of an EPUB 3 navigation document.
+func parseNav(book *epubBook, navPath string) []tocEntry {
+	e := book.file(navPath)
+	if e == nil {
+		return nil
+	}
+	m := navTOCRe.FindSubmatch(e.Data)
+	if m == nil {
+		return nil
+	}
+	var out []tocEntry
+	for _, a := range navLinkRe.FindAllSubmatch(m[1], -1) {
+		label := strings.Join(strings.Fields(tagRe.ReplaceAllString(string(a[2]), "")), " ")
+		out = append(out, newTOCEntry(navPath, string(a[1]), xmlUnescape(label)))
+	}
+	return out
+}
+
+func newTOCEntry(from, href, label string) tocEntry {
+	t := tocEntry{Label: strings.TrimSpace(label), Path: resolveHref(from, href)}
+	if i := strings.IndexByte(href, '#'); i >= 0 {
+		t.Fragment = href[i+1:]
+	}
+	return t
+}
+
+func (t tocEntry) hrefFrom(from string) string {
+	h := relativeHref(from, t.Path)
+	if t.Fragment != "" {
+		h += "#" + t.Fragment
+	}
+	return h
+}
+
+func buildNCX(ncxPath, title, uid string, toc []tocEntry) []byte {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">` + "\n")
+	fmt.Fprintf(&b, "<head><meta name=\"dtb:uid\" content=\"%s\"/><meta name=\"dtb:depth\" content=\"1\"/></head>\n", xmlEscape(uid))
+	fmt.Fprintf(&b, "<docTitle><text>%s</text></docTitle>\n<navMap>\n", xmlEscape(title))
+	for i, t := range toc {
+		fmt.Fprintf(&b, "<navPoint id=\"np%d\" playOrder=\"%d\"><navLabel><text>%s</text></navLabel><content src=\"%s\"/></navPoint>\n",
+			i+1, i+1, xmlEscape(t.Label), xmlEscape(t.hrefFrom(ncxPath)))
+	}
+	b.WriteString("</navMap>\n</ncx>\n")
+	return []byte(b.String())
+}
+
+func buildNav(navPath, title string, toc []tocEntry) []byte {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<!DOCTYPE html>\n")
+	b.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">` + "\n")
+	fmt.Fprintf(&b, "<head><title>%s</title></head>\n<body>\n<nav epub:type=\"toc\" id=\"toc\">\n<h1>%s</h1>\n<ol>\n", xmlEscape(title), xmlEscape(title))
+	for _, t := range toc {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", xmlEscape(t.hrefFrom(navPath)), xmlEscape(t.Label))
+	}
+	b.WriteString("</ol>\n</nav>\n</body>\n</html>\n")
+	return []byte(b.String())
+}
+
+// removeSpineItemRef deletes the <itemref> for idref from OPF text.
+func removeSpineItemRef(opf []byte, idref string) []byte {
+	re := regexp.MustCompile(`(?s)[ \t]*<(?:opf:)?itemref\b[^>]*\bidref\s*=\s*["']` + regexp.QuoteMeta(idref) + `["'][^>]*?(?:/>|>\s*</(?:opf:)?itemref>)[ \t]*\r?\n?`)
+	return re.ReplaceAll(opf, nil)
+}
+
+// removeGuideReference deletes EPUB 2 <guide> references to href.
+func removeGuideReference(opf []byte, href string) []byte {
+	re := regexp.MustCompile(`(?s)[ \t]*<(?:opf:)?reference\b[^>]*\bhref\s*=\s*["']` + regexp.QuoteMeta(href) + `(?:#[^"']*)?["'][^>]*?(?:/>|>\s*</(?:opf:)?reference>)[ \t]*\r?\n?`)
+	return re.ReplaceAll(opf, nil)
+}
+
+// setOPFElementText replaces the text of the first dc:<name> element.
+func setOPFElementText(opf []byte, name, text string) []byte {
+	re := regexp.MustCompile(`(?s)(<dc:` + name + `\b[^>]*>).*?(</dc:` + name + `>)`)
+	loc := re.FindSubmatchIndex(opf)
+	if loc == nil {
+		return opf
+	}
+	var out bytes.Buffer
+	out.Write(opf[:loc[3]])
+	out.WriteString(xmlEscape(text))
+	out.Write(opf[loc[4]:])
+	return out.Bytes()
+}
+
+// appendOPFIdentifier adds suffix to the package's unique identifier.
+func appendOPFIdentifier(opf []byte, suffix string) []byte {
+	uid := regexp.MustCompile(`<package\b[^>]*\bunique-identifier\s*=\s*["']([^"']+)["']`).FindSubmatch(opf)
+	pattern := `(?s)(<dc:identifier\b[^>]*>)(.*?)(</dc:identifier>)`
+	if uid != nil {
+		pattern = `(?s)(<dc:identifier\b[^>]*\bid\s*=\s*["']` + regexp.QuoteMeta(string(uid[1])) + `["'][^>]*>)(.*?)(</dc:identifier>)`
+	}
+	loc := regexp.MustCompile(pattern).FindSubmatchIndex(opf)
+	if loc == nil {
+		return opf
+	}
+	var out bytes.Buffer
+	out.Write(opf[:loc[5]])
+	out.WriteString(xmlEscape(suffix))
+	out.Write(opf[loc[5]:])
+	return out.Bytes()
+}
+
+// relativeHref is the href from the document at fromPath to zip path to.
+func relativeHref(fromPath, to string) string {
+	from := strings.Split(path.Dir(fromPath), "/")
+	if from[0] == "." {
+		from = nil
+	}
+	parts := strings.Split(to, "/")
+	i := 0
+	for i < len(from) && i < len(parts)-1 && from[i] == parts[i] {
+		i++
+	}
+	rel := strings.Repeat("../", len(from)-i) + strings.Join(parts[i:], "/")
+	return hrefEscaper.Replace(rel)
+}
+
+// hrefEscaper escapes the characters resolveHref unescapes that commonly
+// appear in EPUB file names.
+var hrefEscaper = strings.NewReplacer("%", "%25", " ", "%20", "#", "%23")
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func xmlUnescape(s string) string {
+	var v struct {
+		Text string `xml:",chardata"`
+	}
+	if err := xml.Unmarshal([]byte("<x>"+s+"</x>"), &v); err != nil {
+		return s
+	}
+	return v.Text
+}
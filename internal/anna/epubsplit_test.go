@@ -0,0 +1,195 @@
+package anna
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// omnibusEPUB builds an EPUB 3 book with an NCX, a nav document, a cover and
+// six chapters, each with its own incompressible 200 KB illustration.
+// Chapter 4 is split over two files, only the first of which is in the TOC.
+func omnibusEPUB(t *testing.T) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(7))
+	noise := func(n int) string {
+		b := make([]byte, n)
+		rng.Read(b)
+		return string(b)
+	}
+	entries := validEPUBEntries()
+	delete(entries, "OEBPS/Text/01.xhtml")
+
+	var manifest, spine, navPoints, navLinks strings.Builder
+	for i := 1; i <= 7; i++ {
+		ch := fmt.Sprintf("ch%d", i)
+		fmt.Fprintf(&manifest, `<item id="%s" href="Text/%s.xhtml" media-type="application/xhtml+xml"/>`+"\n", ch, ch)
+		fmt.Fprintf(&manifest, `<item id="img%d" href="Images/%s.png" media-type="image/png"/>`+"\n", i, ch)
+		fmt.Fprintf(&spine, `<itemref idref="%s"/>`, ch)
+		entries["OEBPS/Text/"+ch+".xhtml"] = fmt.Sprintf(`<html xmlns="http://www.w3.org/1999/xhtml"><head><title>%s</title><link rel="stylesheet" href="../Styles/style.css"/></head><body><h1 id="top">%s</h1><img src="../Images/%s.png"/></body></html>`, ch, ch, ch)
+		entries["OEBPS/Images/"+ch+".png"] = noise(200 * 1024)
+		if i == 5 {
+			continue // the second half of chapter 4
+		}
+		fmt.Fprintf(&navPoints, `<navPoint id="n%d"><navLabel><text>Chapter %d &amp; more</text></navLabel><content src="Text/%s.xhtml#top"/></navPoint>`, i, i, ch)
+		fmt.Fprintf(&navLinks, `<li><a href="Text/%s.xhtml#top">Chapter %d &amp; more</a></li>`, ch, i)
+	}
+	entries["OEBPS/content.opf"] = `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:isbn:123</dc:identifier>
+    <dc:title>Omnibus</dc:title>
+    <meta name="cover" content="cover"/>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="css" href="Styles/style.css" media-type="text/css"/>
+    <item id="cover" href="Images/cover.jpg" media-type="image/jpeg"/>
+    <item id="orphan" href="Images/orphan.png" media-type="image/png"/>
+` + manifest.String() + `  </manifest>
+  <spine toc="ncx">` + spine.String() + `</spine>
+</package>`
+	entries["OEBPS/toc.ncx"] = `<?xml version="1.0"?><ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1"><navMap>` + navPoints.String() + `</navMap></ncx>`
+	entries["OEBPS/nav.xhtml"] = `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body><nav epub:type="toc"><ol>` + navLinks.String() + `</ol></nav></body></html>`
+	entries["OEBPS/Styles/style.css"] = `body { margin: 0 }`
+	entries["OEBPS/Images/cover.jpg"] = noise(20 * 1024)
+	entries["OEBPS/Images/orphan.png"] = noise(100 * 1024)
+	return makeZip(t, entries)
+}
+
+var uidRe = regexp.MustCompile(`<dc:identifier id="uid">([^<]*)<`)
+
+func TestSplitEPUB_VolumesAlongTOC(t *testing.T) {
+	data := omnibusEPUB(t)
+	const limit = 520 * 1024
+
+	parts, err := SplitEPUB(data, limit)
+	if err != nil {
+		t.Fatalf("SplitEPUB: %v", err)
+	}
+	if len(parts) != 4 {
+		t.Fatalf("expected 4 volumes, got %d", len(parts))
+	}
+
+	seen := map[string]int{}
+	ids := map[string]bool{}
+	for i, part := range parts {
+		n := i + 1
+		if int64(len(part)) > limit {
+			t.Errorf("volume %d is %d bytes, over the %d limit", n, len(part), limit)
+		}
+		if err := ValidateEPUB(part); err != nil {
+			t.Errorf("volume %d does not validate: %v", n, err)
+		}
+		book, err := parseEPUB(part)
+		if err != nil {
+			t.Fatalf("volume %d: %v", n, err)
+		}
+		if want := fmt.Sprintf("Omnibus (Part %d of 4)", n); book.title() != want {
+			t.Errorf("volume %d title = %q, want %q", n, book.title(), want)
+		}
+		id := string(uidRe.FindSubmatch(book.opf())[1])
+		if ids[id] {
+			t.Errorf("volume %d reuses identifier %q", n, id)
+		}
+		ids[id] = true
+		if book.file("OEBPS/Images/cover.jpg") == nil {
+			t.Errorf("volume %d is missing the cover", n)
+		}
+		if book.file("OEBPS/Images/orphan.png") != nil {
+			t.Errorf("volume %d carries an unreferenced image", n)
+		}
+		for _, ref := range book.pkg.Spine.ItemRefs {
+			it, ok := book.itemByID(ref.IDRef)
+			if !ok {
+				t.Fatalf("volume %d spine references missing item %q", n, ref.IDRef)
+			}
+			seen[it.ID]++
+			img := "OEBPS/Images/" + it.ID + ".png"
+			if book.file(img) == nil {
+				t.Errorf("volume %d lacks %s used by %s", n, img, it.ID)
+			}
+		}
+		for _, e := range parseNCX(book, "OEBPS/toc.ncx") {
+			if book.file(e.Path) == nil {
+				t.Errorf("volume %d NCX points at missing %s", n, e.Path)
+			}
+		}
+		nav := parseNav(book, "OEBPS/nav.xhtml")
+		if len(nav) == 0 || book.file(nav[0].Path) == nil {
+			t.Errorf("volume %d nav is empty or broken: %+v", n, nav)
+		}
+		if !strings.Contains(string(book.file("OEBPS/nav.xhtml").Data), "&amp; more") {
+			t.Errorf("volume %d nav lost the escaped labels", n)
+		}
+	}
+	for i := 1; i <= 7; i++ {
+		if c := seen[fmt.Sprintf("ch%d", i)]; c != 1 {
+			t.Errorf("chapter %d appears in %d volumes", i, c)
+		}
+	}
+	// Chapter 4 spans ch4 and ch5; the cut must not fall between them.
+	for _, part := range parts {
+		book, _ := parseEPUB(part)
+		has4, has5 := book.file("OEBPS/Text/ch4.xhtml") != nil, book.file("OEBPS/Text/ch5.xhtml") != nil
+		if has4 != has5 {
+			t.Error("the split cut chapter 4 in half despite a TOC boundary being available")
+		}
+	}
+}
+
+func TestSplitEPUB_ChapterLargerThanLimit(t *testing.T) {
+	_, err := SplitEPUB(omnibusEPUB(t), 150*1024)
+	if err == nil || !strings.Contains(err.Error(), ErrCannotSplit.Error()) {
+		t.Fatalf("expected ErrCannotSplit, got %v", err)
+	}
+}
+
+func TestSendInVolumes_SendsEachPart(t *testing.T) {
+	srv := newFakeSMTP(t)
+	port := srv.start()
+	usePolicy(t, NewRecipientPolicy([]string{"@kindle.com"}, 20))
+	data := omnibusEPUB(t)
+	mail := MailConfig{Host: "127.0.0.1", Port: port, User: "u", Password: "pw", FromEmail: "reader@example.com", Security: SecurityPlain}
+	limit := int64(800 * 1024)
+
+	if err := sendInVolumes(&Book{Title: "Omnibus"}, data, limit, mail, Recipient{Email: "a@kindle.com"}, ""); err != nil {
+		t.Fatalf("sendInVolumes: %v", err)
+	}
+	sent := srv.sent()
+	if len(sent) < 2 {
+		t.Fatalf("expected several volumes, got %d messages", len(sent))
+	}
+	for i, m := range sent {
+		want := fmt.Sprintf("Omnibus (Part %d of %d)", i+1, len(sent))
+		if !strings.Contains(m.Data, want) {
+			t.Errorf("message %d is not %q", i+1, want)
+		}
+	}
+
+	usePolicy(t, NewRecipientPolicy([]string{"@kindle.com"}, 1))
+	err := sendInVolumes(&Book{Title: "Omnibus"}, data, limit, mail, Recipient{Email: "a@kindle.com"}, "")
+	if err == nil || !strings.Contains(err.Error(), "KINDLE_DAILY_SEND_LIMIT") {
+		t.Fatalf("expected the daily cap to stop a partial delivery, got %v", err)
+	}
+}
+
+func TestRelativeHref(t *testing.T) {
+	cases := map[[2]string]string{
+		{"OEBPS/toc.ncx", "OEBPS/Text/a b.xhtml"}:      "Text/a%20b.xhtml",
+		{"OEBPS/Text/nav.xhtml", "OEBPS/Text/1.xhtml"}: "1.xhtml",
+		{"OEBPS/Nav/nav.xhtml", "OEBPS/Text/1.xhtml"}:  "../Text/1.xhtml",
+		{"toc.ncx", "Text/1.xhtml"}:                    "Text/1.xhtml",
+	}
+	for in, want := range cases {
+		if got := relativeHref(in[0], in[1]); got != want {
+			t.Errorf("relativeHref(%q, %q) = %q, want %q", in[0], in[1], got, want)
+		}
+		if back := resolveHref(in[0], want); back != in[1] {
+			t.Errorf("resolveHref does not invert relativeHref for %q: %q", in[1], back)
+		}
+	}
+}
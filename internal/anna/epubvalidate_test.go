@@ -3,12 +3,13 @@ package anna
 import (
 	"archive/zip"
 	"bytes"
+	"cmp"
 	"strings"
 	"testing"
 )
 
 // makeZip builds a zip from name->content; mimetype (if present) is stored first.
-func makeZip(t *testing.T, entries map[string]string) []byte {
+func makeZip(t testing.TB, entries map[string]string) []byte {
 	t.Helper()
 	var buf bytes.Buffer
 	zw := zip.NewWriter(&buf)
@@ -41,6 +42,56 @@ func validEPUBEntries() map[string]string {
 	}
 }
 
+// opfFixture is a test book's package document. Empty fields take the
+// defaults: EPUB 2.0, an identifier and the title "Dune", and one chapter,
+// OEBPS/Text/01.xhtml, in the manifest and spine.
+type opfFixture struct {
+	Version  string
+	Metadata string // the <metadata> body
+	Manifest string // the <manifest> body
+	Spine    string // the <spine> body
+	TOC      string // the spine's toc attribute, for an NCX
+}
+
+const (
+	fixtureMetadata = `    <dc:identifier id="uid">urn:uuid:1234</dc:identifier>
+    <dc:title>Dune</dc:title>
+`
+	fixtureChapterItem = `    <item id="t" href="Text/01.xhtml" media-type="application/xhtml+xml"/>
+`
+	fixtureChapterRef = `    <itemref idref="t"/>
+`
+)
+
+func (o opfFixture) String() string {
+	version := cmp.Or(o.Version, "2.0")
+	spine := "<spine>"
+	if o.TOC != "" {
+		spine = `<spine toc="` + o.TOC + `">`
+	}
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="` + version + `" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+` + cmp.Or(o.Metadata, fixtureMetadata) + `  </metadata>
+  <manifest>
+` + cmp.Or(o.Manifest, fixtureChapterItem) + `  </manifest>
+  ` + spine + `
+` + cmp.Or(o.Spine, fixtureChapterRef) + `  </spine>
+</package>`
+}
+
+// fixtureEPUB is validEPUBEntries with opf as its package document and the
+// entries in extra replacing or adding to its files.
+func fixtureEPUB(t testing.TB, opf opfFixture, extra map[string]string) []byte {
+	t.Helper()
+	entries := validEPUBEntries()
+	entries["OEBPS/content.opf"] = opf.String()
+	for name, body := range extra {
+		entries[name] = body
+	}
+	return makeZip(t, entries)
+}
+
 func TestIsEPUBZip(t *testing.T) {
 	if !isEPUBZip(makeZip(t, validEPUBEntries())) {
 		t.Fatal("a real EPUB should be recognized as an EPUB zip")
@@ -0,0 +1,243 @@
+package anna
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an in-process SMTP server good enough to exercise SMTPSender:
+// EHLO, optional STARTTLS / implicit TLS, AUTH PLAIN / XOAUTH2, MAIL, RCPT,
+// DATA. Replies can be overridden per command to simulate failures.
+type fakeSMTP struct {
+	t        *testing.T
+	ln       net.Listener
+	tlsConf  *tls.Config
+	certPool *x509.CertPool
+
+	StartTLS    bool              // advertise STARTTLS
+	ImplicitTLS bool              // wrap the listener in TLS
+	Replies     map[string]string // e.g. "RCPT": "451 try later"
+	// AcceptAuth decides whether the decoded AUTH payload is accepted; nil
+	// accepts everything.
+	AcceptAuth func(mech string, payload []byte) bool
+
+	mu       sync.Mutex
+	messages []fakeMessage
+	authSeen []string
+	tlsSeen  bool
+}
+
+type fakeMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	cert, pool := selfSignedCert(t)
+	return &fakeSMTP{
+		t:        t,
+		tlsConf:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		certPool: pool,
+		Replies:  map[string]string{},
+	}
+}
+
+// start begins accepting connections and returns the port.
+func (s *fakeSMTP) start() string {
+	s.t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatalf("listen: %v", err)
+	}
+	if s.ImplicitTLS {
+		ln = tls.NewListener(ln, s.tlsConf)
+	}
+	s.ln = ln
+	s.t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// clientTLS trusts the fake server's certificate.
+func (s *fakeSMTP) clientTLS() *tls.Config {
+	return &tls.Config{RootCAs: s.certPool, ServerName: "127.0.0.1"}
+}
+
+func (s *fakeSMTP) sent() []fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMessage(nil), s.messages...)
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(line string) {
+		w.WriteString(line + "\r\n")
+		w.Flush()
+	}
+	override := func(cmd, def string) string {
+		if r, ok := s.Replies[cmd]; ok {
+			return r
+		}
+		return def
+	}
+	if _, ok := conn.(*tls.Conn); ok {
+		s.mu.Lock()
+		s.tlsSeen = true
+		s.mu.Unlock()
+	}
+
+	var cur fakeMessage
+	reply("220 fake.smtp ESMTP ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO", "HELO":
+			_, isTLS := conn.(*tls.Conn)
+			w.WriteString("250-fake.smtp\r\n")
+			if s.StartTLS && !isTLS {
+				w.WriteString("250-STARTTLS\r\n")
+			}
+			reply("250 AUTH PLAIN XOAUTH2")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tconn := tls.Server(conn, s.tlsConf)
+			if err := tconn.Handshake(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.tlsSeen = true
+			s.mu.Unlock()
+			conn = tconn
+			r = bufio.NewReader(conn)
+			w = bufio.NewWriter(conn)
+		case "AUTH":
+			parts := strings.Fields(line)
+			mech := strings.ToUpper(parts[1])
+			var payload []byte
+			if len(parts) > 2 {
+				payload, _ = base64.StdEncoding.DecodeString(parts[2])
+			}
+			s.mu.Lock()
+			s.authSeen = append(s.authSeen, mech+" "+string(payload))
+			s.mu.Unlock()
+			if s.AcceptAuth == nil || s.AcceptAuth(mech, payload) {
+				reply("235 2.7.0 Accepted")
+				continue
+			}
+			if mech == "XOAUTH2" {
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer"}`)))
+				if l, err := r.ReadString('\n'); err != nil || strings.TrimSpace(l) != "*" && strings.TrimSpace(l) != "" {
+					return
+				}
+			}
+			reply("535 5.7.8 Username and Password not accepted")
+		case "MAIL":
+			cur = fakeMessage{From: addrArg(line)}
+			reply(override("MAIL", "250 OK"))
+		case "RCPT":
+			cur.To = append(cur.To, addrArg(line))
+			reply(override("RCPT", "250 OK"))
+		case "DATA":
+			reply("354 end with .")
+			var b strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				b.WriteString(strings.TrimPrefix(l, "."))
+			}
+			cur.Data = b.String()
+			if resp := override("DATA", "250 queued"); strings.HasPrefix(resp, "250") {
+				s.mu.Lock()
+				s.messages = append(s.messages, cur)
+				s.mu.Unlock()
+				reply(resp)
+			} else {
+				reply(resp)
+			}
+		case "RSET", "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unrecognized")
+		}
+	}
+}
+
+func addrArg(line string) string {
+	if i := strings.Index(line, "<"); i >= 0 {
+		if j := strings.Index(line[i:], ">"); j >= 0 {
+			return line[i+1 : i+j]
+		}
+	}
+	return ""
+}
+
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake.smtp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
@@ -1,9 +1,10 @@
 package anna
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
@@ -17,57 +18,93 @@ const maxAlternateEditions = 3
 // sendOneEdition downloads a single edition by hash, validates it, saves an
 // optional local backup, and emails it to the Kindle. It returns an error
 // describing why the edition could not be sent (corrupt/HTML download, DRM,
-// MOBI/AZW, SMTP failure, ...). EPUB sanitize + validation happen inside
-// SendFileToKindle.
-func sendOneEdition(b *Book, secretKey, smtpHost, smtpPort, smtpUser, smtpPassword, fromEmail, kindleEmail string) error {
+// a MOBI/AZW that won't convert, SMTP failure, ...). PDFs and formats Amazon
+// doesn't accept are converted first (see ConverterRegistry). EPUB sanitize
+// + validation happen inside sendFileToKindle; an EPUB too large even after
+// shrinking is sent in volumes (see SplitEPUB).
+func sendOneEdition(b *Book, secretKey string, mail MailConfig, to Recipient) error {
 	l := logger.GetLogger()
 
-	fileData, err := downloadFileData(b.Hash, secretKey)
+	spool, err := downloadFile(b.Hash, secretKey, DownloadOptions{Progress: downloadLogger(b.Hash)})
 	if err != nil {
 		return err
 	}
+	defer spool.Close()
 
-	actualFormat, _ := detectFileFormat("", fileData)
+	actualFormat := spool.Format()
 
-	// Optional local backup (best-effort; never fails the send).
+	// Optional local backup, with its verified MD5 (best-effort; never fails
+	// the send).
 	if downloadPath := os.Getenv("ANNAS_DOWNLOAD_PATH"); downloadPath != "" {
 		nameFormat := actualFormat
 		if nameFormat == "unknown" {
 			nameFormat = b.Format
 		}
-		filePath := filepath.Join(downloadPath, sanitizeFilename(b.Title)+"."+nameFormat)
-		if _, statErr := os.Stat(filePath); statErr != nil {
-			if werr := os.WriteFile(filePath, fileData, 0644); werr != nil {
-				l.Warn("Failed to save backup copy", zap.String("path", filePath), zap.Error(werr))
-			}
-		}
+		saveBackup(downloadPath, b.Title, nameFormat, spool)
 	}
 
 	if actualFormat == "unknown" {
 		return fmt.Errorf("the downloaded file for %q is not a recognized ebook (likely a corrupt download or an error page)", b.Title)
 	}
 
-	// PDFs read poorly on Kindle and large ones exceed the email size cap, so a
-	// PDF-only book often can't be delivered at all. Convert to EPUB first when a
-	// converter is available. Best-effort: on any failure we send the original
-	// PDF unchanged, so this never regresses PDF delivery.
-	if actualFormat == "pdf" {
-		if epubData, cerr := ConvertPDFToEPUB(fileData); cerr != nil {
-			l.Warn("PDF→EPUB conversion skipped; sending original PDF",
-				zap.String("title", b.Title), zap.Error(cerr))
-		} else {
-			l.Info("Converted PDF to EPUB before sending",
+	// Convert anything Amazon doesn't accept (MOBI/AZW/AZW3, FB2, DjVu, ...),
+	// via the best route the converter registry has (see convert.go). Word
+	// documents, RTF, HTML, text and images go as they are. PDFs read poorly
+	// on Kindle and large ones exceed the email size cap, so they're converted
+	// too, but best-effort: on any failure we send the original PDF unchanged,
+	// so this never regresses PDF delivery. Profiles that prefer PDF
+	// (large-screen devices) get the original. The external converters read
+	// the download where it is spooled; nothing is read into memory yet.
+	report := &DeliveryReport{}
+	var fileData []byte
+	if !kindleAccepts(actualFormat) || (actualFormat == "pdf" && !to.keepsPDF()) {
+		conv, cerr := converterRegistry.ConvertFile(spool.Path(), actualFormat, "epub")
+		switch {
+		case cerr == nil:
+			l.Info("Converted edition before sending",
 				zap.String("title", b.Title),
-				zap.Int("pdf_bytes", len(fileData)),
-				zap.Int("epub_bytes", len(epubData)),
+				zap.String("from", conv.From),
+				zap.String("to", conv.To),
+				zap.String("via", conv.Via()),
+				zap.Int64("original_bytes", spool.Size()),
+				zap.Int("converted_bytes", len(conv.Data)),
 			)
-			fileData = epubData
-			actualFormat = "epub"
+			report.ConvertedFrom = actualFormat
+			fileData = conv.Data
+			actualFormat = conv.To
+		case kindleAccepts(actualFormat):
+			l.Warn("Conversion skipped; sending original",
+				zap.String("title", b.Title), zap.String("format", actualFormat), zap.Error(cerr))
+		default:
+			return fmt.Errorf("this edition is %s, which Amazon's Send-to-Kindle email doesn't accept, and converting it to EPUB failed: %w",
+				strings.ToUpper(actualFormat), cerr)
 		}
 	}
 
-	if actualFormat == "mobi" || actualFormat == "azw" || actualFormat == "azw3" {
-		return fmt.Errorf("this edition is %s, which Amazon's Send-to-Kindle email no longer accepts", strings.ToUpper(actualFormat))
+	if fileData == nil {
+		// Only an EPUB can be made to fit (see ShrinkEPUB and SplitEPUB);
+		// anything else over the limit is refused before it is read.
+		if limit, target, reason := mail.sizeLimitFor(to); actualFormat != "epub" && spool.Size() > limit {
+			return &TooLargeError{Target: target, Size: spool.Size(), Limit: limit, Reason: reason}
+		}
+		// From here on the book is rewritten and encoded for email, all in
+		// memory.
+		if fileData, err = spool.Bytes(); err != nil {
+			return fmt.Errorf("failed to read the download: %w", err)
+		}
+	}
+
+	// Kindle titles the book from its OPF, so give it the metadata we know
+	// rather than whatever the uploader's file carries, and a cover if it has
+	// none. Best-effort.
+	if actualFormat == "epub" {
+		if out, merr := RewriteEPUBMetadata(fileData, bookMetadata(b)); merr != nil {
+			l.Warn("Metadata rewrite skipped", zap.String("title", b.Title), zap.Error(merr))
+		} else if !bytes.Equal(out, fileData) {
+			fileData = out
+			report.MetadataRewritten = true
+		}
+		fileData, report.CoverAdded = addMissingCover(b, fileData)
 	}
 
 	mimeType := getMimeType(actualFormat)
@@ -76,8 +113,66 @@ func sendOneEdition(b *Book, secretKey, smtpHost, smtpPort, smtpUser, smtpPasswo
 		filename = b.Hash + "." + actualFormat // guard against an empty/garbled title
 	}
 
-	return SendFileToKindle(fileData, filename, mimeType, "Book: "+b.Title,
-		smtpHost, smtpPort, smtpUser, smtpPassword, fromEmail, kindleEmail)
+	err = sendFileToKindle(fileData, filename, mimeType, "Book: "+b.Title, mail, to, report)
+	var tooLarge *TooLargeError
+	if actualFormat == "epub" && errors.As(err, &tooLarge) {
+		// Last resort: deliver the book as several volumes.
+		if serr := sendInVolumes(b, fileData, tooLarge.Limit, mail, to, report.ConvertedFrom); serr != nil {
+			if errors.Is(serr, ErrQueued) {
+				return serr
+			}
+			return fmt.Errorf("%w; splitting it into volumes failed too: %v", err, serr)
+		}
+		return nil
+	}
+	return err
+}
+
+// sendInVolumes splits an EPUB that is too large even after shrinking into
+// "Title (Part i of N)" volumes under limit and sends each one. If a volume is
+// queued in the outbox the rest are still sent and the QueuedError returned.
+func sendInVolumes(b *Book, fileData []byte, limit int64, mail MailConfig, to Recipient, convertedFrom string) error {
+	l := logger.GetLogger()
+	if shrunk, _, err := ShrinkEPUB(fileData, limit); err == nil {
+		fileData = shrunk
+	}
+	parts, err := SplitEPUB(fileData, limit)
+	if err != nil {
+		return err
+	}
+	if len(parts) < 2 {
+		return fmt.Errorf("%w: it is a single indivisible part", ErrCannotSplit)
+	}
+	if left := recipientPolicy().Remaining(to); left >= 0 && left < len(parts) {
+		return fmt.Errorf("the book needs %d volumes but %s can only receive %d more books today (KINDLE_DAILY_SEND_LIMIT)", len(parts), to, left)
+	}
+	l.Info("Sending oversized EPUB in volumes",
+		zap.String("title", b.Title),
+		zap.Int("volumes", len(parts)),
+		zap.Int64("limit_bytes", limit),
+	)
+
+	var queued error
+	for i, part := range parts {
+		volTitle := fmt.Sprintf("%s (Part %d of %d)", b.Title, i+1, len(parts))
+		filename := sanitizeFilename(volTitle) + ".epub"
+		report := &DeliveryReport{ConvertedFrom: convertedFrom, Volume: fmt.Sprintf("%d of %d", i+1, len(parts))}
+		err := sendFileToKindle(part, filename, getMimeType("epub"), "Book: "+volTitle, mail, to, report)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrQueued):
+			queued = err
+		default:
+			switch i {
+			case 0:
+				return fmt.Errorf("volume 1 of %d: %w", len(parts), err)
+			case 1:
+				return fmt.Errorf("volume 1 of %d was sent, but volume 2 failed: %w", len(parts), err)
+			}
+			return fmt.Errorf("volumes 1-%d of %d were sent, but volume %d failed: %w", i, len(parts), i+1, err)
+		}
+	}
+	return queued
 }
 
 // findAlternateEditions searches for other EPUB editions of the same book to try
@@ -0,0 +1,781 @@
+package anna
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/epub"
+)
+
+// ConvertFB2ToEPUB rebuilds a FictionBook 2 book as an EPUB 3, in pure Go.
+// FB2 is a single XML document: a <description> with the book's metadata,
+// one or more <body> elements of nested <section>s, and the images as
+// base64 <binary> elements. Each top-level section of the first body
+// becomes a chapter; later bodies (footnotes, comments) become a notes page
+// each, and note links are pointed at them. Many Russian FB2 files are in
+// windows-1251, which the XML declaration names; they come out as UTF-8.
+
+// ErrNotFB2 means the data is neither an FB2 document nor a zip holding one.
+var ErrNotFB2 = errors.New("not a FictionBook (FB2) document")
+
+// fb2MaxDepth caps how deeply nested elements are kept; anything deeper is
+// flattened into its ancestor, so a pathological file can't exhaust the
+// stack while rendering.
+const fb2MaxDepth = 128
+
+// ConvertFB2ToEPUB converts FB2 bytes, or a zip holding an .fb2 file, to
+// EPUB bytes.
+func ConvertFB2ToEPUB(data []byte) ([]byte, error) {
+	return convertFB2ToEPUB(context.Background(), data)
+}
+
+// convertFB2ToEPUB is ConvertFB2ToEPUB, giving up with ctx's error while
+// parsing and between documents once ctx is done.
+func convertFB2ToEPUB(ctx context.Context, data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte("PK")) {
+		inner, err := unzipFB2(data)
+		if err != nil {
+			return nil, err
+		}
+		data = inner
+	}
+	root, err := parseFB2(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	c := newFB2Converter(root)
+	if err := c.convert(ctx); err != nil {
+		return nil, err
+	}
+	return c.epub()
+}
+
+// unzipFB2 reads the .fb2 file out of a zip ("book.fb2.zip").
+func unzipFB2(data []byte) ([]byte, error) {
+	z, err := openZip(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range z.files() {
+		if strings.HasSuffix(strings.ToLower(f.Name), ".fb2") {
+			return z.readFile(f)
+		}
+	}
+	return nil, fmt.Errorf("%w: the zip holds no .fb2 file", ErrNotFB2)
+}
+
+// fb2Node is an element of the FB2 document, or a run of text when name is
+// empty.
+type fb2Node struct {
+	name     string
+	attrs    []xml.Attr
+	children []*fb2Node
+	text     string
+}
+
+// attr returns the attribute with the local name key, whatever its
+// namespace: FB2 links are xlink:href, l:href or plain href depending on
+// the tool that wrote the file.
+func (n *fb2Node) attr(key string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.attrs {
+		if a.Name.Local == key {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first child element called name.
+func (n *fb2Node) child(name string) *fb2Node {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// all returns the child elements called name.
+func (n *fb2Node) all(name string) []*fb2Node {
+	if n == nil {
+		return nil
+	}
+	var out []*fb2Node
+	for _, c := range n.children {
+		if c.name == name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// textContent is the node's text with whitespace collapsed.
+func (n *fb2Node) textContent() string {
+	if n == nil {
+		return ""
+	}
+	var b strings.Builder
+	var walk func(*fb2Node)
+	walk = func(n *fb2Node) {
+		if n.name == "" {
+			b.WriteString(n.text)
+			return
+		}
+		for _, c := range n.children {
+			walk(c)
+			if c.name == "p" || c.name == "v" {
+				b.WriteByte(' ')
+			}
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// parseFB2 parses an FB2 document leniently: HTML entities are allowed,
+// unclosed elements are closed, and a truncated file keeps what was read.
+func parseFB2(ctx context.Context, data []byte) (*fb2Node, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = charset.NewReaderLabel
+
+	var root *fb2Node
+	var stack []*fb2Node
+	skipped := 0 // elements opened past fb2MaxDepth
+	var parseErr error
+	for tokens := 0; ; tokens++ {
+		if tokens%4096 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		tok, err := d.Token()
+		if err != nil {
+			if err != io.EOF {
+				parseErr = err
+			}
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(stack) >= fb2MaxDepth {
+				skipped++
+				continue
+			}
+			n := &fb2Node{name: t.Name.Local, attrs: t.Attr}
+			if len(stack) == 0 {
+				if root != nil {
+					continue
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if skipped > 0 {
+				skipped--
+			} else if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, &fb2Node{text: string(t)})
+			}
+		}
+	}
+	if root == nil || root.name != "FictionBook" {
+		if parseErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNotFB2, parseErr)
+		}
+		return nil, ErrNotFB2
+	}
+	if root.child("body") == nil {
+		if parseErr != nil {
+			return nil, fmt.Errorf("parse FB2: %w", parseErr)
+		}
+		return nil, errors.New("the FB2 document has no body")
+	}
+	return root, nil
+}
+
+// fb2Image is a <binary> image, written to the EPUB at path.
+type fb2Image struct {
+	path      string
+	mediaType string
+	data      []byte
+}
+
+// fb2Converter collects what ConvertFB2ToEPUB writes into the EPUB.
+type fb2Converter struct {
+	root   *fb2Node
+	info   *fb2Node // description/title-info
+	uid    string   // "urn:isbn:…"; empty, epub.Package derives one
+	title  string
+	lang   string
+	images map[string]*fb2Image // by binary id
+	order  []string             // binary ids in document order
+	docs   []xhtmlDoc
+	toc    []tocEntry
+	ids    map[string]string // FB2 id → document path
+	used   map[string]bool   // anchors already written
+	nextID int
+}
+
+func newFB2Converter(root *fb2Node) *fb2Converter {
+	info := root.child("description").child("title-info")
+	c := &fb2Converter{
+		root:   root,
+		info:   info,
+		title:  info.child("book-title").textContent(),
+		lang:   info.child("lang").textContent(),
+		images: map[string]*fb2Image{},
+		ids:    map[string]string{},
+		used:   map[string]bool{},
+	}
+	if isbn := fb2ISBN(root); isbn != "" {
+		c.uid = "urn:isbn:" + isbn
+	}
+	if c.title == "" {
+		c.title = "Untitled"
+	}
+	if c.lang == "" || !langTagRe.MatchString(c.lang) {
+		c.lang = "und"
+	}
+	return c
+}
+
+var langTagRe = regexp.MustCompile(`^[A-Za-z]{2,8}(?:-[A-Za-z0-9]{1,8})*$`)
+
+// fb2ISBN is the publish-info ISBN, digits only, if it looks like one.
+func fb2ISBN(root *fb2Node) string {
+	raw := root.child("description").child("publish-info").child("isbn").textContent()
+	isbn := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' || r == 'X' || r == 'x' {
+			return r
+		}
+		return -1
+	}, raw)
+	if len(isbn) != 10 && len(isbn) != 13 {
+		return ""
+	}
+	return strings.ToUpper(isbn)
+}
+
+const (
+	fb2TextDir  = "OEBPS/Text/"
+	fb2ImageDir = "OEBPS/Images/"
+	fb2CSSPath  = "OEBPS/Styles/fb2.css"
+)
+
+// fb2Unit is one output document and the FB2 nodes it is made from.
+type fb2Unit struct {
+	path  string
+	nodes []*fb2Node
+	label string // TOC label, if any
+	notes bool   // a notes body: its sections don't get TOC entries
+}
+
+func (c *fb2Converter) convert(ctx context.Context) error {
+	c.readBinaries()
+
+	var units []fb2Unit
+	for i, body := range c.root.all("body") {
+		if i > 0 {
+			label := body.child("title").textContent()
+			if label == "" {
+				label = "Notes"
+			}
+			units = append(units, fb2Unit{path: fmt.Sprintf("%snotes%d.xhtml", fb2TextDir, i), nodes: body.children, label: label, notes: true})
+			continue
+		}
+		// What comes before the first section (the book's title, an
+		// epigraph) is a title page; each section a chapter.
+		var front []*fb2Node
+		sections := 0
+		for _, n := range body.children {
+			if n.name != "section" {
+				if sections == 0 {
+					front = append(front, n)
+				} else if units != nil {
+					last := &units[len(units)-1]
+					last.nodes = append(last.nodes, n)
+				}
+				continue
+			}
+			if sections == 0 && hasFB2Content(front) {
+				units = append(units, fb2Unit{path: fb2TextDir + "title.xhtml", nodes: front})
+			}
+			sections++
+			units = append(units, fb2Unit{
+				path:  fmt.Sprintf("%schapter%04d.xhtml", fb2TextDir, sections),
+				nodes: []*fb2Node{n},
+				label: n.child("title").textContent(),
+			})
+		}
+		if sections == 0 && hasFB2Content(front) {
+			units = append(units, fb2Unit{path: fb2TextDir + "chapter0001.xhtml", nodes: front})
+		}
+	}
+	if len(units) == 0 {
+		return errors.New("the FB2 document contains no text")
+	}
+
+	// Links may point forward, so every id's document is known before
+	// anything is rendered.
+	for _, u := range units {
+		for _, n := range u.nodes {
+			c.collectIDs(n, u.path)
+		}
+	}
+	for _, u := range units {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r := &fb2Renderer{c: c, path: u.path}
+		if u.notes {
+			r.depth = 1 // note sections get subheadings, not chapter headings
+		}
+		r.blocks(u.nodes)
+		if u.label != "" {
+			c.toc = append(c.toc, tocEntry{Label: u.label, Path: u.path})
+		}
+		if !u.notes {
+			c.toc = append(c.toc, r.toc...)
+		}
+		c.docs = append(c.docs, xhtmlDoc{path: u.path, data: c.document(u.path, u.label, r.b.String())})
+	}
+	return nil
+}
+
+// hasFB2Content reports whether nodes hold anything beyond whitespace.
+func hasFB2Content(nodes []*fb2Node) bool {
+	for _, n := range nodes {
+		if n.name != "" || strings.TrimSpace(n.text) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *fb2Converter) collectIDs(n *fb2Node, docPath string) {
+	if n.name == "" {
+		return
+	}
+	if id := n.attr("id"); id != "" {
+		if _, ok := c.ids[id]; !ok {
+			c.ids[id] = docPath
+		}
+	}
+	for _, ch := range n.children {
+		c.collectIDs(ch, docPath)
+	}
+}
+
+// readBinaries decodes the <binary> images. Their declared content type is
+// often wrong, so the bytes decide; anything that isn't an image is dropped.
+func (c *fb2Converter) readBinaries() {
+	names := map[string]bool{}
+	for _, b := range c.root.all("binary") {
+		id := b.attr("id")
+		if id == "" || c.images[id] != nil {
+			continue
+		}
+		data, err := decodeFB2Base64(b.textContent())
+		if err != nil {
+			continue
+		}
+		ext, mediaType := sniffImage(data)
+		if ext == "" {
+			continue
+		}
+		name := strings.TrimSuffix(fb2FileName(id), path.Ext(id))
+		p := fb2ImageDir + name + ext
+		for i := 2; names[p]; i++ {
+			p = fmt.Sprintf("%s%s-%d%s", fb2ImageDir, name, i, ext)
+		}
+		names[p] = true
+		c.images[id] = &fb2Image{path: p, mediaType: mediaType, data: data}
+		c.order = append(c.order, id)
+	}
+}
+
+func decodeFB2Base64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+var fb2NameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fb2FileName turns a binary id into a safe file name.
+func fb2FileName(id string) string {
+	name := strings.Trim(fb2NameRe.ReplaceAllString(id, "_"), "._")
+	if name == "" {
+		name = "image"
+	}
+	return name
+}
+
+// image returns the image an FB2 link ("#cover.jpg") points at.
+func (c *fb2Converter) image(href string) *fb2Image {
+	return c.images[strings.TrimPrefix(href, "#")]
+}
+
+// fb2Anchor turns an FB2 id into an XHTML one.
+func fb2Anchor(id string) string {
+	if xmlNameRe.MatchString(id) {
+		return id
+	}
+	return "id_" + fb2NameRe.ReplaceAllString(id, "_")
+}
+
+// fb2Renderer renders FB2 nodes into one XHTML document's body.
+type fb2Renderer struct {
+	c      *fb2Converter
+	path   string
+	b      strings.Builder
+	depth  int // section nesting
+	nested int // inside an epigraph, poem, cite, ...
+	toc    []tocEntry
+}
+
+// idAttr is the id attribute for n, if it has an id.
+func (r *fb2Renderer) idAttr(n *fb2Node) string {
+	id := n.attr("id")
+	if id == "" {
+		return ""
+	}
+	return r.writeID(fb2Anchor(id))
+}
+
+// writeID is an id attribute, or nothing if the id is empty or already used:
+// ids must be unique across the book for links to resolve.
+func (r *fb2Renderer) writeID(id string) string {
+	if id == "" || r.c.used[id] {
+		return ""
+	}
+	r.c.used[id] = true
+	return ` id="` + xmlEscape(id) + `"`
+}
+
+// blockTags maps FB2 block elements to the XHTML element and class they
+// render as.
+var blockTags = map[string][2]string{
+	"p":           {"p", ""},
+	"subtitle":    {"p", "subtitle"},
+	"text-author": {"p", "text-author"},
+	"date":        {"p", "date"},
+	"v":           {"p", "v"},
+	"epigraph":    {"blockquote", "epigraph"},
+	"cite":        {"blockquote", "cite"},
+	"annotation":  {"div", "annotation"},
+	"poem":        {"div", "poem"},
+	"stanza":      {"div", "stanza"},
+}
+
+// blockContainers are the elements whose children are blocks rather than
+// inline text.
+var blockContainers = map[string]bool{
+	"epigraph": true, "cite": true, "annotation": true, "poem": true, "stanza": true,
+}
+
+func (r *fb2Renderer) blocks(nodes []*fb2Node) {
+	for _, n := range nodes {
+		r.block(n)
+	}
+}
+
+func (r *fb2Renderer) block(n *fb2Node) {
+	switch n.name {
+	case "":
+		if t := strings.TrimSpace(n.text); t != "" {
+			fmt.Fprintf(&r.b, "<p>%s</p>\n", xmlEscape(t))
+		}
+	case "section":
+		r.depth++
+		id := ""
+		if v := n.attr("id"); v != "" {
+			id = fb2Anchor(v)
+		}
+		// Second-level sections (a chapter's parts) get TOC entries too,
+		// so they need an anchor.
+		if label := n.child("title").textContent(); r.depth == 2 && label != "" {
+			for id == "" || r.c.used[id] {
+				r.c.nextID++
+				id = fmt.Sprintf("section-%d", r.c.nextID)
+			}
+			r.toc = append(r.toc, tocEntry{Label: label, Path: r.path, Fragment: id})
+		}
+		fmt.Fprintf(&r.b, "<div class=\"section\"%s>\n", r.writeID(id))
+		r.blocks(n.children)
+		r.b.WriteString("</div>\n")
+		r.depth--
+	case "title":
+		if r.nested > 0 {
+			// A poem's or epigraph's title isn't a heading.
+			r.title(n, "p", "subtitle")
+			return
+		}
+		r.title(n, fmt.Sprintf("h%d", min(max(r.depth, 1), 6)), "title")
+	case "image":
+		if img := r.c.image(n.attr("href")); img != nil {
+			fmt.Fprintf(&r.b, "<div class=\"image\"%s><img src=\"%s\" alt=\"%s\"/></div>\n",
+				r.idAttr(n), xmlEscape(relativeHref(r.path, img.path)), xmlEscape(n.attr("title")))
+		}
+	case "empty-line":
+		r.b.WriteString("<p class=\"empty-line\">&#160;</p>\n")
+	case "table":
+		fmt.Fprintf(&r.b, "<table%s>\n", r.idAttr(n))
+		for _, tr := range n.all("tr") {
+			r.b.WriteString("<tr>")
+			for _, cell := range tr.children {
+				if cell.name != "th" && cell.name != "td" {
+					continue
+				}
+				fmt.Fprintf(&r.b, "<%s%s", cell.name, r.idAttr(cell))
+				for _, a := range []string{"colspan", "rowspan"} {
+					if v := cell.attr(a); v != "" {
+						fmt.Fprintf(&r.b, ` %s="%s"`, a, xmlEscape(v))
+					}
+				}
+				r.b.WriteString(">")
+				r.inline(cell.children)
+				fmt.Fprintf(&r.b, "</%s>", cell.name)
+			}
+			r.b.WriteString("</tr>\n")
+		}
+		r.b.WriteString("</table>\n")
+	default:
+		tag, ok := blockTags[n.name]
+		if !ok {
+			// Unknown element: keep its content.
+			r.blocks(n.children)
+			return
+		}
+		class := ""
+		if tag[1] != "" {
+			class = ` class="` + tag[1] + `"`
+		}
+		fmt.Fprintf(&r.b, "<%s%s%s>", tag[0], class, r.idAttr(n))
+		if blockContainers[n.name] {
+			r.b.WriteString("\n")
+			r.nested++
+			r.blocks(n.children)
+			r.nested--
+		} else {
+			r.inline(n.children)
+		}
+		fmt.Fprintf(&r.b, "</%s>\n", tag[0])
+	}
+}
+
+// title renders a <title> as tag, its paragraphs becoming lines.
+func (r *fb2Renderer) title(n *fb2Node, tag, class string) {
+	fmt.Fprintf(&r.b, "<%s class=\"%s\"%s>", tag, class, r.idAttr(n))
+	first := true
+	for _, p := range n.children {
+		if p.name == "" && strings.TrimSpace(p.text) == "" || p.name == "empty-line" {
+			continue
+		}
+		if !first {
+			r.b.WriteString("<br/>")
+		}
+		first = false
+		if p.name == "" {
+			r.b.WriteString(xmlEscape(strings.TrimSpace(p.text)))
+		} else {
+			r.inline(p.children)
+		}
+	}
+	fmt.Fprintf(&r.b, "</%s>\n", tag)
+}
+
+// inlineTags maps FB2 inline elements to XHTML.
+var inlineTags = map[string]string{
+	"strong":        "strong",
+	"emphasis":      "em",
+	"strikethrough": "del",
+	"sub":           "sub",
+	"sup":           "sup",
+	"code":          "code",
+	"style":         "span",
+}
+
+func (r *fb2Renderer) inline(nodes []*fb2Node) {
+	for _, n := range nodes {
+		switch n.name {
+		case "":
+			r.b.WriteString(xmlEscape(n.text))
+		case "a":
+			href, ok := r.link(n.attr("href"))
+			if !ok {
+				r.inline(n.children)
+				continue
+			}
+			class := ""
+			if n.attr("type") == "note" {
+				class = ` class="note"`
+			}
+			fmt.Fprintf(&r.b, `<a href="%s"%s%s>`, xmlEscape(href), class, r.idAttr(n))
+			r.inline(n.children)
+			r.b.WriteString("</a>")
+		case "image":
+			if img := r.c.image(n.attr("href")); img != nil {
+				fmt.Fprintf(&r.b, `<img src="%s" alt="%s"/>`, xmlEscape(relativeHref(r.path, img.path)), xmlEscape(n.attr("alt")))
+			}
+		default:
+			tag, ok := inlineTags[n.name]
+			if !ok {
+				r.inline(n.children)
+				continue
+			}
+			fmt.Fprintf(&r.b, "<%s%s>", tag, r.idAttr(n))
+			r.inline(n.children)
+			fmt.Fprintf(&r.b, "</%s>", tag)
+		}
+	}
+}
+
+// link resolves an FB2 link: "#id" to wherever that id was rendered, web
+// links as they are. Links to nothing are dropped.
+func (r *fb2Renderer) link(href string) (string, bool) {
+	if id, ok := strings.CutPrefix(href, "#"); ok {
+		doc, found := r.c.ids[id]
+		if !found {
+			return "", false
+		}
+		if doc == r.path {
+			return "#" + fb2Anchor(id), true
+		}
+		return relativeHref(r.path, doc) + "#" + fb2Anchor(id), true
+	}
+	if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "mailto:") {
+		return href, true
+	}
+	return "", false
+}
+
+// document wraps a rendered body in an XHTML document.
+func (c *fb2Converter) document(docPath, title, body string) []byte {
+	if title == "" {
+		title = c.title
+	}
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="` + xmlEscape(c.lang) + `" lang="` + xmlEscape(c.lang) + `">
+<head><title>` + xmlEscape(title) + `</title><link rel="stylesheet" type="text/css" href="` + xmlEscape(relativeHref(docPath, fb2CSSPath)) + `"/></head>
+<body>
+` + body + `</body>
+</html>
+`)
+}
+
+const fb2CSS = `h1, h2, h3, h4, h5, h6 { text-align: center; }
+p { margin: 0; text-indent: 1.5em; }
+p.subtitle { text-align: center; font-weight: bold; margin: 1em 0; text-indent: 0; }
+p.empty-line { text-indent: 0; }
+blockquote.epigraph { margin: 1em 0 1em 30%; font-style: italic; }
+blockquote.cite { margin: 1em 2em; }
+p.text-author { text-align: right; font-weight: bold; text-indent: 0; }
+div.poem { margin: 1em 2em; }
+div.stanza { margin: 1em 0; }
+p.v { text-indent: 0; }
+p.date { text-align: right; font-style: italic; text-indent: 0; }
+div.image { text-align: center; margin: 1em 0; }
+div.image img { max-width: 100%; }
+a.note { vertical-align: super; font-size: 75%; }
+`
+
+// fb2Person formats a title-info <author> or <translator>.
+func fb2Person(n *fb2Node) string {
+	var parts []string
+	for _, f := range []string{"first-name", "middle-name", "last-name"} {
+		if v := n.child(f).textContent(); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	if len(parts) == 0 {
+		return n.child("nickname").textContent()
+	}
+	return strings.Join(parts, " ")
+}
+
+var fb2DateRe = regexp.MustCompile(`^\d{4}(?:-\d{2}(?:-\d{2})?)?$`)
+
+// date is the book's date in the W3C form OPF wants, if it has one.
+func (c *fb2Converter) date() string {
+	d := c.info.child("date")
+	for _, v := range []string{d.attr("value"), d.textContent(), c.root.child("description").child("publish-info").child("year").textContent()} {
+		if fb2DateRe.MatchString(v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// epub packs the converted book the way mobiConverter.epub does: an EPUB 3
+// package with both a navigation document and an NCX.
+func (c *fb2Converter) epub() ([]byte, error) {
+	m := epub.Metadata{
+		Title:       c.title,
+		Language:    c.lang,
+		Identifier:  c.uid,
+		Publisher:   c.root.child("description").child("publish-info").child("publisher").textContent(),
+		Date:        c.date(),
+		Description: c.info.child("annotation").textContent(),
+	}
+	for _, a := range c.info.all("author") {
+		m.Authors = append(m.Authors, fb2Person(a))
+	}
+	for _, t := range c.info.all("translator") {
+		m.Translators = append(m.Translators, fb2Person(t))
+	}
+	for _, g := range c.info.all("genre") {
+		m.Subjects = append(m.Subjects, g.textContent())
+	}
+	if seq := c.info.child("sequence"); seq != nil {
+		m.Series, m.SeriesIndex = seq.attr("name"), seq.attr("number")
+	}
+
+	p := &epub.Package{Metadata: m}
+	p.AddFile(fb2CSSPath, "text/css", []byte(fb2CSS))
+	for _, d := range c.docs {
+		p.AddDocument(d.path, d.data, "")
+	}
+	if img := c.info.child("coverpage").child("image"); img != nil {
+		if cover := c.image(img.attr("href")); cover != nil {
+			p.Cover = cover.path
+		}
+	}
+	for _, id := range c.order {
+		img := c.images[id]
+		p.AddFile(img.path, img.mediaType, img.data)
+	}
+	toc := c.toc
+	if len(toc) == 0 {
+		toc = headingTOC(c.title, c.docs)
+	}
+	p.TOC = navPoints(toc)
+	return p.Bytes()
+}
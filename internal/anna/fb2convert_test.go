@@ -0,0 +1,236 @@
+package anna
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// fb2Book is an FB2 document with full title-info, a title page, two
+// chapters (the second with titled parts and a poem), a footnote, an inline
+// image and a cover.
+func fb2Book(t *testing.T) string {
+	t.Helper()
+	cover := base64.StdEncoding.EncodeToString(noisyJPEG(t, 16, 16))
+	pic := base64.StdEncoding.EncodeToString(tinyPNG(t))
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info>
+    <genre>sf_social</genre>
+    <author><first-name>Евгений</first-name><middle-name>Иванович</middle-name><last-name>Замятин</last-name></author>
+    <book-title>Мы</book-title>
+    <annotation><p>A novel of the One State.</p><p>Written in 1920.</p></annotation>
+    <date value="1920-01-01">1920</date>
+    <coverpage><image l:href="#cover.jpg"/></coverpage>
+    <lang>ru</lang>
+    <translator><first-name>Mirra</first-name><last-name>Ginsburg</last-name></translator>
+    <sequence name="Dystopias" number="1"/>
+  </title-info>
+  <publish-info><publisher>Harper</publisher><isbn>978-0-14-018585-2</isbn></publish-info>
+</description>
+<body>
+  <title><p>Мы</p><p>Роман</p></title>
+  <epigraph><p>An epigraph.</p><text-author>Someone</text-author></epigraph>
+  <section>
+    <title><p>Запись 1-я</p></title>
+    <p>Я просто списываю<a l:href="#n1" type="note">1</a> &amp; <emphasis>думаю</emphasis>.</p>
+    <empty-line/>
+    <image l:href="#pic.png" title="A picture"/>
+  </section>
+  <section id="ch2">
+    <title><p>Запись 2-я</p></title>
+    <section><title><p>Part one</p></title><p>See <a l:href="#ch2">above</a> and <a l:href="#nowhere">nothing</a>.</p></section>
+    <section id="2nd"><title><p>Part two</p></title>
+      <poem><title><p>A poem</p></title><stanza><v>Line one</v><v>Line two</v></stanza></poem>
+      <table><tr><th>a</th><td colspan="2">b</td></tr></table>
+    </section>
+  </section>
+</body>
+<body name="notes">
+  <title><p>Примечания</p></title>
+  <section id="n1"><title><p>1</p></title><p>A footnote.</p></section>
+</body>
+<binary id="cover.jpg" content-type="image/jpeg">` + cover + `</binary>
+<binary id="pic.png" content-type="image/jpeg">
+` + pic + `
+</binary>
+<binary id="junk" content-type="application/octet-stream">bm90IGFuIGltYWdl</binary>
+</FictionBook>
+`
+}
+
+func TestConvertFB2ToEPUB(t *testing.T) {
+	out, err := ConvertFB2ToEPUB([]byte(fb2Book(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateEPUB(out); err != nil {
+		t.Fatalf("converted EPUB does not validate: %v", err)
+	}
+	if r := CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("converted EPUB should check clean:\n%s", r)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "Мы" {
+		t.Errorf("title = %q", book.title())
+	}
+	if c := book.pkg.Metadata.Creators; len(c) != 1 || c[0] != "Евгений Иванович Замятин" {
+		t.Errorf("creators = %q", c)
+	}
+	if l := book.pkg.Metadata.Languages; len(l) != 1 || l[0] != "ru" {
+		t.Errorf("languages = %q", l)
+	}
+	opf := string(book.opf())
+	for _, want := range []string{
+		`<dc:identifier id="bookid">urn:isbn:9780140185852</dc:identifier>`,
+		"<dc:publisher>Harper</dc:publisher>",
+		"<dc:date>1920-01-01</dc:date>",
+		"<dc:description>A novel of the One State. Written in 1920.</dc:description>",
+		"<dc:subject>sf_social</dc:subject>",
+		`<dc:contributor id="trl1">Mirra Ginsburg</dc:contributor>`,
+		`<meta name="calibre:series" content="Dystopias"/>`,
+		`<meta refines="#series" property="group-position">1</meta>`,
+		`<item id="cover-image" href="Images/cover.jpg" media-type="image/jpeg" properties="cover-image"/>`,
+		`href="Images/pic.png" media-type="image/png"`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("OPF lacks %s:\n%s", want, opf)
+		}
+	}
+	if strings.Contains(opf, "junk") {
+		t.Error("a binary that isn't an image should be dropped")
+	}
+	if n := len(book.pkg.Spine.ItemRefs); n != 4 {
+		t.Errorf("spine has %d documents, want title page, 2 chapters and notes", n)
+	}
+
+	title := string(readEntry(t, out, "OEBPS/Text/title.xhtml"))
+	ch1 := string(readEntry(t, out, "OEBPS/Text/chapter0001.xhtml"))
+	ch2 := string(readEntry(t, out, "OEBPS/Text/chapter0002.xhtml"))
+	notes := string(readEntry(t, out, "OEBPS/Text/notes1.xhtml"))
+	for doc, wants := range map[string][]string{
+		title: {`<h1 class="title">Мы<br/>Роман</h1>`, `<blockquote class="epigraph">`, `<p class="text-author">Someone</p>`},
+		ch1: {
+			`<h1 class="title">Запись 1-я</h1>`,
+			`<a href="notes1.xhtml#n1" class="note">1</a> &amp; <em>думаю</em>`,
+			`<img src="../Images/pic.png" alt="A picture"/>`,
+			`<p class="empty-line">&#160;</p>`,
+			`xml:lang="ru"`,
+		},
+		ch2: {
+			`<div class="section" id="ch2">`,
+			`See <a href="#ch2">above</a> and nothing.`,
+			`<h2 class="title">Part one</h2>`,
+			`<p class="subtitle">A poem</p>`,
+			`<p class="v">Line one</p>`,
+			`<td colspan="2">b</td>`,
+			`id="id_2nd"`,
+		},
+		notes: {`<h1 class="title">Примечания</h1>`, `<div class="section" id="n1">`},
+	} {
+		for _, want := range wants {
+			if !strings.Contains(doc, want) {
+				t.Errorf("document lacks %s:\n%s", want, doc)
+			}
+		}
+	}
+
+	nav := string(readEntry(t, out, "OEBPS/nav.xhtml"))
+	for _, want := range []string{
+		`<a href="Text/chapter0001.xhtml">Запись 1-я</a>`,
+		`<a href="Text/chapter0002.xhtml#section-1">Part one</a>`,
+		`<a href="Text/chapter0002.xhtml#id_2nd">Part two</a>`,
+		`<a href="Text/notes1.xhtml">Примечания</a>`,
+	} {
+		if !strings.Contains(nav, want) {
+			t.Errorf("nav lacks %s:\n%s", want, nav)
+		}
+	}
+	if strings.Contains(nav, ">1</a>") {
+		t.Errorf("footnotes should not be in the table of contents:\n%s", nav)
+	}
+}
+
+func TestConvertFB2ToEPUB_Windows1251AndZip(t *testing.T) {
+	src := strings.Replace(fb2Book(t), `encoding="UTF-8"`, `encoding="windows-1251"`, 1)
+	enc, err := charmap.Windows1251.NewEncoder().String(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipped := makeZip(t, map[string]string{"zamyatin_my.fb2": enc})
+	if f, _ := detectFileFormat("", zipped); f != "fb2" {
+		t.Fatalf("an .fb2.zip should detect as fb2, got %q", f)
+	}
+	if f, _ := detectFileFormat("", []byte(enc)); f != "fb2" {
+		t.Fatalf("a windows-1251 FB2 should detect as fb2, got %q", f)
+	}
+
+	for name, data := range map[string][]byte{"fb2": []byte(enc), "fb2.zip": zipped} {
+		out, err := ConvertFB2ToEPUB(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		book, err := parseEPUB(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if book.title() != "Мы" {
+			t.Errorf("%s: title = %q, want it decoded from windows-1251", name, book.title())
+		}
+		if ch := string(readEntry(t, out, "OEBPS/Text/chapter0001.xhtml")); !strings.Contains(ch, "Я просто списываю") {
+			t.Errorf("%s: chapter text not decoded:\n%s", name, ch)
+		}
+	}
+}
+
+func TestConvertFB2ToEPUB_Minimal(t *testing.T) {
+	// No description, text straight in the body, an unclosed paragraph and
+	// an HTML entity: all common in the wild.
+	out, err := ConvertFB2ToEPUB([]byte(`<FictionBook><body><p>Hello&nbsp;world<p>Bye</body></FictionBook>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("converted EPUB should check clean:\n%s", r)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "Untitled" || book.pkg.Metadata.Languages[0] != "und" {
+		t.Errorf("title %q, languages %q", book.title(), book.pkg.Metadata.Languages)
+	}
+	if ch := string(readEntry(t, out, "OEBPS/Text/chapter0001.xhtml")); !strings.Contains(ch, "Hello\u00a0world") {
+		t.Errorf("chapter:\n%s", ch)
+	}
+}
+
+func TestConvertFB2ToEPUB_Rejects(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"not xml":      []byte("just some text"),
+		"other xml":    []byte(`<?xml version="1.0"?><rss><channel/></rss>`),
+		"zip":          makeZip(t, map[string]string{"a.txt": "x"}),
+		"no body":      []byte(`<FictionBook><description/></FictionBook>`),
+		"empty bodies": []byte(`<FictionBook><body> </body></FictionBook>`),
+	} {
+		if _, err := ConvertFB2ToEPUB(data); err == nil {
+			t.Errorf("%s: converted", name)
+		} else if name != "no body" && name != "empty bodies" && !errors.Is(err, ErrNotFB2) {
+			t.Errorf("%s: err = %v, want ErrNotFB2", name, err)
+		}
+	}
+}
+
+func TestDefaultConverters_PreferNativeFB2(t *testing.T) {
+	plans := converterRegistry.Plans("fb2", "epub")
+	if len(plans) == 0 || plans[0][0].Converter.Name() != "native" {
+		t.Fatalf("fb2 should convert natively first: %+v", plans)
+	}
+}
@@ -0,0 +1,183 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Besides EPUB and PDF, Send-to-Kindle takes Word documents, RTF, HTML,
+// plain text and images as they are; FB2 (see ConvertFB2ToEPUB), comics
+// (see ConvertComicToEPUB) and DjVu (with Calibre) are converted to EPUB.
+// detectFileFormat recognizes all of them from the bytes alone, as Anna's
+// Archive mirrors don't send a useful Content-Type.
+
+// sniffSize bounds how much of a file the text-based checks look at.
+const sniffSize = 64 << 10
+
+// isDOCXZip reports whether a zip is a Word document: an OOXML package with a
+// word/document.xml part. ODT, XLSX and CBZ are zips too and are not.
+func isDOCXZip(z *safeZip) bool {
+	var types, document bool
+	for _, f := range z.files() {
+		switch f.Name {
+		case "[Content_Types].xml":
+			types = true
+		case "word/document.xml":
+			document = true
+		}
+	}
+	return types && document
+}
+
+// isFB2Zip reports whether a zip holds an FB2 book (".fb2.zip"), which
+// ConvertFB2ToEPUB unpacks.
+func isFB2Zip(z *safeZip) bool {
+	for _, f := range z.files() {
+		if strings.HasSuffix(strings.ToLower(f.Name), ".fb2") {
+			return true
+		}
+	}
+	return false
+}
+
+// isComicZip reports whether a zip is a comic book (CBZ): mostly page
+// images, the first of which really is one.
+func isComicZip(z *safeZip) bool {
+	var pages []*zip.File
+	files := 0
+	for _, f := range z.files() {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		files++
+		if isComicEntry(f.Name) {
+			pages = append(pages, f)
+		}
+	}
+	if len(pages) == 0 || 2*len(pages) < files {
+		return false
+	}
+	b, err := z.readFile(pages[0])
+	if err != nil {
+		return false
+	}
+	ext, _ := sniffImage(b)
+	return ext != ""
+}
+
+// zipFormat names the format of a zip the way detectFileFormat does:
+// "epub", "docx", "fb2", "cbz", or "unknown" for any other zip.
+func zipFormat(z *safeZip) string {
+	switch {
+	case zipIsEPUB(z):
+		return "epub"
+	case isDOCXZip(z):
+		return "docx"
+	case isFB2Zip(z):
+		return "fb2"
+	case isComicZip(z):
+		return "cbz"
+	}
+	return "unknown"
+}
+
+// oleMagic starts every OLE compound file, the container of legacy .doc.
+var oleMagic = []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")
+
+// wordDocumentStream is the directory entry name of a .doc's main stream.
+var wordDocumentStream = utf16le("WordDocument")
+
+// isWordDoc reports whether data is a legacy .doc: an OLE compound file
+// holding a WordDocument stream (Excel and PowerPoint files are OLE too).
+func isWordDoc(data []byte) bool {
+	return bytes.HasPrefix(data, oleMagic) && bytes.Contains(data, wordDocumentStream)
+}
+
+func utf16le(s string) []byte {
+	b := make([]byte, 0, 2*len(s))
+	for _, c := range []byte(s) {
+		b = append(b, c, 0)
+	}
+	return b
+}
+
+// isDjVu reports whether data is a DjVu document, single or multi-page.
+func isDjVu(data []byte) bool {
+	return len(data) >= 16 && string(data[:8]) == "AT&TFORM" &&
+		(string(data[12:16]) == "DJVU" || string(data[12:16]) == "DJVM")
+}
+
+// isBMP reports whether data is a Windows bitmap. "BM" alone is too weak a
+// signature, so the reserved header fields and DIB header size are checked.
+func isBMP(data []byte) bool {
+	if len(data) < 26 || string(data[:2]) != "BM" || binary.LittleEndian.Uint32(data[6:10]) != 0 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(data[14:18]) {
+	case 12, 40, 52, 56, 64, 108, 124:
+		return true
+	}
+	return false
+}
+
+// textHead is the start of data with any UTF-8 byte order mark and leading
+// whitespace removed, for the markup checks.
+func textHead(data []byte) []byte {
+	head := data[:min(len(data), sniffSize)]
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	return bytes.TrimLeft(head, " \t\r\n")
+}
+
+// isFB2 reports whether data is a FictionBook 2 document: XML with a
+// FictionBook root element.
+func isFB2(data []byte) bool {
+	head := textHead(data)
+	if !bytes.HasPrefix(head, []byte("<?xml")) && !bytes.HasPrefix(head, []byte("<FictionBook")) {
+		return false
+	}
+	return bytes.Contains(head[:min(len(head), 4096)], []byte("<FictionBook"))
+}
+
+// isHTMLDoc reports whether data is an HTML or XHTML page.
+func isHTMLDoc(data []byte) bool {
+	head := textHead(data)
+	if strings.HasPrefix(http.DetectContentType(head), "text/html") {
+		return true
+	}
+	return bytes.HasPrefix(head, []byte("<?xml")) &&
+		bytes.Contains(bytes.ToLower(head[:min(len(head), 4096)]), []byte("<html"))
+}
+
+// isPlainText reports whether data is UTF-8 text without control characters
+// other than tabs, line and page breaks.
+func isPlainText(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	head := bytes.TrimPrefix(data[:min(len(data), sniffSize)], []byte("\xef\xbb\xbf"))
+	if len(data) > sniffSize {
+		// Don't hold a rune cut in half at the end of the sample against it.
+		for i := 0; i < utf8.UTFMax-1 && len(head) > 0 && !utf8.Valid(head); i++ {
+			head = head[:len(head)-1]
+		}
+	}
+	if !utf8.Valid(head) {
+		return false
+	}
+	for _, c := range head {
+		if (c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// DetectFileFormat names the format of a book file from its bytes the way
+// the send pipeline does: "epub", "pdf", "cbz", ..., or "unknown".
+func DetectFileFormat(data []byte) (format, mimeType string) {
+	return detectFileFormat("", data)
+}
@@ -0,0 +1,97 @@
+package anna
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestDetectFileFormat_DocumentsAndImages(t *testing.T) {
+	bmp := make([]byte, 58)
+	copy(bmp, "BM")
+	binary.LittleEndian.PutUint32(bmp[2:], 58)
+	binary.LittleEndian.PutUint32(bmp[10:], 54)
+	binary.LittleEndian.PutUint32(bmp[14:], 40)
+
+	doc := append([]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), make([]byte, 504)...)
+	doc = append(doc, utf16le("WordDocument")...)
+
+	prose := strings.Repeat("It was a pleasure to burn. ", 100)
+	for name, tc := range map[string]struct {
+		data       []byte
+		format, mt string
+	}{
+		"docx": {makeZip(t, map[string]string{"[Content_Types].xml": "<Types/>", "word/document.xml": "<w:document/>"}),
+			"docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		"doc":        {doc, "doc", "application/msword"},
+		"rtf":        {[]byte(`{\rtf1\ansi Hello}`), "rtf", "application/rtf"},
+		"djvu":       {[]byte("AT&TFORM\x00\x00\x10\x00DJVMDIRM"), "djvu", "image/vnd.djvu"},
+		"jpeg":       {noisyJPEG(t, 8, 8), "jpg", "image/jpeg"},
+		"png":        {tinyPNG(t), "png", "image/png"},
+		"gif":        {[]byte("GIF89a\x01\x00\x01\x00"), "gif", "image/gif"},
+		"bmp":        {bmp, "bmp", "image/bmp"},
+		"fb2":        {[]byte("\xef\xbb\xbf<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<FictionBook xmlns=\"http://www.gribuser.ru/xml/fictionbook/2.0\"><body/></FictionBook>"), "fb2", "application/x-fictionbook+xml"},
+		"html":       {[]byte("  <!DOCTYPE html><html><body><p>Hi</p></body></html>"), "html", "text/html"},
+		"xhtml":      {[]byte(`<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"/>`), "html", "text/html"},
+		"bare html":  {[]byte("<script>location='/captcha'</script>"), "html", "text/html"},
+		"txt":        {[]byte(prose), "txt", "text/plain"},
+		"utf-8 txt":  {[]byte("Преступление и наказание\r\n\tЧасть первая\n"), "txt", "text/plain"},
+		"binary":     {[]byte("\x00\x01\x02\x03garbage"), "unknown", "application/octet-stream"},
+		"latin-1":    {[]byte("caf\xe9 cr\xe8me"), "unknown", "application/octet-stream"},
+		"xlsx":       {makeZip(t, map[string]string{"[Content_Types].xml": "<Types/>", "xl/workbook.xml": "<workbook/>"}), "unknown", "application/octet-stream"},
+		"excel":      {append([]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), utf16le("Workbook")...), "unknown", "application/octet-stream"},
+		"bm text":    {[]byte("BMW owners' manual, abridged edition"), "txt", "text/plain"},
+		"epub first": {makeZip(t, validEPUBEntries()), "epub", "application/epub+zip"},
+	} {
+		if f, mt := detectFileFormat("", tc.data); f != tc.format || mt != tc.mt {
+			t.Errorf("%s: detected %q (%s), want %q (%s)", name, f, mt, tc.format, tc.mt)
+		}
+	}
+}
+
+func TestDetectFileFormat_ContentType(t *testing.T) {
+	for ct, want := range map[string]string{
+		"application/epub+zip": "epub",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document": "docx",
+		"application/msword":            "doc",
+		"image/jpeg":                    "jpg",
+		"image/vnd.djvu":                "djvu",
+		"text/html; charset=utf-8":      "unknown", // error pages look like this
+		"text/plain":                    "unknown",
+		"application/x-fictionbook+xml": "fb2",
+	} {
+		if f, _ := detectFileFormat(ct, []byte("\x00")); f != want {
+			t.Errorf("Content-Type %q detected as %q, want %q", ct, f, want)
+		}
+	}
+}
+
+func TestKindleAccepts(t *testing.T) {
+	for _, f := range []string{"epub", "pdf", "docx", "doc", "rtf", "html", "txt", "jpg", "png", "gif", "bmp"} {
+		if !kindleAccepts(f) {
+			t.Errorf("%s should be sent as is", f)
+		}
+	}
+	for _, f := range []string{"mobi", "azw3", "fb2", "djvu", "unknown"} {
+		if kindleAccepts(f) {
+			t.Errorf("%s should be converted", f)
+		}
+	}
+}
+
+func TestMentionsFormat(t *testing.T) {
+	for text, want := range map[string]bool{
+		"English [en], .epub, 🚀/lgli/zlib, 1.2MB": true,
+		"pdf, 3.4 MB":                                true,
+		"Russian [ru], fb2":                          true,
+		"The Doctor's Dilemma":                       false,
+		"A Document of Civilisation":                 false,
+		"https://covers.example/img/dune.jpg":        false,
+		"Teaching HTML and CSS to Kids":              false,
+		"Thoughts on the txtual Nature of Documents": false,
+	} {
+		if got := mentionsFormat(text); got != want {
+			t.Errorf("mentionsFormat(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
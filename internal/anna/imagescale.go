@@ -0,0 +1,77 @@
+package anna
+
+import (
+	"image"
+	"image/draw"
+)
+
+// downscale shrinks img so its longer side is at most maxDim, averaging the
+// source pixels under each destination pixel (a box filter — plenty for
+// photos headed to a 300 ppi e-ink screen). Grayscale images stay grayscale
+// so they re-encode small. Images already small enough are returned as-is.
+func downscale(img image.Image, maxDim int) image.Image {
+	sb := img.Bounds()
+	w, h := sb.Dx(), sb.Dy()
+	if maxDim <= 0 || (w <= maxDim && h <= maxDim) || w == 0 || h == 0 {
+		return img
+	}
+	dw, dh := maxDim, h*maxDim/w
+	if h > w {
+		dw, dh = w*maxDim/h, maxDim
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	if g, ok := img.(*image.Gray); ok {
+		dst := image.NewGray(image.Rect(0, 0, dw, dh))
+		boxFilter(g.Pix, g.Stride, w, h, dst.Pix, dst.Stride, dw, dh, 1)
+		return dst
+	}
+	src, ok := img.(*image.NRGBA)
+	if !ok || src.Rect.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(src, src.Rect, img, sb.Min, draw.Src)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	boxFilter(src.Pix, src.Stride, w, h, dst.Pix, dst.Stride, dw, dh, 4)
+	return dst
+}
+
+// boxFilter averages channels-per-pixel interleaved samples from an sw×sh
+// source into a dw×dh destination.
+func boxFilter(src []uint8, sstride, sw, sh int, dst []uint8, dstride, dw, dh, channels int) {
+	sum := make([]uint32, channels)
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*sh/dh, (dy+1)*sh/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*sw/dw, (dx+1)*sw/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			for c := range sum {
+				sum[c] = 0
+			}
+			for y := y0; y < y1; y++ {
+				row := src[y*sstride:]
+				for x := x0; x < x1; x++ {
+					p := row[x*channels:]
+					for c := 0; c < channels; c++ {
+						sum[c] += uint32(p[c])
+					}
+				}
+			}
+			n := uint32((y1 - y0) * (x1 - x0))
+			out := dst[dy*dstride+dx*channels:]
+			for c := 0; c < channels; c++ {
+				out[c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+}
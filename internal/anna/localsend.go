@@ -0,0 +1,99 @@
+package anna
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Local transports hand the message to the machine's own mail system instead
+// of talking SMTP ourselves: a sendmail-compatible binary (Postfix, msmtp,
+// nullmailer, ...) or a Maildir that another process picks up.
+
+const defaultSendmailPath = "/usr/sbin/sendmail"
+
+// sendmailTimeout bounds a single sendmail invocation.
+const sendmailTimeout = 2 * time.Minute
+
+// SendmailSender pipes the message to a sendmail-compatible binary.
+type SendmailSender struct {
+	Path string
+}
+
+func (s *SendmailSender) Send(env Envelope, msg io.WriterTo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendmailTimeout)
+	defer cancel()
+
+	// -i: a lone "." line is not end-of-message; -f: envelope sender.
+	args := append([]string{"-i", "-f", env.From, "--"}, env.To...)
+	cmd := exec.CommandContext(ctx, s.Path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %w", s.Path, err)
+	}
+	_, werr := msg.WriteTo(stdin)
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s timed out after %s", s.Path, sendmailTimeout)
+		}
+		return fmt.Errorf("%s failed: %w (%s)", s.Path, err, truncate(stderr.String(), 300))
+	}
+	if werr != nil {
+		return fmt.Errorf("write message to %s: %w", s.Path, werr)
+	}
+	return nil
+}
+
+// MaildirSender drops the message into a Maildir's new/ directory, using the
+// standard write-to-tmp-then-rename dance so readers never see partial files.
+type MaildirSender struct {
+	Dir string
+}
+
+var maildirSeq atomic.Uint64
+
+func (s *MaildirSender) Send(env Envelope, msg io.WriterTo) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(s.Dir, sub), 0700); err != nil {
+			return fmt.Errorf("create maildir: %w", err)
+		}
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "." +
+		strconv.Itoa(os.Getpid()) + "_" + strconv.FormatUint(maildirSeq.Add(1), 10) + "." + host
+
+	tmpPath := filepath.Join(s.Dir, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("create maildir file: %w", err)
+	}
+	_, werr := msg.WriteTo(f)
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("write maildir file: %w", werr)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.Dir, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("deliver maildir file: %w", err)
+	}
+	return nil
+}
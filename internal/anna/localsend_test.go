@@ -0,0 +1,94 @@
+package anna
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendmailSender_PipesMessageAndEnvelope(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "sendmail-stub")
+	sh := "#!/bin/sh\necho \"$@\" > \"" + out + ".args\"\ncat > \"" + out + "\"\n"
+	if err := os.WriteFile(script, []byte(sh), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &SendmailSender{Path: script}
+	if err := s.Send(testEnvelope(), strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	args, _ := os.ReadFile(out + ".args")
+	if strings.TrimSpace(string(args)) != "-i -f reader@example.com -- reader_x@kindle.com" {
+		t.Errorf("sendmail args = %q", args)
+	}
+	got, _ := os.ReadFile(out)
+	if string(got) != "Subject: hi\r\n\r\nbody\r\n" {
+		t.Errorf("sendmail stdin = %q", got)
+	}
+}
+
+func TestSendmailSender_Failure(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "sendmail-fail")
+	os.WriteFile(script, []byte("#!/bin/sh\ncat >/dev/null\necho 'queue full' >&2\nexit 75\n"), 0700)
+	err := (&SendmailSender{Path: script}).Send(testEnvelope(), strings.NewReader("x"))
+	if err == nil || !strings.Contains(err.Error(), "queue full") {
+		t.Fatalf("expected stderr in the error, got %v", err)
+	}
+}
+
+func TestMaildirSender_DeliversToNew(t *testing.T) {
+	dir := t.TempDir()
+	s := &MaildirSender{Dir: dir}
+	for i := 0; i < 2; i++ {
+		if err := s.Send(testEnvelope(), strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	newFiles, _ := os.ReadDir(filepath.Join(dir, "new"))
+	tmpFiles, _ := os.ReadDir(filepath.Join(dir, "tmp"))
+	if len(newFiles) != 2 || len(tmpFiles) != 0 {
+		t.Fatalf("expected 2 files in new/ and none in tmp/, got %d and %d", len(newFiles), len(tmpFiles))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur")); err != nil {
+		t.Error("cur/ must exist for a valid Maildir")
+	}
+}
+
+func TestMailConfig_ValidateAndSelect(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     MailConfig
+		wantErr bool
+		want    string
+	}{
+		{"smtp complete", MailConfig{Host: "smtp.gmail.com", Port: "587", User: "u", Password: "p", FromEmail: "f"}, false, "*anna.SMTPSender"},
+		{"smtp missing password", MailConfig{Host: "smtp.gmail.com", User: "u", FromEmail: "f"}, true, ""},
+		{"xoauth2 without token", MailConfig{Host: "h", User: "u", FromEmail: "f", Auth: "xoauth2"}, true, ""},
+		{"xoauth2 refresh", MailConfig{Host: "h", User: "u", FromEmail: "f", Auth: "XOAUTH2", OAuthClientID: "c", OAuthRefreshToken: "r"}, false, "*anna.SMTPSender"},
+		{"bad security", MailConfig{Host: "h", User: "u", Password: "p", FromEmail: "f", Security: "ssl3"}, true, ""},
+		{"sendmail", MailConfig{Transport: "sendmail", FromEmail: "f"}, false, "*anna.SendmailSender"},
+		{"maildir needs dir", MailConfig{Transport: "maildir"}, true, ""},
+		{"maildir", MailConfig{Transport: "maildir", MaildirPath: "/tmp/x"}, false, "*anna.MaildirSender"},
+		{"unknown transport", MailConfig{Transport: "pigeon"}, true, ""},
+	}
+	for _, tc := range cases {
+		s, err := NewSender(tc.cfg)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if got := fmt.Sprintf("%T", s); tc.want != "" && got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+	if got := (MailConfig{Port: "465"}).security(); got != SecurityTLS {
+		t.Errorf("port 465 should default to implicit TLS, got %q", got)
+	}
+	if err := (MailConfig{}).Validate(); err != errEmailNotConfigured {
+		t.Errorf("empty config must return the well-known not-configured error, got %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package anna
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"time"
+)
+
+// Send-to-Kindle emails used to be assembled by hand with a fixed
+// "boundary123" boundary and the raw title pasted into the Subject header and
+// the attachment's filename parameter. That works for ASCII titles, but a
+// French, Japanese or Russian title produced an invalid header and Amazon
+// either showed a garbled document name or dropped the document entirely.
+// kindleMessage composes a standards-compliant RFC 5322 / MIME message instead:
+// random boundary, RFC 2047 encoded Subject, RFC 2231 encoded filename, and the
+// Date and Message-ID headers that some receiving MTAs insist on.
+
+// mimeRand and mimeNow are package vars so tests can make boundaries,
+// Message-IDs and Date headers deterministic for golden-file comparison.
+var (
+	mimeRand io.Reader = rand.Reader
+	mimeNow            = time.Now
+)
+
+// mimeLineLen is the maximum encoded line length recommended by RFC 2045/5322.
+const mimeLineLen = 76
+
+// kindleMessage is a single Send-to-Kindle email: a short text/plain body and
+// one attachment.
+type kindleMessage struct {
+	From       string
+	To         string
+	Subject    string // Subject header (Amazon shows this only in error emails)
+	Body       string // text/plain part
+	Filename   string // attachment filename; Amazon uses it as the document name
+	MimeType   string
+	Attachment []byte
+
+	Date      time.Time
+	MessageID string // including angle brackets
+	Boundary  string
+}
+
+// newKindleMessage fills in the per-message headers (Date, Message-ID,
+// boundary) for a Send-to-Kindle email.
+func newKindleMessage(from, to, subject, body, filename, mimeType string, attachment []byte) (*kindleMessage, error) {
+	boundary, err := randomToken(18)
+	if err != nil {
+		return nil, fmt.Errorf("generate MIME boundary: %w", err)
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, fmt.Errorf("generate Message-ID: %w", err)
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return &kindleMessage{
+		From:       from,
+		To:         to,
+		Subject:    subject,
+		Body:       body,
+		Filename:   filename,
+		MimeType:   mimeType,
+		Attachment: attachment,
+		Date:       mimeNow(),
+		MessageID:  "<" + id + "@" + messageIDDomain(from) + ">",
+		Boundary:   "=_pibrarian_" + boundary,
+	}, nil
+}
+
+// WriteTo writes the complete RFC 5322 message (CRLF line endings) to w.
+// The attachment is base64-encoded on the fly, so however big the book,
+// composing the message needs only a few small buffers — it streams
+// straight into the SMTP DATA writer, the sendmail pipe or the file.
+func (m *kindleMessage) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriterSize(w, composeBufferSize)
+	cw := &countingWriter{w: bw}
+	m.write(cw)
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+// composeBufferSize batches the many small writes of composing a message
+// into few writes to the transport.
+const composeBufferSize = 32 * 1024
+
+func (m *kindleMessage) write(w *countingWriter) {
+	w.printf("From: %s\r\n", headerSafe(m.From))
+	w.printf("To: %s\r\n", headerSafe(m.To))
+	w.printf("Subject: %s\r\n", encodeHeaderText(m.Subject))
+	w.printf("Date: %s\r\n", m.Date.Format(time.RFC1123Z))
+	w.printf("Message-ID: %s\r\n", m.MessageID)
+	w.printf("MIME-Version: 1.0\r\n")
+	w.printf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", m.Boundary)
+	w.printf("\r\n")
+
+	// Text body
+	w.printf("--%s\r\n", m.Boundary)
+	w.printf("Content-Type: text/plain; charset=utf-8\r\n")
+	w.printf("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n")))
+	qp.Close()
+	w.printf("\r\n")
+
+	// Attachment
+	w.printf("--%s\r\n", m.Boundary)
+	w.printf("Content-Type: %s;%s\r\n", m.MimeType, encodeParam("name", m.Filename))
+	w.printf("Content-Transfer-Encoding: base64\r\n")
+	w.printf("Content-Disposition: attachment;%s\r\n\r\n", encodeParam("filename", m.Filename))
+
+	lw := &lineWrapper{w: w}
+	enc := base64.NewEncoder(base64.StdEncoding, lw)
+	enc.Write(m.Attachment) // errors are latched in w
+	enc.Close()
+	lw.finish()
+
+	w.printf("--%s--\r\n", m.Boundary)
+}
+
+// lineWrapper breaks a stream of base64 text into CRLF-terminated lines of
+// mimeLineLen characters.
+type lineWrapper struct {
+	w   io.Writer
+	col int
+	buf []byte
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	n := len(p)
+	l.buf = l.buf[:0]
+	for len(p) > 0 {
+		take := mimeLineLen - l.col
+		if take > len(p) {
+			take = len(p)
+		}
+		l.buf = append(l.buf, p[:take]...)
+		p = p[take:]
+		if l.col += take; l.col == mimeLineLen {
+			l.buf = append(l.buf, '\r', '\n')
+			l.col = 0
+		}
+	}
+	if _, err := l.w.Write(l.buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// finish terminates a partial last line.
+func (l *lineWrapper) finish() {
+	if l.col > 0 {
+		l.w.Write([]byte("\r\n"))
+		l.col = 0
+	}
+}
+
+// countingWriter tracks bytes written and latches the first error so the
+// composer can write unconditionally and report once.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func (c *countingWriter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(c, format, args...)
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(mimeRand, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// messageIDDomain returns the domain half of the sender address, which keeps
+// our Message-IDs globally unique without leaking the Pi's hostname.
+func messageIDDomain(from string) string {
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		d := strings.Trim(from[i+1:], "<> \t")
+		if d != "" {
+			return d
+		}
+	}
+	return "localhost"
+}
+
+// headerSafe strips CR/LF so a caller-supplied value can't inject headers.
+func headerSafe(s string) string {
+	return strings.NewReplacer("\r", "", "\n", " ").Replace(s)
+}
+
+func isPlainASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeHeaderText returns an unstructured header value (e.g. Subject),
+// RFC 2047 encoded when it isn't plain ASCII. Encoded words are folded onto
+// continuation lines so long titles stay within the header line limit.
+func encodeHeaderText(s string) string {
+	s = headerSafe(s)
+	if isPlainASCII(s) {
+		return s
+	}
+	enc := mime.QEncoding
+	// Q-encoding keeps mostly-Latin titles readable; B is shorter for scripts
+	// where nearly every byte would need escaping (CJK, Cyrillic, ...).
+	if nonASCII := len(s) - countASCII(s); nonASCII*2 > len(s) {
+		enc = mime.BEncoding
+	}
+	return strings.ReplaceAll(enc.Encode("utf-8", s), "?= =?", "?=\r\n =?")
+}
+
+func countASCII(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x80 {
+			n++
+		}
+	}
+	return n
+}
+
+// encodeParam formats a MIME parameter (with a leading space) for use in a
+// Content-Type or Content-Disposition header. ASCII values are quoted as-is.
+// Other values get an ASCII fallback plus the RFC 2231 extended form, split
+// into numbered continuations so no header line grows unbounded.
+func encodeParam(name, value string) string {
+	value = headerSafe(value)
+	if isPlainASCII(value) {
+		return fmt.Sprintf(" %s=\"%s\"", name, quoteParam(value))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, " %s=\"%s\"", name, quoteParam(asciiFallback(value)))
+
+	const chunk = 56
+	pct := percentEncode(value)
+	if len(pct) <= chunk {
+		fmt.Fprintf(&b, ";\r\n %s*=utf-8''%s", name, pct)
+		return b.String()
+	}
+	for i, n := 0, 0; i < len(pct); n++ {
+		end := i + chunk
+		if end > len(pct) {
+			end = len(pct)
+		}
+		// Never split a %XX escape across continuations.
+		if end < len(pct) {
+			if pct[end-1] == '%' {
+				end--
+			} else if end >= 2 && pct[end-2] == '%' {
+				end -= 2
+			}
+		}
+		prefix := ""
+		if n == 0 {
+			prefix = "utf-8''"
+		}
+		fmt.Fprintf(&b, ";\r\n %s*%d*=%s%s", name, n, prefix, pct[i:end])
+		i = end
+	}
+	return b.String()
+}
+
+func quoteParam(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// percentEncode applies RFC 2231 value encoding: attribute-chars pass through,
+// everything else becomes %XX of the UTF-8 bytes.
+func percentEncode(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&0x0f])
+	}
+	return b.String()
+}
+
+// asciiFallback is the plain filename for clients that don't understand
+// RFC 2231: non-ASCII runs collapse to "_", and a name with nothing left
+// but its extension becomes "book.<ext>".
+func asciiFallback(s string) string {
+	var b strings.Builder
+	lastUnderscore := false
+	for _, r := range s {
+		if r >= 0x20 && r <= 0x7e {
+			b.WriteRune(r)
+			lastUnderscore = r == '_'
+			continue
+		}
+		if !lastUnderscore {
+			b.WriteByte('_')
+			lastUnderscore = true
+		}
+	}
+	out := b.String()
+	base, ext := out, ""
+	if i := strings.LastIndex(out, "."); i >= 0 {
+		base, ext = out[:i], out[i:]
+	}
+	if strings.Trim(base, "_ .") == "" {
+		return "book" + ext
+	}
+	return out
+}
@@ -0,0 +1,285 @@
+package anna
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files under testdata/")
+
+// seqReader yields 0,1,2,... so boundaries and Message-IDs are stable in tests.
+type seqReader struct{ n byte }
+
+func (r *seqReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.n
+		r.n++
+	}
+	return len(p), nil
+}
+
+// deterministicMIME pins the random source and clock used by the composer.
+func deterministicMIME(t *testing.T) {
+	t.Helper()
+	origRand, origNow := mimeRand, mimeNow
+	t.Cleanup(func() { mimeRand, mimeNow = origRand, origNow })
+	mimeRand = &seqReader{}
+	mimeNow = func() time.Time { return time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC) }
+}
+
+func composeForTest(t *testing.T, title, filename string) []byte {
+	t.Helper()
+	msg, err := newKindleMessage("reader@gmail.com", "reader_x@kindle.com", filename,
+		"Book: "+title, filename, "application/epub+zip", []byte("PK\x03\x04 fake epub payload "+title))
+	if err != nil {
+		t.Fatalf("newKindleMessage: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "mime", name)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden %s (run with -update to create): %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("message differs from %s (run with -update after verifying)\n--- got ---\n%s", path, got)
+	}
+}
+
+var unicodeTitles = []struct {
+	golden, title string
+}{
+	{"ascii.eml", "The Deal"},
+	{"french.eml", "Les Misérables — Tome Premier"},
+	{"japanese.eml", "吾輩は猫である"},
+	{"russian.eml", "Война и мир. Том первый. Очень длинное название книги для проверки переносов"},
+}
+
+func TestKindleMessage_Golden(t *testing.T) {
+	for _, tc := range unicodeTitles {
+		t.Run(tc.golden, func(t *testing.T) {
+			deterministicMIME(t)
+			checkGolden(t, tc.golden, composeForTest(t, tc.title, tc.title+".epub"))
+		})
+	}
+}
+
+// The golden files pin the exact bytes; this test proves a standard parser
+// recovers the original Unicode subject and filename from them.
+func TestKindleMessage_RoundTripsUnicode(t *testing.T) {
+	for _, tc := range unicodeTitles {
+		t.Run(tc.golden, func(t *testing.T) {
+			filename := tc.title + ".epub"
+			raw := composeForTest(t, tc.title, filename)
+
+			for _, line := range strings.Split(string(raw), "\r\n") {
+				if len(line) > 998 {
+					t.Fatalf("line exceeds RFC 5322 limit: %d chars", len(line))
+				}
+				for i := 0; i < len(line); i++ {
+					if line[i] >= 0x80 {
+						t.Fatalf("raw 8-bit byte in message line %q", line)
+					}
+				}
+			}
+
+			m, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+			if err != nil {
+				t.Fatalf("decode subject: %v", err)
+			}
+			if subject != filename {
+				t.Errorf("subject = %q, want %q", subject, filename)
+			}
+			if m.Header.Get("Date") == "" || m.Header.Get("Message-Id") == "" {
+				t.Error("Date and Message-ID headers are required")
+			}
+
+			_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatalf("parse content-type: %v", err)
+			}
+			mr := multipart.NewReader(m.Body, params["boundary"])
+			if _, err := mr.NextPart(); err != nil { // text body
+				t.Fatalf("text part: %v", err)
+			}
+			att, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("attachment part: %v", err)
+			}
+			_, dparams, err := mime.ParseMediaType(att.Header.Get("Content-Disposition"))
+			if err != nil {
+				t.Fatalf("parse content-disposition: %v", err)
+			}
+			if dparams["filename"] != filename {
+				t.Errorf("filename = %q, want %q", dparams["filename"], filename)
+			}
+		})
+	}
+}
+
+func TestKindleMessage_RandomBoundaryAndMessageID(t *testing.T) {
+	a, err := newKindleMessage("me@example.com", "k@kindle.com", "s", "b", "f.epub", "application/epub+zip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newKindleMessage("me@example.com", "k@kindle.com", "s", "b", "f.epub", "application/epub+zip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Boundary == b.Boundary || a.MessageID == b.MessageID {
+		t.Fatal("boundary and Message-ID must differ between messages")
+	}
+	if !strings.HasSuffix(a.MessageID, "@example.com>") {
+		t.Errorf("Message-ID should use the sender's domain, got %q", a.MessageID)
+	}
+}
+
+func TestKindleMessage_HeaderInjection(t *testing.T) {
+	msg, err := newKindleMessage("me@example.com", "k@kindle.com\r\nBcc: evil@example.com", "x\r\nBcc: evil@example.com",
+		"body", "f.epub", "application/epub+zip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	msg.WriteTo(&buf)
+	if strings.Contains(buf.String(), "\r\nBcc:") {
+		t.Fatalf("CRLF in a header value must not create a new header:\n%s", buf.String())
+	}
+}
+
+func TestAsciiFallback(t *testing.T) {
+	cases := map[string]string{
+		"Les Misérables.epub": "Les Mis_rables.epub",
+		"吾輩は猫である.epub":        "book.epub",
+		"plain.epub":          "plain.epub",
+	}
+	for in, want := range cases {
+		if got := asciiFallback(in); got != want {
+			t.Errorf("asciiFallback(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// wrappedBase64 is the attachment encoding done the simple way: encode
+// everything, then cut into 76-character lines.
+func wrappedBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for i := 0; i < len(encoded); i += mimeLineLen {
+		end := min(i+mimeLineLen, len(encoded))
+		b.WriteString(encoded[i:end] + "\r\n")
+	}
+	return b.String()
+}
+
+func TestKindleMessage_StreamedBase64MatchesReference(t *testing.T) {
+	// Sizes around the 57-byte (one line) and encoder block boundaries.
+	for _, n := range []int{0, 1, 2, 56, 57, 58, 114, 1000, 3*1024 + 7, 100_000} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		msg, err := newKindleMessage("me@example.com", "k@kindle.com", "f.epub", "body", "f.epub", "application/epub+zip", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		n64, err := msg.WriteTo(&buf)
+		if err != nil || n64 != int64(buf.Len()) {
+			t.Fatalf("WriteTo(%d bytes) = %d, %v; wrote %d", n, n64, err, buf.Len())
+		}
+		want := "\r\n\r\n" + wrappedBase64(data) + "--" + msg.Boundary + "--\r\n"
+		if !strings.HasSuffix(buf.String(), want) {
+			t.Errorf("%d-byte attachment: streamed encoding differs from the reference", n)
+		}
+	}
+}
+
+func TestKindleMessage_StreamsWithFlatMemory(t *testing.T) {
+	attachment := make([]byte, 16<<20)
+	msg, err := newKindleMessage("me@example.com", "k@kindle.com", "big.epub", "body", "big.epub", "application/epub+zip", attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := msg.WriteTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("composing a 16 MB message allocated %d bytes; the attachment should be streamed", alloc)
+	}
+}
+
+// BenchmarkKindleMessage compares streaming an 18 MB book into the transport
+// with what SendFileToKindle used to do: base64 the whole attachment into a
+// string, assemble the message in a bytes.Buffer, then hand that over. Run
+// with -benchmem; B/op is the extra memory per send.
+func BenchmarkKindleMessage(b *testing.B) {
+	attachment := make([]byte, 18<<20)
+	for i := range attachment {
+		attachment[i] = byte(i * 31)
+	}
+	msg, err := newKindleMessage("me@example.com", "k@kindle.com", "big.epub", "body", "big.epub", "application/epub+zip", attachment)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(attachment)))
+		for i := 0; i < b.N; i++ {
+			encoded := base64.StdEncoding.EncodeToString(msg.Attachment)
+			var buf bytes.Buffer
+			for j := 0; j < len(encoded); j += mimeLineLen {
+				buf.WriteString(encoded[j:min(j+mimeLineLen, len(encoded))])
+				buf.WriteString("\r\n")
+			}
+			if _, err := buf.WriteTo(io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(attachment)))
+		for i := 0; i < b.N; i++ {
+			if _, err := msg.WriteTo(io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+var _ io.WriterTo = (*kindleMessage)(nil)
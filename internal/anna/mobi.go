@@ -0,0 +1,602 @@
+package anna
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Kindle's own formats — MOBI (KF7), AZW and AZW3 (KF8) — are Palm databases:
+// a table of records holding a header, the compressed book text, then images,
+// fonts and index tables. Amazon's Send-to-Kindle email no longer accepts
+// them, yet plenty of books only turn up in those formats. This file reads
+// the container: record table, headers, EXTH metadata, and the PalmDOC and
+// HUFF/CDIC text compression. mobiconvert.go turns the result into an EPUB.
+
+// ErrMOBIDRM means the MOBI/AZW file is encrypted, so it can't be converted.
+var ErrMOBIDRM = errors.New("the file is DRM-protected (encrypted MOBI/AZW); it can't be converted")
+
+const (
+	mobiCompressionNone    = 1
+	mobiCompressionPalmDOC = 2
+	mobiCompressionHuff    = 17480
+
+	// maxMOBITextBytes bounds the decompressed text, so a corrupt or hostile
+	// file can't make us allocate without limit.
+	maxMOBITextBytes = 64 << 20
+
+	// mobiNoIndex marks an absent record number in a MOBI header.
+	mobiNoIndex = 0xFFFFFFFF
+)
+
+// pdbFile is a Palm database: a header and a table of record offsets.
+type pdbFile struct {
+	data    []byte
+	offsets []int // start of each record, then len(data)
+}
+
+func parsePDB(data []byte) (*pdbFile, error) {
+	if len(data) < 78 || string(data[60:68]) != "BOOKMOBI" {
+		return nil, errors.New("not a MOBI/AZW file (no BOOKMOBI header)")
+	}
+	n := int(binary.BigEndian.Uint16(data[76:]))
+	if n == 0 || 78+8*n > len(data) {
+		return nil, errors.New("MOBI record table is truncated")
+	}
+	p := &pdbFile{data: data}
+	prev := 78 + 8*n
+	for i := 0; i < n; i++ {
+		off := binary.BigEndian.Uint32(data[78+8*i:])
+		if off < uint32(prev) || off > uint32(len(data)) {
+			return nil, fmt.Errorf("MOBI record %d has a bad offset", i)
+		}
+		p.offsets = append(p.offsets, int(off))
+		prev = int(off)
+	}
+	p.offsets = append(p.offsets, len(data))
+	return p, nil
+}
+
+func (p *pdbFile) count() int { return len(p.offsets) - 1 }
+
+// record returns record i, or nil if there is no such record.
+func (p *pdbFile) record(i int) []byte {
+	if i < 0 || i >= p.count() {
+		return nil
+	}
+	return p.data[p.offsets[i]:p.offsets[i+1]]
+}
+
+// mobiHeader is record 0 of a MOBI book, or of the KF8 half of a combined
+// MOBI/KF8 file: the PalmDOC header, the MOBI header and its EXTH metadata.
+// Record numbers are absolute; -1 means absent.
+type mobiHeader struct {
+	start         int // the record holding this header
+	compression   int
+	textLength    int
+	textRecords   int
+	encryption    int
+	encoding      int
+	version       int
+	locale        int
+	extraFlags    int
+	fullName      []byte
+	firstResource int
+	huffRecord    int
+	huffCount     int
+	ncx           int
+	fdst          int // KF8 only, like skel and frag
+	skel          int
+	frag          int
+	exth          map[int][][]byte
+}
+
+func parseMOBIHeader(p *pdbFile, start int) (*mobiHeader, error) {
+	r := p.record(start)
+	if len(r) < 40 || string(r[16:20]) != "MOBI" {
+		return nil, errors.New("missing MOBI header")
+	}
+	be := binary.BigEndian
+	end := 16 + int(be.Uint32(r[20:])) // the MOBI header's length counts from its identifier
+	if end > len(r) {
+		end = len(r)
+	}
+	u32 := func(off int) (uint32, bool) {
+		if off+4 > end {
+			return 0, false
+		}
+		return be.Uint32(r[off:]), true
+	}
+	num := func(off int) int {
+		v, _ := u32(off)
+		return int(v & 0x7FFFFFFF)
+	}
+	index := func(off int) int {
+		v, ok := u32(off)
+		if !ok || v == mobiNoIndex || v >= uint32(p.count()) {
+			return -1
+		}
+		return start + int(v)
+	}
+
+	h := &mobiHeader{
+		start:       start,
+		compression: int(be.Uint16(r[0:])),
+		textRecords: int(be.Uint16(r[8:])),
+		encryption:  int(be.Uint16(r[12:])),
+		encoding:    num(28),
+		version:     num(36),
+		locale:      num(92),
+		ncx:         -1,
+		fdst:        -1,
+		skel:        -1,
+		frag:        -1,
+		exth:        map[int][][]byte{},
+	}
+	tl := be.Uint32(r[4:])
+	if tl > maxMOBITextBytes {
+		return nil, fmt.Errorf("MOBI text length %d is implausibly large", tl)
+	}
+	h.textLength = int(tl)
+	if off, n := num(84), num(88); n <= len(r) && off <= len(r)-n {
+		h.fullName = r[off : off+n]
+	}
+	h.firstResource = index(108)
+	h.huffRecord = index(112)
+	h.huffCount = num(116)
+	if flags, _ := u32(128); flags&0x40 != 0 {
+		h.exth = parseEXTH(r[end:])
+	}
+	if h.version >= 5 && end >= 16+0xE4 {
+		h.extraFlags = int(be.Uint16(r[0xF2:]))
+	}
+	h.ncx = index(0xF4)
+	if h.version >= 8 {
+		h.fdst = index(0xC0)
+		h.frag = index(0xF8)
+		h.skel = index(0xFC)
+	}
+	return h, nil
+}
+
+// parseEXTH reads the EXTH metadata block: typed records, some repeated
+// (one 100 per author).
+func parseEXTH(b []byte) map[int][][]byte {
+	out := map[int][][]byte{}
+	if len(b) < 12 || string(b[:4]) != "EXTH" {
+		return out
+	}
+	n := binary.BigEndian.Uint32(b[8:])
+	pos := 12
+	for i := uint32(0); i < n && pos+8 <= len(b); i++ {
+		typ := binary.BigEndian.Uint32(b[pos:])
+		size := binary.BigEndian.Uint32(b[pos+4:])
+		if size < 8 || uint64(pos)+uint64(size) > uint64(len(b)) {
+			break
+		}
+		out[int(typ)] = append(out[int(typ)], b[pos+8:pos+int(size)])
+		pos += int(size)
+	}
+	return out
+}
+
+// EXTH record types used in conversion.
+const (
+	exthAuthor      = 100
+	exthPublisher   = 101
+	exthDescription = 103
+	exthISBN        = 104
+	exthSubject     = 105
+	exthDate        = 106
+	exthKF8Boundary = 121
+	exthCoverOffset = 201
+	exthTitle       = 503
+	exthLanguage    = 524
+)
+
+// exthStrings returns every value of an EXTH string record, decoded.
+func (h *mobiHeader) exthStrings(typ int) []string {
+	var out []string
+	for _, v := range h.exth[typ] {
+		if s := strings.TrimSpace(h.decode(v)); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (h *mobiHeader) exthString(typ int) string {
+	if v := h.exthStrings(typ); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (h *mobiHeader) exthInt(typ int) (int, bool) {
+	v := h.exth[typ]
+	if len(v) == 0 || len(v[0]) != 4 {
+		return 0, false
+	}
+	n := binary.BigEndian.Uint32(v[0])
+	return int(n & 0x7FFFFFFF), n != mobiNoIndex
+}
+
+// decode converts text in the book's encoding (UTF-8 or Windows-1252) to UTF-8.
+func (h *mobiHeader) decode(b []byte) string {
+	if h.encoding == 1252 {
+		if s, err := charmap.Windows1252.NewDecoder().Bytes(b); err == nil {
+			return string(s)
+		}
+	}
+	if !utf8.Valid(b) {
+		return strings.ToValidUTF8(string(b), "�")
+	}
+	return string(b)
+}
+
+// title is the book's title: EXTH 503 if set, else the header's full name.
+func (h *mobiHeader) title() string {
+	if t := h.exthString(exthTitle); t != "" {
+		return t
+	}
+	return strings.TrimSpace(h.decode(h.fullName))
+}
+
+// text decompresses the text records into the book's raw markup, stopping
+// between records once ctx is done.
+func (h *mobiHeader) text(ctx context.Context, p *pdbFile) ([]byte, error) {
+	var huff *huffDecoder
+	switch h.compression {
+	case mobiCompressionNone, mobiCompressionPalmDOC:
+	case mobiCompressionHuff:
+		var err error
+		if huff, err = newHuffDecoder(p, h.huffRecord, h.huffCount); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported MOBI compression type %d", h.compression)
+	}
+
+	out := make([]byte, 0, h.textLength)
+	for i := 1; i <= h.textRecords; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rec := p.record(h.start + i)
+		if rec == nil {
+			return nil, fmt.Errorf("MOBI text record %d is missing", i)
+		}
+		rec = rec[:len(rec)-trailingEntriesSize(rec, h.extraFlags)]
+		var err error
+		switch h.compression {
+		case mobiCompressionNone:
+			out = append(out, rec...)
+		case mobiCompressionPalmDOC:
+			out, err = palmDOCDecompress(out, rec)
+		case mobiCompressionHuff:
+			out, err = huff.decompress(out, rec, 0)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("MOBI text record %d: %w", i, err)
+		}
+		if len(out) > maxMOBITextBytes {
+			return nil, errors.New("MOBI text decompresses to an implausible size")
+		}
+	}
+	if len(out) > h.textLength {
+		out = out[:h.textLength]
+	}
+	return out, nil
+}
+
+// trailingEntriesSize is how many bytes at the end of a text record are
+// trailing entries (indexing and multibyte-overlap data) rather than text.
+// Bit 0 of flags marks multibyte overlap bytes; each higher set bit marks one
+// entry whose size is stored at the end of the record.
+func trailingEntriesSize(rec []byte, flags int) int {
+	n := 0
+	for f := flags >> 1; f != 0; f >>= 1 {
+		if f&1 == 0 {
+			continue
+		}
+		n += trailingEntrySize(rec[:len(rec)-n])
+		if n >= len(rec) {
+			return len(rec)
+		}
+	}
+	if flags&1 != 0 && n < len(rec) {
+		n += int(rec[len(rec)-n-1]&3) + 1
+	}
+	return min(n, len(rec))
+}
+
+// trailingEntrySize reads the size stored at the end of b: a variable-width
+// integer written backwards, seven bits a byte, whose first byte has the high
+// bit set.
+func trailingEntrySize(b []byte) int {
+	v, shift := 0, 0
+	for i := len(b) - 1; i >= 0; i-- {
+		v |= int(b[i]&0x7F) << shift
+		shift += 7
+		if b[i]&0x80 != 0 || shift >= 28 {
+			break
+		}
+	}
+	return v
+}
+
+// palmDOCDecompress appends the PalmDOC (LZ77 variant) decompression of src
+// to dst.
+func palmDOCDecompress(dst, src []byte) ([]byte, error) {
+	for i := 0; i < len(src); {
+		c := src[i]
+		i++
+		switch {
+		case c >= 1 && c <= 8: // the next c bytes are literal
+			if i+int(c) > len(src) {
+				return dst, errors.New("PalmDOC literal runs past the end of the record")
+			}
+			dst = append(dst, src[i:i+int(c)]...)
+			i += int(c)
+		case c < 0x80:
+			dst = append(dst, c)
+		case c >= 0xC0: // a space followed by an ASCII character
+			dst = append(dst, ' ', c^0x80)
+		default: // back-reference: 11 bits of distance, 3 bits of length
+			if i >= len(src) {
+				return dst, errors.New("PalmDOC back-reference is truncated")
+			}
+			v := int(c)<<8 | int(src[i])
+			i++
+			dist, n := (v&0x3FFF)>>3, v&7+3
+			if dist == 0 || dist > len(dst) {
+				return dst, errors.New("PalmDOC back-reference points before the start of the text")
+			}
+			for j := 0; j < n; j++ {
+				dst = append(dst, dst[len(dst)-dist])
+			}
+		}
+	}
+	return dst, nil
+}
+
+// huffDecoder decompresses HUFF/CDIC text: a canonical Huffman code whose
+// symbols index a phrase dictionary, where phrases may themselves be
+// compressed.
+type huffDecoder struct {
+	dict1   [256]huffCode
+	minCode [33]uint64
+	maxCode [33]uint64
+	phrases []huffPhrase
+}
+
+type huffCode struct {
+	length  uint
+	term    bool
+	maxCode uint64
+}
+
+type huffPhrase struct {
+	data    []byte
+	literal bool // data is decompressed
+	busy    bool // being expanded; seeing it again means a cycle
+}
+
+// newHuffDecoder loads the HUFF record at first and the count-1 CDIC records
+// that follow it.
+func newHuffDecoder(p *pdbFile, first, count int) (*huffDecoder, error) {
+	be := binary.BigEndian
+	huff := p.record(first)
+	if len(huff) < 16 || string(huff[:8]) != "HUFF\x00\x00\x00\x18" {
+		return nil, errors.New("MOBI HUFF record is missing or invalid")
+	}
+	off1, off2 := int(be.Uint32(huff[8:])&0xFFFFFF), int(be.Uint32(huff[12:])&0xFFFFFF)
+	if off1+256*4 > len(huff) || off2+64*4 > len(huff) {
+		return nil, errors.New("MOBI HUFF tables are truncated")
+	}
+	d := &huffDecoder{}
+	for i := range d.dict1 {
+		v := be.Uint32(huff[off1+4*i:])
+		length := uint(v & 0x1F)
+		if length == 0 {
+			return nil, errors.New("MOBI HUFF table has a zero-length code")
+		}
+		d.dict1[i] = huffCode{
+			length:  length,
+			term:    v&0x80 != 0,
+			maxCode: ((uint64(v>>8) + 1) << (32 - length)) - 1,
+		}
+	}
+	d.maxCode[0] = 1<<32 - 1
+	for n := uint(1); n <= 32; n++ {
+		lo := uint64(be.Uint32(huff[off2+8*int(n-1):]))
+		hi := uint64(be.Uint32(huff[off2+8*int(n-1)+4:]))
+		d.minCode[n] = lo << (32 - n)
+		d.maxCode[n] = ((hi + 1) << (32 - n)) - 1
+	}
+
+	for i := 1; i < count; i++ {
+		cdic := p.record(first + i)
+		if len(cdic) < 16 || string(cdic[:8]) != "CDIC\x00\x00\x00\x10" {
+			return nil, fmt.Errorf("MOBI CDIC record %d is missing or invalid", i)
+		}
+		total := int(be.Uint32(cdic[8:]) & 0x7FFFFFFF)
+		bits := be.Uint32(cdic[12:])
+		n := total - len(d.phrases)
+		if bits < 31 {
+			n = min(n, 1<<bits)
+		}
+		for j := 0; j < n; j++ {
+			if 16+2*j+2 > len(cdic) {
+				return nil, fmt.Errorf("MOBI CDIC record %d is truncated", i)
+			}
+			off := 16 + int(be.Uint16(cdic[16+2*j:]))
+			if off+2 > len(cdic) {
+				return nil, fmt.Errorf("MOBI CDIC record %d is truncated", i)
+			}
+			blen := be.Uint16(cdic[off:])
+			end := off + 2 + int(blen&0x7FFF)
+			if end > len(cdic) {
+				return nil, fmt.Errorf("MOBI CDIC record %d is truncated", i)
+			}
+			d.phrases = append(d.phrases, huffPhrase{data: cdic[off+2 : end], literal: blen&0x8000 != 0})
+		}
+	}
+	return d, nil
+}
+
+// decompress appends the decompression of src to dst. depth guards against
+// runaway phrase nesting.
+func (d *huffDecoder) decompress(dst, src []byte, depth int) ([]byte, error) {
+	if depth > 32 {
+		return dst, errors.New("HUFF phrases nest too deeply")
+	}
+	bitsLeft := len(src) * 8
+	buf := make([]byte, len(src)+8)
+	copy(buf, src)
+	pos := 0
+	x := binary.BigEndian.Uint64(buf)
+	n := 32
+	for {
+		if n <= 0 {
+			pos += 4
+			x = binary.BigEndian.Uint64(buf[pos:])
+			n += 32
+		}
+		code := (x >> uint(n)) & 0xFFFFFFFF
+		c := d.dict1[code>>24]
+		length, maxCode := c.length, c.maxCode
+		if !c.term {
+			for length < 32 && code < d.minCode[length] {
+				length++
+			}
+			maxCode = d.maxCode[length]
+		}
+		n -= int(length)
+		bitsLeft -= int(length)
+		if bitsLeft < 0 {
+			break
+		}
+		r := (maxCode - code) >> (32 - length)
+		if r >= uint64(len(d.phrases)) {
+			return dst, errors.New("HUFF code refers past the end of the dictionary")
+		}
+		ph := &d.phrases[r]
+		if !ph.literal {
+			if ph.busy {
+				return dst, errors.New("HUFF dictionary refers to itself")
+			}
+			ph.busy = true
+			out, err := d.decompress(nil, ph.data, depth+1)
+			ph.busy = false
+			if err != nil {
+				return dst, err
+			}
+			ph.data, ph.literal = out, true
+		}
+		dst = append(dst, ph.data...)
+		if len(dst) > maxMOBITextBytes {
+			return dst, errors.New("HUFF text decompresses to an implausible size")
+		}
+	}
+	return dst, nil
+}
+
+// mobiResource is one record of the resource section that the EPUB carries
+// over: an image or an embedded font.
+type mobiResource struct {
+	path      string // zip path in the EPUB
+	mediaType string
+	data      []byte
+}
+
+// resources reads the resource records that follow the text, indexed from
+// firstResource: entry i is nil for records that aren't images or fonts
+// (index tables, audio, placeholders).
+func (h *mobiHeader) resources(p *pdbFile) []*mobiResource {
+	var out []*mobiResource
+	for i := h.firstResource; i >= 0 && i < p.count(); i++ {
+		rec := p.record(i)
+		if bytes.HasPrefix(rec, []byte("\xe9\x8e\r\n")) || bytes.HasPrefix(rec, []byte("BOUNDARY")) {
+			break // end of this book's records
+		}
+		n := len(out) + 1
+		var res *mobiResource
+		if ext, mt := sniffImage(rec); ext != "" {
+			res = &mobiResource{path: fmt.Sprintf("OEBPS/images/image%05d%s", n, ext), mediaType: mt, data: rec}
+		} else if bytes.HasPrefix(rec, []byte("FONT")) {
+			if font, err := decodeFontRecord(rec); err == nil {
+				ext, mt := sniffFont(font)
+				res = &mobiResource{path: fmt.Sprintf("OEBPS/fonts/font%05d%s", n, ext), mediaType: mt, data: font}
+			}
+		}
+		out = append(out, res)
+	}
+	return out
+}
+
+func sniffImage(b []byte) (ext, mediaType string) {
+	switch {
+	case bytes.HasPrefix(b, []byte("\xff\xd8\xff")):
+		return ".jpg", "image/jpeg"
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png", "image/png"
+	case bytes.HasPrefix(b, []byte("GIF87a")), bytes.HasPrefix(b, []byte("GIF89a")):
+		return ".gif", "image/gif"
+	}
+	return "", ""
+}
+
+func sniffFont(b []byte) (ext, mediaType string) {
+	switch {
+	case bytes.HasPrefix(b, []byte("OTTO")):
+		return ".otf", "font/otf"
+	case bytes.HasPrefix(b, []byte("wOFF")):
+		return ".woff", "font/woff"
+	}
+	return ".ttf", "font/ttf"
+}
+
+// decodeFontRecord unpacks a KF8 FONT record: a header, then the font,
+// optionally zlib-compressed, with its first 1040 bytes optionally XORed
+// with a key stored in the record.
+func decodeFontRecord(rec []byte) ([]byte, error) {
+	if len(rec) < 24 {
+		return nil, errors.New("FONT record is truncated")
+	}
+	be := binary.BigEndian
+	flags := be.Uint32(rec[8:])
+	start, keyLen, keyStart := be.Uint32(rec[12:]), be.Uint32(rec[16:]), be.Uint32(rec[20:])
+	if start > uint32(len(rec)) {
+		return nil, errors.New("FONT record data offset is out of range")
+	}
+	font := append([]byte(nil), rec[start:]...)
+	if flags&2 != 0 {
+		if keyLen == 0 || uint64(keyStart)+uint64(keyLen) > uint64(len(rec)) {
+			return nil, errors.New("FONT record key is out of range")
+		}
+		key := rec[keyStart : keyStart+keyLen]
+		for i := 0; i < len(font) && i < 1040; i++ {
+			font[i] ^= key[i%len(key)]
+		}
+	}
+	if flags&1 != 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(font))
+		if err != nil {
+			return nil, fmt.Errorf("FONT record: %w", err)
+		}
+		defer zr.Close()
+		if font, err = io.ReadAll(io.LimitReader(zr, maxMOBITextBytes)); err != nil {
+			return nil, fmt.Errorf("FONT record: %w", err)
+		}
+	}
+	return font, nil
+}
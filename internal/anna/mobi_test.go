@@ -0,0 +1,429 @@
+package anna
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"testing"
+)
+
+// buildPDB assembles a BOOKMOBI Palm database from records.
+func buildPDB(records [][]byte) []byte {
+	be := binary.BigEndian
+	hdr := make([]byte, 78+8*len(records)+2)
+	copy(hdr, "test-book")
+	copy(hdr[60:], "BOOKMOBI")
+	be.PutUint16(hdr[76:], uint16(len(records)))
+	off := len(hdr)
+	for i, r := range records {
+		be.PutUint32(hdr[78+8*i:], uint32(off))
+		be.PutUint32(hdr[82+8*i:], uint32(2*i))
+		off += len(r)
+	}
+	return bytes.Join(append([][]byte{hdr}, records...), nil)
+}
+
+type exthRecord struct {
+	typ  int
+	data []byte
+}
+
+// mobiFixture describes record 0 of a test book. Record numbers are relative
+// to that record, as in a real file.
+type mobiFixture struct {
+	compression, encryption, version int
+	encoding                         uint32
+	textLength, textRecords          int
+	firstResource, huffRecord        uint32
+	huffCount                        uint32
+	ncx, fdst, skel, frag            uint32
+	extraFlags                       uint16
+	title                            string
+	exth                             []exthRecord
+}
+
+func newMOBIFixture() *mobiFixture {
+	return &mobiFixture{
+		compression: mobiCompressionNone, version: 6, encoding: 65001,
+		firstResource: mobiNoIndex, huffRecord: mobiNoIndex,
+		ncx: mobiNoIndex, fdst: mobiNoIndex, skel: mobiNoIndex, frag: mobiNoIndex,
+	}
+}
+
+func (f *mobiFixture) record0() []byte {
+	be := binary.BigEndian
+	const headerLen = 264
+	r := make([]byte, 16+headerLen)
+	be.PutUint16(r[0:], uint16(f.compression))
+	be.PutUint32(r[4:], uint32(f.textLength))
+	be.PutUint16(r[8:], uint16(f.textRecords))
+	be.PutUint16(r[10:], 4096)
+	be.PutUint16(r[12:], uint16(f.encryption))
+	copy(r[16:], "MOBI")
+	be.PutUint32(r[20:], headerLen)
+	be.PutUint32(r[24:], 2)
+	be.PutUint32(r[28:], f.encoding)
+	be.PutUint32(r[36:], uint32(f.version))
+	be.PutUint32(r[92:], 0x0409) // en-US
+	be.PutUint32(r[108:], f.firstResource)
+	be.PutUint32(r[112:], f.huffRecord)
+	be.PutUint32(r[116:], f.huffCount)
+	be.PutUint32(r[0xC0:], f.fdst)
+	be.PutUint16(r[0xF2:], f.extraFlags)
+	be.PutUint32(r[0xF4:], f.ncx)
+	be.PutUint32(r[0xF8:], f.frag)
+	be.PutUint32(r[0xFC:], f.skel)
+	if len(f.exth) > 0 {
+		be.PutUint32(r[128:], 0x40)
+		var recs []byte
+		for _, e := range f.exth {
+			recs = be.AppendUint32(recs, uint32(e.typ))
+			recs = be.AppendUint32(recs, uint32(8+len(e.data)))
+			recs = append(recs, e.data...)
+		}
+		r = append(r, "EXTH"...)
+		r = be.AppendUint32(r, uint32(12+len(recs)))
+		r = be.AppendUint32(r, uint32(len(f.exth)))
+		r = append(r, recs...)
+	}
+	be.PutUint32(r[84:], uint32(len(r)))
+	be.PutUint32(r[88:], uint32(len(f.title)))
+	r = append(r, f.title...)
+	return append(r, 0, 0)
+}
+
+func exthInt(typ int, v uint32) exthRecord {
+	return exthRecord{typ, binary.BigEndian.AppendUint32(nil, v)}
+}
+
+// palmDOCLiterals "compresses" text using only PalmDOC's literal codes.
+func palmDOCLiterals(text []byte) []byte {
+	var out []byte
+	for _, c := range text {
+		if c == 0 || (c >= 9 && c < 0x80) {
+			out = append(out, c)
+		} else {
+			out = append(out, 1, c)
+		}
+	}
+	return out
+}
+
+func TestPalmDOCDecompress(t *testing.T) {
+	// "abc", back-reference 3 back for 6, " x" as one byte, a 2-byte literal.
+	src := []byte{'a', 'b', 'c', 0x80, 0x1B, 0xF8, 0x02, 0xE9, 0xFF}
+	got, err := palmDOCDecompress(nil, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "abcabcabc x\xe9\xff"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := palmDOCDecompress(nil, []byte{'a', 0x80, 0x1B}); err == nil {
+		t.Error("a back-reference before the start of the text should fail")
+	}
+	if _, err := palmDOCDecompress(nil, []byte{0x05, 'a'}); err == nil {
+		t.Error("a literal run past the end of the record should fail")
+	}
+}
+
+func TestTrailingEntriesSize(t *testing.T) {
+	// text | one multibyte-overlap byte | a 3-byte trailing entry
+	rec := append([]byte("some text"), 0x00, 0xAA, 0xBB, 0x83)
+	if got := trailingEntriesSize(rec, 0b11); got != 4 {
+		t.Errorf("trailingEntriesSize = %d, want 4", got)
+	}
+	if got := trailingEntriesSize(rec, 0); got != 0 {
+		t.Errorf("no flags: trailingEntriesSize = %d, want 0", got)
+	}
+	if got := trailingEntriesSize([]byte{0xFF}, 0b10); got != 1 {
+		t.Errorf("an entry claiming more than the record should be clamped, got %d", got)
+	}
+}
+
+// huffRecords builds a HUFF/CDIC pair where each 8-bit code b means phrase
+// 255-b. Phrases are literal single bytes except phrase 0 (code 0xFF), which
+// is itself compressed and expands to "xy".
+func huffRecords() [][]byte {
+	be := binary.BigEndian
+	huff := []byte("HUFF\x00\x00\x00\x18")
+	huff = be.AppendUint32(huff, 24)
+	huff = be.AppendUint32(huff, 24+256*4)
+	huff = append(huff, make([]byte, 8)...)
+	for i := 0; i < 256; i++ {
+		huff = be.AppendUint32(huff, 255<<8|0x80|8)
+	}
+	huff = append(huff, make([]byte, 64*4)...)
+
+	var offsets, entries []byte
+	for r := 0; r < 256; r++ {
+		offsets = be.AppendUint16(offsets, uint16(2*256+len(entries)))
+		if r == 0 {
+			entries = be.AppendUint16(entries, 2)
+			entries = append(entries, 255-'x', 255-'y')
+		} else {
+			entries = be.AppendUint16(entries, 0x8000|1)
+			entries = append(entries, byte(r))
+		}
+	}
+	cdic := []byte("CDIC\x00\x00\x00\x10")
+	cdic = be.AppendUint32(cdic, 256)
+	cdic = be.AppendUint32(cdic, 8)
+	cdic = append(append(cdic, offsets...), entries...)
+	return [][]byte{huff, cdic}
+}
+
+func huffEncode(text string) []byte {
+	out := make([]byte, len(text))
+	for i := range text {
+		out[i] = 255 - text[i]
+	}
+	return out
+}
+
+func TestHuffDecompress(t *testing.T) {
+	p, err := parsePDB(buildPDB(huffRecords()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newHuffDecoder(p, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.decompress(nil, append(huffEncode("ab"), 0xFF, 0xFF), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abxyxy" {
+		t.Errorf("got %q, want %q", got, "abxyxy")
+	}
+}
+
+func TestHuffDecompress_RejectsSelfReference(t *testing.T) {
+	recs := huffRecords()
+	cdic := recs[1]
+	// Make phrase 0 expand to itself.
+	off := 16 + int(binary.BigEndian.Uint16(cdic[16:]))
+	cdic[off+2], cdic[off+3] = 0xFF, 0xFF
+	p, _ := parsePDB(buildPDB(recs))
+	d, err := newHuffDecoder(p, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.decompress(nil, []byte{0xFF}, 0); err == nil {
+		t.Error("a phrase that refers to itself should fail, not recurse forever")
+	}
+}
+
+func TestDecodeFontRecord(t *testing.T) {
+	font := append([]byte("\x00\x01\x00\x00"), bytes.Repeat([]byte("glyf"), 400)...)
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(font)
+	zw.Close()
+	key := []byte{0x5A, 0xA5, 0x3C, 0xC3}
+	data := z.Bytes()
+	for i := 0; i < len(data) && i < 1040; i++ {
+		data[i] ^= key[i%len(key)]
+	}
+
+	be := binary.BigEndian
+	rec := []byte("FONT")
+	rec = be.AppendUint32(rec, uint32(len(font)))
+	rec = be.AppendUint32(rec, 3) // zlib + XOR
+	rec = be.AppendUint32(rec, uint32(24+len(key)))
+	rec = be.AppendUint32(rec, uint32(len(key)))
+	rec = be.AppendUint32(rec, 24)
+	rec = append(append(rec, key...), data...)
+
+	got, err := decodeFontRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, font) {
+		t.Error("decoded font differs from the original")
+	}
+	if ext, mt := sniffFont(got); ext != ".ttf" || mt != "font/ttf" {
+		t.Errorf("sniffFont = %s %s", ext, mt)
+	}
+}
+
+func TestParseMOBIHeader_EXTH(t *testing.T) {
+	f := newMOBIFixture()
+	f.title = "Full Name"
+	f.exth = []exthRecord{
+		{exthAuthor, []byte("First Author")},
+		{exthAuthor, []byte("Second Author")},
+		{exthTitle, []byte("Updated Title")},
+		exthInt(exthCoverOffset, 3),
+	}
+	p, err := parsePDB(buildPDB([][]byte{f.record0()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseMOBIHeader(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.exthStrings(exthAuthor); len(got) != 2 || got[1] != "Second Author" {
+		t.Errorf("authors = %q", got)
+	}
+	if h.title() != "Updated Title" {
+		t.Errorf("title = %q, want the EXTH 503 title", h.title())
+	}
+	if n, ok := h.exthInt(exthCoverOffset); !ok || n != 3 {
+		t.Errorf("cover offset = %d, %v", n, ok)
+	}
+	if h.ncx != -1 || h.firstResource != -1 {
+		t.Errorf("absent indexes should be -1, got ncx=%d firstResource=%d", h.ncx, h.firstResource)
+	}
+}
+
+func TestConvertMOBIToEPUB_RejectsDRM(t *testing.T) {
+	f := newMOBIFixture()
+	f.encryption = 2
+	f.textRecords, f.textLength = 1, 4
+	data := buildPDB([][]byte{f.record0(), []byte("xxxx")})
+	if _, err := ConvertMOBIToEPUB(data); !errors.Is(err, ErrMOBIDRM) {
+		t.Fatalf("encrypted MOBI should fail with ErrMOBIDRM, got %v", err)
+	}
+}
+
+func TestConvertMOBIToEPUB_RejectsGarbage(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"not a pdb": bytes.Repeat([]byte("x"), 200),
+		"truncated record table": func() []byte {
+			d := buildPDB([][]byte{[]byte("rec")})
+			return d[:80]
+		}(),
+	} {
+		if _, err := ConvertMOBIToEPUB(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// mobiVarintBytes encodes v the way INDX entries store tag values.
+func mobiVarintBytes(v int) []byte {
+	out := []byte{byte(v&0x7F) | 0x80}
+	for v >>= 7; v > 0; v >>= 7 {
+		out = append([]byte{byte(v & 0x7F)}, out...)
+	}
+	return out
+}
+
+type testIndexTag struct {
+	tag, perEntry int
+	mask          byte
+}
+
+type testIndexEntry struct {
+	label  string
+	values map[int][]int
+}
+
+// buildIndex builds an INDX table: header record, one data record and,
+// when cncx is set, a CNCX record.
+func buildIndex(tags []testIndexTag, entries []testIndexEntry, cncx []byte) [][]byte {
+	be := binary.BigEndian
+	const headerLen = 192
+	tagx := []byte("TAGX")
+	tagx = be.AppendUint32(tagx, uint32(12+4*(len(tags)+1)))
+	tagx = be.AppendUint32(tagx, 1)
+	for _, t := range tags {
+		tagx = append(tagx, byte(t.tag), byte(t.perEntry), t.mask, 0)
+	}
+	tagx = append(tagx, 0, 0, 0, 1)
+
+	hdr := make([]byte, headerLen)
+	copy(hdr, "INDX")
+	be.PutUint32(hdr[4:], headerLen)
+	be.PutUint32(hdr[24:], 1)
+	if cncx != nil {
+		be.PutUint32(hdr[52:], 1)
+	}
+	hdr = append(hdr, tagx...)
+
+	rec := make([]byte, headerLen)
+	copy(rec, "INDX")
+	be.PutUint32(rec[4:], headerLen)
+	var offsets []int
+	for _, e := range entries {
+		offsets = append(offsets, len(rec))
+		rec = append(rec, byte(len(e.label)))
+		rec = append(rec, e.label...)
+		var control byte
+		var values []byte
+		for _, t := range tags {
+			if v, ok := e.values[t.tag]; ok {
+				control |= byte(len(v)/t.perEntry) << bits.TrailingZeros8(t.mask)
+				for _, x := range v {
+					values = append(values, mobiVarintBytes(x)...)
+				}
+			}
+		}
+		rec = append(append(rec, control), values...)
+	}
+	be.PutUint32(rec[20:], uint32(len(rec)))
+	be.PutUint32(rec[24:], uint32(len(entries)))
+	rec = append(rec, "IDXT"...)
+	for _, o := range offsets {
+		rec = be.AppendUint16(rec, uint16(o))
+	}
+
+	out := [][]byte{hdr, rec}
+	if cncx != nil {
+		out = append(out, cncx)
+	}
+	return out
+}
+
+// cncxRecord packs strings into a CNCX record, returning their offsets.
+func cncxRecord(strs ...string) ([]byte, []int) {
+	var rec []byte
+	var offsets []int
+	for _, s := range strs {
+		offsets = append(offsets, len(rec))
+		rec = append(append(rec, mobiVarintBytes(len(s))...), s...)
+	}
+	return rec, offsets
+}
+
+func TestReadIndex(t *testing.T) {
+	cncx, offs := cncxRecord("One", "Two")
+	recs := buildIndex(
+		[]testIndexTag{{1, 1, 0x01}, {3, 1, 0x02}, {6, 2, 0x0C}},
+		[]testIndexEntry{
+			{"A", map[int][]int{1: {300}, 3: {offs[0]}}},
+			{"B", map[int][]int{3: {offs[1]}, 6: {7, 70000}}},
+		},
+		cncx,
+	)
+	p, err := parsePDB(buildPDB(recs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, strs, err := readIndex(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].label != "A" || entries[1].label != "B" {
+		t.Fatalf("entries = %+v", entries)
+	}
+	if v := entries[0].tags[1]; len(v) != 1 || v[0] != 300 {
+		t.Errorf("entry A tag 1 = %v, want [300]", v)
+	}
+	if v := entries[1].tags[6]; len(v) != 2 || v[0] != 7 || v[1] != 70000 {
+		t.Errorf("entry B tag 6 = %v, want [7 70000]", v)
+	}
+	if _, ok := entries[1].tags[1]; ok {
+		t.Error("entry B has no tag 1")
+	}
+	if got := string(strs[entries[1].tags[3][0]]); got != "Two" {
+		t.Errorf("entry B label string = %q, want Two", got)
+	}
+}
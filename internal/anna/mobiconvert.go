@@ -0,0 +1,791 @@
+package anna
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/epub"
+)
+
+// ConvertMOBIToEPUB rebuilds a DRM-free MOBI/AZW/AZW3 book as an EPUB, so
+// those editions can go through the same sanitize/validate path as any other
+// EPUB instead of being turned away. It is pure Go: no Calibre needed.
+//
+// A KF7 (classic MOBI) book is one HTML stream with page-break markers and
+// links to byte offsets ("filepos"); it is split at the page breaks and the
+// links become anchors. A KF8 (AZW3) book carries its files as skeletons
+// and fragments, which are reassembled, with stylesheets stored as separate
+// flows; its kindle:embed/flow/pos references become relative links. A
+// combined file holds both, and the KF8 half is used. Metadata comes from
+// the EXTH header, the table of contents from the book's NCX index.
+
+// ConvertMOBIToEPUB converts MOBI/AZW/AZW3 bytes to EPUB bytes. Encrypted
+// books fail with ErrMOBIDRM.
+func ConvertMOBIToEPUB(data []byte) ([]byte, error) {
+	return convertMOBIToEPUB(context.Background(), data)
+}
+
+// convertMOBIToEPUB is ConvertMOBIToEPUB, giving up with ctx's error between
+// text records and documents once ctx is done.
+func convertMOBIToEPUB(ctx context.Context, data []byte) ([]byte, error) {
+	p, err := parsePDB(data)
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseMOBIHeader(p, 0)
+	if err != nil {
+		return nil, err
+	}
+	if h.encryption != 0 {
+		return nil, ErrMOBIDRM
+	}
+	// A combined file carries a KF7 book for old Kindles and, after a
+	// boundary record, the KF8 one; the KF8 half is the richer of the two.
+	if b, ok := h.exthInt(exthKF8Boundary); ok && h.version < 8 {
+		if kf8 := kf8Header(p, b); kf8 != nil {
+			h = kf8
+		}
+	}
+	if h.encryption != 0 {
+		return nil, ErrMOBIDRM
+	}
+
+	c := &mobiConverter{
+		ctx:       ctx,
+		h:         h,
+		resources: h.resources(p),
+	}
+	if isbn := h.exthString(exthISBN); isbn != "" {
+		c.uid = "urn:isbn:" + isbn
+	}
+	text, err := h.text(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if h.version >= 8 && h.skel >= 0 && h.frag >= 0 {
+		err = c.readKF8(p, text)
+	} else {
+		err = c.readKF7(p, text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(c.docs) == 0 {
+		return nil, errors.New("the MOBI file contains no text")
+	}
+	return c.epub()
+}
+
+// kf8Header finds the KF8 header of a combined file. EXTH 121 names the
+// boundary, which is either the header itself or the marker record before it.
+func kf8Header(p *pdbFile, boundary int) *mobiHeader {
+	for _, i := range []int{boundary, boundary + 1} {
+		if h, err := parseMOBIHeader(p, i); err == nil && h.version >= 8 {
+			return h
+		}
+	}
+	return nil
+}
+
+// mobiConverter collects what ConvertMOBIToEPUB writes into the EPUB.
+type mobiConverter struct {
+	ctx       context.Context
+	h         *mobiHeader
+	uid       string          // "urn:isbn:…"; empty, epub.Package derives one
+	resources []*mobiResource // see mobiHeader.resources
+	styles    []*mobiResource // KF8 flows after the first: CSS and SVG
+	docs      []xhtmlDoc
+	toc       []tocEntry
+}
+
+// resource returns resource n, counted from 1 as books reference them.
+func (c *mobiConverter) resource(n int) *mobiResource {
+	if n < 1 || n > len(c.resources) {
+		return nil
+	}
+	return c.resources[n-1]
+}
+
+func (c *mobiConverter) docPath(i int) string {
+	return fmt.Sprintf("OEBPS/part%04d.xhtml", i)
+}
+
+// mobiNCXEntry is a table-of-contents entry from the book's NCX index.
+type mobiNCXEntry struct {
+	label string
+	pos   int // KF7: byte offset in the text
+	fid   int // KF8: fragment and offset; -1 in KF7 books
+	off   int
+}
+
+// readNCX reads the NCX index. Navigation is optional: a book without a
+// usable one gets a table of contents from its headings instead.
+func (c *mobiConverter) readNCX(p *pdbFile) []mobiNCXEntry {
+	if c.h.ncx < 0 {
+		return nil
+	}
+	entries, cncx, err := readIndex(p, c.h.ncx)
+	if err != nil {
+		return nil
+	}
+	var out []mobiNCXEntry
+	for _, e := range entries {
+		n := mobiNCXEntry{fid: -1}
+		if v := e.tags[3]; len(v) > 0 {
+			n.label = strings.Join(strings.Fields(c.h.decode(cncx[v[0]])), " ")
+		}
+		if v := e.tags[6]; len(v) >= 2 {
+			n.fid, n.off = v[0], v[1]
+		} else if v := e.tags[1]; len(v) > 0 {
+			n.pos = v[0]
+		} else {
+			continue
+		}
+		if n.label != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+var (
+	fileposRe   = regexp.MustCompile(`(?i)\bfilepos\s*=\s*["']?0*(\d+)["']?`)
+	pagebreakRe = regexp.MustCompile(`(?i)<mbp:pagebreak\s*/?>(?:\s*</mbp:pagebreak>)?`)
+)
+
+// readKF7 splits a classic MOBI's HTML stream into documents at its page
+// breaks.
+func (c *mobiConverter) readKF7(p *pdbFile, raw []byte) error {
+	// filepos links and NCX entries point at byte offsets in the text, so
+	// anchors for them go in before anything moves.
+	ncx := c.readNCX(p)
+	targets := map[int]bool{}
+	for _, m := range fileposRe.FindAllSubmatch(raw, -1) {
+		if n, err := strconv.Atoi(string(m[1])); err == nil {
+			targets[n] = true
+		}
+	}
+	for _, e := range ncx {
+		targets[e.pos] = true
+	}
+	raw = insertFileposAnchors(raw, targets)
+	raw = fileposRe.ReplaceAllFunc(raw, func(m []byte) []byte {
+		n, _ := strconv.Atoi(string(fileposRe.FindSubmatch(m)[1]))
+		return []byte(fmt.Sprintf(`href="#filepos%d"`, n))
+	})
+
+	// A page break with nothing before it (the markup that opens the book,
+	// a run of breaks) is carried into the next document, not made a blank
+	// page.
+	var roots []*html.Node
+	var head []*html.Node
+	pending := ""
+	for i, piece := range pagebreakRe.Split(c.h.decode(raw), -1) {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		pending += piece
+		root, err := html.Parse(strings.NewReader(pending))
+		if err != nil {
+			return fmt.Errorf("parse MOBI text: %w", err)
+		}
+		if i == 0 {
+			head = headStyles(root)
+		}
+		if hasBodyContent(root) {
+			roots = append(roots, root)
+			pending = ""
+		}
+	}
+
+	ids := map[string]string{}
+	for i, root := range roots {
+		walkElements(root, func(n *html.Node) {
+			if id, ok := htmlAttr(n, "id"); ok && ids[id] == "" {
+				ids[id] = c.docPath(i)
+			}
+		})
+	}
+	title := c.h.title()
+	for i, root := range roots {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		docPath := c.docPath(i)
+		cleanMOBIHTML(root, func(n *html.Node) { c.fixKF7Element(n, docPath, ids) })
+		data, err := renderXHTML(root, title, head)
+		if err != nil {
+			return err
+		}
+		c.docs = append(c.docs, xhtmlDoc{path: docPath, data: data})
+	}
+
+	for _, e := range ncx {
+		id := fmt.Sprintf("filepos%d", e.pos)
+		if docPath := ids[id]; docPath != "" {
+			c.toc = append(c.toc, tocEntry{Label: e.label, Path: docPath, Fragment: id})
+		}
+	}
+	return nil
+}
+
+// insertFileposAnchors puts an <a id="fileposN"/> at each target offset of
+// raw. An offset inside a tag moves to just after it.
+func insertFileposAnchors(raw []byte, targets map[int]bool) []byte {
+	type anchor struct{ at, n int }
+	var anchors []anchor
+	for n := range targets {
+		if n < 0 || n > len(raw) {
+			continue
+		}
+		at := n
+		if lt := bytes.LastIndexByte(raw[:at], '<'); lt >= 0 && lt > bytes.LastIndexByte(raw[:at], '>') {
+			if gt := bytes.IndexByte(raw[at:], '>'); gt >= 0 {
+				at += gt + 1
+			}
+		}
+		anchors = append(anchors, anchor{at, n})
+	}
+	sort.Slice(anchors, func(i, j int) bool {
+		if anchors[i].at != anchors[j].at {
+			return anchors[i].at < anchors[j].at
+		}
+		return anchors[i].n < anchors[j].n
+	})
+	var out bytes.Buffer
+	out.Grow(len(raw) + 32*len(anchors))
+	last := 0
+	for _, a := range anchors {
+		out.Write(raw[last:a.at])
+		fmt.Fprintf(&out, `<a id="filepos%d"></a>`, a.n)
+		last = a.at
+	}
+	out.Write(raw[last:])
+	return out.Bytes()
+}
+
+// fixKF7Element points images at their resource files and in-book links at
+// the document now holding their target.
+func (c *mobiConverter) fixKF7Element(n *html.Node, docPath string, ids map[string]string) {
+	if n.DataAtom == atom.Img {
+		for _, key := range []string{"recindex", "hirecindex", "lorecindex"} {
+			v, ok := htmlAttr(n, key)
+			if !ok {
+				continue
+			}
+			if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				if r := c.resource(i); r != nil {
+					setHTMLAttr(n, "src", relativeHref(docPath, r.path))
+					break
+				}
+			}
+		}
+		removeHTMLAttr(n, "recindex", "hirecindex", "lorecindex")
+		if _, ok := htmlAttr(n, "alt"); !ok {
+			setHTMLAttr(n, "alt", "")
+		}
+	}
+	if href, ok := htmlAttr(n, "href"); ok && strings.HasPrefix(href, "#") {
+		switch target := ids[href[1:]]; target {
+		case "":
+			removeHTMLAttr(n, "href") // its target didn't survive
+		case docPath:
+		default:
+			setHTMLAttr(n, "href", relativeHref(docPath, target)+href)
+		}
+	}
+}
+
+var (
+	kindlePosRe   = regexp.MustCompile(`kindle:pos:fid:([0-9A-Va-v]{4}):off:([0-9A-Va-v]{10})`)
+	kindleEmbedRe = regexp.MustCompile(`kindle:embed:([0-9A-Va-v]{4})(?:\?mime=[^"'\s)]*)?`)
+	kindleFlowRe  = regexp.MustCompile(`kindle:flow:([0-9A-Va-v]{4})(?:\?mime=[^"'\s)]*)?`)
+)
+
+// kf8Part is one rebuilt KF8 file.
+type kf8Part struct {
+	path       string
+	start, end int // the span of the text flow it was built from
+	text       []byte
+}
+
+type kf8Fragment struct {
+	insertPos, length int
+}
+
+// readKF8 rebuilds a KF8 book's files. The text flow is a run of skeletons,
+// each followed by the fragments that go into it; a fragment's insert
+// position is an offset in the text flow as if the file were already
+// assembled there.
+func (c *mobiConverter) readKF8(p *pdbFile, raw []byte) error {
+	flows := kf8Flows(p, c.h, raw)
+	text := flows[0]
+	skels, _, err := readIndex(p, c.h.skel)
+	if err != nil {
+		return fmt.Errorf("KF8 skeleton index: %w", err)
+	}
+	fragEntries, _, err := readIndex(p, c.h.frag)
+	if err != nil {
+		return fmt.Errorf("KF8 fragment index: %w", err)
+	}
+	frags := make([]kf8Fragment, 0, len(fragEntries))
+	for _, e := range fragEntries {
+		pos, err := strconv.Atoi(e.label)
+		if v := e.tags[6]; err == nil && len(v) >= 2 {
+			frags = append(frags, kf8Fragment{insertPos: pos, length: v[1]})
+		} else {
+			return errors.New("KF8 fragment index has a malformed entry")
+		}
+	}
+
+	var parts []*kf8Part
+	next := 0
+	for i, s := range skels {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		count, span := s.tags[1], s.tags[6]
+		if len(count) < 1 || len(span) < 2 || span[0]+span[1] > len(text) {
+			return errors.New("KF8 skeleton index has a malformed entry")
+		}
+		start, end := span[0], span[0]+span[1]
+		part := append([]byte(nil), text[start:end]...)
+		for k := 0; k < count[0]; k++ {
+			if next >= len(frags) {
+				return errors.New("KF8 skeleton refers to a missing fragment")
+			}
+			f := frags[next]
+			next++
+			at := f.insertPos - start
+			if at < 0 || at > len(part) || end+f.length > len(text) {
+				return fmt.Errorf("KF8 fragment %d is out of range", next-1)
+			}
+			part = slices.Insert(part, at, text[end:end+f.length]...)
+			end += f.length
+		}
+		parts = append(parts, &kf8Part{path: c.docPath(i), start: start, end: end, text: part})
+	}
+	if len(parts) == 0 {
+		parts = append(parts, &kf8Part{path: c.docPath(0), end: len(text), text: text})
+	}
+
+	for i, f := range flows[1:] {
+		res := &mobiResource{path: fmt.Sprintf("OEBPS/styles/flow%03d.css", i+1), mediaType: "text/css", data: f}
+		if bytes.Contains(f[:min(len(f), 256)], []byte("<svg")) {
+			res.path, res.mediaType = fmt.Sprintf("OEBPS/images/flow%03d.svg", i+1), "image/svg+xml"
+		}
+		c.styles = append(c.styles, res)
+	}
+	for _, s := range c.styles {
+		s.data = c.rewriteKindleURLs(s.data, s.path)
+	}
+
+	// Links name a fragment and an offset; they resolve to the nearest
+	// anchor in the rebuilt file. Targets are all found before any file is
+	// rewritten, since rewriting moves the offsets.
+	linked := map[string]bool{} // aids that links point at
+	locate := func(fid, off int) (string, string, bool) {
+		if fid < 0 || fid >= len(frags) {
+			return "", "", false
+		}
+		pos := frags[fid].insertPos + off
+		for _, pt := range parts {
+			if pos >= pt.start && pos < pt.end {
+				id, aid := kf8Anchor(pt.text, pos-pt.start)
+				if aid != "" {
+					linked[aid] = true
+				}
+				return pt.path, id, true
+			}
+		}
+		return "", "", false
+	}
+	for _, e := range c.readNCX(p) {
+		if docPath, id, ok := locate(e.fid, e.off); ok {
+			c.toc = append(c.toc, tocEntry{Label: e.label, Path: docPath, Fragment: id})
+		}
+	}
+	rewritten := make([][]byte, len(parts))
+	for i, pt := range parts {
+		rewritten[i] = kindlePosRe.ReplaceAllFunc(pt.text, func(m []byte) []byte {
+			sub := kindlePosRe.FindSubmatch(m)
+			fid, _ := strconv.ParseInt(string(sub[1]), 32, 32)
+			off, _ := strconv.ParseInt(string(sub[2]), 32, 32)
+			docPath, id, ok := locate(int(fid), int(off))
+			if !ok {
+				return []byte("#")
+			}
+			href := relativeHref(pt.path, docPath)
+			if id != "" {
+				href += "#" + id
+			}
+			return []byte(href)
+		})
+		rewritten[i] = c.rewriteKindleURLs(rewritten[i], pt.path)
+	}
+
+	title := c.h.title()
+	for i, pt := range parts {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		data := convertAIDs(rewritten[i], linked)
+		if wellFormedXML(data) != nil {
+			// Not the XHTML KF8 normally carries: clean it up like KF7 markup.
+			root, err := html.Parse(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("parse KF8 part %d: %w", i, err)
+			}
+			cleanMOBIHTML(root, nil)
+			if data, err = renderXHTML(root, title, headStyles(root)); err != nil {
+				return err
+			}
+		}
+		c.docs = append(c.docs, xhtmlDoc{path: pt.path, data: data})
+	}
+	return nil
+}
+
+// kf8Flows splits the text into the flows listed by the FDST record: the
+// HTML first, then stylesheets and SVG images.
+func kf8Flows(p *pdbFile, h *mobiHeader, text []byte) [][]byte {
+	rec := p.record(h.fdst)
+	if len(rec) < 12 || string(rec[:4]) != "FDST" {
+		return [][]byte{text}
+	}
+	be := binary.BigEndian
+	var flows [][]byte
+	for i := uint32(0); i < be.Uint32(rec[8:]) && 12+8*int(i)+8 <= len(rec); i++ {
+		start, end := be.Uint32(rec[12+8*i:]), be.Uint32(rec[16+8*i:])
+		if start > end || end > uint32(len(text)) {
+			break
+		}
+		flows = append(flows, text[start:end])
+	}
+	if len(flows) == 0 {
+		return [][]byte{text}
+	}
+	return flows
+}
+
+// rewriteKindleURLs replaces kindle:embed (resource) and kindle:flow
+// (stylesheet, SVG) references with links relative to from.
+func (c *mobiConverter) rewriteKindleURLs(b []byte, from string) []byte {
+	b = kindleEmbedRe.ReplaceAllFunc(b, func(m []byte) []byte {
+		n, _ := strconv.ParseInt(string(kindleEmbedRe.FindSubmatch(m)[1]), 32, 32)
+		if r := c.resource(int(n)); r != nil {
+			return []byte(relativeHref(from, r.path))
+		}
+		return nil
+	})
+	return kindleFlowRe.ReplaceAllFunc(b, func(m []byte) []byte {
+		n, _ := strconv.ParseInt(string(kindleFlowRe.FindSubmatch(m)[1]), 32, 32)
+		if n >= 1 && int(n) <= len(c.styles) {
+			return []byte(relativeHref(from, c.styles[n-1].path))
+		}
+		return nil
+	})
+}
+
+var (
+	aidAttrRe    = regexp.MustCompile(`\s(?:aid|AID)\s*=\s*["']([^"']+)["']`)
+	tagWithAIDRe = regexp.MustCompile(`<[^>]*\s(?:aid|AID)\s*=\s*["'][^"']+["'][^>]*>`)
+	tagIDRe      = regexp.MustCompile(`(?i)^<[^>]*\sid\s*=\s*['"]([^'"]*)['"]`)
+	tagNameRe    = regexp.MustCompile(`(?i)^<[^>]*\sname\s*=\s*['"]([^'"]*)['"]`)
+	bodyTagRe    = regexp.MustCompile(`(?i)^<body[\s>]`)
+)
+
+// kf8Anchor finds what a link to offset pos of a KF8 file targets: the id
+// (or name, or aid) of the nearest tag at or before pos. An empty id means
+// the top of the file; aid is set when the target is an aid, which
+// convertAIDs turns into the id "aid-<aid>".
+func kf8Anchor(text []byte, pos int) (id, aid string) {
+	pos = min(max(pos, 0), len(text))
+	if gt := bytes.IndexByte(text[pos:], '>'); gt >= 0 {
+		if lt := bytes.IndexByte(text[pos:], '<'); lt <= 0 || gt < lt {
+			pos += gt + 1 // pos is at or inside a tag: that tag counts
+		}
+	}
+	for end := pos; ; {
+		lt := bytes.LastIndexByte(text[:end], '<')
+		if lt < 0 {
+			return "", ""
+		}
+		tag := text[lt:end]
+		if gt := bytes.IndexByte(tag, '>'); gt >= 0 {
+			tag = tag[:gt+1]
+		}
+		end = lt
+		if bodyTagRe.Match(tag) {
+			return "", ""
+		}
+		if bytes.HasPrefix(tag, []byte("<meta ")) {
+			continue
+		}
+		if m := tagIDRe.FindSubmatch(tag); m != nil {
+			return string(m[1]), ""
+		}
+		if m := tagNameRe.FindSubmatch(tag); m != nil {
+			return string(m[1]), ""
+		}
+		if m := aidAttrRe.FindSubmatch(tag); m != nil {
+			return "aid-" + string(m[1]), string(m[1])
+		}
+	}
+}
+
+// convertAIDs replaces KF8's aid attributes: those a link points at become
+// ids, the rest are dropped.
+func convertAIDs(b []byte, linked map[string]bool) []byte {
+	return tagWithAIDRe.ReplaceAllFunc(b, func(tag []byte) []byte {
+		m := aidAttrRe.FindSubmatchIndex(tag)
+		aid := string(tag[m[2]:m[3]])
+		var repl string
+		if linked[aid] && !tagIDRe.Match(tag) {
+			repl = fmt.Sprintf(` id="aid-%s"`, aid)
+		}
+		out := append([]byte(nil), tag[:m[0]]...)
+		out = append(out, repl...)
+		return append(out, tag[m[1]:]...)
+	})
+}
+
+// xmlNameRe matches element and attribute names that are valid in XHTML
+// without a namespace declaration.
+var xmlNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// cleanMOBIHTML makes a parsed MOBI document fit to render as XHTML:
+// comments, scripts and the Mobipocket <guide> go, Mobipocket's own elements (mbp:*) are replaced by
+// their content, and attributes that aren't valid names are dropped. fix, if
+// set, is called on every element first.
+func cleanMOBIHTML(n *html.Node, fix func(*html.Node)) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.CommentNode:
+			n.RemoveChild(c)
+		case html.ElementNode:
+			if c.DataAtom == atom.Script || c.DataAtom == atom.Object || c.DataAtom == atom.Embed || c.Data == "guide" {
+				n.RemoveChild(c)
+				break
+			}
+			if fix != nil {
+				fix(c)
+			}
+			cleanMOBIHTML(c, fix)
+			attrs := c.Attr[:0]
+			for _, a := range c.Attr {
+				if a.Namespace != "" || xmlNameRe.MatchString(a.Key) {
+					attrs = append(attrs, a)
+				}
+			}
+			c.Attr = attrs
+			if c.Namespace == "svg" && c.Data == "svg" && n.Namespace != "svg" {
+				setHTMLAttr(c, "xmlns", "http://www.w3.org/2000/svg")
+				c.Attr = append(c.Attr, html.Attribute{Namespace: "xmlns", Key: "xlink", Val: "http://www.w3.org/1999/xlink"})
+			}
+			if c.Namespace == "" && !xmlNameRe.MatchString(c.Data) {
+				for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+					c.RemoveChild(gc)
+					n.InsertBefore(gc, c)
+				}
+				n.RemoveChild(c)
+			}
+		}
+		c = next
+	}
+}
+
+// renderXHTML writes a parsed document as an XHTML file: its body, under a
+// head with title and the given style and link elements.
+func renderXHTML(root *html.Node, title string, head []*html.Node) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n<!DOCTYPE html>\n")
+	b.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml">` + "\n<head>\n")
+	fmt.Fprintf(&b, "<title>%s</title>\n", xmlEscape(title))
+	for _, n := range head {
+		if err := html.Render(&b, n); err != nil {
+			return nil, err
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("</head>\n<body>\n")
+	if body := findElement(root, atom.Body); body != nil {
+		for c := body.FirstChild; c != nil; c = c.NextSibling {
+			if err := html.Render(&b, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	b.WriteString("\n</body>\n</html>\n")
+	return b.Bytes(), nil
+}
+
+// headStyles returns a document's <style> and stylesheet <link> elements.
+// Styles that can't be written into XHTML as-is are skipped.
+func headStyles(root *html.Node) []*html.Node {
+	head := findElement(root, atom.Head)
+	if head == nil {
+		return nil
+	}
+	var out []*html.Node
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		switch c.DataAtom {
+		case atom.Style:
+			if t := c.FirstChild; t == nil || !strings.ContainsAny(t.Data, "<&") {
+				out = append(out, c)
+			}
+		case atom.Link:
+			if rel, _ := htmlAttr(c, "rel"); strings.EqualFold(rel, "stylesheet") {
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+// hasBodyContent reports whether a document's body has any text or images.
+func hasBodyContent(root *html.Node) bool {
+	body := findElement(root, atom.Body)
+	found := false
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil && !found; c = c.NextSibling {
+			switch {
+			case c.Type == html.TextNode && strings.TrimSpace(c.Data) != "":
+				found = true
+			case c.Type == html.ElementNode && (c.DataAtom == atom.Img || c.DataAtom == atom.Svg):
+				found = true
+			default:
+				walk(c)
+			}
+		}
+	}
+	if body != nil {
+		walk(body)
+	}
+	return found
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := findElement(c, a); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func walkElements(n *html.Node, fn func(*html.Node)) {
+	if n.Type == html.ElementNode {
+		fn(n)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkElements(c, fn)
+	}
+}
+
+func htmlAttr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func setHTMLAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+func removeHTMLAttr(n *html.Node, keys ...string) {
+	n.Attr = slices.DeleteFunc(n.Attr, func(a html.Attribute) bool {
+		return a.Namespace == "" && slices.Contains(keys, a.Key)
+	})
+}
+
+// mobiLanguages maps the primary language of a MOBI header's Windows locale
+// to a language tag, for books without an EXTH language.
+var mobiLanguages = map[int]string{
+	4: "zh", 7: "de", 9: "en", 10: "es", 12: "fr", 16: "it", 17: "ja",
+	19: "nl", 21: "pl", 22: "pt", 25: "ru", 29: "sv",
+}
+
+func (c *mobiConverter) language() string {
+	if l := c.h.exthString(exthLanguage); l != "" {
+		return l
+	}
+	if l := mobiLanguages[c.h.locale&0xFF]; l != "" {
+		return l
+	}
+	return "en"
+}
+
+// epub packs the converted book: an EPUB 3 package with both a navigation
+// document and an NCX, which older readers (and Amazon) still look at.
+func (c *mobiConverter) epub() ([]byte, error) {
+	title := c.h.title()
+	if title == "" {
+		title = "Untitled"
+	}
+	p := &epub.Package{Metadata: epub.Metadata{
+		Title:       title,
+		Authors:     c.h.exthStrings(exthAuthor),
+		Language:    c.language(),
+		Identifier:  c.uid,
+		Publisher:   c.h.exthString(exthPublisher),
+		Date:        c.h.exthString(exthDate),
+		Description: c.h.exthString(exthDescription),
+		Subjects:    c.h.exthStrings(exthSubject),
+	}}
+	for _, d := range c.docs {
+		p.AddDocument(d.path, d.data, "")
+	}
+	for _, s := range c.styles {
+		p.AddFile(s.path, s.mediaType, s.data)
+	}
+	if n, ok := c.h.exthInt(exthCoverOffset); ok && n < len(c.resources) && c.resources[n] != nil &&
+		strings.HasPrefix(c.resources[n].mediaType, "image/") {
+		p.Cover = c.resources[n].path
+	}
+	for _, r := range c.resources {
+		if r != nil {
+			p.AddFile(r.path, r.mediaType, r.data)
+		}
+	}
+	toc := c.toc
+	if len(toc) == 0 {
+		toc = headingTOC(title, c.docs)
+	}
+	p.TOC = navPoints(toc)
+	return p.Bytes()
+}
+
+// navPoints turns a table of contents into the form epub.Package takes.
+func navPoints(toc []tocEntry) []epub.NavPoint {
+	points := make([]epub.NavPoint, len(toc))
+	for i, t := range toc {
+		points[i] = epub.NavPoint(t)
+	}
+	return points
+}
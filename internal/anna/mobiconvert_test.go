@@ -0,0 +1,273 @@
+package anna
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func tinyPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// kf7Book builds a classic MOBI: Windows-1252 text, PalmDOC-compressed in
+// two records with trailing entries, split by a page break, with a filepos
+// link, an inline image, a cover and an NCX entry.
+func kf7Book(t *testing.T) (data []byte, chapterTwo int) {
+	t.Helper()
+	text := []byte("<html><head><style>p { margin: 0 }</style><guide></guide></head><body>" +
+		"<p>See <a filepos=0000000000>chapter two</a>.</p><img recindex=\"00002\">" +
+		"<!-- a comment --><mbp:pagebreak/>" +
+		"<h2>Chapter Two</h2><p>Caf\xe9 au lait<mbp:nu>.</mbp:nu></p></body></html>")
+	chapterTwo = bytes.Index(text, []byte("<h2>"))
+	text = bytes.Replace(text, []byte("0000000000"), []byte(fmt.Sprintf("%010d", chapterTwo)), 1)
+
+	ncxStrings, offs := cncxRecord("Chapter Two")
+	ncx := buildIndex([]testIndexTag{{1, 1, 0x01}, {3, 1, 0x02}},
+		[]testIndexEntry{{"0", map[int][]int{1: {chapterTwo}, 3: {offs[0]}}}}, ncxStrings)
+
+	// text records 1-2, images 3-4, NCX 5-7
+	f := newMOBIFixture()
+	f.compression = mobiCompressionPalmDOC
+	f.encoding = 1252
+	f.textLength, f.textRecords = len(text), 2
+	f.extraFlags = 0b10 // one trailing entry per record
+	f.firstResource, f.ncx = 3, 5
+	f.title = "Header Name"
+	f.exth = []exthRecord{
+		{exthAuthor, []byte("Ana Autora")},
+		{exthTitle, []byte("Caf\xe9 Stories")},
+		{exthLanguage, []byte("es")},
+		{exthPublisher, []byte("Small Press")},
+		exthInt(exthCoverOffset, 0),
+	}
+	half := len(text) / 2
+	trailing := []byte{0x11, 0x82} // a 2-byte trailing entry
+	recs := [][]byte{
+		f.record0(),
+		append(palmDOCLiterals(text[:half]), trailing...),
+		append(palmDOCLiterals(text[half:]), trailing...),
+		noisyJPEG(t, 16, 16),
+		tinyPNG(t),
+	}
+	recs = append(recs, ncx...)
+	recs = append(recs, []byte("\xe9\x8e\r\n"))
+	return buildPDB(recs), chapterTwo
+}
+
+func TestConvertMOBIToEPUB_KF7(t *testing.T) {
+	data, chapterTwo := kf7Book(t)
+	out, err := ConvertMOBIToEPUB(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateEPUB(out); err != nil {
+		t.Fatalf("converted EPUB does not validate: %v", err)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "Café Stories" {
+		t.Errorf("title = %q, want the EXTH title decoded from Windows-1252", book.title())
+	}
+	if c := book.pkg.Metadata.Creators; len(c) != 1 || c[0] != "Ana Autora" {
+		t.Errorf("creators = %q", c)
+	}
+	if l := book.pkg.Metadata.Languages; len(l) != 1 || l[0] != "es" {
+		t.Errorf("languages = %q", l)
+	}
+	if n := len(book.pkg.Spine.ItemRefs); n != 2 {
+		t.Fatalf("spine has %d documents, want 2 (one per page break)", n)
+	}
+
+	anchor := fmt.Sprintf("filepos%d", chapterTwo)
+	part0 := string(readEntry(t, out, "OEBPS/part0000.xhtml"))
+	part1 := string(readEntry(t, out, "OEBPS/part0001.xhtml"))
+	for _, want := range []string{`href="part0001.xhtml#` + anchor + `"`, `src="images/image00002.png"`, "p { margin: 0 }"} {
+		if !strings.Contains(part0, want) {
+			t.Errorf("part 0 lacks %q:\n%s", want, part0)
+		}
+	}
+	for _, bad := range []string{"filepos=", "recindex", "<!--", "mbp:", "<guide"} {
+		if strings.Contains(part0+part1, bad) {
+			t.Errorf("converted documents still contain %q", bad)
+		}
+	}
+	if !strings.Contains(part1, `id="`+anchor+`"`) || !strings.Contains(part1, "Café au lait.") {
+		t.Errorf("part 1 lacks the link target or its text:\n%s", part1)
+	}
+
+	opf := string(book.opf())
+	if !strings.Contains(opf, `properties="cover-image"`) || !strings.Contains(opf, `<meta name="cover" content="cover-image"/>`) {
+		t.Errorf("OPF does not mark the EXTH cover:\n%s", opf)
+	}
+	if !strings.Contains(opf, "<dc:publisher>Small Press</dc:publisher>") {
+		t.Errorf("OPF lacks the publisher:\n%s", opf)
+	}
+	nav := string(readEntry(t, out, "OEBPS/nav.xhtml"))
+	if !strings.Contains(nav, `<a href="part0001.xhtml#`+anchor+`">Chapter Two</a>`) {
+		t.Errorf("nav lacks the NCX entry:\n%s", nav)
+	}
+}
+
+func TestConvertMOBIToEPUB_HUFFCompressed(t *testing.T) {
+	text := "<html><body><h1>Heading</h1><p>Huffman text.</p></body></html>"
+	f := newMOBIFixture()
+	f.compression = mobiCompressionHuff
+	f.textLength, f.textRecords = len(text), 1
+	f.huffRecord, f.huffCount = 2, 2
+	f.title = "Huff Book"
+	recs := append([][]byte{f.record0(), huffEncode(text)}, huffRecords()...)
+	out, err := ConvertMOBIToEPUB(buildPDB(recs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part := string(readEntry(t, out, "OEBPS/part0000.xhtml")); !strings.Contains(part, "<p>Huffman text.</p>") {
+		t.Errorf("HUFF text not decoded:\n%s", part)
+	}
+	// No NCX: the table of contents falls back to headings.
+	if nav := string(readEntry(t, out, "OEBPS/nav.xhtml")); !strings.Contains(nav, ">Heading</a>") {
+		t.Errorf("nav should list the heading:\n%s", nav)
+	}
+}
+
+func fontRecord(font []byte) []byte {
+	be := binary.BigEndian
+	rec := []byte("FONT")
+	rec = be.AppendUint32(rec, uint32(len(font)))
+	rec = be.AppendUint32(rec, 0)
+	rec = be.AppendUint32(rec, 24)
+	rec = be.AppendUint32(rec, 0)
+	rec = be.AppendUint32(rec, 0)
+	return append(rec, font...)
+}
+
+// kf8Records builds the records of a KF8 book (record 0 first): two files
+// rebuilt from skeletons and fragments, a CSS flow using an embedded font,
+// a kindle:pos link from the first file to an aid in the second, an image
+// and an NCX entry.
+func kf8Records(t *testing.T) [][]byte {
+	t.Helper()
+	skel := func(title string) string {
+		return `<?xml version="1.0" encoding="utf-8"?><html xmlns="http://www.w3.org/1999/xhtml"><head><title>` + title +
+			`</title><link rel="stylesheet" type="text/css" href="kindle:flow:0001?mime=text/css"/></head><body aid="0"></body></html>`
+	}
+	skel0, skel1 := skel("One"), skel("Two")
+	frag0 := `<p aid="1">Go to <a href="kindle:pos:fid:0001:off:0000000000">chapter two</a>.</p><img src="kindle:embed:0001?mime=image/jpeg" alt=""/>`
+	frag1 := `<h1 aid="2">Chapter Two</h1><p aid="3">Second file.</p>`
+	flow0 := skel0 + frag0 + skel1 + frag1
+	css := `@font-face { font-family: "Book"; src: url(kindle:embed:0002?mime=application/x-font-ttf) } p { font-family: "Book" }`
+	text := flow0 + css
+
+	at0 := strings.Index(skel0, "</body>")
+	skel1Start := len(skel0) + len(frag0)
+	at1 := skel1Start + strings.Index(skel1, "</body>")
+
+	skels := buildIndex([]testIndexTag{{1, 1, 0x03}, {6, 2, 0x0C}}, []testIndexEntry{
+		{"SKEL0000000", map[int][]int{1: {1}, 6: {0, len(skel0)}}},
+		{"SKEL0000001", map[int][]int{1: {1}, 6: {skel1Start, len(skel1)}}},
+	}, nil)
+	frags := buildIndex([]testIndexTag{{2, 1, 0x01}, {3, 1, 0x02}, {4, 1, 0x04}, {6, 2, 0x08}}, []testIndexEntry{
+		{fmt.Sprintf("%010d", at0), map[int][]int{2: {0}, 3: {0}, 4: {0}, 6: {0, len(frag0)}}},
+		{fmt.Sprintf("%010d", at1), map[int][]int{2: {0}, 3: {1}, 4: {1}, 6: {0, len(frag1)}}},
+	}, nil)
+	ncxStrings, offs := cncxRecord("Chapter Two")
+	ncx := buildIndex([]testIndexTag{{3, 1, 0x01}, {6, 2, 0x02}},
+		[]testIndexEntry{{"00", map[int][]int{3: {offs[0]}, 6: {1, 0}}}}, ncxStrings)
+
+	be := binary.BigEndian
+	fdst := []byte("FDST")
+	fdst = be.AppendUint32(fdst, 12)
+	fdst = be.AppendUint32(fdst, 2)
+	for _, v := range []int{0, len(flow0), len(flow0), len(text)} {
+		fdst = be.AppendUint32(fdst, uint32(v))
+	}
+
+	// text 1, resources 2-3, FDST 4, skeleton 5-6, fragments 7-8, NCX 9-11
+	f := newMOBIFixture()
+	f.version = 8
+	f.textLength, f.textRecords = len(text), 1
+	f.firstResource, f.fdst, f.skel, f.frag, f.ncx = 2, 4, 5, 7, 9
+	f.title = "KF8 Book"
+	f.exth = []exthRecord{{exthAuthor, []byte("Kay Eff")}, exthInt(exthCoverOffset, 0)}
+	recs := [][]byte{f.record0(), []byte(text), noisyJPEG(t, 16, 16), fontRecord([]byte("\x00\x01\x00\x00font")), fdst}
+	recs = append(recs, skels...)
+	recs = append(recs, frags...)
+	recs = append(recs, ncx...)
+	return append(recs, []byte("\xe9\x8e\r\n"))
+}
+
+func checkKF8Conversion(t *testing.T, out []byte) {
+	t.Helper()
+	if err := ValidateEPUB(out); err != nil {
+		t.Fatalf("converted EPUB does not validate: %v", err)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "KF8 Book" {
+		t.Errorf("title = %q", book.title())
+	}
+	part0 := string(readEntry(t, out, "OEBPS/part0000.xhtml"))
+	part1 := string(readEntry(t, out, "OEBPS/part0001.xhtml"))
+	for _, want := range []string{
+		`href="styles/flow001.css"`,
+		`<a href="part0001.xhtml#aid-2">chapter two</a>`,
+		`src="images/image00001.jpg"`,
+		`<body><p>Go to`,
+	} {
+		if !strings.Contains(part0, want) {
+			t.Errorf("part 0 lacks %q:\n%s", want, part0)
+		}
+	}
+	if !strings.Contains(part1, `<h1 id="aid-2">Chapter Two</h1><p>Second file.</p>`) {
+		t.Errorf("part 1 was not rebuilt with the link target:\n%s", part1)
+	}
+	if strings.Contains(part0+part1, "kindle:") || strings.Contains(part0+part1, "aid=") {
+		t.Error("kindle: references or aid attributes survived")
+	}
+	css := string(readEntry(t, out, "OEBPS/styles/flow001.css"))
+	if !strings.Contains(css, "url(../fonts/font00002.ttf)") {
+		t.Errorf("stylesheet font reference not rewritten: %s", css)
+	}
+	if font := readEntry(t, out, "OEBPS/fonts/font00002.ttf"); string(font) != "\x00\x01\x00\x00font" {
+		t.Errorf("font = %q", font)
+	}
+	nav := string(readEntry(t, out, "OEBPS/nav.xhtml"))
+	if !strings.Contains(nav, `<a href="part0001.xhtml#aid-2">Chapter Two</a>`) {
+		t.Errorf("nav lacks the NCX entry:\n%s", nav)
+	}
+}
+
+func TestConvertMOBIToEPUB_KF8(t *testing.T) {
+	out, err := ConvertMOBIToEPUB(buildPDB(kf8Records(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKF8Conversion(t, out)
+}
+
+func TestConvertMOBIToEPUB_CombinedUsesKF8(t *testing.T) {
+	kf7Text := "<html><body><p>The old KF7 copy.</p></body></html>"
+	f := newMOBIFixture()
+	f.textLength, f.textRecords = len(kf7Text), 1
+	f.title = "KF7 Copy"
+	f.exth = []exthRecord{exthInt(exthKF8Boundary, 2)}
+	recs := append([][]byte{f.record0(), []byte(kf7Text), []byte("BOUNDARY")}, kf8Records(t)...)
+	out, err := ConvertMOBIToEPUB(buildPDB(recs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKF8Conversion(t, out)
+}
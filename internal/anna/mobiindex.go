@@ -0,0 +1,165 @@
+package anna
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// MOBI INDX tables hold the book's navigation (NCX) and, in KF8, the
+// skeleton and fragment tables the HTML files are rebuilt from. A table is a
+// header record describing its tags (TAGX), data records of entries, and
+// CNCX records holding the entries' strings.
+
+// indexEntry is one entry of an INDX table: its label and tag values.
+type indexEntry struct {
+	label string
+	tags  map[int][]int
+}
+
+type indexTag struct {
+	tag, perEntry int
+	mask          byte
+	end           bool
+}
+
+// readIndex reads the INDX table whose header is record idx. The returned map
+// holds its CNCX strings keyed by offset.
+func readIndex(p *pdbFile, idx int) ([]indexEntry, map[int][]byte, error) {
+	be := binary.BigEndian
+	hdr := p.record(idx)
+	if len(hdr) < 56 || string(hdr[:4]) != "INDX" {
+		return nil, nil, errors.New("INDX header record is missing or invalid")
+	}
+	headerLen := int(be.Uint32(hdr[4:]) & 0xFFFF)
+	count := int(be.Uint32(hdr[24:]) & 0xFFFF)
+	nCNCX := int(be.Uint32(hdr[52:]) & 0xFFFF)
+	if headerLen+12 > len(hdr) || string(hdr[headerLen:headerLen+4]) != "TAGX" {
+		return nil, nil, errors.New("INDX header has no TAGX section")
+	}
+	tagx := hdr[headerLen:]
+	tagxLen := min(int(be.Uint32(tagx[4:])&0xFFFF), len(tagx))
+	controlBytes := int(be.Uint32(tagx[8:]) & 0xFF)
+	var defs []indexTag
+	for i := 12; i+4 <= tagxLen; i += 4 {
+		defs = append(defs, indexTag{tag: int(tagx[i]), perEntry: int(tagx[i+1]), mask: tagx[i+2], end: tagx[i+3] == 1})
+	}
+
+	cncx := map[int][]byte{}
+	for j := 0; j < nCNCX; j++ {
+		readCNCX(p.record(idx+count+1+j), j*0x10000, cncx)
+	}
+
+	var entries []indexEntry
+	for i := 1; i <= count; i++ {
+		rec := p.record(idx + i)
+		if len(rec) < 28 || string(rec[:4]) != "INDX" {
+			return nil, nil, fmt.Errorf("INDX data record %d is missing or invalid", i)
+		}
+		idxt := int(be.Uint32(rec[20:]) & 0xFFFF)
+		n := int(be.Uint32(rec[24:]) & 0xFFFF)
+		if idxt+4+2*n > len(rec) {
+			return nil, nil, fmt.Errorf("INDX data record %d is truncated", i)
+		}
+		pos := make([]int, n+1)
+		for j := 0; j < n; j++ {
+			pos[j] = int(be.Uint16(rec[idxt+4+2*j:]))
+		}
+		pos[n] = idxt // the last entry ends where the IDXT starts
+		for j := 0; j < n; j++ {
+			start, end := pos[j], pos[j+1]
+			if start >= end || end > len(rec) || start+1+int(rec[start]) > end {
+				return nil, nil, fmt.Errorf("INDX data record %d has a bad entry", i)
+			}
+			labelEnd := start + 1 + int(rec[start])
+			entries = append(entries, indexEntry{
+				label: string(rec[start+1 : labelEnd]),
+				tags:  readIndexTags(defs, controlBytes, rec[labelEnd:end]),
+			})
+		}
+	}
+	return entries, cncx, nil
+}
+
+// readIndexTags decodes an entry's tag values: control bytes saying which
+// tags are present and how many values each has, then the values as
+// variable-width integers.
+func readIndexTags(defs []indexTag, controlBytes int, b []byte) map[int][]int {
+	type present struct {
+		tag, count, size, perEntry int
+	}
+	var tags []present
+	ci, data := 0, controlBytes
+	for _, d := range defs {
+		if d.end {
+			ci++
+			continue
+		}
+		if ci >= len(b) || ci >= controlBytes {
+			break
+		}
+		v := b[ci] & d.mask
+		switch {
+		case v == 0:
+		case v == d.mask && bits.OnesCount8(d.mask) > 1:
+			// All bits set: the values' total byte length follows instead.
+			size, n := mobiVarint(b[min(data, len(b)):])
+			data += n
+			tags = append(tags, present{tag: d.tag, count: -1, size: size, perEntry: d.perEntry})
+		default:
+			for m := d.mask; m&1 == 0; m >>= 1 {
+				v >>= 1
+			}
+			tags = append(tags, present{tag: d.tag, count: int(v), perEntry: d.perEntry})
+		}
+	}
+
+	out := map[int][]int{}
+	for _, t := range tags {
+		var values []int
+		if t.count >= 0 {
+			for k := 0; k < t.count*t.perEntry && data < len(b); k++ {
+				v, n := mobiVarint(b[data:])
+				data += n
+				values = append(values, v)
+			}
+		} else {
+			for used := 0; used < t.size && data < len(b); {
+				v, n := mobiVarint(b[data:])
+				data += n
+				used += n
+				values = append(values, v)
+			}
+		}
+		out[t.tag] = values
+	}
+	return out
+}
+
+// mobiVarint reads a forward variable-width integer: seven bits a byte, most
+// significant first, the last byte marked by its high bit. It returns the
+// value and the bytes consumed.
+func mobiVarint(b []byte) (int, int) {
+	v := 0
+	for i, c := range b {
+		v = v<<7 | int(c&0x7F)
+		if c&0x80 != 0 || i == 4 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
+
+// readCNCX adds the strings of a CNCX record to out, keyed by base plus their
+// offset in the record. Each is a variable-width length and the bytes.
+func readCNCX(rec []byte, base int, out map[int][]byte) {
+	for off := 0; off < len(rec) && rec[off] != 0; {
+		l, n := mobiVarint(rec[off:])
+		if off+n+l > len(rec) {
+			return
+		}
+		out[base+off] = rec[off+n : off+n+l]
+		off += n + l
+	}
+}
@@ -0,0 +1,130 @@
+package anna
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"github.com/sam-hartman/kindle-pibrarian/internal/outbox"
+	"go.uber.org/zap"
+)
+
+// When MailConfig.OutboxDir is set, a send that fails for a transient reason
+// (SMTP 4xx, a timeout, a dropped connection, sendmail EX_TEMPFAIL) is not
+// reported as a failure: the prepared attachment goes into the on-disk
+// outbox and the worker started by the server retries it with backoff.
+
+// ErrQueued matches (errors.Is) a *QueuedError.
+var ErrQueued = errors.New("delivery queued for retry")
+
+// QueuedError reports that a send failed transiently and was queued.
+type QueuedError struct {
+	ID    string // outbox item ID
+	Cause error
+}
+
+func (e *QueuedError) Error() string {
+	return fmt.Sprintf("mail server temporarily unavailable (%v); queued for automatic retry as %s", e.Cause, e.ID)
+}
+
+func (e *QueuedError) Unwrap() error        { return e.Cause }
+func (e *QueuedError) Is(target error) bool { return target == ErrQueued }
+
+// sendmailTempFail is sendmail's EX_TEMPFAIL exit status.
+const sendmailTempFail = 75
+
+// isTransientSendError reports whether a delivery error is worth retrying.
+func isTransientSendError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 400 && tpErr.Code < 500
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode() == sendmailTempFail
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	s := err.Error()
+	return strings.Contains(s, "broken pipe") || strings.Contains(s, "connection reset")
+}
+
+// queueForRetry parks a prepared message in the outbox.
+func queueForRetry(mail MailConfig, msg *kindleMessage, cause error) error {
+	box, err := outbox.Open(mail.OutboxDir)
+	if err != nil {
+		return err
+	}
+	it, err := box.Enqueue(outbox.Item{
+		To:        msg.To,
+		Filename:  msg.Filename,
+		MimeType:  msg.MimeType,
+		Subject:   msg.Subject,
+		Body:      msg.Body,
+		MessageID: msg.MessageID,
+	}, msg.Attachment)
+	if err != nil {
+		return err
+	}
+	return &QueuedError{ID: it.ID, Cause: cause}
+}
+
+// OutboxSendFunc returns the outbox worker's delivery function. It rebuilds
+// the message with the original Message-ID so retries stay traceable, and
+// calls config for the mail settings on every attempt, so a fixed password
+// or host reaches items already queued.
+func OutboxSendFunc(config func() (MailConfig, error)) outbox.SendFunc {
+	return func(ctx context.Context, it *outbox.Item, attachment []byte) error {
+		l := logger.GetLogger()
+		mail, err := config()
+		if err != nil {
+			return err
+		}
+		sender, err := NewSender(mail)
+		if err != nil {
+			return err // config may be fixed before the attempts run out
+		}
+		msg, err := newKindleMessage(mail.FromEmail, it.To, it.Subject, it.Body, it.Filename, it.MimeType, attachment)
+		if err != nil {
+			return err
+		}
+		if it.MessageID != "" {
+			msg.MessageID = it.MessageID
+		}
+		if err := sender.Send(Envelope{From: mail.FromEmail, To: []string{it.To}}, msg); err != nil {
+			l.Warn("Outbox delivery attempt failed",
+				zap.String("id", it.ID),
+				zap.Int("attempt", it.Attempts),
+				zap.Error(err),
+			)
+			if !isTransientSendError(err) {
+				return outbox.Permanent(err)
+			}
+			return err
+		}
+		l.Info("Outbox delivery succeeded",
+			zap.String("id", it.ID),
+			zap.String("filename", it.Filename),
+			zap.String("kindle_email", it.To),
+			zap.Int("attempt", it.Attempts),
+		)
+		recordSend(mail, msg, strings.TrimPrefix(it.Body, "Book: "))
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package anna
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/outbox"
+)
+
+func TestIsTransientSendError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&textproto.Error{Code: 451, Msg: "try later"}, true},
+		{&textproto.Error{Code: 421, Msg: "service not available"}, true},
+		{&textproto.Error{Code: 552, Msg: "message too big"}, false},
+		{&textproto.Error{Code: 535, Msg: "bad credentials"}, false},
+		{fmt.Errorf("connect: %w", syscall.ECONNREFUSED), true},
+		{io.EOF, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "i/o timeout", Name: "smtp.example.com", IsTimeout: true}}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "smtp.invalid", IsNotFound: true}}, false},
+		{errors.New("write tcp: broken pipe"), true},
+		{errors.New("this EPUB can't be sent to Kindle: DRM"), false},
+	}
+	for _, tc := range cases {
+		if got := isTransientSendError(tc.err); got != tc.want {
+			t.Errorf("isTransientSendError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestSendFileToKindle_QueuesTransientFailureAndWorkerDelivers(t *testing.T) {
+	srv := newFakeSMTP(t)
+	srv.Replies["DATA"] = "451 4.3.0 Mail server temporarily rejected message"
+	port := srv.start()
+
+	mail := MailConfig{
+		Host: "127.0.0.1", Port: port, User: "reader@example.com", Password: "pw",
+		FromEmail: "reader@example.com", Security: SecurityPlain, OutboxDir: t.TempDir(),
+	}
+	err := SendFileToKindle([]byte("%PDF-1.4 tiny"), "book.pdf", "application/pdf", "Book: book", mail, Recipient{Email: "reader_x@kindle.com"})
+	var queued *QueuedError
+	if !errors.As(err, &queued) || !errors.Is(err, ErrQueued) {
+		t.Fatalf("expected a QueuedError, got %v", err)
+	}
+
+	box, err := outbox.Open(mail.OutboxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := box.Get(queued.ID)
+	if err != nil || it.State != outbox.StateQueued || it.To != "reader_x@kindle.com" || it.MessageID == "" {
+		t.Fatalf("unexpected queued item %+v (err %v)", it, err)
+	}
+
+	// Server recovers; the worker delivers with the original Message-ID.
+	delete(srv.Replies, "DATA")
+	box.ProcessDue(context.Background(), OutboxSendFunc(func() (MailConfig, error) { return mail, nil }))
+	it, _ = box.Get(queued.ID)
+	if it.State != outbox.StateSent {
+		t.Fatalf("expected sent after retry, got %+v", it)
+	}
+	msgs := srv.sent()
+	if len(msgs) != 1 || !strings.Contains(msgs[0].Data, "Message-ID: "+it.MessageID) {
+		t.Fatalf("retry should reuse the original Message-ID %s", it.MessageID)
+	}
+}
+
+func TestSendFileToKindle_PermanentFailureNotQueued(t *testing.T) {
+	srv := newFakeSMTP(t)
+	srv.Replies["RCPT"] = "550 5.1.1 no such user"
+	port := srv.start()
+
+	mail := MailConfig{
+		Host: "127.0.0.1", Port: port, User: "u", Password: "pw",
+		FromEmail: "reader@example.com", Security: SecurityPlain, OutboxDir: t.TempDir(),
+	}
+	err := SendFileToKindle([]byte("%PDF-1.4 tiny"), "book.pdf", "application/pdf", "Book: book", mail, Recipient{Email: "nobody@kindle.com"})
+	if err == nil || errors.Is(err, ErrQueued) {
+		t.Fatalf("a 5xx rejection must fail outright, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package anna
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+// pandoc converts document formats (Word, OpenDocument, HTML, Markdown, ...)
+// to EPUB. Like Calibre it's an OPTIONAL dependency and sits behind Calibre in
+// the registry; it's useful on a Pi where the much larger Calibre isn't
+// installed.
+//
+// Install on the Pi (Debian/Raspberry Pi OS):  sudo apt install -y pandoc
+
+// pandocCmd is the pandoc CLI; a package var so tests can point it at a stub.
+var pandocCmd = "pandoc"
+
+// pandocReaders are the formats pandoc converts from and its reader for each.
+var pandocReaders = []struct{ format, reader string }{
+	{"docx", "docx"},
+	{"odt", "odt"},
+	{"rtf", "rtf"},
+	{"html", "html"},
+	{"md", "markdown"},
+	{"fb2", "fb2"},
+}
+
+// pandocConvertTimeout bounds a pandoc run. Document conversions are fast;
+// this is well under the request timeouts, like pdfConvertTimeout.
+const pandocConvertTimeout = 30 * time.Second
+
+// pandocConverter converts documents to EPUB with pandoc.
+type pandocConverter struct{}
+
+func (pandocConverter) Name() string { return "pandoc" }
+
+func (pandocConverter) Routes() []ConversionRoute {
+	routes := make([]ConversionRoute, len(pandocReaders))
+	for i, r := range pandocReaders {
+		routes[i] = ConversionRoute{From: r.format, To: "epub"}
+	}
+	return routes
+}
+
+func (pandocConverter) Available() bool {
+	_, err := exec.LookPath(pandocCmd)
+	return err == nil
+}
+
+func (pandocConverter) Timeout() time.Duration { return pandocConvertTimeout }
+
+func (c pandocConverter) Convert(ctx context.Context, data []byte, route ConversionRoute) ([]byte, error) {
+	return c.convert(ctx, dataInput(data), route)
+}
+
+func (c pandocConverter) ConvertFile(ctx context.Context, path string, route ConversionRoute) ([]byte, error) {
+	return c.convert(ctx, fileInput(path), route)
+}
+
+func (pandocConverter) convert(ctx context.Context, in toolInput, route ConversionRoute) ([]byte, error) {
+	i := slices.IndexFunc(pandocReaders, func(r struct{ format, reader string }) bool { return r.format == route.From })
+	if i < 0 || route.To != "epub" {
+		return nil, fmt.Errorf("pandoc can't convert %s", route)
+	}
+	reader := pandocReaders[i].reader
+	return runConverterTool(ctx, pandocCmd, in, route, func(in, out string) []string {
+		return []string{"--from", reader, "--to", "epub3", "--output", out, in}
+	})
+}
@@ -1,26 +1,26 @@
 package anna
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
 	"time"
 )
 
 // PDFs are a poor Kindle experience (fixed layout, no reflow) and large scans
-// routinely blow past the ~18MB Send-to-Kindle email cap, so a PDF-only book
+// routinely blow past the email size limit (see sizelimit.go), so a PDF-only book
 // often "just doesn't send". When the only edition we can get is a PDF, we
 // convert it to EPUB (reflowable, far smaller) before emailing it.
 //
 // Conversion shells out to Calibre's `ebook-convert`, the de-facto standard for
 // this. It's an OPTIONAL dependency: if Calibre isn't installed, or conversion
 // fails/times out, callers fall back to sending the original PDF unchanged, so
-// this can never make PDF delivery worse than it already is.
+// this can never make PDF delivery worse than it already is. Calibre also
+// reads most other formats we download, so it backs the converter registry
+// (convert.go) for those too.
 //
 // Install on the Pi (Debian/Raspberry Pi OS):  sudo apt install -y calibre
 
@@ -29,7 +29,7 @@ import (
 var pdfConverterCmd = "ebook-convert"
 
 // ErrConverterUnavailable means Calibre's ebook-convert isn't on PATH, so we
-// can't convert and should send the original PDF as-is.
+// can't convert with it and should send the original PDF as-is.
 var ErrConverterUnavailable = errors.New("pdf→epub converter (calibre ebook-convert) not installed")
 
 // pdfConvertTimeout bounds how long a single conversion may run. It is kept
@@ -46,62 +46,82 @@ func pdfConvertTimeout() time.Duration {
 	return def
 }
 
-// PDFConverterAvailable reports whether Calibre's ebook-convert is on PATH.
-func PDFConverterAvailable() bool {
-	_, err := exec.LookPath(pdfConverterCmd)
-	return err == nil
+// calibreInputs are the formats ebook-convert reads that we may download.
+var calibreInputs = []string{
+	"pdf", "mobi", "azw", "azw3", "docx", "odt", "rtf", "html", "txt",
+	"fb2", "djvu", "cbz", "cbr", "lit", "pdb",
 }
 
-// ConvertPDFToEPUB converts PDF bytes to EPUB bytes via Calibre's ebook-convert.
-// Returns ErrConverterUnavailable if Calibre isn't installed. The returned bytes
-// are only used when err == nil; on any error the caller sends the original PDF.
-func ConvertPDFToEPUB(pdfData []byte) ([]byte, error) {
-	if len(pdfData) == 0 {
-		return nil, errors.New("empty pdf data")
-	}
-	if !PDFConverterAvailable() {
-		return nil, ErrConverterUnavailable
-	}
+// calibreConverter converts to EPUB with Calibre's ebook-convert. It is the
+// only PDF converter and the fallback for most other formats.
+type calibreConverter struct{}
 
-	tmpDir, err := os.MkdirTemp("", "pib-pdf2epub-")
-	if err != nil {
-		return nil, fmt.Errorf("create temp dir: %w", err)
-	}
-	defer os.RemoveAll(tmpDir)
+func (calibreConverter) Name() string { return "calibre" }
 
-	inPath := filepath.Join(tmpDir, "in.pdf")
-	outPath := filepath.Join(tmpDir, "out.epub")
-	if err := os.WriteFile(inPath, pdfData, 0600); err != nil {
-		return nil, fmt.Errorf("write temp pdf: %w", err)
+func (calibreConverter) Routes() []ConversionRoute {
+	routes := make([]ConversionRoute, len(calibreInputs))
+	for i, from := range calibreInputs {
+		routes[i] = ConversionRoute{From: from, To: "epub"}
 	}
+	return routes
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), pdfConvertTimeout())
-	defer cancel()
+func (calibreConverter) Available() bool { return PDFConverterAvailable() }
 
-	var stderr bytes.Buffer
-	cmd := exec.CommandContext(ctx, pdfConverterCmd, inPath, outPath,
-		"--enable-heuristics", // clean up PDF line breaks / hyphenation into reflowable text
-	)
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return nil, fmt.Errorf("pdf→epub conversion timed out after %s", pdfConvertTimeout())
-		}
-		return nil, fmt.Errorf("ebook-convert failed: %w (%s)", err, truncate(stderr.String(), 300))
+func (calibreConverter) Timeout() time.Duration { return pdfConvertTimeout() }
+
+func (c calibreConverter) Convert(ctx context.Context, data []byte, route ConversionRoute) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty %s data", route.From)
 	}
+	return c.convert(ctx, dataInput(data), route)
+}
 
-	epubData, err := os.ReadFile(outPath)
+func (c calibreConverter) ConvertFile(ctx context.Context, path string, route ConversionRoute) ([]byte, error) {
+	return c.convert(ctx, fileInput(path), route)
+}
+
+func (calibreConverter) convert(ctx context.Context, in toolInput, route ConversionRoute) ([]byte, error) {
+	if !PDFConverterAvailable() {
+		return nil, ErrConverterUnavailable
+	}
+	out, err := runConverterTool(ctx, pdfConverterCmd, in, route, func(in, out string) []string {
+		args := []string{in, out}
+		if route.From == "pdf" {
+			args = append(args, "--enable-heuristics") // clean up PDF line breaks / hyphenation into reflowable text
+		}
+		return args
+	})
 	if err != nil {
-		return nil, fmt.Errorf("read converted epub: %w", err)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s conversion timed out after %s", route, pdfConvertTimeout())
+		}
+		return nil, err
 	}
-	if len(epubData) == 0 {
+	if len(out) == 0 {
 		return nil, errors.New("conversion produced an empty epub")
 	}
 	// Sanity-check that we actually got an EPUB (a text-only / image-only PDF can
 	// yield a degenerate output); reject anything that isn't a real EPUB zip so
-	// the caller falls back to the original PDF.
-	if !isEPUBZip(epubData) {
+	// the caller falls back to the original.
+	if !isEPUBZip(out) {
 		return nil, errors.New("conversion output is not a valid epub")
 	}
-	return epubData, nil
+	return out, nil
+}
+
+// PDFConverterAvailable reports whether Calibre's ebook-convert is on PATH.
+func PDFConverterAvailable() bool {
+	_, err := exec.LookPath(pdfConverterCmd)
+	return err == nil
+}
+
+// ConvertPDFToEPUB converts PDF bytes to EPUB bytes via Calibre's ebook-convert.
+// Returns ErrConverterUnavailable if Calibre isn't installed. The returned bytes
+// are only used when err == nil; on any error the caller sends the original PDF.
+// Deliveries go through the converter registry (see convert.go) instead.
+func ConvertPDFToEPUB(pdfData []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pdfConvertTimeout())
+	defer cancel()
+	return calibreConverter{}.Convert(ctx, pdfData, ConversionRoute{From: "pdf", To: "epub"})
 }
@@ -0,0 +1,320 @@
+package anna
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Anyone holding WEB_PASSCODE can pass an arbitrary kindle_email, and our
+// Gmail account would happily mail a file to it. The recipient policy keeps
+// the server from being an open relay:
+//
+//   - KINDLE_ALLOWED_RECIPIENTS is a comma-separated allowlist of exact
+//     addresses and/or domains ("@kindle.com"). Unset means Amazon's Kindle
+//     domains only; "*" allows anything. KINDLE_EMAIL and profile addresses
+//     (Recipient.Trusted) are always allowed.
+//   - KINDLE_DAILY_SEND_LIMIT caps sends per recipient per calendar day
+//     (default 20; 0 disables the cap). With SEND_LOG_PATH set, today's
+//     counts are kept in daily-sends.json beside the send log so a restart
+//     doesn't reset them; otherwise they live in memory.
+//
+// The check runs before any download on both the direct path
+// (EmailToKindle, SendFileToKindle) and the relay path (downloadViaRelay).
+// The send itself reserves its slot with Reserve, which checks and counts in
+// one step, so concurrent sends to one recipient can't all slip under the
+// cap; a send that then fails gives the slot back.
+
+// defaultAllowedRecipients applies when KINDLE_ALLOWED_RECIPIENTS is unset.
+var defaultAllowedRecipients = []string{"@kindle.com", "@free.kindle.com"}
+
+const defaultDailySendLimit = 20
+
+var (
+	// ErrRecipientNotAllowed matches (errors.Is) a *PolicyError for an
+	// address outside the allowlist.
+	ErrRecipientNotAllowed = errors.New("recipient not allowed")
+	// ErrDailyLimitReached matches a *PolicyError for a recipient that has
+	// used up today's sends.
+	ErrDailyLimitReached = errors.New("daily send limit reached")
+)
+
+// PolicyError reports a send refused by the recipient policy.
+type PolicyError struct {
+	Recipient string
+	Err       error // ErrRecipientNotAllowed or ErrDailyLimitReached
+	Limit     int
+}
+
+func (e *PolicyError) Error() string {
+	if errors.Is(e.Err, ErrDailyLimitReached) {
+		return fmt.Sprintf("%s has already received %d books today (KINDLE_DAILY_SEND_LIMIT); try again tomorrow", e.Recipient, e.Limit)
+	}
+	return fmt.Sprintf("%s is not an allowed recipient (see KINDLE_ALLOWED_RECIPIENTS); use a Kindle profile or an approved address", e.Recipient)
+}
+
+func (e *PolicyError) Unwrap() error { return e.Err }
+
+// RecipientPolicy enforces the allowlist and the per-recipient daily cap.
+// It is safe for concurrent use.
+type RecipientPolicy struct {
+	allowAll   bool
+	addresses  map[string]bool
+	domains    []string // lowercase, without the "@"
+	dailyLimit int
+
+	mu    sync.Mutex
+	day   string
+	sends map[string]int
+	now   func() time.Time
+	path  string // where the counts persist; "" keeps them in memory
+}
+
+// dailySends is the on-disk form of a policy's counts.
+type dailySends struct {
+	Day   string         `json:"day"`
+	Sends map[string]int `json:"sends"`
+}
+
+// NewRecipientPolicy builds a policy from allowlist entries (addresses,
+// "@domain" or "*") and a daily limit (0 = unlimited).
+func NewRecipientPolicy(allowed []string, dailyLimit int) *RecipientPolicy {
+	p := &RecipientPolicy{
+		addresses:  map[string]bool{},
+		dailyLimit: dailyLimit,
+		sends:      map[string]int{},
+		now:        time.Now,
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		switch {
+		case a == "":
+		case a == "*":
+			p.allowAll = true
+		case strings.HasPrefix(a, "@"):
+			p.domains = append(p.domains, a[1:])
+		case !strings.Contains(a, "@"):
+			p.domains = append(p.domains, a) // bare domain
+		default:
+			p.addresses[a] = true
+		}
+	}
+	return p
+}
+
+func (p *RecipientPolicy) allowed(to Recipient) bool {
+	if p.allowAll || to.Trusted {
+		return true
+	}
+	addr := strings.ToLower(strings.TrimSpace(to.Email))
+	if p.addresses[addr] {
+		return true
+	}
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return false
+	}
+	domain := addr[at+1:]
+	for _, d := range p.domains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// rollover resets the counters at the start of a new day. Caller holds mu.
+func (p *RecipientPolicy) rollover() {
+	if day := p.now().Format("2006-01-02"); day != p.day {
+		p.day = day
+		p.sends = map[string]int{}
+	}
+}
+
+// Check reports whether a send to `to` is allowed right now, without
+// counting it.
+func (p *RecipientPolicy) Check(to Recipient) error {
+	if !p.allowed(to) {
+		return &PolicyError{Recipient: to.String(), Err: ErrRecipientNotAllowed}
+	}
+	if p.dailyLimit <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rollover()
+	if p.sends[strings.ToLower(to.Email)] >= p.dailyLimit {
+		return &PolicyError{Recipient: to.String(), Err: ErrDailyLimitReached, Limit: p.dailyLimit}
+	}
+	return nil
+}
+
+// Remaining reports how many more sends `to` may receive today, or -1 when
+// there is no cap.
+func (p *RecipientPolicy) Remaining(to Recipient) int {
+	if p.dailyLimit <= 0 {
+		return -1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rollover()
+	if n := p.dailyLimit - p.sends[strings.ToLower(to.Email)]; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Reserve is Check that also counts the send against today's cap, in one
+// step. Call release if the send then fails, to give the slot back.
+func (p *RecipientPolicy) Reserve(to Recipient) (release func(), err error) {
+	if !p.allowed(to) {
+		return nil, &PolicyError{Recipient: to.String(), Err: ErrRecipientNotAllowed}
+	}
+	if p.dailyLimit <= 0 {
+		return func() {}, nil
+	}
+	key := strings.ToLower(to.Email)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rollover()
+	if p.sends[key] >= p.dailyLimit {
+		return nil, &PolicyError{Recipient: to.String(), Err: ErrDailyLimitReached, Limit: p.dailyLimit}
+	}
+	p.sends[key]++
+	p.persist()
+	day := p.day
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.rollover()
+			if p.day == day && p.sends[key] > 0 {
+				p.sends[key]--
+				p.persist()
+			}
+		})
+	}, nil
+}
+
+// persistTo keeps the counts in path, picking up today's from a previous
+// run.
+func (p *RecipientPolicy) persistTo(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read daily send counts: %w", err)
+	}
+	var saved dailySends
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("parse daily send counts %s: %w", path, err)
+	}
+	p.rollover()
+	if saved.Day == p.day {
+		for k, n := range saved.Sends {
+			p.sends[k] += n
+		}
+	}
+	return nil
+}
+
+// persist writes the counts to p.path, if set. Best-effort: a failure is
+// logged and the in-memory counts still apply. Caller holds mu.
+func (p *RecipientPolicy) persist() {
+	if p.path == "" {
+		return
+	}
+	data, err := json.Marshal(dailySends{Day: p.day, Sends: p.sends})
+	if err == nil {
+		tmp := p.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, p.path)
+		}
+	}
+	if err != nil {
+		logger.GetLogger().Warn("Could not save daily send counts", zap.String("path", p.path), zap.Error(err))
+	}
+}
+
+// recipientPolicy is the process-wide policy, built from the environment on
+// first use. Tests swap it out.
+var (
+	recipientPolicyOnce sync.Once
+	recipientPolicyVal  *RecipientPolicy
+)
+
+func recipientPolicy() *RecipientPolicy {
+	recipientPolicyOnce.Do(func() {
+		if recipientPolicyVal == nil {
+			recipientPolicyVal = recipientPolicyFromEnv()
+		}
+	})
+	return recipientPolicyVal
+}
+
+func recipientPolicyFromEnv() *RecipientPolicy {
+	l := logger.GetLogger()
+	allowed := defaultAllowedRecipients
+	if v := strings.TrimSpace(os.Getenv("KINDLE_ALLOWED_RECIPIENTS")); v != "" {
+		allowed = strings.Split(v, ",")
+	}
+	if kindleEmail := strings.TrimSpace(os.Getenv("KINDLE_EMAIL")); strings.Contains(kindleEmail, "@") {
+		allowed = append(append([]string{}, allowed...), kindleEmail)
+	}
+	limit := defaultDailySendLimit
+	if v := strings.TrimSpace(os.Getenv("KINDLE_DAILY_SEND_LIMIT")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			l.Warn("Invalid KINDLE_DAILY_SEND_LIMIT; using default", zap.String("value", v), zap.Int("default", defaultDailySendLimit))
+		} else {
+			limit = n
+		}
+	}
+	p := NewRecipientPolicy(allowed, limit)
+	if sendLog := strings.TrimSpace(os.Getenv("SEND_LOG_PATH")); sendLog != "" && limit > 0 {
+		if err := p.persistTo(filepath.Join(filepath.Dir(sendLog), "daily-sends.json")); err != nil {
+			l.Warn("Could not load daily send counts; starting from zero", zap.Error(err))
+		}
+	}
+	return p
+}
+
+// checkRecipient applies the process-wide policy and logs refusals.
+func checkRecipient(to Recipient) error {
+	err := recipientPolicy().Check(to)
+	if err != nil {
+		logRefusal(to, err)
+	}
+	return err
+}
+
+// reserveRecipient reserves a send to `to` under the process-wide policy and
+// logs refusals. Call release if the send fails.
+func reserveRecipient(to Recipient) (release func(), err error) {
+	release, err = recipientPolicy().Reserve(to)
+	if err != nil {
+		logRefusal(to, err)
+	}
+	return release, err
+}
+
+func logRefusal(to Recipient, err error) {
+	logger.GetLogger().Warn("Send refused by recipient policy",
+		zap.String("recipient", to.String()),
+		zap.Error(err),
+	)
+}
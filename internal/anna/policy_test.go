@@ -0,0 +1,211 @@
+package anna
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/relay"
+)
+
+// usePolicy swaps the process-wide recipient policy for the test.
+func usePolicy(t *testing.T, p *RecipientPolicy) {
+	t.Helper()
+	prev := recipientPolicy()
+	recipientPolicyVal = p
+	t.Cleanup(func() { recipientPolicyVal = prev })
+}
+
+func TestRecipientPolicy_Allowlist(t *testing.T) {
+	p := NewRecipientPolicy([]string{"@kindle.com", "free.kindle.com", "Friend_Q@Example.org"}, 0)
+	cases := []struct {
+		to   Recipient
+		want bool
+	}{
+		{Recipient{Email: "alice_x@kindle.com"}, true},
+		{Recipient{Email: "bob@FREE.kindle.com"}, true},
+		{Recipient{Email: "friend_q@example.org"}, true},
+		{Recipient{Email: "someone@example.org"}, false},
+		{Recipient{Email: "x@evil-kindle.com"}, false},
+		{Recipient{Email: "x@kindle.com.evil.net"}, false},
+		{Recipient{Email: "kids@gmail.com", Name: "kids-tablet", Trusted: true}, true},
+	}
+	for _, tc := range cases {
+		err := p.Check(tc.to)
+		if got := err == nil; got != tc.want {
+			t.Errorf("Check(%s) = %v, want allowed=%v", tc.to, err, tc.want)
+		}
+		if err != nil && !errors.Is(err, ErrRecipientNotAllowed) {
+			t.Errorf("Check(%s) should be ErrRecipientNotAllowed, got %v", tc.to, err)
+		}
+	}
+	if err := NewRecipientPolicy([]string{"*"}, 0).Check(Recipient{Email: "anyone@example.org"}); err != nil {
+		t.Errorf("\"*\" should allow anything, got %v", err)
+	}
+}
+
+func TestRecipientPolicy_DailyLimit(t *testing.T) {
+	p := NewRecipientPolicy([]string{"@kindle.com"}, 2)
+	now := time.Date(2026, 5, 1, 23, 0, 0, 0, time.Local)
+	p.now = func() time.Time { return now }
+
+	alice := Recipient{Email: "alice_x@kindle.com"}
+	for i := 0; i < 2; i++ {
+		if _, err := p.Reserve(Recipient{Email: "ALICE_X@kindle.com"}); err != nil {
+			t.Fatalf("send %d: %v", i+1, err)
+		}
+	}
+	err := p.Check(alice)
+	if !errors.Is(err, ErrDailyLimitReached) || !strings.Contains(err.Error(), "2 books today") {
+		t.Fatalf("expected the daily limit, got %v", err)
+	}
+	// Trusted recipients are still capped.
+	if err := p.Check(Recipient{Email: "alice_x@kindle.com", Trusted: true}); !errors.Is(err, ErrDailyLimitReached) {
+		t.Fatalf("the cap should apply to profiles too, got %v", err)
+	}
+	// Other recipients have their own budget.
+	if err := p.Check(Recipient{Email: "bob@kindle.com"}); err != nil {
+		t.Fatalf("bob should be unaffected: %v", err)
+	}
+	// A new day resets the count.
+	now = now.Add(2 * time.Hour)
+	if err := p.Check(alice); err != nil {
+		t.Fatalf("limit should reset at midnight: %v", err)
+	}
+}
+
+func TestRecipientPolicy_ReserveIsAtomic(t *testing.T) {
+	p := NewRecipientPolicy([]string{"@kindle.com"}, 3)
+	alice := Recipient{Email: "alice_x@kindle.com"}
+
+	var wg sync.WaitGroup
+	var granted atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Reserve(alice); err == nil {
+				granted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if granted.Load() != 3 {
+		t.Fatalf("%d concurrent sends got through a cap of 3", granted.Load())
+	}
+
+	// A failed send gives its slot back, once.
+	p = NewRecipientPolicy([]string{"@kindle.com"}, 1)
+	release, err := p.Reserve(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Reserve(alice); !errors.Is(err, ErrDailyLimitReached) {
+		t.Fatalf("the reserved slot should count, got %v", err)
+	}
+	release()
+	release()
+	if p.Remaining(alice) != 1 {
+		t.Fatalf("remaining = %d after release, want 1", p.Remaining(alice))
+	}
+}
+
+func TestRecipientPolicy_PersistsCounts(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SEND_LOG_PATH", filepath.Join(dir, "sends.json"))
+	t.Setenv("KINDLE_DAILY_SEND_LIMIT", "2")
+	alice := Recipient{Email: "alice_x@kindle.com"}
+
+	p := recipientPolicyFromEnv()
+	if _, err := p.Reserve(alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "daily-sends.json")); err != nil {
+		t.Fatalf("counts not saved beside the send log: %v", err)
+	}
+
+	// A restart picks up today's count.
+	restarted := recipientPolicyFromEnv()
+	if n := restarted.Remaining(alice); n != 1 {
+		t.Fatalf("remaining after restart = %d, want 1", n)
+	}
+
+	// Yesterday's counts don't carry over.
+	restarted.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	if n := restarted.Remaining(alice); n != 2 {
+		t.Fatalf("remaining the next day = %d, want 2", n)
+	}
+}
+
+func TestSendFileToKindle_RefusesDisallowedRecipient(t *testing.T) {
+	usePolicy(t, NewRecipientPolicy([]string{"@kindle.com"}, 0))
+	srv := newFakeSMTP(t)
+	port := srv.start()
+	mail := MailConfig{Host: "127.0.0.1", Port: port, User: "u", Password: "pw", FromEmail: "reader@example.com", Security: SecurityPlain}
+
+	err := SendFileToKindle([]byte("%PDF-1.4 tiny"), "book.pdf", "application/pdf", "Book: book", mail, Recipient{Email: "victim@example.org"})
+	if !errors.Is(err, ErrRecipientNotAllowed) {
+		t.Fatalf("expected ErrRecipientNotAllowed, got %v", err)
+	}
+	if len(srv.sent()) != 0 {
+		t.Fatal("nothing should have been sent")
+	}
+}
+
+func TestDownloadViaRelay_EnforcesPolicy(t *testing.T) {
+	usePolicy(t, NewRecipientPolicy([]string{"@kindle.com"}, 1))
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"content":[{"type":"text","text":"ok"}]}}`))
+	}))
+	defer srv.Close()
+	t.Setenv(relay.EnvBaseURL, srv.URL)
+	t.Setenv(relay.EnvSecret, "test-secret")
+
+	if err := downloadViaRelay("abc", "Title", "epub", "", Recipient{Email: "victim@example.org"}); !errors.Is(err, ErrRecipientNotAllowed) {
+		t.Fatalf("expected ErrRecipientNotAllowed, got %v", err)
+	}
+	if calls != 0 {
+		t.Fatal("a refused recipient must not reach the relay")
+	}
+
+	to := Recipient{Email: "alice_x@kindle.com"}
+	if err := downloadViaRelay("abc", "Title", "epub", "", to); err != nil {
+		t.Fatalf("first relay send: %v", err)
+	}
+	if err := downloadViaRelay("abc", "Title", "epub", "", to); !errors.Is(err, ErrDailyLimitReached) {
+		t.Fatalf("expected the daily cap on the relay path, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("relay calls = %d, want 1", calls)
+	}
+
+	// A bare profile name is forwarded for the Pi to resolve and check.
+	if err := downloadViaRelay("abc", "Title", "epub", "", Recipient{Name: "kids-tablet"}); err != nil {
+		t.Fatalf("profile name via relay: %v", err)
+	}
+}
+
+func TestCallRelayTool_SurfacesPiToolErrorText(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"isError":true,"content":[{"type":"text","text":"Not sent: x@example.org is not an allowed recipient."}]}}`))
+	}))
+	defer srv.Close()
+	t.Setenv(relay.EnvBaseURL, srv.URL)
+	t.Setenv(relay.EnvSecret, "test-secret")
+
+	_, err := callRelayTool("download", map[string]interface{}{"hash": "abc"})
+	if err == nil || !strings.Contains(err.Error(), "not an allowed recipient") {
+		t.Fatalf("expected the Pi's explanation, got %v", err)
+	}
+}
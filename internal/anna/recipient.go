@@ -0,0 +1,50 @@
+package anna
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Recipient is one Kindle to deliver to: its Send-to-Kindle address plus the
+// per-device preferences from a named profile (see modes.Env.Profiles). A
+// bare address is a Recipient with only Email set.
+type Recipient struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+	// Format is the device's preferred format. "pdf" keeps PDFs as PDFs
+	// (tablets and large-screen Kindles render them fine); anything else,
+	// including empty, means EPUB and converts PDFs when possible.
+	Format string `json:"format,omitempty"`
+	// MaxBytes caps the attachment size for this device. Zero means the
+	// transport's limit.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// Trusted marks an address the operator configured (a profile or
+	// KINDLE_EMAIL); it bypasses the recipient allowlist but not the daily
+	// cap. Never set from caller input.
+	Trusted bool `json:"-"`
+}
+
+// String renders the recipient for logs and user-facing messages.
+func (r Recipient) String() string {
+	switch {
+	case r.Name != "" && r.Email != "":
+		return fmt.Sprintf("%s <%s>", r.Name, r.Email)
+	case r.Email != "":
+		return r.Email
+	}
+	return r.Name
+}
+
+// relayTarget is what the relay path forwards as kindle_email: the address
+// when known, else the profile name for the Pi to resolve.
+func (r Recipient) relayTarget() string {
+	if r.Email != "" {
+		return r.Email
+	}
+	return r.Name
+}
+
+// keepsPDF reports whether PDFs should be sent unconverted.
+func (r Recipient) keepsPDF() bool {
+	return strings.EqualFold(strings.TrimSpace(r.Format), "pdf")
+}
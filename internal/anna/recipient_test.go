@@ -0,0 +1,33 @@
+package anna
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSendFileToKindle_ProfileSizeLimit(t *testing.T) {
+	srv := newFakeSMTP(t)
+	port := srv.start()
+	mail := MailConfig{Host: "127.0.0.1", Port: port, User: "u", Password: "pw", FromEmail: "reader@example.com", Security: SecurityPlain}
+
+	to := Recipient{Name: "kids-tablet", Email: "kids_y@kindle.com", MaxBytes: 8}
+	err := SendFileToKindle([]byte("%PDF-1.4 too big"), "book.pdf", "application/pdf", "Book: book", mail, to)
+	if err == nil || !strings.Contains(err.Error(), "file too large for kids-tablet <kids_y@kindle.com>") {
+		t.Fatalf("expected the profile limit to apply, got %v", err)
+	}
+	if len(srv.sent()) != 0 {
+		t.Fatal("nothing should have been sent")
+	}
+}
+
+func TestRecipient_Helpers(t *testing.T) {
+	if got := (Recipient{Name: "kids-tablet"}).relayTarget(); got != "kids-tablet" {
+		t.Errorf("relayTarget without an address should forward the name, got %q", got)
+	}
+	if got := (Recipient{Name: "a", Email: "a@kindle.com"}).relayTarget(); got != "a@kindle.com" {
+		t.Errorf("relayTarget should prefer the address, got %q", got)
+	}
+	if !(Recipient{Format: "PDF"}).keepsPDF() || (Recipient{}).keepsPDF() {
+		t.Error("keepsPDF should only be true for a pdf profile")
+	}
+}
@@ -1,7 +1,9 @@
 package anna
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,6 +13,10 @@ import (
 	"go.uber.org/zap"
 )
 
+// ErrRelayUnsupported is returned by operations that need the book file on
+// this side, which relay mode never has.
+var ErrRelayUnsupported = errors.New("not available in relay mode (" + relay.EnvBaseURL + " is set): books are downloaded and mailed on the Pi")
+
 // JSON-RPC envelopes for the Pi's annas-mcp HTTP server.
 type jsonRPCRequest struct {
 	JSONRPC string         `json:"jsonrpc"`
@@ -32,7 +38,7 @@ type jsonRPCResponse struct {
 			Items []*Book `json:"items"`
 		} `json:"structuredContent"`
 		// Some MCP responses also include a "content" array with a
-		// human-readable text field; we ignore it here.
+		// human-readable text field; see relayErrorText.
 		IsError bool `json:"isError"`
 	} `json:"result"`
 	Error *struct {
@@ -83,6 +89,9 @@ func callRelayTool(toolName string, args map[string]interface{}) (*jsonRPCRespon
 		return nil, fmt.Errorf("relay tool error: %s", parsed.Error.Message)
 	}
 	if parsed.Result != nil && parsed.Result.IsError {
+		if text := relayErrorText(body); text != "" {
+			return nil, fmt.Errorf("relay tool returned isError=true: %s", truncate(text, 500))
+		}
 		return nil, fmt.Errorf("relay tool returned isError=true")
 	}
 	return parsed, nil
@@ -122,6 +131,28 @@ func decodeJSONRPC(body []byte) (*jsonRPCResponse, error) {
 	return &parsed, nil
 }
 
+// relayErrorText pulls the first text content out of an isError result so
+// the Pi's explanation (e.g. a refused recipient) reaches the user.
+func relayErrorText(body []byte) string {
+	var parsed struct {
+		Result struct {
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"result"`
+	}
+	if i := bytes.Index(body, []byte("data:")); i >= 0 {
+		body = bytes.TrimSpace(body[i+5:])
+		if j := bytes.IndexByte(body, '\n'); j >= 0 {
+			body = body[:j]
+		}
+	}
+	if json.Unmarshal(body, &parsed) != nil || len(parsed.Result.Content) == 0 {
+		return ""
+	}
+	return parsed.Result.Content[0].Text
+}
+
 func truncate(s string, n int) string {
 	if len(s) <= n {
 		return s
@@ -154,11 +185,22 @@ func findBookViaRelay(query, preferredFormat string) ([]*Book, error) {
 }
 
 // downloadViaRelay calls the pi-annas-mcp `download` tool through the
-// relay. When kindleEmail is non-empty the Pi-side server handles SMTP
-// directly; otherwise it just downloads the file on the Pi (we discard
-// the file on this side, since the Fly app has no local storage).
-func downloadViaRelay(hash, title, format, author, kindleEmail string) error {
+// relay. When `to` is set the Pi-side server handles SMTP directly;
+// otherwise it just downloads the file on the Pi (we discard the file on
+// this side, since the Fly app has no local storage). The recipient policy
+// is enforced here too, so Fly can't be used to reach the Pi's mailer with
+// an arbitrary address; a bare profile name is left for the Pi to resolve
+// and check.
+func downloadViaRelay(hash, title, format, author string, to Recipient) error {
 	l := logger.GetLogger()
+	kindleEmail := to.relayTarget()
+	release := func() {}
+	if to.Email != "" {
+		var err error
+		if release, err = reserveRecipient(to); err != nil {
+			return err
+		}
+	}
 	args := map[string]interface{}{
 		"hash":   hash,
 		"title":  title,
@@ -176,6 +218,7 @@ func downloadViaRelay(hash, title, format, author, kindleEmail string) error {
 		zap.Bool("send_to_kindle", kindleEmail != ""),
 	)
 	if _, err := callRelayTool("download", args); err != nil {
+		release()
 		return err
 	}
 	return nil
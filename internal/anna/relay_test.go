@@ -2,6 +2,7 @@ package anna
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -104,7 +105,7 @@ func TestDownloadViaRelay_KindleEmailIncluded(t *testing.T) {
 	srv, cap := mockRelay(t, resp)
 	defer srv.Close()
 
-	if err := downloadViaRelay("abc", "Title", "epub", "Jane Doe", "user@kindle.com"); err != nil {
+	if err := downloadViaRelay("abc", "Title", "epub", "Jane Doe", Recipient{Email: "user@kindle.com"}); err != nil {
 		t.Fatalf("downloadViaRelay: %v", err)
 	}
 	if cap.body.Params.Name != "download" {
@@ -132,7 +133,7 @@ func TestDownloadViaRelay_NoKindleEmailOmitsField(t *testing.T) {
 	srv, cap := mockRelay(t, resp)
 	defer srv.Close()
 
-	if err := downloadViaRelay("abc", "Title", "epub", "", ""); err != nil {
+	if err := downloadViaRelay("abc", "Title", "epub", "", Recipient{}); err != nil {
 		t.Fatalf("downloadViaRelay: %v", err)
 	}
 	if _, ok := cap.body.Params.Arguments["kindle_email"]; ok {
@@ -170,3 +171,20 @@ func TestDecodeJSONRPC_HandlesSSEFraming(t *testing.T) {
 		t.Errorf("unexpected result: %+v", parsed.Result)
 	}
 }
+
+func TestCheckEdition_RefusedViaRelay(t *testing.T) {
+	t.Setenv(relay.EnvBaseURL, "http://relay.invalid")
+	t.Setenv(relay.EnvSecret, "test-secret")
+	if _, err := CheckEdition("abc123", ""); !errors.Is(err, ErrRelayUnsupported) {
+		t.Fatalf("err = %v, want ErrRelayUnsupported", err)
+	}
+}
+
+func TestSendTextToKindle_RefusedViaRelay(t *testing.T) {
+	t.Setenv(relay.EnvBaseURL, "http://relay.invalid")
+	t.Setenv(relay.EnvSecret, "test-secret")
+	_, err := SendTextToKindle("Some text.", TextOptions{}, MailConfig{}, Recipient{Email: "reader@kindle.com"})
+	if !errors.Is(err, ErrRelayUnsupported) {
+		t.Fatalf("err = %v, want ErrRelayUnsupported", err)
+	}
+}
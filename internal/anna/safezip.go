@@ -0,0 +1,212 @@
+package anna
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Every EPUB stage unpacks an archive that came from the internet into
+// memory, on a Pi with a gigabyte or two of it. A zip bomb — or just a
+// corrupt header claiming a 4 GB entry — must not take the server down, so
+// all of them go through safeZip, which refuses archives with too many
+// entries, entries or totals too big, implausible compression ratios and
+// names that escape the archive.
+
+// zipLimitSet bounds what safeZip will unpack.
+type zipLimitSet struct {
+	MaxEntries    int
+	MaxEntryBytes int64 // uncompressed, per entry
+	MaxTotalBytes int64 // uncompressed, all entries read
+	MaxRatio      int64 // uncompressed:compressed, for entries over ratioFloor
+}
+
+// zipLimits are the default limits; a package var so tests can shrink them.
+// A book is held in memory unpacked and again repacked, and has to fit an
+// email of 18-50 MB in the end, so 256 MB unpacked is already generous on a
+// Pi with 1 GB.
+var zipLimits = zipLimitSet{
+	MaxEntries:    10000,
+	MaxEntryBytes: 64 << 20,
+	MaxTotalBytes: 256 << 20,
+	MaxRatio:      100,
+}
+
+// activeZipLimits is zipLimits with ZIP_MAX_ENTRY_MB and ZIP_MAX_TOTAL_MB
+// applied.
+func activeZipLimits() zipLimitSet {
+	limits := zipLimits
+	limits.MaxEntryBytes = mbFromEnv("ZIP_MAX_ENTRY_MB", limits.MaxEntryBytes)
+	limits.MaxTotalBytes = mbFromEnv("ZIP_MAX_TOTAL_MB", limits.MaxTotalBytes)
+	return limits
+}
+
+// mbFromEnv reads a size in MB from the environment variable name, or
+// returns def if it is unset or invalid.
+func mbFromEnv(name string, def int64) int64 {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		if n, err := strconv.ParseFloat(v, 64); err == nil && n > 0 {
+			return int64(n * (1 << 20))
+		}
+		logger.GetLogger().Warn("Ignoring invalid "+name, zap.String("value", v))
+	}
+	return def
+}
+
+// ratioFloor exempts small entries from the ratio check: a few KB of
+// repetitive markup can legitimately compress 100 to 1.
+const ratioFloor = 1 << 20
+
+// The limits a ZipError reports breaking.
+var (
+	ErrZipTooManyEntries = errors.New("too many entries")
+	ErrZipEntryTooLarge  = errors.New("entry too large")
+	ErrZipTooLarge       = errors.New("too much data uncompressed")
+	ErrZipRatio          = errors.New("implausible compression ratio")
+	ErrZipUnsafePath     = errors.New("unsafe entry name")
+)
+
+// ZipError is returned when an archive breaks one of the limits. Err is one
+// of the ErrZip* errors above, so callers can use errors.Is.
+type ZipError struct {
+	Name   string // the entry, or "" for the whole archive
+	Err    error
+	Detail string
+}
+
+func (e *ZipError) Error() string {
+	msg := "refusing to unpack zip: " + e.Err.Error()
+	if e.Name != "" {
+		msg += fmt.Sprintf(" (%q)", e.Name)
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *ZipError) Unwrap() error { return e.Err }
+
+// safeZip is a zip archive read within its limits.
+type safeZip struct {
+	zr     *zip.Reader
+	limits zipLimitSet
+	read   int64 // uncompressed bytes read so far
+}
+
+// openZip opens data as a zip archive and checks its directory against
+// activeZipLimits: entry count, entry names, and the sizes the headers
+// declare. Entries are checked again as they are read, as headers can lie.
+func openZip(data []byte) (*safeZip, error) {
+	return openZipReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// openZipReader is openZip for a zip of size bytes read through r, such as
+// an open file.
+func openZipReader(r io.ReaderAt, size int64) (*safeZip, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	limits := activeZipLimits()
+	if n := len(zr.File); n > limits.MaxEntries {
+		return nil, &ZipError{Err: ErrZipTooManyEntries, Detail: fmt.Sprintf("%d entries, max %d", n, limits.MaxEntries)}
+	}
+	var total uint64
+	for _, f := range zr.File {
+		if !safeZipName(f.Name) {
+			return nil, &ZipError{Name: f.Name, Err: ErrZipUnsafePath}
+		}
+		if f.UncompressedSize64 > uint64(limits.MaxEntryBytes) {
+			return nil, &ZipError{Name: f.Name, Err: ErrZipEntryTooLarge, Detail: sizeDetail(f.UncompressedSize64, limits.MaxEntryBytes)}
+		}
+		if err := limits.checkRatio(f.Name, f.UncompressedSize64, f.CompressedSize64); err != nil {
+			return nil, err
+		}
+		total += f.UncompressedSize64
+	}
+	if total > uint64(limits.MaxTotalBytes) {
+		return nil, &ZipError{Err: ErrZipTooLarge, Detail: sizeDetail(total, limits.MaxTotalBytes)}
+	}
+	return &safeZip{zr: zr, limits: limits}, nil
+}
+
+// safeZipName reports whether an entry name stays inside the archive: no
+// absolute paths, drive letters, backslashes or ".." segments.
+func safeZipName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.ContainsAny(name, "\\\x00") {
+		return false
+	}
+	if len(name) >= 2 && name[1] == ':' {
+		return false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return false
+		}
+	}
+	return path.Clean(name) != ".."
+}
+
+func (l zipLimitSet) checkRatio(name string, uncompressed, compressed uint64) error {
+	if uncompressed <= ratioFloor {
+		return nil
+	}
+	if compressed == 0 || uncompressed/compressed > uint64(l.MaxRatio) {
+		return &ZipError{Name: name, Err: ErrZipRatio, Detail: fmt.Sprintf("%d bytes from %d, max %d:1", uncompressed, compressed, l.MaxRatio)}
+	}
+	return nil
+}
+
+func sizeDetail(n uint64, limit int64) string {
+	return fmt.Sprintf("%.1f MB, max %d MB", float64(n)/(1<<20), limit>>20)
+}
+
+// files lists the archive's entries.
+func (z *safeZip) files() []*zip.File { return z.zr.File }
+
+// readFile reads an entry, stopping at the per-entry and total limits
+// whatever its header says.
+func (z *safeZip) readFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	limit := min(z.limits.MaxEntryBytes, z.limits.MaxTotalBytes-z.read)
+	b, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		if limit < z.limits.MaxEntryBytes {
+			return nil, &ZipError{Err: ErrZipTooLarge, Detail: fmt.Sprintf("over %d MB", z.limits.MaxTotalBytes>>20)}
+		}
+		return nil, &ZipError{Name: f.Name, Err: ErrZipEntryTooLarge, Detail: fmt.Sprintf("over %d MB", z.limits.MaxEntryBytes>>20)}
+	}
+	if err := z.limits.checkRatio(f.Name, uint64(len(b)), f.CompressedSize64); err != nil {
+		return nil, err
+	}
+	z.read += int64(len(b))
+	return b, nil
+}
+
+// readNamed reads the entry called name.
+func (z *safeZip) readNamed(name string) ([]byte, error) {
+	for _, f := range z.zr.File {
+		if f.Name == name {
+			return z.readFile(f)
+		}
+	}
+	return nil, fmt.Errorf("open %s: %w", name, fs.ErrNotExist)
+}
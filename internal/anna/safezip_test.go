@@ -0,0 +1,196 @@
+package anna
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// withZipLimits runs the test with tighter zip limits.
+func withZipLimits(t *testing.T, entries int, entryBytes, totalBytes int64) {
+	t.Helper()
+	orig := zipLimits
+	t.Cleanup(func() { zipLimits = orig })
+	zipLimits.MaxEntries, zipLimits.MaxEntryBytes, zipLimits.MaxTotalBytes = entries, entryBytes, totalBytes
+}
+
+func TestOpenZip_Limits(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data  func(t *testing.T) []byte
+		limit func(t *testing.T)
+		want  error
+	}{
+		"too many entries": {
+			data:  func(t *testing.T) []byte { return fixtureEPUB(t, opfFixture{}, map[string]string{"a": "1", "b": "2"}) },
+			limit: func(t *testing.T) { withZipLimits(t, 5, 1<<20, 1<<20) },
+			want:  ErrZipTooManyEntries,
+		},
+		"entry too large": {
+			data: func(t *testing.T) []byte {
+				return fixtureEPUB(t, opfFixture{}, map[string]string{"big.xhtml": strings.Repeat("x", 5000)})
+			},
+			limit: func(t *testing.T) { withZipLimits(t, 100, 4000, 1<<20) },
+			want:  ErrZipEntryTooLarge,
+		},
+		"total too large": {
+			data: func(t *testing.T) []byte {
+				return fixtureEPUB(t, opfFixture{}, map[string]string{"a.xhtml": strings.Repeat("x", 3000), "b.xhtml": strings.Repeat("y", 3000)})
+			},
+			limit: func(t *testing.T) { withZipLimits(t, 100, 4000, 5000) },
+			want:  ErrZipTooLarge,
+		},
+		"compression bomb": {
+			data: func(t *testing.T) []byte {
+				return fixtureEPUB(t, opfFixture{}, map[string]string{"zeros.xhtml": string(make([]byte, 4<<20))})
+			},
+			want: ErrZipRatio,
+		},
+		"parent directory": {
+			data: func(t *testing.T) []byte {
+				return fixtureEPUB(t, opfFixture{}, map[string]string{"OEBPS/../../etc/passwd": "x"})
+			},
+			want: ErrZipUnsafePath,
+		},
+		"absolute name": {
+			data: func(t *testing.T) []byte { return fixtureEPUB(t, opfFixture{}, map[string]string{"/etc/passwd": "x"}) },
+			want: ErrZipUnsafePath,
+		},
+		"backslashes": {
+			data: func(t *testing.T) []byte { return fixtureEPUB(t, opfFixture{}, map[string]string{`..\evil.dll`: "x"}) },
+			want: ErrZipUnsafePath,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := tc.data(t)
+			if tc.limit != nil {
+				tc.limit(t)
+			}
+			_, err := openZip(data)
+			var zerr *ZipError
+			if !errors.Is(err, tc.want) || !errors.As(err, &zerr) {
+				t.Fatalf("openZip = %v, want %v", err, tc.want)
+			}
+
+			// Every EPUB function refuses it the same way.
+			if _, err := parseEPUB(data); !errors.Is(err, tc.want) {
+				t.Errorf("parseEPUB = %v", err)
+			}
+			if r := CheckEPUB(data); r.Count(SeverityFatal) != 1 || r.Findings[0].Code != "ZIP_UNSAFE" {
+				t.Errorf("CheckEPUB:\n%s", r)
+			}
+			if isEPUBZip(data) {
+				t.Error("isEPUBZip accepted it")
+			}
+			if out, n, err := SanitizeEPUB(data); err != nil || n != 0 || !bytes.Equal(out, data) {
+				t.Errorf("SanitizeEPUB should leave it alone: %d %v", n, err)
+			}
+		})
+	}
+}
+
+func TestOpenZip_ReadLimitsIgnoreHeaders(t *testing.T) {
+	data := fixtureEPUB(t, opfFixture{}, map[string]string{"a.xhtml": strings.Repeat("x", 3000), "b.xhtml": strings.Repeat("y", 3000)})
+	z, err := openZip(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tighten the limits after the directory was checked, as if the headers
+	// had understated the sizes.
+	z.limits.MaxEntryBytes, z.limits.MaxTotalBytes = 4000, 5000
+	if _, err := z.readNamed("a.xhtml"); err != nil {
+		t.Fatalf("first entry: %v", err)
+	}
+	if _, err := z.readNamed("b.xhtml"); !errors.Is(err, ErrZipTooLarge) {
+		t.Errorf("second entry = %v, want ErrZipTooLarge", err)
+	}
+	z.limits.MaxTotalBytes = 1 << 20
+	z.limits.MaxEntryBytes = 100
+	if _, err := z.readNamed("b.xhtml"); !errors.Is(err, ErrZipEntryTooLarge) {
+		t.Errorf("oversized entry = %v, want ErrZipEntryTooLarge", err)
+	}
+}
+
+func TestActiveZipLimits_Env(t *testing.T) {
+	if l := activeZipLimits(); l.MaxEntryBytes != 64<<20 || l.MaxTotalBytes != 256<<20 {
+		t.Errorf("defaults = %+v", l)
+	}
+	t.Setenv("ZIP_MAX_ENTRY_MB", "0.004")
+	t.Setenv("ZIP_MAX_TOTAL_MB", "oops")
+	l := activeZipLimits()
+	if l.MaxEntryBytes != 4194 || l.MaxTotalBytes != zipLimits.MaxTotalBytes {
+		t.Errorf("limits = %+v, want the entry limit from ZIP_MAX_ENTRY_MB and the default total", l)
+	}
+	big := fixtureEPUB(t, opfFixture{}, map[string]string{"big.xhtml": strings.Repeat("x", 5000)})
+	if _, err := openZip(big); !errors.Is(err, ErrZipEntryTooLarge) {
+		t.Errorf("err = %v, want ErrZipEntryTooLarge", err)
+	}
+}
+
+func TestSafeZipName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"OEBPS/Text/01.xhtml": true,
+		"mimetype":            true,
+		"OEBPS/..hidden.css":  true,
+		"":                    false,
+		"../x":                false,
+		"a/../../x":           false,
+		"/abs":                false,
+		"C:/Windows/x":        false,
+		`a\b`:                 false,
+		"a\x00b":              false,
+	} {
+		if got := safeZipName(name); got != want {
+			t.Errorf("safeZipName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// FuzzEPUBFunctions throws arbitrary bytes at every function that unpacks an
+// EPUB: none may panic, and none may hand back a book that fails to parse
+// after saying it rewrote it.
+func FuzzEPUBFunctions(f *testing.F) {
+	f.Add(makeZip(f, validEPUBEntries()))
+	f.Add(checkedEPUB(f, nil))
+	f.Add(checkedEPUB(f, map[string]string{"OEBPS/Text/01.xhtml": `<html><body><p>open<script>x()</script><img src="http://x/y.png"/>`}))
+	f.Add(fixtureEPUB(f, opfFixture{}, map[string]string{"../escape": "x"}))
+	f.Add([]byte("PK\x03\x04 not really a zip"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		isEPUBZip(data)
+		CheckEPUB(data).Summary()
+		if out, n, err := SanitizeEPUB(data); err == nil && n > 0 {
+			if _, err := openZip(out); err != nil {
+				t.Fatalf("SanitizeEPUB produced an unreadable zip: %v", err)
+			}
+		}
+		if out, hr, err := HardenEPUB(data); err == nil && hr.Total() > 0 {
+			if _, err := parseEPUB(out); err != nil {
+				t.Fatalf("HardenEPUB produced an unreadable EPUB: %v", err)
+			}
+		}
+		if out, repairs, err := RepairEPUB(data); err == nil && len(repairs) > 0 {
+			if _, err := parseEPUB(out); err != nil {
+				t.Fatalf("RepairEPUB produced an unreadable EPUB: %v", err)
+			}
+		}
+		if book, err := parseEPUB(data); err == nil {
+			if _, err := book.bytes(0); err != nil {
+				t.Fatalf("re-packing a parsed book: %v", err)
+			}
+		}
+	})
+}
+
+func TestCheckEPUB_ZipErrorKeepsEntryName(t *testing.T) {
+	data := fixtureEPUB(t, opfFixture{}, map[string]string{"../escape": "x"})
+	r := CheckEPUB(data)
+	if len(r.Findings) != 1 || r.Findings[0].Path != "../escape" || !strings.Contains(r.Findings[0].Message, "unsafe entry name") {
+		t.Errorf("finding = %+v", r.Findings)
+	}
+	var zerr *ZipError
+	if _, err := parseEPUB(data); !errors.As(err, &zerr) || zerr.Name != "../escape" {
+		t.Errorf("parseEPUB = %v", err)
+	}
+}
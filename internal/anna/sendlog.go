@@ -0,0 +1,30 @@
+package anna
+
+import (
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"github.com/sam-hartman/kindle-pibrarian/internal/sendlog"
+	"go.uber.org/zap"
+)
+
+// recordSend notes an accepted send in the send log (MailConfig.SendLogPath)
+// so a later Amazon bounce can be tied back to it. Failing to record never
+// fails the send: the book is already on its way.
+func recordSend(mail MailConfig, msg *kindleMessage, title string) {
+	if mail.SendLogPath == "" {
+		return
+	}
+	l := logger.GetLogger()
+	log, err := sendlog.Open(mail.SendLogPath)
+	if err == nil {
+		err = log.Add(sendlog.Record{
+			MessageID: msg.MessageID,
+			To:        msg.To,
+			Filename:  msg.Filename,
+			Title:     title,
+			Size:      int64(len(msg.Attachment)),
+		})
+	}
+	if err != nil {
+		l.Warn("Could not record send in send log", zap.String("message_id", msg.MessageID), zap.Error(err))
+	}
+}
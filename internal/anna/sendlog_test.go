@@ -0,0 +1,36 @@
+package anna
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/sendlog"
+)
+
+func TestSendFileToKindle_RecordsSendForBounceMatching(t *testing.T) {
+	srv := newFakeSMTP(t)
+	port := srv.start()
+
+	mail := MailConfig{
+		Host: "127.0.0.1", Port: port, User: "u", Password: "pw",
+		FromEmail: "reader@example.com", Security: SecurityPlain,
+		SendLogPath: filepath.Join(t.TempDir(), "sends.json"),
+	}
+	if err := SendFileToKindle([]byte("%PDF-1.4 tiny"), "The Deal.pdf", "application/pdf", "Book: The Deal", mail, Recipient{Email: "reader_x@kindle.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	log, _ := sendlog.Open(mail.SendLogPath)
+	records, err := log.List()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected one record, got %+v (err %v)", records, err)
+	}
+	r := records[0]
+	if r.Title != "The Deal" || r.Filename != "The Deal.pdf" || r.To != "reader_x@kindle.com" || r.Status != sendlog.StatusSent {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if msgs := srv.sent(); len(msgs) != 1 || !strings.Contains(msgs[0].Data, "Message-ID: "+r.MessageID) {
+		t.Fatalf("record should carry the sent Message-ID %s", r.MessageID)
+	}
+}
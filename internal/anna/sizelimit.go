@@ -0,0 +1,130 @@
+package anna
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How big a book we may email depends on the transport: Gmail rejects
+// messages over 25 MB, Postfix defaults to 10 MB, Fastmail allows far more —
+// and whatever the relay accepts, Amazon's Send-to-Kindle drops anything over
+// 50 MB. MailConfig.MessageLimit picks a limit for the configured transport
+// (MAIL_MAX_MESSAGE_MB overrides it), and SendFileToKindle shrinks EPUBs that
+// don't fit (see ShrinkEPUB) before giving up with a *TooLargeError.
+
+const mb = 1024 * 1024
+
+// amazonMessageLimit is Send-to-Kindle's own cap on a whole email.
+const amazonMessageLimit = 50 * mb
+
+// Default message limits when MAIL_MAX_MESSAGE_MB is unset.
+const (
+	defaultSMTPMessageLimit     = 25 * mb // the common limit among big providers
+	defaultSendmailMessageLimit = 10 * mb // Postfix's message_size_limit default
+)
+
+// providerMessageLimits are known limits for SMTP providers, matched by
+// suffix of SMTP_HOST.
+var providerMessageLimits = []struct {
+	hostSuffix string
+	limit      int64
+}{
+	{"gmail.com", 25 * mb},
+	{"googlemail.com", 25 * mb},
+	{"fastmail.com", 70 * mb},
+	{"mail.yahoo.com", 25 * mb},
+	{"mail.me.com", 20 * mb},
+	{"office365.com", 35 * mb},
+	{"outlook.com", 20 * mb},
+}
+
+// messageOverhead is reserved for headers and the text part.
+const messageOverhead = 64 * 1024
+
+// MessageLimit returns the largest message the transport will take, already
+// capped at Amazon's limit, and a short description of where it comes from.
+func (c MailConfig) MessageLimit() (int64, string) {
+	limit, source := c.transportMessageLimit()
+	if limit > amazonMessageLimit {
+		return amazonMessageLimit, "Amazon's 50 MB Send-to-Kindle limit"
+	}
+	return limit, source
+}
+
+func (c MailConfig) transportMessageLimit() (int64, string) {
+	if c.MaxMessageBytes > 0 {
+		return c.MaxMessageBytes, fmt.Sprintf("MAIL_MAX_MESSAGE_MB=%s", formatMB(c.MaxMessageBytes))
+	}
+	switch c.transport() {
+	case TransportSendmail:
+		return defaultSendmailMessageLimit, "the sendmail transport's default 10 MB limit (set MAIL_MAX_MESSAGE_MB if your MTA allows more)"
+	case TransportMaildir:
+		return amazonMessageLimit, "Amazon's 50 MB Send-to-Kindle limit"
+	}
+	host := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(c.Host), "."))
+	for _, p := range providerMessageLimits {
+		if host == p.hostSuffix || strings.HasSuffix(host, "."+p.hostSuffix) {
+			return p.limit, fmt.Sprintf("%s's %s MB message limit", c.Host, formatMB(p.limit))
+		}
+	}
+	return defaultSMTPMessageLimit, fmt.Sprintf("the default %s MB SMTP message limit (set MAIL_MAX_MESSAGE_MB to change)", formatMB(defaultSMTPMessageLimit))
+}
+
+// AttachmentLimit converts MessageLimit into the largest file that fits once
+// base64-encoded (4/3, plus a CRLF every 76 characters) next to the headers.
+func (c MailConfig) AttachmentLimit() int64 {
+	limit, _ := c.MessageLimit()
+	return attachmentBudget(limit)
+}
+
+func attachmentBudget(messageLimit int64) int64 {
+	n := messageLimit - messageOverhead
+	if n <= 0 {
+		return 0
+	}
+	return n / 78 * 76 / 4 * 3
+}
+
+// sizeLimitFor is the effective attachment limit for sending to `to` over c:
+// the transport's budget, tightened by the profile's MaxBytes. reason
+// describes whichever limit applies.
+func (c MailConfig) sizeLimitFor(to Recipient) (limit int64, target, reason string) {
+	msgLimit, source := c.MessageLimit()
+	limit, target, reason = attachmentBudget(msgLimit), "email", source
+	if to.MaxBytes > 0 && to.MaxBytes < limit {
+		limit, target = to.MaxBytes, to.String()
+		reason = fmt.Sprintf("the profile's %.2f MB limit", float64(to.MaxBytes)/mb)
+	}
+	return limit, target, reason
+}
+
+// TooLargeError reports a file that doesn't fit the applicable size limit,
+// even after shrinking. Its text keeps the "N bytes (X MB)" form the MCP
+// layer extracts.
+type TooLargeError struct {
+	Target string // "email" or the recipient profile
+	Size   int64
+	Limit  int64
+	Reason string
+	// Shrink is set when a shrink pass ran but didn't get under Limit.
+	Shrink *ShrinkReport
+}
+
+func (e *TooLargeError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "file too large for %s: %d bytes (%.2f MB) exceeds %s", e.Target, e.Size, float64(e.Size)/mb, e.Reason)
+	if e.Target == "email" {
+		fmt.Fprintf(&b, " (at most %.2f MB per attachment)", float64(e.Limit)/mb)
+	}
+	if e.Shrink != nil {
+		fmt.Fprintf(&b, "; shrinking only got it from %s", e.Shrink)
+	}
+	b.WriteString(". Consider downloading directly instead")
+	return b.String()
+}
+
+// formatMB renders a byte count in MB without a trailing ".0".
+func formatMB(n int64) string {
+	s := fmt.Sprintf("%.1f", float64(n)/mb)
+	return strings.TrimSuffix(s, ".0")
+}
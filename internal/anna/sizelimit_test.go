@@ -0,0 +1,98 @@
+package anna
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMailConfig_MessageLimit(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  MailConfig
+		want int64
+	}{
+		{"gmail", MailConfig{Host: "smtp.gmail.com"}, 25 * mb},
+		{"fastmail capped by amazon", MailConfig{Host: "smtp.fastmail.com"}, amazonMessageLimit},
+		{"unknown smtp host", MailConfig{Host: "mail.example.org"}, defaultSMTPMessageLimit},
+		{"suffix must be a domain boundary", MailConfig{Host: "notgmail.com"}, defaultSMTPMessageLimit},
+		{"sendmail", MailConfig{Transport: TransportSendmail}, defaultSendmailMessageLimit},
+		{"maildir", MailConfig{Transport: TransportMaildir}, amazonMessageLimit},
+		{"override", MailConfig{Host: "smtp.gmail.com", MaxMessageBytes: 40 * mb}, 40 * mb},
+		{"override capped by amazon", MailConfig{Transport: TransportSendmail, MaxMessageBytes: 100 * mb}, amazonMessageLimit},
+	}
+	for _, c := range cases {
+		if got, why := c.cfg.MessageLimit(); got != c.want || why == "" {
+			t.Errorf("%s: MessageLimit() = %d (%q), want %d", c.name, got, why, c.want)
+		}
+	}
+}
+
+func TestAttachmentLimit_LeavesRoomForBase64(t *testing.T) {
+	got := MailConfig{Host: "smtp.gmail.com"}.AttachmentLimit()
+	// base64 + line breaks inflate by ~37%; the old hardcoded Gmail limit was 18 MB.
+	if got < 18*mb || got > 19*mb+512*1024 {
+		t.Errorf("Gmail attachment budget %d bytes looks wrong", got)
+	}
+	encoded := (got+2)/3*4 + (got+56)/57*2 + messageOverhead
+	if encoded > 25*mb {
+		t.Errorf("a %d byte attachment encodes to %d bytes, over the 25 MB limit", got, encoded)
+	}
+}
+
+func TestSizeLimitFor_ProfileTightens(t *testing.T) {
+	cfg := MailConfig{Host: "smtp.gmail.com"}
+	limit, target, _ := cfg.sizeLimitFor(Recipient{Email: "a@kindle.com", MaxBytes: 100 * mb})
+	if limit != cfg.AttachmentLimit() || target != "email" {
+		t.Errorf("a looser profile limit must not raise the transport's: %d %q", limit, target)
+	}
+	limit, target, reason := cfg.sizeLimitFor(Recipient{Name: "kids", Email: "k@kindle.com", MaxBytes: 5 * mb})
+	if limit != 5*mb || target != "kids <k@kindle.com>" || !strings.Contains(reason, "profile") {
+		t.Errorf("profile limit should apply: %d %q %q", limit, target, reason)
+	}
+}
+
+func TestSendFileToKindle_TransportLimit(t *testing.T) {
+	srv := newFakeSMTP(t)
+	port := srv.start()
+	mail := MailConfig{Host: "127.0.0.1", Port: port, User: "u", Password: "pw", FromEmail: "reader@example.com", Security: SecurityPlain, MaxMessageBytes: messageOverhead + 78}
+
+	err := SendFileToKindle([]byte("%PDF-1.4 "+strings.Repeat("x", 100)), "book.pdf", "application/pdf", "Book: book", mail, Recipient{Email: "a@kindle.com"})
+	tooLarge, ok := err.(*TooLargeError)
+	if !ok {
+		t.Fatalf("expected *TooLargeError, got %v", err)
+	}
+	if tooLarge.Limit != 57 || tooLarge.Shrink != nil {
+		t.Errorf("unexpected error details %+v", tooLarge)
+	}
+	if !regexp.MustCompile(`\d+ bytes \([\d.]+ MB\)`).MatchString(err.Error()) {
+		t.Errorf("error text %q lost the \"N bytes (X MB)\" form", err)
+	}
+	if len(srv.sent()) != 0 {
+		t.Fatal("nothing should have been sent")
+	}
+}
+
+func TestSendFileToKindle_ShrinksOversizedEPUB(t *testing.T) {
+	srv := newFakeSMTP(t)
+	port := srv.start()
+	data := illustratedEPUB(t)
+	budget := int64(len(data)) / 3
+	mail := MailConfig{Host: "127.0.0.1", Port: port, User: "u", Password: "pw", FromEmail: "reader@example.com", Security: SecurityPlain,
+		MaxMessageBytes: messageOverhead + budget*4/3 + budget/20}
+
+	if err := SendFileToKindle(data, "atlas.epub", "application/epub+zip", "Book: Atlas", mail, Recipient{Email: "a@kindle.com"}); err != nil {
+		t.Fatalf("expected the shrunk book to be sent, got %v", err)
+	}
+	sent := srv.sent()
+	if len(sent) != 1 || int64(len(sent[0].Data)) > mail.MaxMessageBytes {
+		t.Fatalf("expected one message within the limit, got %d messages", len(sent))
+	}
+
+	// A limit nothing can reach reports what shrinking achieved.
+	mail.MaxMessageBytes = messageOverhead + 1024
+	err := SendFileToKindle(data, "atlas.epub", "application/epub+zip", "Book: Atlas", mail, Recipient{Email: "a@kindle.com"})
+	if err == nil || !strings.Contains(err.Error(), "shrinking only got it from") {
+		t.Fatalf("expected a TooLargeError with a shrink report, got %v", err)
+	}
+}
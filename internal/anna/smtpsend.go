@@ -0,0 +1,105 @@
+package anna
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// ErrStartTLSUnavailable means the server didn't offer STARTTLS while
+// SMTP_SECURITY=starttls. smtp.SendMail would silently carry on in plaintext;
+// we refuse instead so credentials and books never cross the wire unencrypted.
+var ErrStartTLSUnavailable = errors.New("SMTP server does not offer STARTTLS; refusing to send in plaintext")
+
+// smtpSendTimeout bounds a whole SMTP session. It is generous because an
+// 18MB attachment over the Pi's uplink can take a while.
+const smtpSendTimeout = 5 * time.Minute
+
+// SMTPSender delivers over SMTP with explicit control over transport security.
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Security string    // SecurityStartTLS, SecurityTLS or SecurityPlain
+	Auth     smtp.Auth // nil skips AUTH (e.g. an unauthenticated local relay)
+
+	// TLSConfig overrides the default (verify against Host); tests use it to
+	// trust a self-signed certificate.
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+}
+
+func (s *SMTPSender) tlsConfig() *tls.Config {
+	if s.TLSConfig != nil {
+		return s.TLSConfig
+	}
+	return &tls.Config{ServerName: s.Host, MinVersion: tls.VersionTLS12}
+}
+
+func (s *SMTPSender) Send(env Envelope, msg io.WriterTo) error {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = smtpSendTimeout
+	}
+	addr := net.JoinHostPort(s.Host, s.Port)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if s.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.Security == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return ErrStartTLSUnavailable
+		}
+		if err := c.StartTLS(s.tlsConfig()); err != nil {
+			return fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+	if s.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("SMTP server does not support AUTH")
+		}
+		if err := c.Auth(s.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(env.From); err != nil {
+		return err
+	}
+	for _, rcpt := range env.To {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
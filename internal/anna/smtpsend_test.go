@@ -0,0 +1,128 @@
+package anna
+
+import (
+	"errors"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func testEnvelope() Envelope {
+	return Envelope{From: "reader@example.com", To: []string{"reader_x@kindle.com"}}
+}
+
+func TestSMTPSender_StartTLSPlainAuth(t *testing.T) {
+	srv := newFakeSMTP(t)
+	srv.StartTLS = true
+	port := srv.start()
+
+	s := &SMTPSender{
+		Host:      "127.0.0.1",
+		Port:      port,
+		Security:  SecurityStartTLS,
+		Auth:      smtp.PlainAuth("", "reader@example.com", "app-password", "127.0.0.1"),
+		TLSConfig: srv.clientTLS(),
+	}
+	if err := s.Send(testEnvelope(), strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msgs := srv.sent()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if msgs[0].From != "reader@example.com" || msgs[0].To[0] != "reader_x@kindle.com" {
+		t.Errorf("envelope = %+v", msgs[0])
+	}
+	if !strings.Contains(msgs[0].Data, "body") {
+		t.Errorf("data not delivered: %q", msgs[0].Data)
+	}
+	if !srv.tlsSeen {
+		t.Error("expected the session to be upgraded with STARTTLS")
+	}
+	if len(srv.authSeen) != 1 || !strings.HasPrefix(srv.authSeen[0], "PLAIN") {
+		t.Errorf("expected AUTH PLAIN, got %v", srv.authSeen)
+	}
+}
+
+func TestSMTPSender_RequiresStartTLS(t *testing.T) {
+	srv := newFakeSMTP(t) // does not advertise STARTTLS
+	port := srv.start()
+
+	s := &SMTPSender{Host: "127.0.0.1", Port: port, Security: SecurityStartTLS, TLSConfig: srv.clientTLS()}
+	err := s.Send(testEnvelope(), strings.NewReader("x\r\n"))
+	if !errors.Is(err, ErrStartTLSUnavailable) {
+		t.Fatalf("expected ErrStartTLSUnavailable, got %v", err)
+	}
+	if len(srv.sent()) != 0 {
+		t.Fatal("nothing may be sent when STARTTLS is required but missing")
+	}
+}
+
+func TestSMTPSender_ImplicitTLS(t *testing.T) {
+	srv := newFakeSMTP(t)
+	srv.ImplicitTLS = true
+	port := srv.start()
+
+	s := &SMTPSender{
+		Host:      "127.0.0.1",
+		Port:      port,
+		Security:  SecurityTLS,
+		Auth:      smtp.PlainAuth("", "u", "p", "127.0.0.1"),
+		TLSConfig: srv.clientTLS(),
+	}
+	if err := s.Send(testEnvelope(), strings.NewReader("x\r\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(srv.sent()) != 1 || !srv.tlsSeen {
+		t.Fatal("expected one message over implicit TLS")
+	}
+}
+
+func TestSMTPSender_PlainNoAuth(t *testing.T) {
+	srv := newFakeSMTP(t)
+	port := srv.start()
+
+	s := &SMTPSender{Host: "127.0.0.1", Port: port, Security: SecurityPlain}
+	if err := s.Send(testEnvelope(), strings.NewReader("x\r\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(srv.sent()) != 1 || srv.tlsSeen || len(srv.authSeen) != 0 {
+		t.Fatal("expected one plaintext, unauthenticated message")
+	}
+}
+
+func TestSMTPSender_RejectedRecipient(t *testing.T) {
+	srv := newFakeSMTP(t)
+	srv.Replies["RCPT"] = "451 4.3.0 try again later"
+	port := srv.start()
+
+	s := &SMTPSender{Host: "127.0.0.1", Port: port, Security: SecurityPlain}
+	err := s.Send(testEnvelope(), strings.NewReader("x\r\n"))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 451 {
+		t.Fatalf("expected a 451 textproto error, got %v", err)
+	}
+}
+
+func TestSendFileToKindle_ViaFakeSMTP(t *testing.T) {
+	srv := newFakeSMTP(t)
+	port := srv.start()
+
+	// Security "plain" against 127.0.0.1 is allowed by PlainAuth (localhost).
+	mail := MailConfig{
+		Host: "127.0.0.1", Port: port, User: "reader@example.com", Password: "pw",
+		FromEmail: "reader@example.com", Security: SecurityPlain,
+	}
+	if err := SendFileToKindle([]byte("%PDF-1.4 tiny"), "Les Misérables.pdf", "application/pdf",
+		"Book: Les Misérables", mail, Recipient{Email: "reader_x@kindle.com"}); err != nil {
+		t.Fatalf("SendFileToKindle: %v", err)
+	}
+	msgs := srv.sent()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if !strings.Contains(msgs[0].Data, "filename*=utf-8''Les%20Mis%C3%A9rables.pdf") {
+		t.Errorf("expected an RFC 2231 filename in the delivered message:\n%s", msgs[0].Data)
+	}
+}
@@ -0,0 +1,426 @@
+package anna
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+)
+
+// Downloads are streamed to a temporary file (a Spool) instead of memory: a
+// 400 MB scanned PDF shouldn't have to fit in a Pi's RAM next to everything
+// else, and a mirror that stalls halfway shouldn't cost the half already
+// fetched. spoolDownload hashes the body as it arrives, refuses files over
+// ANNAS_MAX_DOWNLOAD_MB, gives up on a connection only when it stops sending
+// (rather than after a fixed time, which big files on slow mirrors never
+// beat) and picks a dropped download up where it left off with an HTTP Range
+// request. Checks, backups and format detection then work from the file;
+// only the stages that rewrite or send the book load it.
+
+// defaultMaxDownloadBytes caps a download when ANNAS_MAX_DOWNLOAD_MB is
+// unset. Big enough for any scanned book, small enough for a Pi's SD card.
+const defaultMaxDownloadBytes = 500 * mb
+
+// downloadStallTimeout is how long a download may go without receiving a
+// byte before the connection is dropped and resumed; a package var so tests
+// can shorten it.
+var downloadStallTimeout = 60 * time.Second
+
+// downloadResumes bounds how many times one download is resumed after its
+// connection drops.
+const downloadResumes = 5
+
+// ErrDownloadTooLarge means a download is bigger than the configured maximum.
+var ErrDownloadTooLarge = errors.New("download too large")
+
+// DownloadTooLargeError reports a download over the maximum size. Size is
+// the size the server announced, or the bytes read when it stopped us.
+type DownloadTooLargeError struct {
+	Size, Limit int64
+}
+
+func (e *DownloadTooLargeError) Error() string {
+	return fmt.Sprintf("download too large: %.1f MB exceeds the %.0f MB limit (ANNAS_MAX_DOWNLOAD_MB)", float64(e.Size)/mb, float64(e.Limit)/mb)
+}
+
+func (e *DownloadTooLargeError) Is(target error) bool { return target == ErrDownloadTooLarge }
+
+// Progress is how far a download has got. Total is -1 while the size is
+// unknown.
+type Progress struct {
+	Done, Total int64
+	// Resumes counts the times the download picked up after a dropped
+	// connection.
+	Resumes int
+}
+
+// DownloadOptions configures spoolDownload.
+type DownloadOptions struct {
+	// MaxBytes caps the download; 0 means maxDownloadBytes().
+	MaxBytes int64
+	// Progress, if set, is called as the download advances, at most a few
+	// times a second, and once when it completes.
+	Progress func(Progress)
+}
+
+// maxDownloadBytes is ANNAS_MAX_DOWNLOAD_MB in bytes, or the default.
+func maxDownloadBytes() int64 {
+	if v := strings.TrimSpace(os.Getenv("ANNAS_MAX_DOWNLOAD_MB")); v != "" {
+		if n, err := strconv.ParseFloat(v, 64); err == nil && n > 0 {
+			return int64(n * mb)
+		}
+		logger.GetLogger().Warn("Ignoring invalid ANNAS_MAX_DOWNLOAD_MB", zap.String("value", v))
+	}
+	return defaultMaxDownloadBytes
+}
+
+// A Spool is a downloaded file in a temporary file, with its size and MD5.
+// Close removes it.
+type Spool struct {
+	path   string
+	size   int64
+	md5    string
+	format string // set by Format
+}
+
+// Path is the spooled file's path.
+func (s *Spool) Path() string { return s.path }
+
+// Size is the file's size in bytes.
+func (s *Spool) Size() int64 { return s.size }
+
+// MD5 is the file's MD5 in lowercase hex, computed as it was downloaded.
+func (s *Spool) MD5() string { return s.md5 }
+
+// Open opens the spooled file for reading.
+func (s *Spool) Open() (*os.File, error) { return os.Open(s.path) }
+
+// Bytes reads the whole file into memory, for the stages that need it there.
+func (s *Spool) Bytes() ([]byte, error) { return os.ReadFile(s.path) }
+
+// head reads up to n bytes from the start of the file.
+func (s *Spool) head(n int) ([]byte, error) {
+	f, err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	k, err := io.ReadFull(f, b)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return b[:k], nil
+}
+
+// Format detects the file's format as detectFileFormat does. Most formats
+// are told by their first bytes; zips are looked inside through the open
+// file, and OLE files (.doc) are scanned for their Word stream a chunk at a
+// time, so the file is never read into memory whole.
+func (s *Spool) Format() string {
+	if s.format != "" {
+		return s.format
+	}
+	// One byte past sniffSize lets the text checks see the sample is cut.
+	data, err := s.head(sniffSize + 1)
+	switch {
+	case err != nil:
+		return "unknown"
+	case bytes.HasPrefix(data, []byte("PK")):
+		s.format = s.zipFormat()
+	case bytes.HasPrefix(data, oleMagic):
+		if found, err := s.contains(wordDocumentStream); err == nil && found {
+			s.format = "doc"
+		} else {
+			s.format = "unknown"
+		}
+	default:
+		s.format, _ = detectFileFormat("", data)
+	}
+	return s.format
+}
+
+func (s *Spool) zipFormat() string {
+	f, err := s.Open()
+	if err != nil {
+		return "unknown"
+	}
+	defer f.Close()
+	z, err := openZipReader(f, s.size)
+	if err != nil {
+		return "unknown"
+	}
+	return zipFormat(z)
+}
+
+// contains reports whether pattern occurs in the file.
+func (s *Spool) contains(pattern []byte) (bool, error) {
+	f, err := s.Open()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, 64<<10+len(pattern))
+	kept := 0 // the previous chunk's tail, for a match across chunks
+	for {
+		n, err := f.Read(buf[kept:])
+		if bytes.Contains(buf[:kept+n], pattern) {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		end := kept + n
+		kept = min(end, len(pattern)-1)
+		copy(buf, buf[end-kept:end])
+	}
+}
+
+// SaveCopy copies the file to path.
+func (s *Spool) SaveCopy(path string) error {
+	in, err := s.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(path)
+		return err
+	}
+	return out.Close()
+}
+
+// Close removes the spooled file.
+func (s *Spool) Close() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+	return os.Remove(s.path)
+}
+
+// spoolDownload streams url to a new Spool. A connection that drops or
+// stalls is resumed with a Range request (or restarted, if the server
+// ignores ranges) up to downloadResumes times.
+func spoolDownload(url string, opts DownloadOptions) (*Spool, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = maxDownloadBytes()
+	}
+	f, err := os.CreateTemp("", "pib-download-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download file: %w", err)
+	}
+	d := &spooler{url: url, opts: opts, file: f, hash: md5.New(), total: -1}
+	err = d.run()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &Spool{path: f.Name(), size: d.done, md5: hex.EncodeToString(d.hash.Sum(nil))}, nil
+}
+
+// spooler is the state of one spoolDownload.
+type spooler struct {
+	url  string
+	opts DownloadOptions
+	file *os.File
+	hash hash.Hash
+
+	done, total  int64
+	resumes      int
+	validator    string // ETag or Last-Modified, for If-Range
+	lastProgress time.Time
+}
+
+func (d *spooler) run() error {
+	l := logger.GetLogger()
+	for {
+		err := d.fetch()
+		if err == nil {
+			d.report(true)
+			return nil
+		}
+		var fatal *fatalDownloadError
+		if errors.As(err, &fatal) {
+			return fatal.err
+		}
+		if d.resumes == downloadResumes {
+			return fmt.Errorf("download failed after %d resumes: %w", d.resumes, err)
+		}
+		d.resumes++
+		l.Warn("Download interrupted; resuming",
+			zap.Int64("done", d.done),
+			zap.Int64("total", d.total),
+			zap.Int("resume", d.resumes),
+			zap.Error(err),
+		)
+	}
+}
+
+// fatalDownloadError wraps an error that resuming won't fix.
+type fatalDownloadError struct{ err error }
+
+func (e *fatalDownloadError) Error() string { return e.err.Error() }
+
+// fetch makes one request, appending what it receives to the file. A nil
+// error means the download is complete.
+func (d *spooler) fetch() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return &fatalDownloadError{fmt.Errorf("failed to download file: %w", err)}
+	}
+	if d.done > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.done))
+		if d.validator != "" {
+			req.Header.Set("If-Range", d.validator)
+		}
+	}
+
+	// Nothing at all for downloadStallTimeout, headers or body, drops the
+	// connection.
+	stall := time.AfterFunc(downloadStallTimeout, cancel)
+	defer stall.Stop()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && d.done > 0:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != d.done {
+			return &fatalDownloadError{fmt.Errorf("download server resumed at the wrong place (%q, want byte %d)", resp.Header.Get("Content-Range"), d.done)}
+		}
+		if total >= 0 {
+			d.total = total
+		}
+	case resp.StatusCode == http.StatusOK:
+		if d.done > 0 {
+			// The server ignored the range (or the file changed): start over.
+			if err := d.restart(); err != nil {
+				return &fatalDownloadError{err}
+			}
+		}
+		d.total = resp.ContentLength
+		d.validator = resp.Header.Get("ETag")
+		if d.validator == "" {
+			d.validator = resp.Header.Get("Last-Modified")
+		}
+	case d.done > 0 && resp.StatusCode >= 500:
+		return fmt.Errorf("download server returned status %d", resp.StatusCode)
+	default:
+		return &fatalDownloadError{fmt.Errorf("download server returned status %d", resp.StatusCode)}
+	}
+	if d.total > d.opts.MaxBytes {
+		return &fatalDownloadError{&DownloadTooLargeError{Size: d.total, Limit: d.opts.MaxBytes}}
+	}
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			stall.Reset(downloadStallTimeout)
+			if d.done+int64(n) > d.opts.MaxBytes {
+				return &fatalDownloadError{&DownloadTooLargeError{Size: d.done + int64(n), Limit: d.opts.MaxBytes}}
+			}
+			if _, err := d.file.Write(buf[:n]); err != nil {
+				return &fatalDownloadError{fmt.Errorf("failed to write download: %w", err)}
+			}
+			d.hash.Write(buf[:n])
+			d.done += int64(n)
+			d.report(false)
+		}
+		if errors.Is(rerr, io.EOF) {
+			break
+		}
+		if rerr != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("download stalled for %s", downloadStallTimeout)
+			}
+			return fmt.Errorf("failed to read file: %w", rerr)
+		}
+	}
+	if d.total >= 0 && d.done < d.total {
+		return fmt.Errorf("connection closed after %d of %d bytes", d.done, d.total)
+	}
+	return nil
+}
+
+// restart empties the file and hash for a download starting over.
+func (d *spooler) restart() error {
+	if err := d.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d.hash.Reset()
+	d.done, d.total = 0, -1
+	return nil
+}
+
+// report calls the progress callback, at most every 250ms unless final.
+func (d *spooler) report(final bool) {
+	if d.opts.Progress == nil {
+		return
+	}
+	if now := time.Now(); final || now.Sub(d.lastProgress) >= 250*time.Millisecond {
+		d.lastProgress = now
+		total := d.total
+		if final {
+			total = d.done
+		}
+		d.opts.Progress(Progress{Done: d.done, Total: total, Resumes: d.resumes})
+	}
+}
+
+// parseContentRange parses "bytes START-END/TOTAL"; total is -1 for "*".
+func parseContentRange(v string) (start, total int64, ok bool) {
+	rest, found := strings.CutPrefix(strings.TrimSpace(v), "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	span, size, found := strings.Cut(rest, "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if size == "*" {
+		return start, -1, true
+	}
+	total, err = strconv.ParseInt(size, 10, 64)
+	return start, total, err == nil
+}
@@ -0,0 +1,242 @@
+package anna
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSpool spools data as if it had been downloaded.
+func testSpool(t *testing.T, data []byte) *Spool {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "spool")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &Spool{path: path, size: int64(len(data)), md5: md5Hex(data)}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// flakyServer serves data with Range support, but the first drop requests
+// are cut off halfway; each drop hands in a function that fails them.
+func flakyServer(t *testing.T, data []byte, honorRange bool, drops ...func(w http.ResponseWriter)) (*httptest.Server, *[]string) {
+	t.Helper()
+	var requests atomic.Int32
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		ranges = append(ranges, r.Header.Get("Range"))
+		if !honorRange {
+			r.Header.Del("Range")
+		}
+		if n <= len(drops) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			drops[n-1](w)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "book.pdf", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &ranges
+}
+
+func dropConnection(http.ResponseWriter) { panic(http.ErrAbortHandler) }
+
+func TestSpoolDownload(t *testing.T) {
+	data := randomBytes(1 << 20)
+	srv, ranges := flakyServer(t, data, true)
+	var calls []Progress
+	spool, err := spoolDownload(srv.URL, DownloadOptions{Progress: func(p Progress) { calls = append(calls, p) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	got, err := spool.Bytes()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("spooled %d bytes, err %v", len(got), err)
+	}
+	if spool.Size() != int64(len(data)) || spool.MD5() != md5Hex(data) {
+		t.Errorf("size %d, md5 %s", spool.Size(), spool.MD5())
+	}
+	if len(*ranges) != 1 || (*ranges)[0] != "" {
+		t.Errorf("requests: %q", *ranges)
+	}
+	if last := calls[len(calls)-1]; last.Done != int64(len(data)) || last.Total != int64(len(data)) {
+		t.Errorf("last progress = %+v", last)
+	}
+
+	path := spool.Path()
+	spool.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Close should remove the spooled file")
+	}
+}
+
+func TestSpoolDownload_ResumesWithRange(t *testing.T) {
+	data := randomBytes(256 << 10)
+	srv, ranges := flakyServer(t, data, true, dropConnection, dropConnection)
+	var last Progress
+	spool, err := spoolDownload(srv.URL, DownloadOptions{Progress: func(p Progress) { last = p }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if got, _ := spool.Bytes(); !bytes.Equal(got, data) || spool.MD5() != md5Hex(data) {
+		t.Fatal("resumed download differs from the file")
+	}
+	want := []string{"", "bytes=" + strconv.Itoa(len(data)/2) + "-", ""}
+	if len(*ranges) != 3 || (*ranges)[0] != want[0] || (*ranges)[1] != want[1] {
+		t.Errorf("requests' ranges = %q, want the second to resume at the half", *ranges)
+	}
+	if last.Resumes != 2 {
+		t.Errorf("progress reports %d resumes, want 2", last.Resumes)
+	}
+}
+
+func TestSpoolDownload_RestartsWithoutRange(t *testing.T) {
+	data := randomBytes(128 << 10)
+	srv, _ := flakyServer(t, data, false, dropConnection)
+	spool, err := spoolDownload(srv.URL, DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if got, _ := spool.Bytes(); !bytes.Equal(got, data) || spool.MD5() != md5Hex(data) {
+		t.Fatal("a server ignoring Range should get the download restarted, not appended to")
+	}
+}
+
+func TestSpoolDownload_ResumesAfterStall(t *testing.T) {
+	orig := downloadStallTimeout
+	t.Cleanup(func() { downloadStallTimeout = orig })
+	downloadStallTimeout = 50 * time.Millisecond
+
+	data := randomBytes(64 << 10)
+	release := make(chan struct{})
+	srv, ranges := flakyServer(t, data, true, func(http.ResponseWriter) { <-release })
+	t.Cleanup(func() { close(release) }) // before the server closes
+	spool, err := spoolDownload(srv.URL, DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if got, _ := spool.Bytes(); !bytes.Equal(got, data) {
+		t.Fatal("resumed download differs from the file")
+	}
+	if len(*ranges) != 2 || (*ranges)[1] == "" {
+		t.Errorf("a stalled download should be resumed: %q", *ranges)
+	}
+}
+
+func TestSpoolDownload_Fails(t *testing.T) {
+	data := randomBytes(64 << 10)
+
+	// Announced too big: refused before reading the body.
+	srv, _ := flakyServer(t, data, true)
+	_, err := spoolDownload(srv.URL, DownloadOptions{MaxBytes: 1000})
+	var tooLarge *DownloadTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != int64(len(data)) || tooLarge.Limit != 1000 {
+		t.Errorf("err = %v, want a DownloadTooLargeError", err)
+	}
+
+	// No Content-Length: stopped once past the limit.
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 64; i++ {
+			w.Write(data[:1024])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer chunked.Close()
+	if _, err := spoolDownload(chunked.URL, DownloadOptions{MaxBytes: 10000}); !errors.Is(err, ErrDownloadTooLarge) {
+		t.Errorf("chunked: err = %v, want ErrDownloadTooLarge", err)
+	}
+
+	// ANNAS_MAX_DOWNLOAD_MB sets the default.
+	t.Setenv("ANNAS_MAX_DOWNLOAD_MB", "0.01")
+	if _, err := spoolDownload(srv.URL, DownloadOptions{}); !errors.Is(err, ErrDownloadTooLarge) {
+		t.Errorf("ANNAS_MAX_DOWNLOAD_MB: err = %v", err)
+	}
+	t.Setenv("ANNAS_MAX_DOWNLOAD_MB", "")
+
+	// Dropped every time: gives up.
+	drops := make([]func(http.ResponseWriter), downloadResumes+1)
+	for i := range drops {
+		drops[i] = dropConnection
+	}
+	flaky, _ := flakyServer(t, data, true, drops...)
+	if _, err := spoolDownload(flaky.URL, DownloadOptions{}); err == nil || !strings.Contains(err.Error(), "resumes") {
+		t.Errorf("err = %v, want it to give up after %d resumes", err, downloadResumes)
+	}
+
+	gone := httptest.NewServer(http.NotFoundHandler())
+	defer gone.Close()
+	if _, err := spoolDownload(gone.URL, DownloadOptions{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("err = %v, want the status", err)
+	}
+
+}
+
+func TestSpool_Format(t *testing.T) {
+	// A text file whose sniffed sample ends mid-rune.
+	text := []byte(strings.Repeat("a", sniffSize-1) + "ü" + strings.Repeat("Ω", 100))
+	// A .doc whose Word stream name straddles the chunks Format scans in.
+	doc := append(append(append([]byte{}, oleMagic...), make([]byte, 64<<10)...), wordDocumentStream...)
+	docx := makeZip(t, map[string]string{"[Content_Types].xml": "<Types/>", "word/document.xml": "<w:document/>"})
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"pdf", append([]byte("%PDF-1.7\n"), randomBytes(3*sniffSize)...), "pdf"},
+		{"epub", makeMinimalEPUB(t), "epub"},
+		{"text", text, "txt"},
+		{"cbz", comicArchive(t), "cbz"},
+		{"docx", docx, "docx"},
+		{"doc", doc, "doc"},
+		{"ole", append(append([]byte{}, oleMagic...), randomBytes(100<<10)...), "unknown"},
+		{"other zip", makeZip(t, map[string]string{"a.txt": "a"}), "unknown"},
+		{"junk", randomBytes(100), "unknown"},
+	} {
+		if got := testSpool(t, tc.data).Format(); got != tc.want {
+			t.Errorf("%s: Format() = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, tc := range []struct {
+		in           string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 100-199/200", 100, 200, true},
+		{"bytes 0-0/*", 0, -1, true},
+		{"bytes */200", 0, 0, false},
+		{"items 1-2/3", 0, 0, false},
+		{"", 0, 0, false},
+	} {
+		start, total, ok := parseContentRange(tc.in)
+		if ok != tc.ok || (ok && (start != tc.start || total != tc.total)) {
+			t.Errorf("%q: %d, %d, %v", tc.in, start, total, ok)
+		}
+	}
+}
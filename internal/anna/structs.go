@@ -1,5 +1,7 @@
 package anna
 
+import "github.com/sam-hartman/kindle-pibrarian/internal/goodreads"
+
 type Book struct {
 	Language  string `json:"language"`
 	Format    string `json:"format"`
@@ -9,6 +11,10 @@ type Book struct {
 	Authors   string `json:"authors"`
 	URL       string `json:"url"`
 	Hash      string `json:"hash"`
+
+	// Goodreads is the shelf entry the book was picked from, if any. When it
+	// matches, its metadata is written into the file (see bookMetadata).
+	Goodreads *goodreads.ShelfBook `json:"goodreads,omitempty"`
 }
 
 type fastDownloadResponse struct {
@@ -0,0 +1,563 @@
+package anna
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	xunicode "golang.org/x/text/encoding/unicode"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/epub"
+	"github.com/sam-hartman/kindle-pibrarian/internal/relay"
+)
+
+// Notes, drafts and Project Gutenberg books come as plain text or Markdown.
+// A Kindle takes a .txt as it is, but as one long page with no chapters and
+// every hard-wrapped line broken where the file breaks it. ConvertTextToEPUB
+// makes a proper book of it instead: the encoding is detected (UTF-8,
+// UTF-16 with a byte order mark, Windows-1251 or Latin-1), chapter headings
+// are found by pattern ("Chapter 1", "CHAPTER ONE", "Глава 3", a Roman
+// numeral on its own, Markdown "#" headings) and listed in the table of
+// contents, and wrapped lines are joined back into paragraphs.
+
+// ErrEmptyText means there was no text to make a book of.
+var ErrEmptyText = errors.New("the text is empty")
+
+// TextOptions describes the text given to ConvertTextToEPUB. Everything is
+// optional.
+type TextOptions struct {
+	Title    string // else a Gutenberg header's, Markdown front matter's or lone top heading's, else from Name
+	Author   string
+	Language string // a BCP 47 tag, e.g. "en"
+	// Format is "txt" or "md"; empty tells from Name's extension and the
+	// text itself.
+	Format string
+	// Name is the file the text came from, if any.
+	Name string
+}
+
+// ConvertTextToEPUB converts plain text or Markdown to EPUB bytes.
+func ConvertTextToEPUB(data []byte, opts TextOptions) ([]byte, error) {
+	out, _, _, err := convertText(context.Background(), data, opts)
+	return out, err
+}
+
+// convertText is ConvertTextToEPUB, also returning the book's title and
+// whether the text was read as Markdown. It gives up with ctx's error
+// between steps once ctx is done.
+func convertText(ctx context.Context, data []byte, opts TextOptions) (out []byte, title string, markdown bool, err error) {
+	text, _ := decodeText(data)
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+	if strings.TrimSpace(text) == "" {
+		return nil, "", false, ErrEmptyText
+	}
+
+	book := epub.New(epub.Metadata{})
+	var found textMeta
+	if markdown = isMarkdownText(text, opts); markdown {
+		found = markdownChapters(book, text)
+	} else {
+		found = plainTextChapters(book, text)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", false, err
+	}
+
+	title = firstNonEmpty(opts.Title, found.title)
+	if title == "" && opts.Name != "" {
+		base := filepath.Base(opts.Name)
+		title = strings.TrimSpace(strings.NewReplacer("_", " ").Replace(strings.TrimSuffix(base, filepath.Ext(base))))
+	}
+	if title = strings.Join(strings.Fields(title), " "); title == "" {
+		title = "Untitled"
+	}
+	book.Metadata = epub.Metadata{
+		Title:    title,
+		Language: firstNonEmpty(opts.Language, found.language),
+	}
+	if author := firstNonEmpty(opts.Author, found.author); author != "" {
+		book.Metadata.Authors = []string{author}
+	}
+	out, err = book.Bytes()
+	return out, title, markdown, err
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// textMeta is what the text says about itself.
+type textMeta struct {
+	title, author, language string
+}
+
+// decodeText decodes text of unknown encoding to a string, naming the
+// encoding it settled on. Text that isn't UTF-8 is Windows-1251 when most
+// of its letters are in the upper half (Cyrillic, where every letter is),
+// else Latin-1 (read as Windows-1252, its superset in practice).
+func decodeText(data []byte) (string, string) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xef\xbb\xbf")):
+		return string(data[3:]), "utf-8"
+	case bytes.HasPrefix(data, []byte("\xff\xfe")) || bytes.HasPrefix(data, []byte("\xfe\xff")):
+		if b, err := xunicode.UTF16(xunicode.LittleEndian, xunicode.ExpectBOM).NewDecoder().Bytes(data); err == nil {
+			return string(b), "utf-16"
+		}
+	case utf8.Valid(data):
+		return string(data), "utf-8"
+	}
+	var high, latin int
+	for _, c := range data {
+		switch {
+		case c >= 0xC0:
+			high++
+		case c|0x20 >= 'a' && c|0x20 <= 'z':
+			latin++
+		}
+	}
+	if high > latin {
+		if b, err := charmap.Windows1251.NewDecoder().Bytes(data); err == nil {
+			return string(b), "windows-1251"
+		}
+	}
+	b, _ := charmap.Windows1252.NewDecoder().Bytes(data)
+	return string(b), "windows-1252"
+}
+
+var (
+	textATXHeadingRe = regexp.MustCompile(`^ {0,3}(#{1,6})[ \t]+(.*?)(?:[ \t]+#+)?[ \t]*$`)
+	textFenceRe      = regexp.MustCompile("^ {0,3}(```|~~~)")
+	frontMatterRe    = regexp.MustCompile(`(?s)\A---[ \t]*\n(.*?)\n(?:---|\.\.\.)[ \t]*(?:\n|\z)`)
+	frontMatterKeyRe = regexp.MustCompile(`(?m)^(title|author|lang|language):[ \t]*(.+?)[ \t]*$`)
+)
+
+// isMarkdownText reports whether to read text as Markdown: as told, by file
+// extension, or when it has "#" headings, code fences or front matter.
+func isMarkdownText(text string, opts TextOptions) bool {
+	switch strings.ToLower(opts.Format) {
+	case "md", "markdown":
+		return true
+	case "txt", "text":
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(opts.Name)) {
+	case ".md", ".markdown":
+		return true
+	case ".txt":
+		return false
+	}
+	if frontMatterRe.MatchString(text) {
+		return true
+	}
+	for _, l := range strings.Split(text, "\n") {
+		if textATXHeadingRe.MatchString(l) || textFenceRe.MatchString(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// markdownChapters splits Markdown at its top-level headings, one chapter
+// each. A single heading opening the text above deeper ones is the book's
+// title rather than a chapter.
+func markdownChapters(book *epub.Book, text string) textMeta {
+	var meta textMeta
+	if m := frontMatterRe.FindStringSubmatch(text); m != nil {
+		for _, f := range frontMatterKeyRe.FindAllStringSubmatch(m[1], -1) {
+			v := strings.Trim(f[2], `"'`)
+			switch f[1] {
+			case "title":
+				meta.title = v
+			case "author":
+				meta.author = v
+			default:
+				meta.language = v
+			}
+		}
+		text = text[len(m[0]):]
+	}
+
+	lines := strings.Split(text, "\n")
+	type heading struct{ line, level int }
+	var hs []heading
+	fence := ""
+	for i, l := range lines {
+		if m := textFenceRe.FindStringSubmatch(l); m != nil {
+			if fence == "" {
+				fence = m[1]
+			} else if m[1] == fence {
+				fence = ""
+			}
+			continue
+		}
+		if m := textATXHeadingRe.FindStringSubmatch(l); m != nil && fence == "" {
+			hs = append(hs, heading{i, len(m[1])})
+		}
+	}
+	top := func() int {
+		level := 7
+		for _, h := range hs {
+			level = min(level, h.level)
+		}
+		return level
+	}
+
+	if len(hs) > 1 && hs[0].level == top() && strings.TrimSpace(strings.Join(lines[:hs[0].line], "")) == "" &&
+		!slices.ContainsFunc(hs[1:], func(h heading) bool { return h.level == hs[0].level }) {
+		m := textATXHeadingRe.FindStringSubmatch(lines[hs[0].line])
+		if meta.title == "" {
+			meta.title = strings.Trim(strings.NewReplacer("*", "", "`", "").Replace(m[2]), "_ ")
+		}
+		lines[hs[0].line] = ""
+		hs = hs[1:]
+	}
+
+	level, start := top(), 0
+	add := func(end int) {
+		if chunk := strings.Join(lines[start:end], "\n"); strings.TrimSpace(chunk) != "" {
+			book.AddMarkdownChapter("", chunk)
+		}
+		start = end
+	}
+	for _, h := range hs {
+		if h.level == level {
+			add(h.line)
+		}
+	}
+	add(len(lines))
+	return meta
+}
+
+var (
+	gutenbergStartRe = regexp.MustCompile(`(?im)^\*{3} ?START OF (?:THE|THIS) PROJECT GUTENBERG E-?BOOK.*$`)
+	gutenbergEndRe   = regexp.MustCompile(`(?im)^\*{3} ?END OF (?:THE|THIS) PROJECT GUTENBERG E-?BOOK.*$`)
+	gutenbergFieldRe = regexp.MustCompile(`(?m)^(Title|Author|Language):[ \t]*(.+?)[ \t]*$`)
+)
+
+// gutenbergLanguages maps a Project Gutenberg header's Language to a tag.
+var gutenbergLanguages = map[string]string{
+	"english": "en", "french": "fr", "german": "de", "spanish": "es", "italian": "it",
+	"portuguese": "pt", "dutch": "nl", "finnish": "fi", "swedish": "sv", "danish": "da",
+	"polish": "pl", "russian": "ru", "latin": "la", "chinese": "zh", "japanese": "ja",
+}
+
+// gutenbergText strips a Project Gutenberg book's license header and footer,
+// reading the title, author and language from the header.
+func gutenbergText(text string) (string, textMeta) {
+	var meta textMeta
+	start := gutenbergStartRe.FindStringIndex(text)
+	if start == nil {
+		return text, meta
+	}
+	for _, f := range gutenbergFieldRe.FindAllStringSubmatch(text[:start[0]], -1) {
+		switch f[1] {
+		case "Title":
+			meta.title = f[2]
+		case "Author":
+			meta.author = f[2]
+		case "Language":
+			meta.language = gutenbergLanguages[strings.ToLower(f[2])]
+		}
+	}
+	text = text[start[1]:]
+	if end := gutenbergEndRe.FindStringIndex(text); end != nil {
+		text = text[:end[0]]
+	}
+	return text, meta
+}
+
+const chapterNumberWords = `one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve|thirteen|fourteen|fifteen|sixteen|seventeen|eighteen|nineteen|` +
+	`(?:twenty|thirty|forty|fifty|sixty|seventy|eighty|ninety)(?:[- ](?:one|two|three|four|five|six|seven|eight|nine))?`
+
+var (
+	// chapterHeadingRe matches a chapter heading line; the last group is the
+	// title following the number, if any.
+	chapterHeadingRe = regexp.MustCompile(`(?i)^(?:(?:chapter|chap\.|book|part|volume|vol\.|section|letter|act|глава|часть|книга|том)\s+` +
+		`(?:\d{1,4}|[ivxlcdm]{1,8}|` + chapterNumberWords + `)\b\.?|` +
+		`prologue|epilogue|preface|foreword|introduction|afterword|appendix|пролог|эпилог|предисловие|послесловие)` +
+		`(\s*[.:—–-]?\s*\S.*)?$`)
+	romanHeadingRe = regexp.MustCompile(`^[IVXLC]{1,7}\.?$`)
+	sceneBreakRe   = regexp.MustCompile(`^[*#~=_.•-]+(?:\s+[*#~=_.•-]+)*$`)
+)
+
+// textHeading is a chapter heading found in plain text: lines [line, end),
+// a title and, on the line after a bare "CHAPTER I.", a subtitle.
+type textHeading struct {
+	line, end       int
+	title, subtitle string
+}
+
+func (h textHeading) label() string {
+	if h.subtitle == "" {
+		return h.title
+	}
+	if strings.HasSuffix(h.title, ".") || strings.HasSuffix(h.title, ":") {
+		return h.title + " " + h.subtitle
+	}
+	return h.title + ": " + h.subtitle
+}
+
+func isBlankLine(l string) bool { return strings.TrimSpace(l) == "" }
+
+// isSubtitleLine reports whether a line could be a chapter's title under its
+// number: short, and not a sentence.
+func isSubtitleLine(l string) bool {
+	t := strings.TrimSpace(l)
+	if t == "" || utf8.RuneCountInString(t) > 60 || chapterHeadingRe.MatchString(t) {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(t)
+	return !strings.ContainsRune(`.!?,;:…"'”’»`, last)
+}
+
+// findTextHeadings finds chapter headings: a pattern on a line of its own
+// after a blank line.
+func findTextHeadings(lines []string) []textHeading {
+	var hs []textHeading
+	for i := 0; i < len(lines); i++ {
+		t := strings.Join(strings.Fields(lines[i]), " ")
+		if t == "" || utf8.RuneCountInString(t) > 72 || (i > 0 && !isBlankLine(lines[i-1])) {
+			continue
+		}
+		nextBlank := i+1 == len(lines) || isBlankLine(lines[i+1])
+		var bare bool
+		if m := chapterHeadingRe.FindStringSubmatch(t); m != nil {
+			bare = m[1] == ""
+		} else if romanHeadingRe.MatchString(t) && nextBlank {
+			bare = true
+		} else {
+			continue
+		}
+		h := textHeading{line: i, end: i + 1, title: t}
+		switch {
+		case !nextBlank:
+			// "CHAPTER I.\nDown the Rabbit-Hole" — or a paragraph that
+			// happens to start like a heading.
+			if !bare || !isSubtitleLine(lines[i+1]) || (i+2 < len(lines) && !isBlankLine(lines[i+2])) {
+				continue
+			}
+			h.subtitle, h.end = strings.Join(strings.Fields(lines[i+1]), " "), i+2
+		case bare:
+			// "CHAPTER I.\n\nDown the Rabbit-Hole\n\n"
+			j := i + 1
+			for j < len(lines) && j <= i+2 && isBlankLine(lines[j]) {
+				j++
+			}
+			if j < len(lines) && isBlankLine(lines[j-1]) && isSubtitleLine(lines[j]) && (j+1 == len(lines) || isBlankLine(lines[j+1])) {
+				h.subtitle, h.end = strings.Join(strings.Fields(lines[j]), " "), j+1
+			}
+		}
+		hs = append(hs, h)
+		i = h.end - 1
+	}
+
+	// A table of contents is a run of "headings" with nothing under them;
+	// those stay text. A single empty one is a part's title page.
+	empty := make([]bool, len(hs))
+	for k, h := range hs {
+		next := len(lines)
+		if k+1 < len(hs) {
+			next = hs[k+1].line
+		}
+		empty[k] = strings.TrimSpace(strings.Join(lines[h.end:next], "")) == ""
+	}
+	var kept []textHeading
+	for k := 0; k < len(hs); {
+		run := k
+		for run < len(hs) && empty[run] {
+			run++
+		}
+		if run-k >= 3 {
+			k = run
+			continue
+		}
+		kept = append(kept, hs[k:max(run, k+1)]...)
+		k = max(run, k+1)
+	}
+	return kept
+}
+
+// Ways plain text marks paragraphs.
+const (
+	parasByBlankLine = iota // blank lines between paragraphs
+	parasByIndent           // no blank lines; a paragraph's first line is indented
+	parasByLine             // one paragraph per line
+)
+
+func paragraphStyle(lines []string) int {
+	var nonBlank, breaks, indented int
+	for i, l := range lines {
+		if isBlankLine(l) {
+			continue
+		}
+		if nonBlank > 0 && isBlankLine(lines[i-1]) {
+			breaks++
+		}
+		nonBlank++
+		if l[0] == ' ' || l[0] == '\t' {
+			indented++
+		}
+	}
+	switch {
+	case breaks*10 >= nonBlank:
+		return parasByBlankLine
+	case indented*10 >= nonBlank:
+		return parasByIndent
+	}
+	return parasByLine
+}
+
+// wrapWidth is the length most of the text's lines stay within: the width
+// it was hard-wrapped at, if it was.
+func wrapWidth(lines []string) int {
+	var n []int
+	for _, l := range lines {
+		if !isBlankLine(l) {
+			n = append(n, utf8.RuneCountInString(strings.TrimSpace(l)))
+		}
+	}
+	if len(n) == 0 {
+		return 0
+	}
+	slices.Sort(n)
+	return n[len(n)*9/10]
+}
+
+// plainTextChapters adds plain text to book, a chapter per heading found.
+func plainTextChapters(book *epub.Book, text string) textMeta {
+	text, meta := gutenbergText(text)
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRightFunc(l, unicode.IsSpace)
+	}
+	style, wrap := paragraphStyle(lines), wrapWidth(lines)
+
+	hs := findTextHeadings(lines)
+	start := len(lines)
+	if len(hs) > 0 {
+		start = hs[0].line
+	}
+	if front := textParagraphs(lines[:start], style, wrap); front != "" || len(hs) == 0 {
+		book.AddChapter("", front)
+	}
+	for k, h := range hs {
+		end := len(lines)
+		if k+1 < len(hs) {
+			end = hs[k+1].line
+		}
+		head := "<h1>" + xmlEscape(h.title)
+		if h.subtitle != "" {
+			head += "<br/>" + xmlEscape(h.subtitle)
+		}
+		book.AddChapter(h.label(), head+"</h1>\n"+textParagraphs(lines[h.end:end], style, wrap))
+	}
+	return meta
+}
+
+// textParagraphs renders lines as HTML paragraphs, joining wrapped lines.
+// A short block of short lines in wrapped text (verse, an address) keeps its
+// line breaks; a line of asterisks or the like is a scene break.
+func textParagraphs(lines []string, style, wrap int) string {
+	var b strings.Builder
+	var para []string
+	flush := func() {
+		defer func() { para = para[:0] }()
+		switch {
+		case len(para) == 0:
+			return
+		case len(para) == 1 && sceneBreakRe.MatchString(strings.TrimSpace(para[0])):
+			b.WriteString("<hr/>\n")
+			return
+		case style == parasByBlankLine && len(para) > 1 && isVerse(para, wrap):
+			for i, l := range para {
+				para[i] = xmlEscape(strings.Join(strings.Fields(l), " "))
+			}
+			b.WriteString("<p>" + strings.Join(para, "<br/>") + "</p>\n")
+			return
+		}
+		var s strings.Builder
+		prev := ""
+		for i, l := range para {
+			l = strings.TrimSpace(l)
+			// Keep a hyphen at a line break, but don't leave a space after it.
+			if i > 0 && !(strings.HasSuffix(prev, "-") && !strings.HasSuffix(prev, "--") && startsLower(l)) {
+				s.WriteByte(' ')
+			}
+			s.WriteString(l)
+			prev = l
+		}
+		b.WriteString("<p>" + xmlEscape(strings.Join(strings.Fields(s.String()), " ")) + "</p>\n")
+	}
+	for _, l := range lines {
+		if isBlankLine(l) {
+			flush()
+			continue
+		}
+		switch style {
+		case parasByIndent:
+			if l[0] == ' ' || l[0] == '\t' {
+				flush()
+			}
+		case parasByLine:
+			flush()
+		}
+		para = append(para, l)
+	}
+	flush()
+	return b.String()
+}
+
+func startsLower(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsLower(r)
+}
+
+// isVerse reports whether every line of a block is well short of the width
+// the text is wrapped at.
+func isVerse(block []string, wrap int) bool {
+	if wrap < 50 {
+		return false
+	}
+	for _, l := range block {
+		if utf8.RuneCountInString(strings.TrimSpace(l))*10 > wrap*6 {
+			return false
+		}
+	}
+	return true
+}
+
+// SendTextToKindle converts text (see ConvertTextToEPUB) and emails the book
+// to the Kindle, returning its title. It is how text pasted into a chat
+// reaches the Kindle. The Pi's server has no tool to mail a book made here,
+// so in relay mode it fails with ErrRelayUnsupported.
+func SendTextToKindle(text string, opts TextOptions, mail MailConfig, to Recipient) (string, error) {
+	if _, _, ok := relay.Config(); ok {
+		return "", fmt.Errorf("sending text: %w", ErrRelayUnsupported)
+	}
+	book, title, markdown, err := convertText(context.Background(), []byte(text), opts)
+	if err != nil {
+		return "", err
+	}
+	filename := sanitizeFilename(title)
+	if filename == "" {
+		filename = "text"
+	}
+	report := &DeliveryReport{ConvertedFrom: "txt"}
+	if markdown {
+		report.ConvertedFrom = "md"
+	}
+	return title, sendFileToKindle(book, filename+".epub", getMimeType("epub"), "Book: "+title, mail, to, report)
+}
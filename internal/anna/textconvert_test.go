@@ -0,0 +1,299 @@
+package anna
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+// gutenbergSample is a hard-wrapped Project Gutenberg book: license header and
+// footer, a table of contents, headings with subtitles on the next line and
+// after a blank one, a spelled-out chapter number, verse and a scene break.
+const gutenbergSample = `The Project Gutenberg eBook of A Sample
+
+Title: A Sample Tale
+Author: Jane Doe
+Language: English
+
+*** START OF THE PROJECT GUTENBERG EBOOK A SAMPLE TALE ***
+
+A SAMPLE TALE
+
+CONTENTS
+
+CHAPTER I.
+
+CHAPTER II.
+
+CHAPTER ONE
+
+CHAPTER I.
+Down the Lane
+
+It was a dark and stormy night, and the rain fell in torrents except at
+occasional intervals, when it was checked by a violent gust of wind which
+swept up the streets, rattling along the house-tops and fiercely agi-
+tating the scanty flame of the lamps that struggled against the darkness.
+
+    Twinkle, twinkle, little bat!
+    How I wonder what you're at!
+
+Then the rain stopped, and the night went on much as nights tend to do in
+stories of this sort, with nobody the wiser and everyone a little wetter.
+
+* * *
+
+Morning came & went.
+
+CHAPTER II.
+
+The Second Day
+
+Nothing whatever happened on the second day, which was a relief to all of
+those who had been out in the rain the night before, and to the lamps too.
+
+CHAPTER ONE
+
+A chapter with a spelled-out number and <angle brackets> in its text.
+
+*** END OF THE PROJECT GUTENBERG EBOOK A SAMPLE TALE ***
+
+This license text should not be in the book.
+`
+
+func TestConvertTextToEPUB_PlainText(t *testing.T) {
+	out, err := ConvertTextToEPUB([]byte(strings.ReplaceAll(gutenbergSample, "\n", "\r\n")), TextOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateEPUB(out); err != nil {
+		t.Fatalf("converted EPUB does not validate: %v", err)
+	}
+	if r := CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("converted EPUB should check clean:\n%s", r)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "A Sample Tale" {
+		t.Errorf("title = %q", book.title())
+	}
+	if c := book.pkg.Metadata.Creators; len(c) != 1 || c[0] != "Jane Doe" {
+		t.Errorf("creators = %q", c)
+	}
+	if l := book.pkg.Metadata.Languages; len(l) != 1 || l[0] != "en" {
+		t.Errorf("languages = %q", l)
+	}
+	if n := len(book.pkg.Spine.ItemRefs); n != 4 {
+		t.Errorf("spine has %d documents, want front matter and 3 chapters", n)
+	}
+
+	front := string(readEntry(t, out, "OEBPS/Text/chapter0001.xhtml"))
+	ch1 := string(readEntry(t, out, "OEBPS/Text/chapter0002.xhtml"))
+	ch2 := string(readEntry(t, out, "OEBPS/Text/chapter0003.xhtml"))
+	ch3 := string(readEntry(t, out, "OEBPS/Text/chapter0004.xhtml"))
+	for doc, wants := range map[string][]string{
+		front: {"<p>A SAMPLE TALE</p>", "<p>CHAPTER I.</p>", "<p>CHAPTER ONE</p>"},
+		ch1: {
+			"<h1>CHAPTER I.<br/>Down the Lane</h1>",
+			"fell in torrents except at occasional intervals",
+			"the house-tops and fiercely agi-tating the scanty flame",
+			"<p>Twinkle, twinkle, little bat!<br/>How I wonder what you're at!</p>",
+			"<hr/>",
+			"<p>Morning came &amp; went.</p>",
+		},
+		ch2: {"<h1>CHAPTER II.<br/>The Second Day</h1>", "out in the rain the night before, and to the lamps too.</p>"},
+		ch3: {"<h1>CHAPTER ONE</h1>", "&lt;angle brackets&gt;"},
+	} {
+		for _, want := range wants {
+			if !strings.Contains(doc, want) {
+				t.Errorf("document lacks %s:\n%s", want, doc)
+			}
+		}
+	}
+	for _, unwanted := range []string{"START OF", "Project Gutenberg eBook", "license"} {
+		if strings.Contains(front+ch3, unwanted) {
+			t.Errorf("the Gutenberg header and footer should be stripped, found %q", unwanted)
+		}
+	}
+
+	nav := string(readEntry(t, out, "OEBPS/nav.xhtml"))
+	for _, want := range []string{
+		`<a href="Text/chapter0002.xhtml">CHAPTER I. Down the Lane</a>`,
+		`<a href="Text/chapter0003.xhtml">CHAPTER II. The Second Day</a>`,
+		`<a href="Text/chapter0004.xhtml">CHAPTER ONE</a>`,
+	} {
+		if !strings.Contains(nav, want) {
+			t.Errorf("nav lacks %s:\n%s", want, nav)
+		}
+	}
+}
+
+func TestConvertTextToEPUB_Encodings(t *testing.T) {
+	cyrillic := "Глава 1\n\nЯ просто списываю то, что думаю.\n\nГлава 2\n\nДругой день.\n"
+	cp1251, err := charmap.Windows1251.NewEncoder().String(cyrillic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latin := "Chapter 1\n\nCafé crème à la française, naïve façade.\n"
+	cp1252, err := charmap.Windows1252.NewEncoder().String(latin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utf16, err := xunicode.UTF16(xunicode.LittleEndian, xunicode.UseBOM).NewEncoder().String(cyrillic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, data, want, encoding string
+	}{
+		{"utf-8", cyrillic, "Я просто списываю", "utf-8"},
+		{"utf-8 bom", "\ufeff" + latin, "Café crème", "utf-8"},
+		{"utf-16", utf16, "Я просто списываю", "utf-16"},
+		{"windows-1251", cp1251, "Я просто списываю", "windows-1251"},
+		{"latin-1", cp1252, "naïve façade", "windows-1252"},
+	} {
+		if text, enc := decodeText([]byte(tc.data)); enc != tc.encoding || !strings.Contains(text, tc.want) {
+			t.Errorf("%s: decoded as %s: %q", tc.name, enc, text)
+		}
+		out, err := ConvertTextToEPUB([]byte(tc.data), TextOptions{Title: "T"})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if ch := string(readEntry(t, out, "OEBPS/Text/chapter0001.xhtml")); !strings.Contains(ch, tc.want) {
+			t.Errorf("%s: chapter text not decoded:\n%s", tc.name, ch)
+		}
+	}
+
+	out, err := ConvertTextToEPUB([]byte(cp1251), TextOptions{Title: "Мы"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nav := string(readEntry(t, out, "OEBPS/nav.xhtml")); !strings.Contains(nav, ">Глава 1</a>") || !strings.Contains(nav, ">Глава 2</a>") {
+		t.Errorf("Russian chapter headings should be found:\n%s", nav)
+	}
+}
+
+func TestConvertTextToEPUB_Markdown(t *testing.T) {
+	md := `---
+author: "Ada Lovelace"
+lang: en
+---
+
+# Notes on the *Engine*
+
+## Sketch
+
+Some **bold** text.
+
+` + "```" + `
+# not a heading
+` + "```" + `
+
+## Translator's Notes
+
+- one
+- two
+`
+	out, err := ConvertTextToEPUB([]byte(md), TextOptions{Name: "notes.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("converted EPUB should check clean:\n%s", r)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "Notes on the Engine" {
+		t.Errorf("a lone top heading should be the title, got %q", book.title())
+	}
+	if c := book.pkg.Metadata.Creators; len(c) != 1 || c[0] != "Ada Lovelace" {
+		t.Errorf("creators = %q", c)
+	}
+	if n := len(book.pkg.Spine.ItemRefs); n != 2 {
+		t.Errorf("spine has %d documents, want a chapter per ## heading", n)
+	}
+	ch1 := string(readEntry(t, out, "OEBPS/Text/chapter0001.xhtml"))
+	if !strings.Contains(ch1, "<h2>Sketch</h2>") || !strings.Contains(ch1, "<strong>bold</strong>") || !strings.Contains(ch1, "# not a heading") {
+		t.Errorf("chapter 1:\n%s", ch1)
+	}
+	nav := string(readEntry(t, out, "OEBPS/nav.xhtml"))
+	if !strings.Contains(nav, ">Sketch</a>") || !strings.Contains(nav, ">Translator's Notes</a>") {
+		t.Errorf("nav:\n%s", nav)
+	}
+
+	// Without a file name, "#" headings mark the text as Markdown.
+	out, err = ConvertTextToEPUB([]byte("# One\n\ntext\n\n# Two\n\nmore"), TextOptions{Title: "Given"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err = parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "Given" || len(book.pkg.Spine.ItemRefs) != 2 {
+		t.Errorf("title %q, %d documents", book.title(), len(book.pkg.Spine.ItemRefs))
+	}
+}
+
+func TestConvertTextToEPUB_ParagraphStyles(t *testing.T) {
+	for name, tc := range map[string]struct {
+		text string
+		want []string
+	}{
+		"indented": {
+			"  First paragraph runs\non to a second line.\n  Second paragraph.\n",
+			[]string{"<p>First paragraph runs on to a second line.</p>", "<p>Second paragraph.</p>"},
+		},
+		"line per paragraph": {
+			"One paragraph.\nAnother paragraph.\nA third.\n",
+			[]string{"<p>One paragraph.</p>", "<p>Another paragraph.</p>", "<p>A third.</p>"},
+		},
+	} {
+		out, err := ConvertTextToEPUB([]byte(tc.text), TextOptions{Format: "txt"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ch := string(readEntry(t, out, "OEBPS/Text/chapter0001.xhtml"))
+		for _, want := range tc.want {
+			if !strings.Contains(ch, want) {
+				t.Errorf("%s: chapter lacks %s:\n%s", name, want, ch)
+			}
+		}
+	}
+}
+
+func TestConvertTextToEPUB_TitleAndErrors(t *testing.T) {
+	out, err := ConvertTextToEPUB([]byte("Just a line."), TextOptions{Name: "/tmp/my_notes.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := parseEPUB(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title() != "my notes" {
+		t.Errorf("title = %q, want it from the file name", book.title())
+	}
+	for _, empty := range []string{"", " \n\t\r\n", "\ufeff"} {
+		if _, err := ConvertTextToEPUB([]byte(empty), TextOptions{}); !errors.Is(err, ErrEmptyText) {
+			t.Errorf("%q: err = %v, want ErrEmptyText", empty, err)
+		}
+	}
+}
+
+func TestDefaultConverters_PreferNativeText(t *testing.T) {
+	for _, from := range []string{"txt", "md"} {
+		plans := converterRegistry.Plans(from, "epub")
+		if len(plans) == 0 || plans[0][0].Converter.Name() != "native" {
+			t.Fatalf("%s should convert natively first: %+v", from, plans)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package anna
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/smtp"
+	"strings"
+)
+
+// Delivery used to be hardwired to smtp.SendMail + smtp.PlainAuth, which
+// can't do port-465 implicit TLS, can't insist on STARTTLS, and can't use
+// OAuth2 — and Google keeps revoking our Gmail app passwords. SendFileToKindle
+// now composes the message and hands it to a Sender chosen by MailConfig
+// (MAIL_TRANSPORT and friends, see modes.Env).
+
+// Mail transports (MAIL_TRANSPORT).
+const (
+	TransportSMTP     = "smtp"
+	TransportSendmail = "sendmail"
+	TransportMaildir  = "maildir"
+)
+
+// SMTP connection security (SMTP_SECURITY).
+const (
+	SecurityStartTLS = "starttls" // plain connect, then STARTTLS — required, never skipped
+	SecurityTLS      = "tls"      // implicit TLS from the first byte (port 465)
+	SecurityPlain    = "plain"    // no TLS at all; only sensible for a local relay
+)
+
+// SMTP authentication mechanisms (SMTP_AUTH).
+const (
+	AuthPlain   = "plain"
+	AuthXOAuth2 = "xoauth2"
+	AuthNone    = "none"
+)
+
+// errEmailNotConfigured is matched verbatim by the MCP layer to explain why a
+// send was skipped, so keep the text stable.
+var errEmailNotConfigured = errors.New("email configuration incomplete: SMTP_HOST, SMTP_USER, SMTP_PASSWORD, and FROM_EMAIL must be set")
+
+// Envelope is the SMTP envelope for one delivery (MAIL FROM / RCPT TO).
+type Envelope struct {
+	From string
+	To   []string
+}
+
+// Sender delivers one fully composed RFC 5322 message.
+type Sender interface {
+	Send(env Envelope, msg io.WriterTo) error
+}
+
+// MailConfig selects and configures the outgoing mail transport.
+type MailConfig struct {
+	Transport string // smtp (default), sendmail, maildir
+	FromEmail string
+
+	// SMTP
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Security string // starttls, tls, plain; defaults to tls on port 465, else starttls
+	Auth     string // plain (default), xoauth2, none
+
+	// XOAUTH2: either a fixed access token, or a refresh token that is
+	// exchanged at OAuthTokenURL (Google's endpoint by default).
+	OAuthAccessToken  string
+	OAuthClientID     string
+	OAuthClientSecret string
+	OAuthRefreshToken string
+	OAuthTokenURL     string
+
+	// Local delivery
+	SendmailPath string
+	MaildirPath  string
+
+	// MaxMessageBytes overrides the transport's message size limit
+	// (MAIL_MAX_MESSAGE_MB, see sizelimit.go). 0 means the default.
+	MaxMessageBytes int64
+
+	// CaptureDir switches to capture mode: messages are written there as .eml
+	// files instead of being sent (MAIL_CAPTURE_DIR, see capture.go).
+	CaptureDir string
+
+	// OutboxDir enables the persistent retry queue (see outbox.go).
+	OutboxDir string
+	// SendLogPath records accepted sends for the bounce watcher (see sendlog.go).
+	SendLogPath string
+}
+
+func (c MailConfig) transport() string {
+	if t := strings.ToLower(strings.TrimSpace(c.Transport)); t != "" {
+		return t
+	}
+	return TransportSMTP
+}
+
+func (c MailConfig) security() string {
+	if s := strings.ToLower(strings.TrimSpace(c.Security)); s != "" {
+		return s
+	}
+	if c.Port == "465" {
+		return SecurityTLS
+	}
+	return SecurityStartTLS
+}
+
+func (c MailConfig) auth() string {
+	if a := strings.ToLower(strings.TrimSpace(c.Auth)); a != "" {
+		return a
+	}
+	return AuthPlain
+}
+
+// Validate reports whether the config is complete enough to send mail.
+// Capture mode only needs a From address.
+func (c MailConfig) Validate() error {
+	if c.CaptureDir != "" {
+		if c.FromEmail == "" {
+			return errors.New("email configuration incomplete: FROM_EMAIL must be set")
+		}
+		return nil
+	}
+	switch c.transport() {
+	case TransportSMTP:
+		if c.Host == "" || c.FromEmail == "" {
+			return errEmailNotConfigured
+		}
+		switch c.security() {
+		case SecurityStartTLS, SecurityTLS, SecurityPlain:
+		default:
+			return fmt.Errorf("unknown SMTP_SECURITY %q (want starttls, tls or plain)", c.Security)
+		}
+		switch c.auth() {
+		case AuthPlain:
+			if c.User == "" || c.Password == "" {
+				return errEmailNotConfigured
+			}
+		case AuthXOAuth2:
+			if c.User == "" {
+				return errors.New("email configuration incomplete: SMTP_USER must be set for XOAUTH2")
+			}
+			if c.OAuthAccessToken == "" && (c.OAuthClientID == "" || c.OAuthRefreshToken == "") {
+				return errors.New("email configuration incomplete: XOAUTH2 needs SMTP_OAUTH_ACCESS_TOKEN or SMTP_OAUTH_CLIENT_ID + SMTP_OAUTH_REFRESH_TOKEN")
+			}
+		case AuthNone:
+		default:
+			return fmt.Errorf("unknown SMTP_AUTH %q (want plain, xoauth2 or none)", c.Auth)
+		}
+	case TransportSendmail:
+		if c.FromEmail == "" {
+			return errors.New("email configuration incomplete: FROM_EMAIL must be set")
+		}
+	case TransportMaildir:
+		if c.MaildirPath == "" {
+			return errors.New("email configuration incomplete: MAILDIR_PATH must be set for the maildir transport")
+		}
+	default:
+		return fmt.Errorf("unknown MAIL_TRANSPORT %q (want smtp, sendmail or maildir)", c.Transport)
+	}
+	return nil
+}
+
+// Describe returns a short human-readable summary of the transport, for logs
+// and the test-email command. It never includes secrets.
+func (c MailConfig) Describe() string {
+	if c.CaptureDir != "" {
+		live := c
+		live.CaptureDir = ""
+		return "capture to " + c.CaptureDir + " (instead of " + live.Describe() + ")"
+	}
+	switch c.transport() {
+	case TransportSendmail:
+		return "sendmail (" + c.sendmailPath() + ")"
+	case TransportMaildir:
+		return "maildir (" + c.MaildirPath + ")"
+	default:
+		return fmt.Sprintf("smtp %s:%s (%s, auth %s)", c.Host, c.Port, c.security(), c.auth())
+	}
+}
+
+func (c MailConfig) sendmailPath() string {
+	if c.SendmailPath != "" {
+		return c.SendmailPath
+	}
+	return defaultSendmailPath
+}
+
+// OAuthToken returns a current XOAUTH2 access token for c, refreshing it if
+// needed. The bounce watcher uses it to log in to the same Gmail mailbox.
+func (c MailConfig) OAuthToken() (string, error) {
+	return oauthTokenSourceFor(c).Token()
+}
+
+// NewSender builds the Sender described by c.
+func NewSender(c MailConfig) (Sender, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.CaptureDir != "" {
+		live := c
+		live.CaptureDir = ""
+		return &CaptureSender{Dir: c.CaptureDir, Transport: live.Describe()}, nil
+	}
+	switch c.transport() {
+	case TransportSendmail:
+		return &SendmailSender{Path: c.sendmailPath()}, nil
+	case TransportMaildir:
+		return &MaildirSender{Dir: c.MaildirPath}, nil
+	}
+
+	var auth smtp.Auth
+	switch c.auth() {
+	case AuthPlain:
+		auth = smtp.PlainAuth("", c.User, c.Password, c.Host)
+	case AuthXOAuth2:
+		auth = &xoauth2Auth{user: c.User, host: c.Host, tokens: oauthTokenSourceFor(c)}
+	}
+	return &SMTPSender{
+		Host:     c.Host,
+		Port:     c.Port,
+		Security: c.security(),
+		Auth:     auth,
+	}, nil
+}
@@ -0,0 +1,166 @@
+package anna
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XOAUTH2 lets us authenticate to Gmail with an OAuth2 access token instead of
+// an app password (which Google revokes periodically). Access tokens live for
+// an hour, so we normally hold a long-lived refresh token and exchange it at
+// the token endpoint, caching the access token until shortly before expiry.
+
+const defaultOAuthTokenURL = "https://oauth2.googleapis.com/token"
+
+// xoauth2Auth implements smtp.Auth for the XOAUTH2 SASL mechanism.
+type xoauth2Auth struct {
+	user   string
+	host   string
+	tokens *oauthTokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Same rule as smtp.PlainAuth: a bearer token is as good as a password.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("refusing XOAUTH2 over an unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	tok, err := a.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + tok + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// On failure the server sends a JSON status as a challenge; surface it
+		// (net/smtp then cancels the exchange with "*").
+		a.tokens.invalidate()
+		return nil, fmt.Errorf("XOAUTH2 rejected: %s", strings.TrimSpace(string(fromServer)))
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// oauthTokenSource hands out access tokens, refreshing them as needed.
+type oauthTokenSource struct {
+	static       string
+	clientID     string
+	clientSecret string
+	refreshToken string
+	tokenURL     string
+	client       *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// oauthSources caches token sources per refresh token, because a MailConfig
+// (and therefore a Sender) is rebuilt for every request.
+var (
+	oauthSourcesMu sync.Mutex
+	oauthSources   = map[string]*oauthTokenSource{}
+)
+
+func oauthTokenSourceFor(c MailConfig) *oauthTokenSource {
+	if c.OAuthAccessToken != "" {
+		return &oauthTokenSource{static: c.OAuthAccessToken}
+	}
+	tokenURL := c.OAuthTokenURL
+	if tokenURL == "" {
+		tokenURL = defaultOAuthTokenURL
+	}
+	key := tokenURL + "\x00" + c.OAuthClientID + "\x00" + c.OAuthRefreshToken
+	oauthSourcesMu.Lock()
+	defer oauthSourcesMu.Unlock()
+	if s, ok := oauthSources[key]; ok {
+		return s
+	}
+	s := &oauthTokenSource{
+		clientID:     c.OAuthClientID,
+		clientSecret: c.OAuthClientSecret,
+		refreshToken: c.OAuthRefreshToken,
+		tokenURL:     tokenURL,
+		client:       &http.Client{Timeout: 20 * time.Second},
+	}
+	oauthSources[key] = s
+	return s
+}
+
+// Token returns a valid access token.
+func (s *oauthTokenSource) Token() (string, error) {
+	if s.static != "" {
+		return s.static, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.expiry) {
+		return s.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {s.clientID},
+		"client_secret": {s.clientSecret},
+		"refresh_token": {s.refreshToken},
+	}
+	resp, err := s.client.PostForm(s.tokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("refresh OAuth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("read OAuth2 token response: %w", err)
+	}
+	var tr struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", fmt.Errorf("decode OAuth2 token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		if tr.Error != "" {
+			return "", fmt.Errorf("OAuth2 token refresh failed: %s %s", tr.Error, tr.ErrorDescription)
+		}
+		return "", fmt.Errorf("OAuth2 token refresh failed with status %d", resp.StatusCode)
+	}
+
+	lifetime := time.Duration(tr.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = time.Hour
+	}
+	s.token = tr.AccessToken
+	// Refresh a minute early so a token never expires mid-session.
+	s.expiry = time.Now().Add(lifetime - time.Minute)
+	return s.token, nil
+}
+
+// invalidate drops a cached token the server rejected, so the next send
+// fetches a fresh one.
+func (s *oauthTokenSource) invalidate() {
+	if s.static != "" {
+		return
+	}
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
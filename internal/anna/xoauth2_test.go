@@ -0,0 +1,109 @@
+package anna
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestXOAuth2_StaticToken(t *testing.T) {
+	srv := newFakeSMTP(t)
+	srv.StartTLS = true
+	port := srv.start()
+
+	mail := MailConfig{
+		Host: "127.0.0.1", Port: port, User: "reader@gmail.com", FromEmail: "reader@gmail.com",
+		Auth: AuthXOAuth2, OAuthAccessToken: "ya29.static",
+	}
+	sender, err := NewSender(mail)
+	if err != nil {
+		t.Fatalf("NewSender: %v", err)
+	}
+	sender.(*SMTPSender).TLSConfig = srv.clientTLS()
+	if err := sender.Send(testEnvelope(), strings.NewReader("x\r\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	want := "XOAUTH2 user=reader@gmail.com\x01auth=Bearer ya29.static\x01\x01"
+	if len(srv.authSeen) != 1 || srv.authSeen[0] != want {
+		t.Fatalf("AUTH = %q, want %q", srv.authSeen, want)
+	}
+}
+
+func TestXOAuth2_RefreshesAndCachesToken(t *testing.T) {
+	var refreshes atomic.Int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "1//refresh" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		refreshes.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"ya29.fresh","expires_in":3599,"token_type":"Bearer"}`))
+	}))
+	defer tokenSrv.Close()
+
+	srv := newFakeSMTP(t)
+	srv.StartTLS = true
+	port := srv.start()
+
+	mail := MailConfig{
+		Host: "127.0.0.1", Port: port, User: "reader@gmail.com", FromEmail: "reader@gmail.com",
+		Auth: AuthXOAuth2, OAuthClientID: "cid", OAuthClientSecret: "secret",
+		OAuthRefreshToken: "1//refresh", OAuthTokenURL: tokenSrv.URL,
+	}
+	for i := 0; i < 2; i++ {
+		sender, err := NewSender(mail)
+		if err != nil {
+			t.Fatalf("NewSender: %v", err)
+		}
+		sender.(*SMTPSender).TLSConfig = srv.clientTLS()
+		if err := sender.Send(testEnvelope(), strings.NewReader("x\r\n")); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("expected the access token to be cached across sends, got %d refreshes", n)
+	}
+	if !strings.Contains(srv.authSeen[1], "auth=Bearer ya29.fresh") {
+		t.Errorf("expected the refreshed token in AUTH, got %q", srv.authSeen[1])
+	}
+}
+
+func TestXOAuth2_RejectedTokenSurfacesServerStatus(t *testing.T) {
+	srv := newFakeSMTP(t)
+	srv.StartTLS = true
+	srv.AcceptAuth = func(string, []byte) bool { return false }
+	port := srv.start()
+
+	sender, err := NewSender(MailConfig{
+		Host: "127.0.0.1", Port: port, User: "u@gmail.com", FromEmail: "u@gmail.com",
+		Auth: AuthXOAuth2, OAuthAccessToken: "expired",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.(*SMTPSender).TLSConfig = srv.clientTLS()
+	err = sender.Send(testEnvelope(), strings.NewReader("x\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "XOAUTH2 rejected") || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected an XOAUTH2 rejection carrying the server status, got %v", err)
+	}
+	if len(srv.sent()) != 0 {
+		t.Fatal("nothing may be sent after a failed AUTH")
+	}
+}
+
+func TestOAuthTokenSource_ErrorResponse(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`))
+	}))
+	defer tokenSrv.Close()
+
+	src := oauthTokenSourceFor(MailConfig{OAuthClientID: "c", OAuthRefreshToken: "revoked", OAuthTokenURL: tokenSrv.URL})
+	if _, err := src.Token(); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("expected invalid_grant error, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package bounce
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeIMAP is a local stand-in for Gmail's IMAP server: it serves a fixed
+// mailbox of recorded messages and understands exactly the commands the
+// watcher sends.
+type fakeIMAP struct {
+	t        *testing.T
+	User     string
+	Password string
+	Token    string // accepted XOAUTH2 bearer token
+
+	mu       sync.Mutex
+	messages map[uint32][]byte
+	seen     map[uint32]bool
+	fetches  int
+}
+
+func newFakeIMAP(t *testing.T, user, password string) *fakeIMAP {
+	return &fakeIMAP{t: t, User: user, Password: password, messages: map[uint32][]byte{}, seen: map[uint32]bool{}}
+}
+
+func (s *fakeIMAP) add(uid uint32, raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[uid] = raw
+}
+
+func (s *fakeIMAP) isSeen(uid uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seen[uid]
+}
+
+// start listens on 127.0.0.1 and returns the port.
+func (s *fakeIMAP) start() string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func (s *fakeIMAP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+	reply("* OK fake IMAP ready")
+	authed := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+		if len(fields) < 2 {
+			continue
+		}
+		tag, cmd := fields[0], strings.ToUpper(fields[1])
+		args := fields[2:]
+		if cmd == "UID" && len(args) > 0 {
+			cmd += " " + strings.ToUpper(args[0])
+			args = args[1:]
+		}
+		switch {
+		case cmd == "LOGIN":
+			if len(args) == 2 && unquote(args[0]) == s.User && unquote(args[1]) == s.Password {
+				authed = true
+				reply("%s OK LOGIN completed", tag)
+			} else {
+				reply("%s NO [AUTHENTICATIONFAILED] Invalid credentials", tag)
+			}
+		case cmd == "AUTHENTICATE":
+			ir, _ := base64.StdEncoding.DecodeString(args[len(args)-1])
+			if s.Token != "" && string(ir) == "user="+s.User+"\x01auth=Bearer "+s.Token+"\x01\x01" {
+				authed = true
+				reply("%s OK AUTHENTICATE completed", tag)
+			} else {
+				reply("+ eyJzdGF0dXMiOiI0MDAifQ==")
+				r.ReadString('\n')
+				reply("%s NO [AUTHENTICATIONFAILED] Invalid credentials", tag)
+			}
+		case !authed && cmd != "LOGOUT":
+			reply("%s BAD not authenticated", tag)
+		case cmd == "SELECT":
+			s.mu.Lock()
+			reply("* %d EXISTS", len(s.messages))
+			s.mu.Unlock()
+			reply("%s OK [READ-WRITE] SELECT completed", tag)
+		case cmd == "UID SEARCH":
+			s.mu.Lock()
+			var uids []string
+			for uid := uint32(1); uid <= 100; uid++ {
+				if _, ok := s.messages[uid]; ok && !s.seen[uid] {
+					uids = append(uids, strconv.Itoa(int(uid)))
+				}
+			}
+			s.mu.Unlock()
+			reply("* SEARCH %s", strings.Join(uids, " "))
+			reply("%s OK SEARCH completed", tag)
+		case cmd == "UID FETCH":
+			uid, _ := strconv.Atoi(args[0])
+			s.mu.Lock()
+			raw, ok := s.messages[uint32(uid)]
+			s.fetches++
+			s.mu.Unlock()
+			if ok {
+				fmt.Fprintf(w, "* %d FETCH (UID %d BODY[] {%d}\r\n", uid, uid, len(raw))
+				w.Write(raw)
+				reply(")")
+			}
+			reply("%s OK FETCH completed", tag)
+		case cmd == "UID STORE":
+			uid, _ := strconv.Atoi(args[0])
+			s.mu.Lock()
+			s.seen[uint32(uid)] = true
+			s.mu.Unlock()
+			reply("%s OK STORE completed", tag)
+		case cmd == "LOGOUT":
+			reply("* BYE")
+			reply("%s OK LOGOUT completed", tag)
+			return
+		default:
+			reply("%s BAD unknown command", tag)
+		}
+	}
+}
+
+func unquote(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s
+}
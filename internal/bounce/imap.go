@@ -0,0 +1,219 @@
+package bounce
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is just enough IMAP4rev1 (RFC 3501) to read a mailbox: LOGIN or
+// AUTHENTICATE XOAUTH2, SELECT, UID SEARCH, UID FETCH BODY.PEEK[] and
+// UID STORE. A full client library would be a large dependency for four
+// commands against one well-behaved server (Gmail).
+
+const imapTimeout = 2 * time.Minute
+
+// imapClient is a single IMAP connection.
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is one untagged response line; literals ({n} byte blocks)
+// are collected in order.
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// dialIMAP connects and reads the server greeting.
+func dialIMAP(cfg Config) (*imapClient, error) {
+	addr := net.JoinHostPort(cfg.Host, cfg.port())
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if cfg.security() == SecurityTLS {
+		tlsCfg := cfg.TLSConfig
+		if tlsCfg == nil {
+			tlsCfg = &tls.Config{ServerName: cfg.Host}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsCfg)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to IMAP server %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read IMAP greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", greeting)
+	}
+	return c, nil
+}
+
+func (c *imapClient) Close() error { return c.conn.Close() }
+
+func (c *imapClient) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// literalSize returns n if line ends with an IMAP literal marker "{n}".
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[open+1:len(line)-1], "+"))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// cmd sends one tagged command and collects untagged responses until the
+// tagged completion. A NO or BAD completion is returned as an error.
+func (c *imapClient) cmd(format string, args ...any) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	if _, err := fmt.Fprintf(c.conn, "%s "+format+"\r\n", append([]any{tag}, args...)...); err != nil {
+		return nil, err
+	}
+	return c.readUntilTagged(tag)
+}
+
+func (c *imapClient) readUntilTagged(tag string) ([]imapResponse, error) {
+	var out []imapResponse
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			status := strings.TrimPrefix(line, tag+" ")
+			if strings.HasPrefix(status, "OK") {
+				return out, nil
+			}
+			return out, fmt.Errorf("IMAP: %s", status)
+		}
+		if strings.HasPrefix(line, "+") {
+			// Continuation during AUTHENTICATE: the server is reporting an
+			// error payload. Answer with an empty line so it sends the
+			// tagged NO.
+			if _, err := io.WriteString(c.conn, "\r\n"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		resp := imapResponse{line: line}
+		for {
+			n, ok := literalSize(line)
+			if !ok {
+				break
+			}
+			lit := make([]byte, n)
+			if _, err := io.ReadFull(c.r, lit); err != nil {
+				return nil, err
+			}
+			resp.literals = append(resp.literals, lit)
+			if line, err = c.readLine(); err != nil {
+				return nil, err
+			}
+			resp.line += " " + line
+		}
+		out = append(out, resp)
+	}
+}
+
+func (c *imapClient) login(user, password string) error {
+	_, err := c.cmd("LOGIN %s %s", quote(user), quote(password))
+	if err != nil {
+		return fmt.Errorf("IMAP login failed: %w", err)
+	}
+	return nil
+}
+
+// authXOAuth2 logs in with an OAuth2 access token (Gmail's XOAUTH2).
+func (c *imapClient) authXOAuth2(user, token string) error {
+	ir := base64.StdEncoding.EncodeToString([]byte("user=" + user + "\x01auth=Bearer " + token + "\x01\x01"))
+	if _, err := c.cmd("AUTHENTICATE XOAUTH2 %s", ir); err != nil {
+		return fmt.Errorf("IMAP XOAUTH2 login failed: %w", err)
+	}
+	return nil
+}
+
+func (c *imapClient) selectMailbox(name string) error {
+	if _, err := c.cmd("SELECT %s", quote(name)); err != nil {
+		return fmt.Errorf("select mailbox %q: %w", name, err)
+	}
+	return nil
+}
+
+// uidSearch runs UID SEARCH with the given criteria.
+func (c *imapClient) uidSearch(criteria string) ([]uint32, error) {
+	resps, err := c.cmd("UID SEARCH %s", criteria)
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, r := range resps {
+		if !strings.HasPrefix(r.line, "* SEARCH") {
+			continue
+		}
+		for _, f := range strings.Fields(strings.TrimPrefix(r.line, "* SEARCH")) {
+			if n, err := strconv.ParseUint(f, 10, 32); err == nil {
+				uids = append(uids, uint32(n))
+			}
+		}
+	}
+	return uids, nil
+}
+
+// fetchRaw returns the full RFC 5322 message without setting \Seen.
+func (c *imapClient) fetchRaw(uid uint32) ([]byte, error) {
+	resps, err := c.cmd("UID FETCH %d BODY.PEEK[]", uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range resps {
+		if strings.Contains(r.line, " FETCH ") && len(r.literals) > 0 {
+			return r.literals[0], nil
+		}
+	}
+	return nil, errors.New("IMAP: message body missing from FETCH response")
+}
+
+func (c *imapClient) markSeen(uid uint32) error {
+	_, err := c.cmd("UID STORE %d +FLAGS.SILENT (\\Seen)", uid)
+	return err
+}
+
+func (c *imapClient) logout() {
+	c.cmd("LOGOUT")
+}
+
+// quote renders s as an IMAP quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,232 @@
+package bounce
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Bounce is one rejection read out of the mailbox.
+type Bounce struct {
+	// MessageID of the original send, when the bounce quotes it.
+	MessageID string
+	// Title is the document name Amazon reports (usually our attachment
+	// filename), used when there is no Message-ID.
+	Title string
+	// Code is Amazon's error code (e.g. "E999"), if any.
+	Code string
+	// Reason is a one-line human-readable explanation.
+	Reason string
+}
+
+const docExts = `(?:epub|pdf|mobi|azw3?|docx?|rtf|txt|html?|jpe?g|png|gif|bmp)`
+
+var (
+	// Amazon's personal-document errors look like "E999 - Send to Kindle Internal Error".
+	kindleErrRe = regexp.MustCompile(`\b(E\d{3})\b(?:\s*[-–:]\s*([^\r\n]+))?`)
+	// A document name with an extension Send to Kindle accepts, alone on a
+	// (bulleted) line or in quotes.
+	docLineRe   = regexp.MustCompile(`(?i)^[*•\-–\s]*([^\s*•].*\.` + docExts + `)\s*$`)
+	docQuotedRe = regexp.MustCompile(`(?i)["'“‘]([^"'“”‘’\r\n]+\.` + docExts + `)["'”’]`)
+	msgIDRe     = regexp.MustCompile(`(?i)^message-id:\s*(<[^>\s]+>)`)
+	htmlTagRe   = regexp.MustCompile(`(?s)<[^>]*>`)
+	diagCodeRe  = regexp.MustCompile(`(?i)^diagnostic-code:\s*(?:smtp;\s*)?(.+)$`)
+)
+
+// Parse inspects one raw message. ok is false when it isn't a Kindle
+// rejection or a delivery-status bounce, which is most of the inbox.
+func Parse(raw []byte) (b *Bounce, ok bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	from := strings.ToLower(msg.Header.Get("From"))
+	subject := decodeHeader(msg.Header.Get("Subject"))
+	mediaType, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+
+	isDSN := mediaType == "multipart/report" ||
+		strings.Contains(from, "mailer-daemon") || strings.Contains(from, "postmaster")
+	isAmazon := strings.Contains(from, "amazon.") || strings.Contains(from, "kindle")
+	if !isDSN && !isAmazon {
+		return nil, false
+	}
+
+	var texts []string
+	var quotedIDs []string
+	walkParts(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body, &texts, &quotedIDs)
+	text := strings.Join(texts, "\n")
+
+	b = &Bounce{}
+	// The original Message-ID: quoted headers of the returned message first,
+	// then threading headers (Amazon replies in-thread on some accounts).
+	if len(quotedIDs) > 0 {
+		b.MessageID = quotedIDs[0]
+	} else if id := firstMessageID(msg.Header.Get("In-Reply-To")); id != "" {
+		b.MessageID = id
+	} else if id := firstMessageID(msg.Header.Get("References")); id != "" {
+		b.MessageID = id
+	}
+
+	if m := kindleErrRe.FindStringSubmatch(text); m != nil {
+		b.Code = m[1]
+		b.Reason = strings.TrimSpace(m[0])
+	}
+	if b.Reason == "" {
+		b.Reason = diagnosticCode(text)
+	}
+	if b.Title = documentName(text); b.Title == "" {
+		b.Title = documentName(subject)
+	}
+
+	if isAmazon && !isDSN && b.Code == "" && !looksLikeRejection(subject+"\n"+text) {
+		// Order confirmations, "document delivered" notices and marketing.
+		return nil, false
+	}
+	if b.Reason == "" {
+		b.Reason = strings.TrimSpace(subject)
+	}
+	if b.MessageID == "" && b.Title == "" {
+		return nil, false
+	}
+	return b, true
+}
+
+// walkParts collects the human-readable text of a message and any
+// Message-IDs found in returned message headers (message/rfc822 or
+// text/rfc822-headers parts).
+func walkParts(contentType, cte string, body io.Reader, texts, ids *[]string) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	body = decodeTransfer(cte, body)
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			walkParts(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p, texts, ids)
+		}
+	case mediaType == "message/rfc822" || mediaType == "text/rfc822-headers" || mediaType == "message/rfc822-headers":
+		data, _ := io.ReadAll(io.LimitReader(body, 1<<20))
+		if id := quotedMessageID(data); id != "" {
+			*ids = append(*ids, id)
+		}
+	case mediaType == "message/delivery-status":
+		data, _ := io.ReadAll(io.LimitReader(body, 1<<20))
+		*texts = append(*texts, string(data))
+	case mediaType == "text/plain":
+		data, _ := io.ReadAll(io.LimitReader(body, 1<<20))
+		*texts = append(*texts, string(data))
+		// Some mailers inline the returned headers in the text part.
+		if id := quotedMessageID(data); id != "" {
+			*ids = append(*ids, id)
+		}
+	case mediaType == "text/html":
+		data, _ := io.ReadAll(io.LimitReader(body, 1<<20))
+		s := strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n", "</li>", "\n", "</div>", "\n", "</tr>", "\n").Replace(string(data))
+		*texts = append(*texts, html.UnescapeString(htmlTagRe.ReplaceAllString(s, "")))
+	}
+}
+
+func decodeTransfer(cte string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// newlineStripper drops CR and LF so base64.NewDecoder sees one long run.
+type newlineStripper struct{ r io.Reader }
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		j := 0
+		for _, c := range p[:n] {
+			if c != '\r' && c != '\n' {
+				p[j] = c
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+func quotedMessageID(headers []byte) string {
+	sc := bufio.NewScanner(bytes.NewReader(headers))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			break // end of the returned headers
+		}
+		if m := msgIDRe.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+func firstMessageID(s string) string {
+	if i := strings.IndexByte(s, '<'); i >= 0 {
+		if j := strings.IndexByte(s[i:], '>'); j > 0 {
+			return s[i : i+j+1]
+		}
+	}
+	return ""
+}
+
+func diagnosticCode(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if m := diagCodeRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			return strings.TrimSpace(m[1])
+		}
+	}
+	return ""
+}
+
+func documentName(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if m := docLineRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			return strings.TrimSpace(m[1])
+		}
+	}
+	if m := docQuotedRe.FindStringSubmatch(text); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
+
+func looksLikeRejection(s string) bool {
+	s = strings.ToLower(s)
+	for _, k := range []string{"couldn't deliver", "could not deliver", "unable to deliver", "could not be delivered", "problem converting", "couldn't convert", "could not convert", "not delivered", "failed"} {
+		if strings.Contains(s, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeHeader(s string) string {
+	if d, err := new(mime.WordDecoder).DecodeHeader(s); err == nil {
+		return d
+	}
+	return s
+}
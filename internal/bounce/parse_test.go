@@ -0,0 +1,49 @@
+package bounce
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParse_Fixtures(t *testing.T) {
+	cases := []struct {
+		file string
+		ok   bool
+		want Bounce
+	}{
+		{"amazon_e999.eml", true, Bounce{Title: "The Deal.epub", Code: "E999", Reason: "E999 - Send to Kindle Internal Error"}},
+		{"amazon_inreplyto.eml", true, Bounce{MessageID: "<5f2c9e7d1a@example.com>", Title: "Dune (Part 1 of 2).pdf", Code: "E009", Reason: "E009 - The document is password protected."}},
+		{"gmail_dsn.eml", true, Bounce{MessageID: "<a1b2c3d4e5@example.com>", Reason: "550 5.1.1 Requested action not taken: mailbox unavailable"}},
+		{"amazon_order.eml", false, Bounce{}},
+		{"newsletter.eml", false, Bounce{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.file, func(t *testing.T) {
+			b, ok := Parse(readFixture(t, tc.file))
+			if ok != tc.ok {
+				t.Fatalf("ok = %v, want %v (%+v)", ok, tc.ok, b)
+			}
+			if ok && *b != tc.want {
+				t.Errorf("got  %+v\nwant %+v", *b, tc.want)
+			}
+		})
+	}
+}
+
+func TestParse_Garbage(t *testing.T) {
+	for _, raw := range []string{"", "not a message", "From: mailer-daemon@x\r\n\r\nno ids here\r\n"} {
+		if b, ok := Parse([]byte(raw)); ok {
+			t.Errorf("Parse(%q) = %+v, want not ok", raw, b)
+		}
+	}
+}
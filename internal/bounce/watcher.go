@@ -0,0 +1,222 @@
+// Package bounce watches the FROM_EMAIL mailbox for Amazon's Send-to-Kindle
+// rejections. Amazon accepts our SMTP message and then, sometimes hours
+// later, emails back "We couldn't deliver..." (E999 and friends) — to an
+// inbox nobody reads. The watcher polls that mailbox over IMAP, parses each
+// rejection, ties it to the original send in the send log (internal/sendlog)
+// and flips that send to "failed" with Amazon's reason.
+package bounce
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"github.com/sam-hartman/kindle-pibrarian/internal/sendlog"
+	"go.uber.org/zap"
+)
+
+// IMAP connection security (IMAP_SECURITY).
+const (
+	SecurityTLS   = "tls"   // implicit TLS (port 993, Gmail)
+	SecurityPlain = "plain" // no TLS; only for a local stand-in
+)
+
+// searchCriteria limits the scan to unread mail that could be a rejection.
+// Handled bounces are marked \Seen so each is processed once.
+const searchCriteria = `UNSEEN OR OR FROM "amazon" FROM "mailer-daemon" FROM "postmaster"`
+
+// Config says how to reach the mailbox.
+type Config struct {
+	Host     string
+	Port     string // default 993
+	Security string // tls (default) or plain
+	User     string
+	Password string
+	// Token, when set, supplies an OAuth2 access token and XOAUTH2 is used
+	// instead of LOGIN.
+	Token     func() (string, error)
+	Mailbox   string // default INBOX
+	TLSConfig *tls.Config
+}
+
+func (c Config) port() string {
+	if c.Port != "" {
+		return c.Port
+	}
+	if c.security() == SecurityPlain {
+		return "143"
+	}
+	return "993"
+}
+
+func (c Config) security() string {
+	if s := strings.ToLower(strings.TrimSpace(c.Security)); s != "" {
+		return s
+	}
+	return SecurityTLS
+}
+
+func (c Config) mailbox() string {
+	if c.Mailbox != "" {
+		return c.Mailbox
+	}
+	return "INBOX"
+}
+
+// Validate reports whether the config is complete enough to connect.
+func (c Config) Validate() error {
+	if c.Host == "" || c.User == "" {
+		return errors.New("bounce watcher needs IMAP_HOST and IMAP_USER (or SMTP_USER)")
+	}
+	if c.Token == nil && c.Password == "" {
+		return errors.New("bounce watcher needs IMAP_PASSWORD (or SMTP_PASSWORD) or XOAUTH2")
+	}
+	switch c.security() {
+	case SecurityTLS, SecurityPlain:
+	default:
+		return fmt.Errorf("unknown IMAP_SECURITY %q (want tls or plain)", c.Security)
+	}
+	return nil
+}
+
+// Result summarizes one poll.
+type Result struct {
+	Scanned   int              // candidate messages fetched
+	Bounces   int              // of those, recognised as rejections
+	Failed    []sendlog.Record // sends flipped to failed
+	Unmatched []Bounce         // rejections with no matching send
+}
+
+// Watcher polls one mailbox and records rejections in a send log.
+type Watcher struct {
+	Config Config
+	Log    *sendlog.Log
+
+	mu sync.Mutex
+	// ignored holds UIDs already fetched that weren't rejections, so they
+	// aren't downloaded again on every poll. (They stay unread for the human.)
+	// Only UIDs the latest search returned are kept.
+	ignored map[uint32]bool
+}
+
+// NewWatcher returns a watcher for cfg that updates log.
+func NewWatcher(cfg Config, log *sendlog.Log) *Watcher {
+	return &Watcher{Config: cfg, Log: log, ignored: map[uint32]bool{}}
+}
+
+// Poll connects once, processes every unread candidate message and returns
+// what it found.
+func (w *Watcher) Poll(ctx context.Context) (*Result, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	l := logger.GetLogger()
+
+	if err := w.Config.Validate(); err != nil {
+		return nil, err
+	}
+	c, err := dialIMAP(w.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	defer c.logout()
+
+	if w.Config.Token != nil {
+		tok, err := w.Config.Token()
+		if err != nil {
+			return nil, fmt.Errorf("get IMAP OAuth2 token: %w", err)
+		}
+		err = c.authXOAuth2(w.Config.User, tok)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := c.login(w.Config.User, w.Config.Password); err != nil {
+		return nil, err
+	}
+	if err := c.selectMailbox(w.Config.mailbox()); err != nil {
+		return nil, err
+	}
+	uids, err := c.uidSearch(searchCriteria)
+	if err != nil {
+		return nil, fmt.Errorf("search mailbox: %w", err)
+	}
+	// Forget the ignored messages that have been read or deleted since.
+	still := make(map[uint32]bool, len(w.ignored))
+	for _, uid := range uids {
+		if w.ignored[uid] {
+			still[uid] = true
+		}
+	}
+	w.ignored = still
+
+	res := &Result{}
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		if w.ignored[uid] {
+			continue
+		}
+		raw, err := c.fetchRaw(uid)
+		if err != nil {
+			return res, fmt.Errorf("fetch message %d: %w", uid, err)
+		}
+		res.Scanned++
+		b, ok := Parse(raw)
+		if !ok {
+			w.ignored[uid] = true
+			continue
+		}
+		res.Bounces++
+
+		rec, err := w.Log.MarkFailed(sendlog.Match{MessageID: b.MessageID, Title: b.Title}, b.Reason)
+		switch {
+		case errors.Is(err, sendlog.ErrNotFound):
+			res.Unmatched = append(res.Unmatched, *b)
+			l.Warn("Kindle rejection did not match any logged send",
+				zap.String("title", b.Title),
+				zap.String("message_id", b.MessageID),
+				zap.String("reason", b.Reason),
+			)
+		case err != nil:
+			return res, err
+		default:
+			res.Failed = append(res.Failed, *rec)
+			l.Error("Kindle rejected a delivered book",
+				zap.String("filename", rec.Filename),
+				zap.String("kindle_email", rec.To),
+				zap.String("message_id", rec.MessageID),
+				zap.String("reason", rec.Reason),
+			)
+		}
+		// Handled either way; don't parse it again next poll.
+		if err := c.markSeen(uid); err != nil {
+			l.Warn("Could not mark bounce as read", zap.Uint32("uid", uid), zap.Error(err))
+			w.ignored[uid] = true
+		}
+	}
+	return res, nil
+}
+
+// Run polls every interval until ctx is done. Errors are logged and the
+// next poll tries again.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	l := logger.GetLogger()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := w.Poll(ctx); err != nil && ctx.Err() == nil {
+			l.Warn("Bounce watcher poll failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
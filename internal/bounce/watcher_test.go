@@ -0,0 +1,112 @@
+package bounce
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/sendlog"
+)
+
+func newTestLog(t *testing.T) *sendlog.Log {
+	t.Helper()
+	log, err := sendlog.Open(filepath.Join(t.TempDir(), "sends.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+func TestWatcher_MarksBouncedSendsFailed(t *testing.T) {
+	srv := newFakeIMAP(t, "reader@example.com", "app-password")
+	srv.add(1, readFixture(t, "newsletter.eml"))
+	srv.add(2, readFixture(t, "amazon_e999.eml"))
+	srv.add(3, readFixture(t, "gmail_dsn.eml"))
+	srv.add(4, readFixture(t, "amazon_inreplyto.eml"))
+	port := srv.start()
+
+	log := newTestLog(t)
+	log.Add(sendlog.Record{MessageID: "<77@example.com>", To: "reader_x@kindle.com", Filename: "The Deal.epub"})
+	log.Add(sendlog.Record{MessageID: "<a1b2c3d4e5@example.com>", To: "typo_kindle@kindle.com", Filename: "The Hobbit.epub"})
+	log.Add(sendlog.Record{MessageID: "<fine@example.com>", To: "reader_x@kindle.com", Filename: "Emma.epub"})
+
+	w := NewWatcher(Config{Host: "127.0.0.1", Port: port, Security: SecurityPlain, User: "reader@example.com", Password: "app-password"}, log)
+	res, err := w.Poll(context.Background())
+	if err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+	if res.Scanned != 4 || res.Bounces != 3 || len(res.Failed) != 2 || len(res.Unmatched) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	records, _ := log.List()
+	byFile := map[string]sendlog.Record{}
+	for _, r := range records {
+		byFile[r.Filename] = r
+	}
+	if r := byFile["The Deal.epub"]; r.Status != sendlog.StatusFailed || !strings.Contains(r.Reason, "E999") {
+		t.Errorf("title-matched send not failed: %+v", r)
+	}
+	if r := byFile["The Hobbit.epub"]; r.Status != sendlog.StatusFailed || !strings.Contains(r.Reason, "550 5.1.1") {
+		t.Errorf("Message-ID-matched send not failed: %+v", r)
+	}
+	if r := byFile["Emma.epub"]; r.Status != sendlog.StatusSent {
+		t.Errorf("unrelated send touched: %+v", r)
+	}
+
+	// Rejections are marked read; the human's newsletter is left alone.
+	for uid, want := range map[uint32]bool{1: false, 2: true, 3: true, 4: true} {
+		if got := srv.isSeen(uid); got != want {
+			t.Errorf("uid %d seen = %v, want %v", uid, got, want)
+		}
+	}
+
+	// A second poll neither refetches the ignored newsletter nor reprocesses.
+	before := srv.fetches
+	res, err = w.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 0 || srv.fetches != before {
+		t.Fatalf("second poll should be a no-op, got %+v (fetches %d -> %d)", res, before, srv.fetches)
+	}
+
+	// Once the human reads the newsletter, the watcher forgets it.
+	srv.mu.Lock()
+	srv.seen[1] = true
+	srv.mu.Unlock()
+	if _, err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.ignored) != 0 {
+		t.Fatalf("ignored UIDs should be dropped once they leave the search, got %v", w.ignored)
+	}
+}
+
+func TestWatcher_XOAuth2(t *testing.T) {
+	srv := newFakeIMAP(t, "reader@example.com", "")
+	srv.Token = "ya29.token"
+	srv.add(1, readFixture(t, "amazon_e999.eml"))
+	port := srv.start()
+
+	cfg := Config{Host: "127.0.0.1", Port: port, Security: SecurityPlain, User: "reader@example.com",
+		Token: func() (string, error) { return "ya29.token", nil }}
+	if _, err := NewWatcher(cfg, newTestLog(t)).Poll(context.Background()); err != nil {
+		t.Fatalf("Poll with XOAUTH2: %v", err)
+	}
+
+	cfg.Token = func() (string, error) { return "expired", nil }
+	if _, err := NewWatcher(cfg, newTestLog(t)).Poll(context.Background()); err == nil || !strings.Contains(err.Error(), "AUTHENTICATIONFAILED") {
+		t.Fatalf("expected an auth failure, got %v", err)
+	}
+}
+
+func TestWatcher_BadPassword(t *testing.T) {
+	srv := newFakeIMAP(t, "reader@example.com", "right")
+	port := srv.start()
+	w := NewWatcher(Config{Host: "127.0.0.1", Port: port, Security: SecurityPlain, User: "reader@example.com", Password: "wrong"}, newTestLog(t))
+	if _, err := w.Poll(context.Background()); err == nil || !strings.Contains(err.Error(), "login failed") {
+		t.Fatalf("expected a login failure, got %v", err)
+	}
+}
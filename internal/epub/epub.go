@@ -0,0 +1,253 @@
+// Package epub writes EPUB books from scratch. Everything else in this
+// repository rewrites EPUBs that already exist (see anna.SanitizeEPUB);
+// article capture, text conversion, digests and sample extracts need to make
+// new ones, from chapters of XHTML or Markdown, images, stylesheets and
+// metadata. Converters whose documents are already XHTML of their own lay
+// them out in a Package instead.
+//
+// The output is an EPUB 3 package with an EPUB 2 NCX alongside the
+// navigation document, which older readers (and Amazon) still look at. The
+// mimetype entry comes first and is stored uncompressed, as the OCF spec
+// requires. Chapter markup is parsed leniently and written back as
+// well-formed XHTML, so whatever goes in, the book passes anna.ValidateEPUB
+// and anna.CheckEPUB.
+package epub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Metadata describes a book. Only Title is really needed; the rest is
+// written when set.
+type Metadata struct {
+	Title       string
+	Authors     []string
+	Translators []string
+	Language    string // a BCP 47 tag; "und" when empty
+	Identifier  string // e.g. "urn:isbn:9780140185852"; derived from the content when empty
+	Publisher   string
+	Date        string // publication date, e.g. "1920" or "1920-01-01"
+	Description string
+	Subjects    []string
+	Series      string
+	SeriesIndex string    // the book's number in Series, e.g. "2"
+	Modified    time.Time // dcterms:modified; the time of writing when zero
+}
+
+// Book is an EPUB being put together. Chapters are read in the order they
+// are added; they refer to images and stylesheets by the names those were
+// added under, e.g. <img src="map.png"/> or ![Map](map.png).
+type Book struct {
+	Metadata Metadata
+
+	chapters []*chapter
+	images   []*resource
+	styles   []*resource
+	cover    string
+}
+
+type chapter struct {
+	title string // the table of contents label; "" leaves it out
+	body  *html.Node
+	src   string
+}
+
+type resource struct {
+	name      string
+	mediaType string
+	data      []byte
+}
+
+var (
+	// ErrNoChapters is returned when writing a book without chapters.
+	ErrNoChapters = errors.New("epub: the book has no chapters")
+	// ErrUnsupportedImage is returned for images that aren't JPEG, PNG, GIF
+	// or SVG, the formats every EPUB reader displays.
+	ErrUnsupportedImage = errors.New("epub: unsupported image format")
+)
+
+// New starts a book.
+func New(meta Metadata) *Book {
+	return &Book{Metadata: meta}
+}
+
+// AddChapter adds a chapter of XHTML or HTML: a whole document or just the
+// content of its body. An empty title takes the chapter's first heading (or
+// a whole document's <title>) for the table of contents.
+func (b *Book) AddChapter(title, markup string) {
+	body, docTitle := parseChapter(markup)
+	if title == "" {
+		title = docTitle
+	}
+	if title == "" {
+		title = firstHeading(body)
+	}
+	b.chapters = append(b.chapters, &chapter{title: collapseSpace(title), body: body, src: markup})
+}
+
+// AddMarkdownChapter adds a chapter written in Markdown (see
+// RenderMarkdown).
+func (b *Book) AddMarkdownChapter(title, markdown string) {
+	b.AddChapter(title, RenderMarkdown(markdown))
+}
+
+// AddImage adds a JPEG, PNG, GIF or SVG image for chapters to show.
+func (b *Book) AddImage(name string, data []byte) error {
+	mediaType, err := imageType(name, data)
+	if err != nil {
+		return err
+	}
+	return b.addResource(&b.images, name, mediaType, data)
+}
+
+// SetCover adds an image and makes it the book's cover.
+func (b *Book) SetCover(name string, data []byte) error {
+	if err := b.AddImage(name, data); err != nil {
+		return err
+	}
+	b.cover = name
+	return nil
+}
+
+// AddStylesheet adds CSS that every chapter links to, in the order added.
+func (b *Book) AddStylesheet(name string, css []byte) error {
+	return b.addResource(&b.styles, name, "text/css", css)
+}
+
+var resourceNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (b *Book) addResource(list *[]*resource, name, mediaType string, data []byte) error {
+	if !resourceNameRe.MatchString(name) {
+		return fmt.Errorf("epub: %q is not a usable file name (letters, digits, '.', '_' and '-' only)", name)
+	}
+	if b.resource(name) != nil {
+		return fmt.Errorf("epub: %q was already added", name)
+	}
+	*list = append(*list, &resource{name: name, mediaType: mediaType, data: data})
+	return nil
+}
+
+func (b *Book) resource(name string) *resource {
+	for _, list := range [][]*resource{b.images, b.styles} {
+		for _, r := range list {
+			if r.name == name {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// imageType sniffs an image's media type; SVG, being XML, goes by its name.
+func imageType(name string, data []byte) (string, error) {
+	switch ct := http.DetectContentType(data); ct {
+	case "image/jpeg", "image/png", "image/gif":
+		return ct, nil
+	}
+	if strings.HasSuffix(strings.ToLower(name), ".svg") && bytes.Contains(data[:min(len(data), 1024)], []byte("<svg")) {
+		return "image/svg+xml", nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedImage, name)
+}
+
+// Bytes returns the book as an EPUB file.
+func (b *Book) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write writes the book to w as an EPUB file.
+func (b *Book) Write(w io.Writer) error {
+	if len(b.chapters) == 0 {
+		return ErrNoChapters
+	}
+	m := b.Metadata
+	if m.Title = collapseSpace(m.Title); m.Title == "" {
+		m.Title = "Untitled"
+	}
+	if m.Language = strings.TrimSpace(m.Language); m.Language == "" {
+		m.Language = "und"
+	}
+
+	p := &Package{Metadata: m}
+	for i, c := range b.chapters {
+		docPath := fmt.Sprintf("OEBPS/Text/chapter%04d.xhtml", i+1)
+		doc, props := b.chapterXHTML(c, m)
+		p.AddDocument(docPath, doc, props)
+		if c.title != "" {
+			p.TOC = append(p.TOC, NavPoint{Label: c.title, Path: docPath})
+		}
+	}
+	for _, r := range b.images {
+		p.AddFile("OEBPS/Images/"+r.name, r.mediaType, r.data)
+	}
+	if b.cover != "" {
+		p.Cover = "OEBPS/Images/" + b.cover
+	}
+	for _, r := range b.styles {
+		p.AddFile("OEBPS/Styles/"+r.name, r.mediaType, r.data)
+	}
+	return p.Write(w)
+}
+
+// chapterXHTML writes a chapter as an XHTML file, returning the manifest
+// properties its content calls for.
+func (b *Book) chapterXHTML(c *chapter, m Metadata) ([]byte, string) {
+	title := c.title
+	if title == "" {
+		title = m.Title
+	}
+	x := &xhtmlWriter{resolve: b.chapterHref}
+	var body strings.Builder
+	x.b = &body
+	for n := c.body.FirstChild; n != nil; n = n.NextSibling {
+		x.node(n, "")
+	}
+
+	var out strings.Builder
+	out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<!DOCTYPE html>\n")
+	fmt.Fprintf(&out, `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="%s" xml:lang="%s">`+"\n",
+		escapeAttr(m.Language), escapeAttr(m.Language))
+	fmt.Fprintf(&out, "<head>\n<title>%s</title>\n", escapeText(title))
+	for _, s := range b.styles {
+		fmt.Fprintf(&out, "<link rel=\"stylesheet\" type=\"text/css\" href=\"../Styles/%s\"/>\n", s.name)
+	}
+	out.WriteString("</head>\n<body>\n")
+	out.WriteString(strings.TrimSpace(body.String()))
+	out.WriteString("\n</body>\n</html>\n")
+	return []byte(out.String()), x.properties()
+}
+
+// chapterHref points a chapter's reference to an added image or stylesheet
+// at where that file is in the book.
+func (b *Book) chapterHref(ref string) string {
+	name, frag, _ := strings.Cut(strings.TrimPrefix(ref, "./"), "#")
+	r := b.resource(name)
+	if r == nil {
+		return ref
+	}
+	dir := "../Images/"
+	if r.mediaType == "text/css" {
+		dir = "../Styles/"
+	}
+	if frag != "" {
+		return dir + name + "#" + frag
+	}
+	return dir + name
+}
+
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,284 @@
+package epub_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/anna"
+	"github.com/sam-hartman/kindle-pibrarian/internal/epub"
+)
+
+func tinyPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readEntry(t *testing.T, data []byte, name string) string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// sampleBook has a sloppy HTML chapter, a whole XHTML document, a Markdown
+// chapter, a cover, an image and a stylesheet.
+func sampleBook(t *testing.T) *epub.Book {
+	t.Helper()
+	b := epub.New(epub.Metadata{
+		Title:       "  The   Sample ",
+		Authors:     []string{"Ada Lovelace", " "},
+		Language:    "en",
+		Publisher:   "Self",
+		Date:        "2024-05-01",
+		Description: "A book <made> from scratch & tested.",
+		Subjects:    []string{"Testing"},
+		Series:      "Samples",
+		SeriesIndex: "2",
+		Modified:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	})
+	if err := b.SetCover("cover.png", tinyPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddImage("map.png", tinyPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddStylesheet("book.css", []byte("p { text-indent: 1em }")); err != nil {
+		t.Fatal(err)
+	}
+	b.AddChapter("", `<h1>Opening</h1><p>Unclosed &nbsp;paragraph<br><p onclick="x()">Second <img src="map.png"> <a href="javascript:alert(1)">link</a>
+<script>alert("no")</script><o:p>Word junk</o:p><span epub:type="noteref">1</span>
+<svg viewBox="0 0 10 10"><image xlink:href="map.png" width="10" height="10"/></svg>`)
+	b.AddChapter("", `<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"><head><title>Second Part</title></head>
+<body><p>Body text.</p></body></html>`)
+	b.AddMarkdownChapter("Notes", "Some *notes* with a ![map](map.png) and \x0c a form feed.")
+	return b
+}
+
+func TestBook(t *testing.T) {
+	out, err := sampleBook(t).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := anna.ValidateEPUB(out); err != nil {
+		t.Fatalf("written EPUB does not validate: %v", err)
+	}
+	if r := anna.CheckEPUB(out); len(r.Findings) != 0 || r.Version != "3.0" {
+		t.Errorf("written EPUB should check clean:\n%s", r)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := zr.File[0]; f.Name != "mimetype" || f.Method != zip.Store || len(f.Extra) != 0 {
+		t.Errorf("first entry is %s (method %d), want mimetype stored", f.Name, f.Method)
+	}
+	if !bytes.HasPrefix(out[30:], []byte("mimetypeapplication/epub+zip")) {
+		t.Error("mimetype should be readable at a fixed offset, as the OCF spec requires")
+	}
+
+	opf := readEntry(t, out, "OEBPS/content.opf")
+	for _, want := range []string{
+		`<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">`,
+		"<dc:title>The Sample</dc:title>",
+		"<dc:creator>Ada Lovelace</dc:creator>",
+		"<dc:language>en</dc:language>",
+		"<dc:description>A book &lt;made&gt; from scratch &amp; tested.</dc:description>",
+		"<dc:subject>Testing</dc:subject>",
+		`<meta property="dcterms:modified">2024-05-01T12:00:00Z</meta>`,
+		`<meta name="cover" content="cover-image"/>`,
+		`<meta refines="#series" property="group-position">2</meta>`,
+		`<item id="cover-image" href="Images/cover.png" media-type="image/png" properties="cover-image"/>`,
+		`<item id="chapter0001" href="Text/chapter0001.xhtml" media-type="application/xhtml+xml" properties="svg"/>`,
+		`<item id="style01" href="Styles/book.css" media-type="text/css"/>`,
+		`<spine toc="ncx">`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("OPF lacks %s:\n%s", want, opf)
+		}
+	}
+	if strings.Count(opf, "<dc:creator>") != 1 {
+		t.Errorf("blank authors should be left out:\n%s", opf)
+	}
+
+	ch1 := readEntry(t, out, "OEBPS/Text/chapter0001.xhtml")
+	for _, want := range []string{
+		`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en" xml:lang="en">`,
+		`<link rel="stylesheet" type="text/css" href="../Styles/book.css"/>`,
+		"<title>Opening</title>",
+		"<p>Unclosed \u00a0paragraph<br/></p>",
+		`<p>Second <img src="../Images/map.png"/> <a>link</a>`,
+		"Word junk",
+		`<span epub:type="noteref">1</span>`,
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><image xmlns:xlink="http://www.w3.org/1999/xlink" xlink:href="../Images/map.png" width="10" height="10"/></svg>`,
+	} {
+		if !strings.Contains(ch1, want) {
+			t.Errorf("chapter 1 lacks %s:\n%s", want, ch1)
+		}
+	}
+	for _, unwanted := range []string{"script", "alert", "onclick", "o:p"} {
+		if strings.Contains(ch1, unwanted) {
+			t.Errorf("chapter 1 should not contain %s:\n%s", unwanted, ch1)
+		}
+	}
+	if ch2 := readEntry(t, out, "OEBPS/Text/chapter0002.xhtml"); !strings.Contains(ch2, "<body>\n<p>Body text.</p>\n</body>") {
+		t.Errorf("a whole document should keep just its body:\n%s", ch2)
+	}
+	if ch3 := readEntry(t, out, "OEBPS/Text/chapter0003.xhtml"); !strings.Contains(ch3, `<p>Some <em>notes</em> with a <img src="../Images/map.png" alt="map"/> and  a form feed.</p>`) {
+		t.Errorf("markdown chapter:\n%s", ch3)
+	}
+
+	nav := readEntry(t, out, "OEBPS/nav.xhtml")
+	ncx := readEntry(t, out, "OEBPS/toc.ncx")
+	for i, label := range []string{"Opening", "Second Part", "Notes"} {
+		href := []string{"Text/chapter0001.xhtml", "Text/chapter0002.xhtml", "Text/chapter0003.xhtml"}[i]
+		if !strings.Contains(nav, `<li><a href="`+href+`">`+label+`</a></li>`) {
+			t.Errorf("nav lacks %s:\n%s", label, nav)
+		}
+		if !strings.Contains(ncx, `<navLabel><text>`+label+`</text></navLabel><content src="`+href+`"/>`) {
+			t.Errorf("NCX lacks %s:\n%s", label, ncx)
+		}
+	}
+}
+
+func TestBook_Defaults(t *testing.T) {
+	b := epub.New(epub.Metadata{})
+	b.AddChapter("", "plain text, no headings")
+	out, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := anna.CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("written EPUB should check clean:\n%s", r)
+	}
+	opf := readEntry(t, out, "OEBPS/content.opf")
+	if !strings.Contains(opf, "<dc:title>Untitled</dc:title>") || !strings.Contains(opf, "<dc:language>und</dc:language>") ||
+		!strings.Contains(opf, `<dc:identifier id="bookid">urn:uuid:`) {
+		t.Errorf("defaults:\n%s", opf)
+	}
+	if nav := readEntry(t, out, "OEBPS/nav.xhtml"); !strings.Contains(nav, `<a href="Text/chapter0001.xhtml">Untitled</a>`) {
+		t.Errorf("without headings the table of contents should hold the title:\n%s", nav)
+	}
+
+	// The same content gets the same identifier.
+	again := epub.New(epub.Metadata{})
+	again.AddChapter("", "plain text, no headings")
+	out2, err := again.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readEntry(t, out2, "OEBPS/toc.ncx") != readEntry(t, out, "OEBPS/toc.ncx") {
+		t.Error("the derived identifier should be stable")
+	}
+}
+
+func TestBook_Errors(t *testing.T) {
+	b := epub.New(epub.Metadata{Title: "Empty"})
+	if _, err := b.Bytes(); !errors.Is(err, epub.ErrNoChapters) {
+		t.Errorf("err = %v, want ErrNoChapters", err)
+	}
+	if err := b.AddImage("notes.png", []byte("not an image")); !errors.Is(err, epub.ErrUnsupportedImage) {
+		t.Errorf("err = %v, want ErrUnsupportedImage", err)
+	}
+	for _, name := range []string{"", "../x.png", "dir/x.png", "a b.png", ".hidden.png"} {
+		if err := b.AddImage(name, tinyPNG(t)); err == nil {
+			t.Errorf("%q: accepted", name)
+		}
+	}
+	if err := b.AddImage("x.png", tinyPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddStylesheet("x.png", nil); err == nil {
+		t.Error("a name already used should be refused")
+	}
+	if err := b.AddImage("logo.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`)); err != nil {
+		t.Errorf("SVG: %v", err)
+	}
+}
+
+func TestPackage(t *testing.T) {
+	doc := func(body string) []byte {
+		return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Part</title><link rel="stylesheet" type="text/css" href="../style.css"/></head>
+<body>` + body + `</body></html>
+`)
+	}
+	p := &epub.Package{Metadata: epub.Metadata{
+		Title:       "Laid Out",
+		Authors:     []string{"Ada Lovelace"},
+		Translators: []string{"Charles Babbage", ""},
+		Language:    "en",
+	}}
+	p.AddFile("OEBPS/style.css", "text/css", []byte("p { margin: 0 }"))
+	p.AddDocument("OEBPS/text/part 1.xhtml", doc(`<p><a href="part2.xhtml#n1">note</a></p>`), "")
+	p.AddDocument("OEBPS/text/part2.xhtml", doc(`<p id="n1"><img src="../images/cover.png" alt=""/></p>`), "")
+	p.AddFile("OEBPS/images/cover.png", "image/png", tinyPNG(t))
+	p.Cover = "OEBPS/images/cover.png"
+	p.TOC = []epub.NavPoint{{Label: "One", Path: "OEBPS/text/part 1.xhtml"}, {Label: "Note", Path: "OEBPS/text/part2.xhtml", Fragment: "n1"}}
+	p.Direction = "rtl"
+	p.Meta = []epub.Meta{{Property: "rendition:layout", Content: "pre-paginated"}, {Name: "book-type", Content: "comic"}}
+	out, err := p.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := anna.CheckEPUB(out); len(r.Findings) != 0 {
+		t.Errorf("written EPUB should check clean:\n%s", r)
+	}
+
+	opf := readEntry(t, out, "OEBPS/content.opf")
+	for _, want := range []string{
+		`<item id="chapter0001" href="text/part%201.xhtml" media-type="application/xhtml+xml"/>`,
+		`<item id="cover-image" href="images/cover.png" media-type="image/png" properties="cover-image"/>`,
+		`<item id="style01" href="style.css" media-type="text/css"/>`,
+		`<dc:contributor id="trl1">Charles Babbage</dc:contributor>`,
+		`<meta refines="#trl1" property="role" scheme="marc:relators">trl</meta>`,
+		"<itemref idref=\"chapter0001\"/>\n    <itemref idref=\"chapter0002\"/>",
+		`<spine toc="ncx" page-progression-direction="rtl">`,
+		`<meta property="rendition:layout">pre-paginated</meta>`,
+		`<meta name="book-type" content="comic"/>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("package document lacks %s:\n%s", want, opf)
+		}
+	}
+	if strings.Contains(opf, "trl2") {
+		t.Errorf("a blank translator should be left out:\n%s", opf)
+	}
+	if nav := readEntry(t, out, "OEBPS/nav.xhtml"); !strings.Contains(nav, `<a href="text/part2.xhtml#n1">Note</a>`) {
+		t.Errorf("nav:\n%s", nav)
+	}
+	if ncx := readEntry(t, out, "OEBPS/toc.ncx"); !strings.Contains(ncx, `<content src="text/part%201.xhtml"/>`) {
+		t.Errorf("ncx:\n%s", ncx)
+	}
+
+	p.AddFile("OEBPS/nav.xhtml", "application/xhtml+xml", nil)
+	if _, err := p.Bytes(); err == nil {
+		t.Error("a file over the navigation document should be refused")
+	}
+	if _, err := (&epub.Package{}).Bytes(); !errors.Is(err, epub.ErrNoChapters) {
+		t.Errorf("err = %v, want ErrNoChapters", err)
+	}
+}
@@ -0,0 +1,609 @@
+package epub
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RenderMarkdown converts Markdown to HTML for a chapter body. It covers
+// what books and notes written in Markdown use: ATX and setext headings,
+// paragraphs, emphasis, strong and ~~strikethrough~~, code spans and fenced
+// or indented code blocks, block quotes, nested lists, thematic breaks,
+// links and images (inline, reference-style and <autolinks>), hard line
+// breaks and raw HTML. Tables, footnotes and other extensions come out as
+// text. The result isn't necessarily well-formed XML (raw HTML passes
+// through); AddChapter takes care of that.
+func RenderMarkdown(src string) string {
+	src = strings.ReplaceAll(strings.ReplaceAll(src, "\r\n", "\n"), "\r", "\n")
+	lines := strings.Split(strings.TrimPrefix(src, "\ufeff"), "\n")
+	for i, l := range lines {
+		lines[i] = expandTabs(l)
+	}
+	p := &mdParser{refs: map[string]mdRef{}}
+	lines = p.collectRefs(lines)
+	var b strings.Builder
+	p.blocks(&b, lines, false)
+	return b.String()
+}
+
+type mdParser struct {
+	refs map[string]mdRef
+}
+
+// mdRef is a link reference definition: [label]: url "title".
+type mdRef struct{ url, title string }
+
+var (
+	mdRefDefRe    = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:\s*<?([^\s>]+)>?(?:\s+(?:"([^"]*)"|'([^']*)'|\(([^)]*)\)))?\s*$`)
+	mdFenceRe     = regexp.MustCompile("^ {0,3}(```+|~~~+)\\s*([^`\\s]*)")
+	mdHeadingRe   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdBreakRe     = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdSetextRe    = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdQuoteRe     = regexp.MustCompile(`^ {0,3}> ?`)
+	mdItemRe      = regexp.MustCompile(`^( {0,3})([-+*]|(\d{1,9})([.)]))( +|$)`)
+	mdHTMLBlockRe = regexp.MustCompile(`(?i)^ {0,3}<(?:/?(?:address|article|aside|blockquote|details|div|dl|dt|dd|fieldset|figcaption|figure|footer|form|h[1-6]|header|hr|li|main|nav|ol|p|pre|section|table|tbody|td|th|thead|tr|ul)(?:\s|/?>|$)|!--)`)
+	mdRawTagRe    = regexp.MustCompile(`^(?:<[A-Za-z][A-Za-z0-9-]*(?:\s+[A-Za-z_:][A-Za-z0-9_.:-]*(?:\s*=\s*(?:[^\s"'=<>` + "`" + `]+|'[^']*'|"[^"]*"))?)*\s*/?>|</[A-Za-z][A-Za-z0-9-]*\s*>|<!--[\s\S]*?-->)`)
+	mdAutolinkRe  = regexp.MustCompile(`^<((?:https?|ftp|mailto):[^\s<>]*)>`)
+	mdEmailRe     = regexp.MustCompile(`^<([A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)*)>`)
+	mdEntityRe    = regexp.MustCompile(`^&(?:[A-Za-z][A-Za-z0-9]{1,31}|#[0-9]{1,7}|#[xX][0-9A-Fa-f]{1,6});`)
+	mdLinkTitleRe = regexp.MustCompile(`^\s+(?:"([^"]*)"|'([^']*)'|\(([^)]*)\))\s*\)`)
+)
+
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	var b strings.Builder
+	col := 0
+	for _, r := range line {
+		if r == '\t' {
+			n := 4 - col%4
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteRune(r)
+		col++
+	}
+	return b.String()
+}
+
+func isBlank(line string) bool { return strings.TrimSpace(line) == "" }
+
+func indentOf(line string) int { return len(line) - len(strings.TrimLeft(line, " ")) }
+
+func refKey(label string) string { return strings.ToLower(collapseSpace(label)) }
+
+// collectRefs takes the link reference definitions out of the document,
+// outside code blocks, so links can use them before they are defined.
+func (p *mdParser) collectRefs(lines []string) []string {
+	var out []string
+	fence := ""
+	for i, l := range lines {
+		if fence != "" {
+			if strings.HasPrefix(strings.TrimSpace(l), fence) {
+				fence = ""
+			}
+			out = append(out, l)
+			continue
+		}
+		if m := mdFenceRe.FindStringSubmatch(l); m != nil {
+			fence = m[1]
+		} else if m := mdRefDefRe.FindStringSubmatch(l); m != nil && (i == 0 || isBlank(lines[i-1]) || mdRefDefRe.MatchString(lines[i-1])) {
+			if key := refKey(m[1]); key != "" {
+				if _, seen := p.refs[key]; !seen {
+					p.refs[key] = mdRef{url: m[2], title: m[3] + m[4] + m[5]}
+				}
+				continue
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// startsBlock reports whether line begins a block that interrupts a
+// paragraph.
+func startsBlock(line string) bool {
+	if mdFenceRe.MatchString(line) || mdBreakRe.MatchString(line) || mdQuoteRe.MatchString(line) || mdHTMLBlockRe.MatchString(line) {
+		return true
+	}
+	if mdHeadingRe.MatchString(line) {
+		return true
+	}
+	if m := mdItemRe.FindStringSubmatch(line); m != nil {
+		// Only a bullet or a list starting at 1 with some text interrupts.
+		return m[5] != "" && (m[3] == "" || m[3] == "1") && !isBlank(line[len(m[0]):])
+	}
+	return false
+}
+
+// blocks renders lines as block content. In a tight list item, paragraphs
+// are written without <p>.
+func (p *mdParser) blocks(b *strings.Builder, lines []string, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+
+		case mdFenceRe.MatchString(line):
+			m := mdFenceRe.FindStringSubmatch(line)
+			indent := indentOf(line)
+			i++
+			var code []string
+			for ; i < len(lines); i++ {
+				if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, m[1]) && strings.Trim(t, m[1][:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, strings.TrimPrefix(lines[i], strings.Repeat(" ", min(indent, indentOf(lines[i])))))
+			}
+			p.codeBlock(b, code, m[2])
+
+		case indentOf(line) >= 4:
+			var code []string
+			for ; i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			p.codeBlock(b, code, "")
+
+		case mdHeadingRe.MatchString(line):
+			m := mdHeadingRe.FindStringSubmatch(line)
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", len(m[1]), p.inline(strings.TrimSpace(m[2])), len(m[1]))
+			i++
+
+		case mdBreakRe.MatchString(line):
+			b.WriteString("<hr/>\n")
+			i++
+
+		case mdQuoteRe.MatchString(line):
+			var quote []string
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				if loc := mdQuoteRe.FindStringIndex(lines[i]); loc != nil {
+					quote = append(quote, lines[i][loc[1]:])
+				} else if len(quote) > 0 && !startsBlock(lines[i]) {
+					quote = append(quote, lines[i]) // a lazy continuation
+				} else {
+					break
+				}
+			}
+			b.WriteString("<blockquote>\n")
+			p.blocks(b, quote, false)
+			b.WriteString("</blockquote>\n")
+
+		case mdItemRe.MatchString(line):
+			i = p.list(b, lines, i)
+
+		case mdHTMLBlockRe.MatchString(line):
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				b.WriteString(lines[i] + "\n")
+			}
+
+		default:
+			para := []string{strings.TrimLeft(line, " ")}
+			level := 0
+			for i++; i < len(lines) && !isBlank(lines[i]); i++ {
+				if m := mdSetextRe.FindStringSubmatch(lines[i]); m != nil {
+					level = 1
+					if m[1][0] == '-' {
+						level = 2
+					}
+					i++
+					break
+				}
+				if startsBlock(lines[i]) {
+					break
+				}
+				para = append(para, strings.TrimLeft(lines[i], " "))
+			}
+			text := p.inline(strings.TrimRight(strings.Join(para, "\n"), " "))
+			switch {
+			case level > 0:
+				fmt.Fprintf(b, "<h%d>%s</h%d>\n", level, text, level)
+			case tight:
+				b.WriteString(text + "\n")
+			default:
+				b.WriteString("<p>" + text + "</p>\n")
+			}
+		}
+	}
+}
+
+func (p *mdParser) codeBlock(b *strings.Builder, code []string, lang string) {
+	b.WriteString("<pre><code")
+	if lang != "" {
+		b.WriteString(` class="language-` + escapeAttr(lang) + `"`)
+	}
+	b.WriteString(">")
+	for _, l := range code {
+		b.WriteString(escapeText(l) + "\n")
+	}
+	b.WriteString("</code></pre>\n")
+}
+
+// list renders the list starting at lines[i] and returns the index of the
+// line after it.
+func (p *mdParser) list(b *strings.Builder, lines []string, i int) int {
+	first := mdItemRe.FindStringSubmatch(lines[i])
+	ordered := first[3] != ""
+	kind := first[2]
+	if ordered {
+		kind = first[4]
+	}
+	sameList := func(m []string) bool {
+		if ordered {
+			return m[3] != "" && m[4] == kind
+		}
+		return m[3] == "" && m[2] == kind
+	}
+
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		m := mdItemRe.FindStringSubmatch(lines[i])
+		if m == nil || !sameList(m) {
+			break
+		}
+		width := len(m[0])
+		if len(m[5]) > 4 || isBlank(lines[i][width:]) {
+			// Code after the marker, or an empty first line: the content
+			// starts one space after the marker.
+			width = len(m[1]) + len(m[2]) + 1
+		}
+		item := []string{lines[i][min(width, len(lines[i])):]}
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			switch {
+			case isBlank(l):
+				item = append(item, "")
+				continue
+			case indentOf(l) >= width:
+				item = append(item, l[width:])
+				continue
+			case !isBlank(item[len(item)-1]) && !startsBlock(l) && !mdItemRe.MatchString(l):
+				item = append(item, strings.TrimLeft(l, " ")) // a lazy continuation
+				continue
+			}
+			break
+		}
+		// Blank lines between blocks of an item, or between items, make
+		// the list loose.
+		trailing := 0
+		for len(item) > 1 && isBlank(item[len(item)-1]) {
+			item = item[:len(item)-1]
+			trailing++
+		}
+		for _, l := range item[1:] {
+			if isBlank(l) {
+				loose = true
+			}
+		}
+		items = append(items, item)
+		if trailing > 0 && i < len(lines) {
+			if m := mdItemRe.FindStringSubmatch(lines[i]); m != nil && sameList(m) {
+				loose = true
+			}
+		}
+	}
+
+	if ordered {
+		start, _ := strconv.Atoi(first[3])
+		if start != 1 {
+			fmt.Fprintf(b, "<ol start=\"%d\">\n", start)
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		var inner strings.Builder
+		p.blocks(&inner, item, !loose)
+		b.WriteString("<li>" + strings.TrimSuffix(inner.String(), "\n") + "</li>\n")
+	}
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+func isSpaceByte(c byte) bool { return c == ' ' || c == '\n' || c == '\t' }
+
+// inline renders a paragraph's text.
+func (p *mdParser) inline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch c {
+		case '\\':
+			if i+1 < len(s) && s[i+1] == '\n' {
+				b.WriteString("<br/>\n")
+				i += 2
+				continue
+			}
+			if i+1 < len(s) && isASCIIPunct(s[i+1]) {
+				b.WriteString(escapeText(s[i+1 : i+2]))
+				i += 2
+				continue
+			}
+		case ' ':
+			n := len(s[i:]) - len(strings.TrimLeft(s[i:], " "))
+			if i+n < len(s) && s[i+n] == '\n' {
+				if n >= 2 {
+					b.WriteString("<br/>")
+				}
+				i += n
+				continue
+			}
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+		case '`':
+			if code, end, ok := codeSpan(s, i); ok {
+				b.WriteString("<code>" + escapeText(code) + "</code>")
+				i = end
+				continue
+			}
+			n := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+		case '*', '_', '~':
+			if out, end, ok := p.emphasis(s, i); ok {
+				b.WriteString(out)
+				i = end
+				continue
+			}
+			n := len(s[i:]) - len(strings.TrimLeft(s[i:], string(c)))
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+		case '!':
+			if i+1 < len(s) && s[i+1] == '[' {
+				if out, end, ok := p.link(s, i+1, true); ok {
+					b.WriteString(out)
+					i = end
+					continue
+				}
+			}
+		case '[':
+			if out, end, ok := p.link(s, i, false); ok {
+				b.WriteString(out)
+				i = end
+				continue
+			}
+		case '<':
+			if m := mdAutolinkRe.FindStringSubmatch(s[i:]); m != nil {
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, escapeAttr(m[1]), escapeText(m[1]))
+				i += len(m[0])
+				continue
+			}
+			if m := mdEmailRe.FindStringSubmatch(s[i:]); m != nil {
+				fmt.Fprintf(&b, `<a href="mailto:%s">%s</a>`, escapeAttr(m[1]), escapeText(m[1]))
+				i += len(m[0])
+				continue
+			}
+			if m := mdRawTagRe.FindString(s[i:]); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+		case '&':
+			if m := mdEntityRe.FindString(s[i:]); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+		}
+		switch c {
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '&':
+			b.WriteString("&amp;")
+		default:
+			b.WriteByte(c)
+		}
+		i++
+	}
+	return b.String()
+}
+
+// codeSpan finds the code span opened by the backticks at s[i]: its content
+// and the index after its closing backticks.
+func codeSpan(s string, i int) (string, int, bool) {
+	n := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+	ticks := s[i : i+n]
+	for j := i + n; j < len(s); {
+		k := strings.Index(s[j:], ticks)
+		if k < 0 {
+			return "", 0, false
+		}
+		k += j
+		end := k + n
+		if end < len(s) && s[end] == '`' {
+			// A longer run of backticks doesn't close it.
+			j = end + len(s[end:]) - len(strings.TrimLeft(s[end:], "`"))
+			continue
+		}
+		code := strings.ReplaceAll(s[i+n:k], "\n", " ")
+		if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+			code = code[1 : len(code)-1]
+		}
+		return code, end, true
+	}
+	return "", 0, false
+}
+
+// emphasis renders the emphasis, strong emphasis or strikethrough opened by
+// the delimiter run at s[i], if it is closed by a run of the same length.
+func (p *mdParser) emphasis(s string, i int) (string, int, bool) {
+	c := s[i]
+	n := len(s[i:]) - len(strings.TrimLeft(s[i:], string(c)))
+	if c == '~' && n != 2 || n > 3 {
+		return "", 0, false
+	}
+	if i+n >= len(s) || isSpaceByte(s[i+n]) || (c == '_' && i > 0 && isWordByte(s[i-1])) {
+		return "", 0, false
+	}
+	for j := i + n; j < len(s); j++ {
+		switch {
+		case s[j] == '`':
+			if _, end, ok := codeSpan(s, j); ok {
+				j = end - 1
+			}
+			continue
+		case s[j] == '\\':
+			j++
+			continue
+		case s[j] != c:
+			continue
+		}
+		m := len(s[j:]) - len(strings.TrimLeft(s[j:], string(c)))
+		if m != n || isSpaceByte(s[j-1]) || (c == '_' && j+m < len(s) && isWordByte(s[j+m])) {
+			j += m - 1
+			continue
+		}
+		inner := p.inline(s[i+n : j])
+		switch {
+		case c == '~':
+			inner = "<del>" + inner + "</del>"
+		case n == 1:
+			inner = "<em>" + inner + "</em>"
+		case n == 2:
+			inner = "<strong>" + inner + "</strong>"
+		default:
+			inner = "<strong><em>" + inner + "</em></strong>"
+		}
+		return inner, j + m, true
+	}
+	return "", 0, false
+}
+
+// link renders the link (or image) whose text opens with the bracket at
+// s[i]: inline [text](url "title"), full [text][label], collapsed [text][]
+// or shortcut [text] reference.
+func (p *mdParser) link(s string, i int, image bool) (string, int, bool) {
+	closing, depth := -1, 0
+	for j := i; j < len(s) && closing < 0; j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '`':
+			if _, end, ok := codeSpan(s, j); ok {
+				j = end - 1
+			}
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				closing = j
+			}
+		}
+	}
+	if closing < 0 {
+		return "", 0, false
+	}
+	text := s[i+1 : closing]
+	var url, title string
+	end := closing + 1
+	switch {
+	case end < len(s) && s[end] == '(':
+		var ok bool
+		if url, title, end, ok = linkDestination(s, end+1); !ok {
+			return "", 0, false
+		}
+	default:
+		label := text
+		if end+1 < len(s) && s[end] == '[' {
+			if k := strings.IndexByte(s[end+1:], ']'); k >= 0 {
+				if l := s[end+1 : end+1+k]; l != "" {
+					label = l
+				}
+				end += k + 2
+			}
+		}
+		ref, ok := p.refs[refKey(label)]
+		if !ok {
+			return "", 0, false
+		}
+		url, title = ref.url, ref.title
+	}
+
+	var b strings.Builder
+	if image {
+		fmt.Fprintf(&b, `<img src="%s" alt="%s"`, escapeAttr(url), escapeAttr(plainText(text)))
+		if title != "" {
+			fmt.Fprintf(&b, ` title="%s"`, escapeAttr(title))
+		}
+		b.WriteString("/>")
+		return b.String(), end, true
+	}
+	fmt.Fprintf(&b, `<a href="%s"`, escapeAttr(url))
+	if title != "" {
+		fmt.Fprintf(&b, ` title="%s"`, escapeAttr(title))
+	}
+	b.WriteString(">" + p.inline(text) + "</a>")
+	return b.String(), end, true
+}
+
+// linkDestination parses `url "title")` from s[i:], returning the index
+// after the closing parenthesis.
+func linkDestination(s string, i int) (url, title string, end int, ok bool) {
+	for i < len(s) && isSpaceByte(s[i]) {
+		i++
+	}
+	if i < len(s) && s[i] == '<' {
+		k := strings.IndexByte(s[i:], '>')
+		if k < 0 {
+			return "", "", 0, false
+		}
+		url, i = s[i+1:i+k], i+k+1
+	} else {
+		start, depth := i, 0
+		for ; i < len(s) && !isSpaceByte(s[i]); i++ {
+			if s[i] == '(' {
+				depth++
+			} else if s[i] == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+		}
+		url = s[start:i]
+	}
+	if i < len(s) && s[i] == ')' {
+		return url, "", i + 1, true
+	}
+	if m := mdLinkTitleRe.FindStringSubmatch(s[i:]); m != nil {
+		return url, m[1] + m[2] + m[3], i + len(m[0]), true
+	}
+	rest := strings.TrimLeft(s[i:], " \n")
+	if strings.HasPrefix(rest, ")") {
+		return url, "", len(s) - len(rest) + 1, true
+	}
+	return "", "", 0, false
+}
+
+// plainText strips Markdown punctuation from an image's alt text.
+func plainText(s string) string {
+	return strings.NewReplacer("*", "", "_", "", "`", "", "\\", "").Replace(s)
+}
@@ -0,0 +1,48 @@
+package epub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"atx heading", "## Chapter *One* ##", "<h2>Chapter <em>One</em></h2>\n"},
+		{"setext headings", "Title\n=====\n\nPart\n---", "<h1>Title</h1>\n<h2>Part</h2>\n"},
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one\ntwo</p>\n<p>three</p>\n"},
+		{"hard breaks", "one  \ntwo\\\nthree", "<p>one<br/>\ntwo<br/>\nthree</p>\n"},
+		{"emphasis", "*a* **b** ***c*** _d_ __e__ ~~f~~", "<p><em>a</em> <strong>b</strong> <strong><em>c</em></strong> <em>d</em> <strong>e</strong> <del>f</del></p>\n"},
+		{"nested emphasis", "*a **b** c*", "<p><em>a <strong>b</strong> c</em></p>\n"},
+		{"no emphasis", "snake_case_name, 2 * 3 * 4, a*", "<p>snake_case_name, 2 * 3 * 4, a*</p>\n"},
+		{"code span", "use `a < b` or `` `x` ``", "<p>use <code>a &lt; b</code> or <code>`x`</code></p>\n"},
+		{"escapes", `\*not em\* & <3 &amp;`, "<p>*not em* &amp; &lt;3 &amp;</p>\n"},
+		{"fenced code", "```go\nif a < b {\n\n}\n```", "<pre><code class=\"language-go\">if a &lt; b {\n\n}\n</code></pre>\n"},
+		{"indented code", "text\n\n    x := 1\n\n    y := 2\n", "<p>text</p>\n<pre><code>x := 1\n\ny := 2\n</code></pre>\n"},
+		{"blockquote", "> quoted\nlazy\n> > nested", "<blockquote>\n<p>quoted\nlazy</p>\n<blockquote>\n<p>nested</p>\n</blockquote>\n</blockquote>\n"},
+		{"tight list", "- one\n- two\n  - nested\n- three", "<ul>\n<li>one</li>\n<li>two\n<ul>\n<li>nested</li>\n</ul></li>\n<li>three</li>\n</ul>\n"},
+		{"loose ordered list", "3. one\n\n4. two\n   more", "<ol start=\"3\">\n<li><p>one</p></li>\n<li><p>two\nmore</p></li>\n</ol>\n"},
+		{"list interrupts paragraph", "Shopping:\n* eggs\n* milk", "<p>Shopping:</p>\n<ul>\n<li>eggs</li>\n<li>milk</li>\n</ul>\n"},
+		{"thematic break", "a\n\n* * *\n\nb", "<p>a</p>\n<hr/>\n<p>b</p>\n"},
+		{"links", `[site](https://example.com "Home") and <https://go.dev> and <me@example.com>`,
+			`<p><a href="https://example.com" title="Home">site</a> and <a href="https://go.dev">https://go.dev</a> and <a href="mailto:me@example.com">me@example.com</a></p>` + "\n"},
+		{"reference links", "[One][1], [two][] and [Two].\n\n[1]: https://one.example\n[two]: <https://two.example> 'Second'",
+			`<p><a href="https://one.example">One</a>, <a href="https://two.example" title="Second">two</a> and <a href="https://two.example" title="Second">Two</a>.</p>` + "\n"},
+		{"image", "![A *map*](map.png)", `<p><img src="map.png" alt="A map"/></p>` + "\n"},
+		{"not a link", "[just brackets] and [x](", "<p>[just brackets] and [x](</p>\n"},
+		{"raw html", "<div class=\"x\">\n*kept*\n</div>\n\nan <abbr title=\"e.g.\">abbr</abbr>", "<div class=\"x\">\n*kept*\n</div>\n<p>an <abbr title=\"e.g.\">abbr</abbr></p>\n"},
+		{"unicode", "Ünïcödé — *ok*", "<p>Ünïcödé — <em>ok</em></p>\n"},
+	} {
+		if got := RenderMarkdown(tc.in); got != tc.want {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRenderMarkdown_CRLFAndTabs(t *testing.T) {
+	got := RenderMarkdown("\ufeff# Title\r\n\r\n-\tone\r\n-\ttwo\r\n")
+	if !strings.HasPrefix(got, "<h1>Title</h1>\n<ul>\n<li>one</li>") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,350 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Package is an EPUB whose files are already laid out: XHTML documents in
+// reading order and the images, stylesheets and fonts they use, each at the
+// path in the book the documents link to it by. Package adds the container,
+// the package document, the navigation document and the NCX around them.
+// Book is written through one; converters that turn another format's
+// documents into XHTML of their own (MOBI, FB2, comics) use it directly, so
+// the links between their documents survive.
+type Package struct {
+	Metadata Metadata
+	// TOC is the table of contents; empty, it is the first document under
+	// the book's title.
+	TOC []NavPoint
+	// Cover is the path of the cover image, which must be one of the files.
+	Cover string
+	// Direction is the spine's page-progression-direction, "ltr" or "rtl";
+	// empty leaves it to the reader.
+	Direction string
+	// Meta is extra package metadata, written after Metadata.
+	Meta []Meta
+
+	files []*packageFile
+}
+
+// NavPoint is a table of contents entry: a document and, optionally, an id
+// within it.
+type NavPoint struct {
+	Label    string
+	Path     string // the document's path in the book, e.g. "OEBPS/Text/ch01.xhtml"
+	Fragment string
+}
+
+// Meta is a <meta> element: EPUB 3's property form when Property is set,
+// the EPUB 2 name/content form (which Kindle reads) otherwise.
+type Meta struct {
+	Property string
+	Name     string
+	Content  string
+}
+
+type packageFile struct {
+	path      string
+	mediaType string
+	data      []byte
+	props     string // manifest properties
+	spine     bool
+}
+
+// AddDocument adds an XHTML document at path (e.g. "OEBPS/Text/ch01.xhtml")
+// to the end of the reading order. props are its manifest properties, such
+// as "svg"; usually none.
+func (p *Package) AddDocument(path string, data []byte, props string) {
+	p.files = append(p.files, &packageFile{path: path, mediaType: "application/xhtml+xml", data: data, props: props, spine: true})
+}
+
+// AddFile adds a file the documents use, such as an image or a stylesheet,
+// at path.
+func (p *Package) AddFile(path, mediaType string, data []byte) {
+	p.files = append(p.files, &packageFile{path: path, mediaType: mediaType, data: data})
+}
+
+const (
+	opfPath = "OEBPS/content.opf"
+	navPath = "OEBPS/nav.xhtml"
+	ncxPath = "OEBPS/toc.ncx"
+)
+
+const containerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="` + opfPath + `" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+// Bytes returns the package as an EPUB file.
+func (p *Package) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write writes the package to w as an EPUB file.
+func (p *Package) Write(w io.Writer) error {
+	var first *packageFile
+	seen := map[string]bool{"mimetype": true, "META-INF/container.xml": true, opfPath: true, navPath: true, ncxPath: true}
+	for _, f := range p.files {
+		if seen[f.path] || f.path == "" || path.IsAbs(f.path) || strings.HasPrefix(path.Clean(f.path), "../") {
+			return fmt.Errorf("epub: %q can't be added to the book", f.path)
+		}
+		seen[f.path] = true
+		if f.spine && first == nil {
+			first = f
+		}
+	}
+	if first == nil {
+		return ErrNoChapters
+	}
+	if p.Cover != "" && !seen[p.Cover] {
+		return fmt.Errorf("epub: the cover %q is not in the book", p.Cover)
+	}
+
+	m := p.Metadata
+	if m.Title = collapseSpace(m.Title); m.Title == "" {
+		m.Title = "Untitled"
+	}
+	if m.Language = strings.TrimSpace(m.Language); m.Language == "" {
+		m.Language = "und"
+	}
+	if m.Identifier == "" {
+		m.Identifier = p.uid()
+	}
+	if m.Modified.IsZero() {
+		m.Modified = time.Now()
+	}
+	toc := p.TOC
+	if len(toc) == 0 {
+		toc = []NavPoint{{Label: m.Title, Path: first.path}}
+	}
+
+	var manifest, spine strings.Builder
+	item := func(id, p, mediaType, props string) {
+		fmt.Fprintf(&manifest, `    <item id="%s" href="%s" media-type="%s"`, id, escapeAttr(relativeHref(opfPath, p)), mediaType)
+		if props != "" {
+			fmt.Fprintf(&manifest, ` properties="%s"`, props)
+		}
+		manifest.WriteString("/>\n")
+	}
+	item("nav", navPath, "application/xhtml+xml", "nav")
+	item("ncx", ncxPath, "application/x-dtbncx+xml", "")
+	counts := map[string]int{}
+	for _, f := range p.files {
+		idFormat := "item%04d"
+		switch {
+		case f.spine:
+			idFormat = "chapter%04d"
+		case strings.HasPrefix(f.mediaType, "image/"):
+			idFormat = "image%04d"
+		case f.mediaType == "text/css":
+			idFormat = "style%02d"
+		}
+		counts[idFormat]++
+		id, props := fmt.Sprintf(idFormat, counts[idFormat]), f.props
+		if f.path == p.Cover {
+			id, props = "cover-image", strings.TrimSpace("cover-image "+props)
+		}
+		item(id, f.path, f.mediaType, props)
+		if f.spine {
+			fmt.Fprintf(&spine, "    <itemref idref=\"%s\"/>\n", id)
+		}
+	}
+
+	zw := zip.NewWriter(w)
+	write := func(h *zip.FileHeader, data []byte) error {
+		f, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	add := func(name string, data []byte, method uint16) error {
+		return write(&zip.FileHeader{Name: name, Method: method, Modified: m.Modified}, data)
+	}
+	// No timestamp for mimetype: it would add an extra field, and readers
+	// look for "application/epub+zip" 38 bytes into the file.
+	if err := write(&zip.FileHeader{Name: "mimetype", Method: zip.Store}, []byte("application/epub+zip")); err != nil {
+		return err
+	}
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{
+		{"META-INF/container.xml", []byte(containerXML)},
+		{opfPath, p.packageDocument(m, manifest.String(), spine.String())},
+		{navPath, navDocument(m, toc)},
+		{ncxPath, ncxDocument(m, toc)},
+	} {
+		if err := add(e.name, e.data, zip.Deflate); err != nil {
+			return err
+		}
+	}
+	for _, f := range p.files {
+		// JPEG, PNG and GIF are compressed already.
+		method := uint16(zip.Deflate)
+		switch f.mediaType {
+		case "image/jpeg", "image/png", "image/gif":
+			method = zip.Store
+		}
+		if err := add(f.path, f.data, method); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// uid is a urn:uuid identifier derived from the title, authors and
+// documents, so writing the same book twice gives it the same identity.
+func (p *Package) uid() string {
+	h := md5.New()
+	io.WriteString(h, p.Metadata.Title)
+	for _, a := range p.Metadata.Authors {
+		io.WriteString(h, "\x00"+a)
+	}
+	for _, f := range p.files {
+		if f.spine {
+			h.Write([]byte{0})
+			h.Write(f.data)
+		}
+	}
+	sum := h.Sum(nil)
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func (p *Package) packageDocument(m Metadata, manifest, spine string) []byte {
+	var meta strings.Builder
+	fmt.Fprintf(&meta, "    <dc:identifier id=\"bookid\">%s</dc:identifier>\n", escapeText(m.Identifier))
+	fmt.Fprintf(&meta, "    <dc:title>%s</dc:title>\n", escapeText(m.Title))
+	for _, a := range m.Authors {
+		if a = collapseSpace(a); a != "" {
+			fmt.Fprintf(&meta, "    <dc:creator>%s</dc:creator>\n", escapeText(a))
+		}
+	}
+	n := 0
+	for _, t := range m.Translators {
+		if t = collapseSpace(t); t != "" {
+			n++
+			fmt.Fprintf(&meta, "    <dc:contributor id=\"trl%d\">%s</dc:contributor>\n", n, escapeText(t))
+			fmt.Fprintf(&meta, "    <meta refines=\"#trl%d\" property=\"role\" scheme=\"marc:relators\">trl</meta>\n", n)
+		}
+	}
+	fmt.Fprintf(&meta, "    <dc:language>%s</dc:language>\n", escapeText(m.Language))
+	for _, f := range []struct{ name, value string }{
+		{"publisher", m.Publisher}, {"date", m.Date}, {"description", m.Description},
+	} {
+		if v := strings.TrimSpace(f.value); v != "" {
+			fmt.Fprintf(&meta, "    <dc:%s>%s</dc:%s>\n", f.name, escapeText(v), f.name)
+		}
+	}
+	for _, s := range m.Subjects {
+		if s = collapseSpace(s); s != "" {
+			fmt.Fprintf(&meta, "    <dc:subject>%s</dc:subject>\n", escapeText(s))
+		}
+	}
+	fmt.Fprintf(&meta, "    <meta property=\"dcterms:modified\">%s</meta>\n", m.Modified.UTC().Format("2006-01-02T15:04:05Z"))
+	if p.Cover != "" {
+		meta.WriteString("    <meta name=\"cover\" content=\"cover-image\"/>\n")
+	}
+	if series := collapseSpace(m.Series); series != "" {
+		// Calibre's form for Kindle and older readers, EPUB 3's for the rest.
+		fmt.Fprintf(&meta, "    <meta name=\"calibre:series\" content=\"%s\"/>\n", escapeAttr(series))
+		fmt.Fprintf(&meta, "    <meta property=\"belongs-to-collection\" id=\"series\">%s</meta>\n", escapeText(series))
+		meta.WriteString("    <meta refines=\"#series\" property=\"collection-type\">series</meta>\n")
+		if n := strings.TrimSpace(m.SeriesIndex); n != "" {
+			fmt.Fprintf(&meta, "    <meta name=\"calibre:series_index\" content=\"%s\"/>\n", escapeAttr(n))
+			fmt.Fprintf(&meta, "    <meta refines=\"#series\" property=\"group-position\">%s</meta>\n", escapeText(n))
+		}
+	}
+	for _, x := range p.Meta {
+		if x.Property != "" {
+			fmt.Fprintf(&meta, "    <meta property=\"%s\">%s</meta>\n", escapeAttr(x.Property), escapeText(x.Content))
+		} else {
+			fmt.Fprintf(&meta, "    <meta name=\"%s\" content=\"%s\"/>\n", escapeAttr(x.Name), escapeAttr(x.Content))
+		}
+	}
+
+	spineTag := `<spine toc="ncx">`
+	if p.Direction != "" {
+		spineTag = fmt.Sprintf(`<spine toc="ncx" page-progression-direction="%s">`, escapeAttr(p.Direction))
+	}
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+` + meta.String() + `  </metadata>
+  <manifest>
+` + manifest + `  </manifest>
+  ` + spineTag + `
+` + spine + `  </spine>
+</package>
+`)
+}
+
+func navDocument(m Metadata, toc []NavPoint) []byte {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<!DOCTYPE html>\n")
+	fmt.Fprintf(&b, `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="%s" xml:lang="%s">`+"\n",
+		escapeAttr(m.Language), escapeAttr(m.Language))
+	fmt.Fprintf(&b, "<head><title>%s</title></head>\n<body>\n<nav epub:type=\"toc\" id=\"toc\">\n<h1>%s</h1>\n<ol>\n", escapeText(m.Title), escapeText(m.Title))
+	for _, t := range toc {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", escapeAttr(t.hrefFrom(navPath)), escapeText(collapseSpace(t.Label)))
+	}
+	b.WriteString("</ol>\n</nav>\n</body>\n</html>\n")
+	return []byte(b.String())
+}
+
+func ncxDocument(m Metadata, toc []NavPoint) []byte {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">` + "\n")
+	fmt.Fprintf(&b, "<head><meta name=\"dtb:uid\" content=\"%s\"/><meta name=\"dtb:depth\" content=\"1\"/></head>\n", escapeAttr(m.Identifier))
+	fmt.Fprintf(&b, "<docTitle><text>%s</text></docTitle>\n<navMap>\n", escapeText(m.Title))
+	for i, t := range toc {
+		fmt.Fprintf(&b, "<navPoint id=\"np%d\" playOrder=\"%d\"><navLabel><text>%s</text></navLabel><content src=\"%s\"/></navPoint>\n",
+			i+1, i+1, escapeText(collapseSpace(t.Label)), escapeAttr(t.hrefFrom(ncxPath)))
+	}
+	b.WriteString("</navMap>\n</ncx>\n")
+	return []byte(b.String())
+}
+
+func (t NavPoint) hrefFrom(from string) string {
+	h := relativeHref(from, t.Path)
+	if t.Fragment != "" {
+		h += "#" + t.Fragment
+	}
+	return h
+}
+
+// relativeHref is the href from the file at fromPath to the file at to,
+// both paths in the book.
+func relativeHref(fromPath, to string) string {
+	from := strings.Split(path.Dir(fromPath), "/")
+	if from[0] == "." {
+		from = nil
+	}
+	parts := strings.Split(to, "/")
+	i := 0
+	for i < len(from) && i < len(parts)-1 && from[i] == parts[i] {
+		i++
+	}
+	rel := strings.Repeat("../", len(from)-i) + strings.Join(parts[i:], "/")
+	return hrefEscaper.Replace(rel)
+}
+
+// hrefEscaper escapes the characters that commonly appear in file names
+// but mean something else in an href.
+var hrefEscaper = strings.NewReplacer("%", "%25", " ", "%20", "#", "%23")
@@ -0,0 +1,243 @@
+package epub
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// parseChapter parses chapter markup with the HTML parser, which takes
+// anything, and returns its body and, for a whole document, its title.
+func parseChapter(markup string) (*html.Node, string) {
+	lower := strings.ToLower(markup)
+	if strings.Contains(lower, "<body") || strings.Contains(lower, "<html") {
+		if doc, err := html.Parse(strings.NewReader(markup)); err == nil {
+			body := findElement(doc, atom.Body)
+			var title string
+			if t := findElement(doc, atom.Title); t != nil {
+				title = textContent(t)
+			}
+			if body != nil {
+				return body, title
+			}
+		}
+	}
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(markup), body)
+	if err != nil {
+		// Only a failing reader makes ParseFragment fail; keep the text.
+		body.AppendChild(&html.Node{Type: html.TextNode, Data: markup})
+		return body, ""
+	}
+	for _, n := range nodes {
+		body.AppendChild(n)
+	}
+	return body, ""
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := findElement(c, a); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// firstHeading is the text of the first h1, h2 or h3 under n.
+func firstHeading(n *html.Node) string {
+	if n.Type == html.ElementNode && (n.DataAtom == atom.H1 || n.DataAtom == atom.H2 || n.DataAtom == atom.H3) {
+		if t := collapseSpace(textContent(n)); t != "" {
+			return t
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if t := firstHeading(c); t != "" {
+			return t
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
+
+// Namespaces of the foreign content HTML allows inline, and of HTML back
+// inside it (in an SVG foreignObject).
+var foreignNamespaces = map[string]string{
+	"":     "http://www.w3.org/1999/xhtml",
+	"svg":  "http://www.w3.org/2000/svg",
+	"math": "http://www.w3.org/1998/Math/MathML",
+}
+
+// droppedElements don't belong in a chapter body: scripts (Kindles don't
+// run them) and head elements.
+var droppedElements = []atom.Atom{atom.Script, atom.Noscript, atom.Template, atom.Title, atom.Meta, atom.Base, atom.Link}
+
+var voidElements = []atom.Atom{
+	atom.Area, atom.Br, atom.Col, atom.Embed, atom.Hr, atom.Img, atom.Input,
+	atom.Source, atom.Track, atom.Wbr,
+}
+
+var xmlNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// xhtmlWriter serializes parsed HTML as well-formed XHTML. Elements and
+// attributes whose names XML can't hold are dropped (an element's content
+// is kept), as are event handler attributes and javascript: links.
+type xhtmlWriter struct {
+	b *strings.Builder
+	// resolve rewrites src and href values.
+	resolve func(string) string
+
+	svg, mathml, remote bool
+}
+
+func (x *xhtmlWriter) node(n *html.Node, ns string) {
+	switch n.Type {
+	case html.TextNode:
+		x.b.WriteString(escapeText(n.Data))
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	if n.Namespace == "" && slices.Contains(droppedElements, n.DataAtom) {
+		return
+	}
+	if !xmlNameRe.MatchString(n.Data) {
+		x.children(n, ns)
+		return
+	}
+
+	x.b.WriteString("<" + n.Data)
+	if n.Namespace != ns {
+		if uri, ok := foreignNamespaces[n.Namespace]; ok {
+			x.b.WriteString(` xmlns="` + uri + `"`)
+		}
+		switch n.Namespace {
+		case "svg":
+			x.svg = true
+		case "math":
+			x.mathml = true
+		}
+	}
+	xlink := false
+	for _, a := range n.Attr {
+		if !keepAttr(a) {
+			continue
+		}
+		key := a.Key
+		if a.Namespace != "" {
+			key = a.Namespace + ":" + a.Key
+		}
+		if a.Namespace == "xlink" && !xlink {
+			x.b.WriteString(` xmlns:xlink="http://www.w3.org/1999/xlink"`)
+			xlink = true
+		}
+		val := a.Val
+		switch key {
+		case "src", "href", "xlink:href", "poster":
+			val = x.resolve(val)
+			if isRemote(val) && key != "href" {
+				x.remote = true
+			}
+		}
+		x.b.WriteString(" " + key + `="` + escapeAttr(val) + `"`)
+	}
+
+	if n.FirstChild == nil && (n.Namespace != "" || slices.Contains(voidElements, n.DataAtom)) {
+		x.b.WriteString("/>")
+		return
+	}
+	x.b.WriteString(">")
+	x.children(n, n.Namespace)
+	x.b.WriteString("</" + n.Data + ">")
+}
+
+func (x *xhtmlWriter) children(n *html.Node, ns string) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		x.node(c, ns)
+	}
+}
+
+func keepAttr(a html.Attribute) bool {
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(a.Val)), "javascript:") {
+		return false
+	}
+	switch a.Namespace {
+	case "xlink", "xml":
+		return xmlNameRe.MatchString(a.Key)
+	case "":
+	default:
+		return false
+	}
+	if strings.HasPrefix(a.Key, "on") || a.Key == "xmlns" {
+		return false
+	}
+	if prefix, local, ok := strings.Cut(a.Key, ":"); ok {
+		// The only prefixes declared in a chapter.
+		return (prefix == "epub" || prefix == "xml") && xmlNameRe.MatchString(local)
+	}
+	return xmlNameRe.MatchString(a.Key)
+}
+
+// properties lists the manifest properties the written content needs.
+func (x *xhtmlWriter) properties() string {
+	var p []string
+	if x.mathml {
+		p = append(p, "mathml")
+	}
+	if x.remote {
+		p = append(p, "remote-resources")
+	}
+	if x.svg {
+		p = append(p, "svg")
+	}
+	return strings.Join(p, " ")
+}
+
+func isRemote(ref string) bool {
+	ref = strings.ToLower(ref)
+	return strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://")
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// escapeText escapes s for XML character data, dropping the characters XML
+// 1.0 doesn't allow at all.
+func escapeText(s string) string {
+	return textEscaper.Replace(xmlChars(s))
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(xmlChars(s))
+}
+
+func xmlChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return r
+		case r < 0x20 || r == 0xFFFE || r == 0xFFFF:
+			return -1
+		}
+		return r
+	}, s)
+}
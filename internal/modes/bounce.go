@@ -0,0 +1,68 @@
+package modes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/bounce"
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"github.com/sam-hartman/kindle-pibrarian/internal/sendlog"
+	"go.uber.org/zap"
+)
+
+// bouncePollInterval is how often the watcher checks the mailbox. Amazon's
+// rejections arrive minutes to hours after the send, so there's no rush.
+const bouncePollInterval = 5 * time.Minute
+
+// startBounceWatcher starts the IMAP bounce watcher when IMAP_HOST and
+// SEND_LOG_PATH are set. It runs for the life of the process.
+func startBounceWatcher(env *Env) {
+	l := logger.GetLogger()
+	if env.IMAPHost == "" {
+		return
+	}
+	if env.SendLogPath == "" {
+		l.Warn("Bounce watcher disabled: IMAP_HOST is set but SEND_LOG_PATH is not")
+		return
+	}
+	cfg := env.BounceConfig()
+	if err := cfg.Validate(); err != nil {
+		l.Error("Bounce watcher disabled", zap.Error(err))
+		return
+	}
+	log, err := sendlog.Open(env.SendLogPath)
+	if err != nil {
+		l.Error("Bounce watcher disabled: cannot open SEND_LOG_PATH", zap.String("path", env.SendLogPath), zap.Error(err))
+		return
+	}
+	l.Info("Bounce watcher started", zap.String("imap_host", cfg.Host), zap.String("user", cfg.User))
+	go bounce.NewWatcher(cfg, log).Run(context.Background(), bouncePollInterval)
+}
+
+// handleSends serves GET /sends: the send log, newest first, with any
+// failures the bounce watcher has recorded.
+func handleSends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	env, err := GetEnv()
+	if err != nil || env.SendLogPath == "" {
+		writeJSONError(w, http.StatusNotFound, "send log not configured (set SEND_LOG_PATH)")
+		return
+	}
+	log, err := sendlog.Open(env.SendLogPath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not open send log")
+		return
+	}
+	records, err := log.List()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not read send log")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"sends": records})
+}
@@ -2,14 +2,20 @@ package modes
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/fang"
 	"github.com/sam-hartman/kindle-pibrarian/internal/anna"
+	"github.com/sam-hartman/kindle-pibrarian/internal/bounce"
 	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"github.com/sam-hartman/kindle-pibrarian/internal/outbox"
+	"github.com/sam-hartman/kindle-pibrarian/internal/sendlog"
 	"github.com/sam-hartman/kindle-pibrarian/internal/version"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -74,7 +80,7 @@ func StartCLI() {
 	downloadCmd := &cobra.Command{
 		Use:   "download [hash] [filename]",
 		Short: "Download a book by its MD5 hash",
-		Long:  "Download a book by its MD5 hash to the specified filename. Requires ANNAS_SECRET_KEY and ANNAS_DOWNLOAD_PATH environment variables.",
+		Long:  "Download a book by its MD5 hash to the specified filename. Requires ANNAS_SECRET_KEY and ANNAS_DOWNLOAD_PATH environment variables. With --to, email it to a Kindle (profile name or address) instead.",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			bookHash := args[0]
@@ -106,7 +112,33 @@ func StartCLI() {
 				Format: format,
 			}
 
-			err = book.Download(env.SecretKey, env.DownloadPath)
+			if toFlag, _ := cmd.Flags().GetString("to"); toFlag != "" {
+				to, err := env.ResolveRecipient(toFlag)
+				if err != nil {
+					return err
+				}
+				if err := book.EmailToKindle(env.SecretKey, env.MailConfig(), to); err != nil {
+					var queued *anna.QueuedError
+					if errors.As(err, &queued) {
+						fmt.Printf("Mail server unavailable; queued for retry as %s.\n", queued.ID)
+						return nil
+					}
+					return fmt.Errorf("failed to send book to %s: %w", to, err)
+				}
+				fmt.Printf("Book sent to %s\n", to)
+				return nil
+			}
+
+			err = book.DownloadWithProgress(env.SecretKey, env.DownloadPath, func(p anna.Progress) {
+				if p.Total > 0 {
+					fmt.Fprintf(os.Stderr, "\rDownloading: %.1f of %.1f MB", float64(p.Done)/(1<<20), float64(p.Total)/(1<<20))
+				} else {
+					fmt.Fprintf(os.Stderr, "\rDownloading: %.1f MB", float64(p.Done)/(1<<20))
+				}
+				if p.Done == p.Total {
+					fmt.Fprintln(os.Stderr)
+				}
+			})
 			if err != nil {
 				l.Error("Download command failed",
 					zap.String("bookHash", bookHash),
@@ -129,6 +161,8 @@ func StartCLI() {
 		},
 	}
 
+	downloadCmd.Flags().String("to", "", "Email to this Kindle (profile name or address) instead of saving locally")
+
 	mcpCmd := &cobra.Command{
 		Use:   "mcp",
 		Short: "Start the MCP server",
@@ -166,14 +200,26 @@ func StartCLI() {
 			}
 
 			// Check if email is configured
-			if env.SMTPHost == "" || env.SMTPUser == "" || env.SMTPPassword == "" || env.FromEmail == "" {
-				return fmt.Errorf("email configuration incomplete. Please set SMTP_HOST, SMTP_USER, SMTP_PASSWORD, and FROM_EMAIL")
+			mail := env.MailConfig()
+			if dir, _ := cmd.Flags().GetString("capture"); dir != "" {
+				mail.CaptureDir = dir
+			}
+			if err := mail.Validate(); err != nil {
+				return err
+			}
+			// A test send should report a broken mail server, not queue around it.
+			mail.OutboxDir = ""
+
+			toFlag, _ := cmd.Flags().GetString("to")
+			to, err := env.ResolveRecipient(toFlag)
+			if err != nil {
+				return err
 			}
 
 			l.Info("Testing email functionality",
 				zap.String("from", env.FromEmail),
-				zap.String("to", env.KindleEmail),
-				zap.String("smtp", env.SMTPHost+":"+env.SMTPPort),
+				zap.String("to", to.String()),
+				zap.String("transport", mail.Describe()),
 			)
 
 			// Create a simple test file (small PDF content)
@@ -192,30 +238,388 @@ func StartCLI() {
 				filename,
 				mimeType,
 				"Test Book - Email Functionality",
-				env.SMTPHost,
-				env.SMTPPort,
-				env.SMTPUser,
-				env.SMTPPassword,
-				env.FromEmail,
-				env.KindleEmail,
+				mail,
+				to,
 			)
 			if err != nil {
 				return fmt.Errorf("failed to send test email: %w", err)
 			}
 
+			if mail.CaptureDir != "" {
+				fmt.Printf("✅ Test email captured (not sent)\n")
+				fmt.Printf("   To: %s\n", to)
+				fmt.Printf("   Written to: %s (.eml + .json sidecar)\n", mail.CaptureDir)
+				return nil
+			}
 			fmt.Printf("✅ Test email sent successfully!\n")
 			fmt.Printf("   From: %s\n", env.FromEmail)
-			fmt.Printf("   To: %s\n", env.KindleEmail)
+			fmt.Printf("   To: %s\n", to)
+			fmt.Printf("   Via: %s\n", mail.Describe())
+			_, limitSource := mail.MessageLimit()
+			fmt.Printf("   Size limit: %.2f MB per book (%s)\n", float64(mail.AttachmentLimit())/(1024*1024), limitSource)
 			fmt.Printf("   Check your Kindle or Kindle app in a few minutes.\n")
 			return nil
 		},
 	}
 
+	testEmailCmd.Flags().String("to", "", "Kindle profile name or email address (default: KINDLE_EMAIL)")
+	testEmailCmd.Flags().String("capture", "", "Write the message as .eml (+ JSON sidecar) into this directory instead of sending it (default: MAIL_CAPTURE_DIR)")
+
+	profilesCmd := &cobra.Command{
+		Use:   "profiles",
+		Short: "List the named Kindle profiles",
+		Long:  "Lists the Kindle profiles from KINDLE_PROFILES_FILE. A profile name can be used anywhere a Kindle email is accepted.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			env, err := GetEnv()
+			if err != nil {
+				return fmt.Errorf("failed to get environment: %w", err)
+			}
+			fmt.Println(describeProfiles(env.Profiles, env.KindleEmail))
+			return nil
+		},
+	}
+
+	convertersCmd := &cobra.Command{
+		Use:   "converters",
+		Short: "List the format converters and whether they're usable",
+		Long:  "Lists the conversion backends in order of preference, whether each is available on this machine, its timeout and the conversions it performs. Books in other formats than EPUB are converted by the first route that works.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, c := range anna.DefaultConverters() {
+				status := "available"
+				if !c.Available() {
+					status = "not installed"
+				}
+				routes := make([]string, 0, len(c.Routes()))
+				for _, r := range c.Routes() {
+					routes = append(routes, r.String())
+				}
+				fmt.Printf("%s (%s, timeout %s)\n  %s\n", c.Name(), status, c.Timeout(), strings.Join(routes, " "))
+			}
+			return nil
+		},
+	}
+
+	shrinkCmd := &cobra.Command{
+		Use:   "shrink-epub [in] [out]",
+		Short: "Shrink an EPUB to fit the email size limit",
+		Long:  "Recompresses and downscales an EPUB's images and drops unused fonts until it fits the mail transport's attachment limit (or --max-mb), then writes the result (default: <in>.shrunk.epub) and prints the before/after sizes.",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in := args[0]
+			out := strings.TrimSuffix(in, filepath.Ext(in)) + ".shrunk.epub"
+			if len(args) == 2 {
+				out = args[1]
+			}
+			data, err := os.ReadFile(in)
+			if err != nil {
+				return err
+			}
+
+			var target int64
+			if maxMB, _ := cmd.Flags().GetFloat64("max-mb"); maxMB > 0 {
+				target = int64(maxMB * 1024 * 1024)
+			} else {
+				env, err := GetEnv()
+				if err != nil {
+					return fmt.Errorf("failed to get environment: %w", err)
+				}
+				target = env.MailConfig().AttachmentLimit()
+			}
+
+			shrunk, report, err := anna.ShrinkEPUB(data, target)
+			if err != nil {
+				return fmt.Errorf("failed to shrink %s: %w", in, err)
+			}
+			if err := os.WriteFile(out, shrunk, 0o644); err != nil {
+				return err
+			}
+			fmt.Printf("%s: %s\n", out, report)
+			if report.After > target {
+				fmt.Printf("⚠️  Still over the %.2f MB limit.\n", float64(target)/(1024*1024))
+			}
+			return nil
+		},
+	}
+	shrinkCmd.Flags().Float64("max-mb", 0, "Target size in MB (default: the mail transport's attachment limit)")
+
+	repairCmd := &cobra.Command{
+		Use:   "repair-epub [in] [out]",
+		Short: "Repair an EPUB the way the send pipeline does",
+		Long:  "Fixes a misplaced or compressed mimetype entry, drops manifest entries for missing files, re-serializes malformed XHTML and generates a missing navigation document or NCX, then writes the result (default: <in>.repaired.epub) and lists each repair.",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in := args[0]
+			out := strings.TrimSuffix(in, filepath.Ext(in)) + ".repaired.epub"
+			if len(args) == 2 {
+				out = args[1]
+			}
+			data, err := os.ReadFile(in)
+			if err != nil {
+				return err
+			}
+			repaired, repairs, err := anna.RepairEPUB(data)
+			if err != nil {
+				return fmt.Errorf("failed to repair %s: %w", in, err)
+			}
+			if len(repairs) == 0 {
+				fmt.Printf("%s: nothing to repair\n", in)
+				return nil
+			}
+			if err := os.WriteFile(out, repaired, 0o644); err != nil {
+				return err
+			}
+			fmt.Printf("%s: %d repairs\n", out, len(repairs))
+			for _, r := range repairs {
+				fmt.Printf("  %s\n", r)
+			}
+			fmt.Printf("Check: %s\n", anna.CheckEPUB(repaired).Summary())
+			return nil
+		},
+	}
+
+	comicCmd := &cobra.Command{
+		Use:   "comic-to-epub [in] [out]",
+		Short: "Convert a CBZ or CBR comic to a fixed-layout EPUB",
+		Long:  "Converts a comic archive to the fixed-layout EPUB the send pipeline delivers: pages in natural order, scaled to fit --device (a Kindle model, WIDTHxHEIGHT or \"original\"), right to left with --rtl, landscape spreads cut in two with --split. Writes <in>.epub by default. Flags not given fall back to COMIC_DEVICE, COMIC_READING_DIRECTION and COMIC_SPLIT_SPREADS. CBRs need bsdtar.",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in := args[0]
+			out := strings.TrimSuffix(in, filepath.Ext(in)) + ".epub"
+			if len(args) == 2 {
+				out = args[1]
+			}
+			data, err := os.ReadFile(in)
+			if err != nil {
+				return err
+			}
+
+			opts := anna.ComicOptionsFromEnv()
+			if cmd.Flags().Changed("device") {
+				device, _ := cmd.Flags().GetString("device")
+				if opts.Width, opts.Height, err = anna.ParseComicScreen(device); err != nil {
+					return err
+				}
+			}
+			if rtl, _ := cmd.Flags().GetBool("rtl"); rtl {
+				opts.Direction = "rtl"
+			}
+			if split, _ := cmd.Flags().GetBool("split"); split {
+				opts.SplitSpreads = true
+			}
+
+			var book []byte
+			switch format, _ := anna.DetectFileFormat(data); format {
+			case "cbz":
+				book, err = anna.ConvertComicToEPUB(data, opts)
+			case "cbr":
+				ctx, cancel := context.WithTimeout(cmd.Context(), 2*time.Minute)
+				defer cancel()
+				book, err = anna.ConvertCBRToEPUB(ctx, data, opts)
+			default:
+				return fmt.Errorf("%s is not a comic archive (detected: %s)", in, format)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to convert %s: %w", in, err)
+			}
+			if err := os.WriteFile(out, book, 0o644); err != nil {
+				return err
+			}
+			fmt.Printf("%s: %.2f MB\n", out, float64(len(book))/(1024*1024))
+			return nil
+		},
+	}
+	comicCmd.Flags().String("device", "", "Screen to fit pages to: kindle, basic, paperwhite, oasis, colorsoft, scribe, WIDTHxHEIGHT or original (default paperwhite)")
+	comicCmd.Flags().Bool("rtl", false, "Right-to-left page order (manga)")
+	comicCmd.Flags().Bool("split", false, "Cut landscape two-page spreads into two pages")
+
+	textCmd := &cobra.Command{
+		Use:   "text-to-epub [in] [out]",
+		Short: "Convert a plain-text or Markdown file to an EPUB",
+		Long:  "Converts a .txt or Markdown file to an EPUB with a table of contents: the encoding (UTF-8, Windows-1251 or Latin-1) is detected, chapter headings (\"Chapter 1\", \"CHAPTER ONE\", Markdown #) are found, and hard-wrapped lines are joined into paragraphs. Project Gutenberg headers are stripped and their title and author used. Files ending in .md or .markdown are read as Markdown, as is text that looks like it; --markdown forces it. Writes <in>.epub by default.",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in := args[0]
+			out := strings.TrimSuffix(in, filepath.Ext(in)) + ".epub"
+			if len(args) == 2 {
+				out = args[1]
+			}
+			data, err := os.ReadFile(in)
+			if err != nil {
+				return err
+			}
+			opts := anna.TextOptions{Name: in}
+			opts.Title, _ = cmd.Flags().GetString("title")
+			opts.Author, _ = cmd.Flags().GetString("author")
+			opts.Language, _ = cmd.Flags().GetString("language")
+			if md, _ := cmd.Flags().GetBool("markdown"); md {
+				opts.Format = "md"
+			}
+			book, err := anna.ConvertTextToEPUB(data, opts)
+			if err != nil {
+				return fmt.Errorf("failed to convert %s: %w", in, err)
+			}
+			if err := os.WriteFile(out, book, 0o644); err != nil {
+				return err
+			}
+			fmt.Printf("%s: %.2f MB\n", out, float64(len(book))/(1024*1024))
+			return nil
+		},
+	}
+	textCmd.Flags().String("title", "", "Book title (default: from the text, else the file name)")
+	textCmd.Flags().String("author", "", "Author")
+	textCmd.Flags().String("language", "", "Language tag, e.g. en or ru")
+	textCmd.Flags().Bool("markdown", false, "Read the file as Markdown whatever its name")
+
+	checkEPUBCmd := &cobra.Command{
+		Use:   "check-epub [file]",
+		Short: "Check an EPUB for structural problems",
+		Long:  "Checks an EPUB's container, package document, manifest, spine, content documents and tables of contents, like epubcheck, and lists every problem found with its severity. Exits non-zero if there are errors; warnings alone don't fail.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			report := anna.CheckEPUB(data)
+			if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+				out, err := json.MarshalIndent(report, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(out))
+			} else {
+				fmt.Printf("%s: %s\n", args[0], report)
+			}
+			if !report.Clean() {
+				return fmt.Errorf("%s: %s", args[0], report.Summary())
+			}
+			return nil
+		},
+	}
+	checkEPUBCmd.Flags().Bool("json", false, "Print the report as JSON")
+
+	outboxCmd := &cobra.Command{
+		Use:   "outbox",
+		Short: "Show the delivery retry queue",
+		Long:  "Lists every item in the on-disk outbox (OUTBOX_DIR) with its state: queued, sending, sent or dead.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			box, err := openOutbox()
+			if err != nil {
+				return err
+			}
+			items, err := box.List()
+			if err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				fmt.Println("Outbox is empty.")
+				return nil
+			}
+			for _, it := range items {
+				fmt.Printf("%s  %-7s  attempts=%d  %s -> %s\n", it.ID, it.State, it.Attempts, it.Filename, it.To)
+				if it.State == outbox.StateQueued {
+					fmt.Printf("    next attempt: %s\n", it.NextAttempt.Local().Format(time.RFC1123))
+				}
+				if it.LastError != "" {
+					fmt.Printf("    last error: %s\n", it.LastError)
+				}
+			}
+			return nil
+		},
+	}
+	outboxRetryCmd := &cobra.Command{
+		Use:   "retry [id]",
+		Short: "Re-queue a dead outbox item",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			box, err := openOutbox()
+			if err != nil {
+				return err
+			}
+			it, err := box.Retry(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Re-queued %s (%s); the running server will retry it shortly.\n", it.ID, it.Filename)
+			return nil
+		},
+	}
+	outboxCmd.AddCommand(outboxRetryCmd)
+
+	sendsCmd := &cobra.Command{
+		Use:   "sends",
+		Short: "Show the send log",
+		Long:  "Lists every send recorded in SEND_LOG_PATH, newest first, including any that Amazon later rejected.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			log, err := openSendLog()
+			if err != nil {
+				return err
+			}
+			records, err := log.List()
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				fmt.Println("No sends recorded yet.")
+				return nil
+			}
+			for _, r := range records {
+				fmt.Printf("%s  %-6s  %s -> %s\n", r.SentAt.Local().Format("2006-01-02 15:04"), r.Status, r.Filename, r.To)
+				if r.Reason != "" {
+					fmt.Printf("    reason: %s\n", r.Reason)
+				}
+			}
+			return nil
+		},
+	}
+	checkBouncesCmd := &cobra.Command{
+		Use:   "check-bounces",
+		Short: "Check the mailbox for Amazon rejections now",
+		Long:  "Polls the IMAP mailbox once (IMAP_HOST, IMAP_USER, IMAP_PASSWORD) and marks any rejected sends as failed in the send log.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			env, err := GetEnv()
+			if err != nil {
+				return fmt.Errorf("failed to get environment: %w", err)
+			}
+			log, err := openSendLog()
+			if err != nil {
+				return err
+			}
+			res, err := bounce.NewWatcher(env.BounceConfig(), log).Poll(cmd.Context())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Scanned %d message(s), found %d rejection(s).\n", res.Scanned, res.Bounces)
+			for _, r := range res.Failed {
+				fmt.Printf("  FAILED  %s -> %s: %s\n", r.Filename, r.To, r.Reason)
+			}
+			for _, b := range res.Unmatched {
+				fmt.Printf("  unmatched rejection for %q: %s\n", b.Title, b.Reason)
+			}
+			return nil
+		},
+	}
+	sendsCmd.AddCommand(checkBouncesCmd)
+
 	rootCmd.AddCommand(searchCmd)
 	rootCmd.AddCommand(downloadCmd)
 	rootCmd.AddCommand(mcpCmd)
 	rootCmd.AddCommand(httpCmd)
 	rootCmd.AddCommand(testEmailCmd)
+	rootCmd.AddCommand(profilesCmd)
+	rootCmd.AddCommand(convertersCmd)
+	rootCmd.AddCommand(shrinkCmd)
+	rootCmd.AddCommand(checkEPUBCmd)
+	rootCmd.AddCommand(repairCmd)
+	rootCmd.AddCommand(comicCmd)
+	rootCmd.AddCommand(textCmd)
+	rootCmd.AddCommand(outboxCmd)
+	rootCmd.AddCommand(sendsCmd)
 
 	if err := fang.Execute(
 		context.Background(),
@@ -225,3 +629,25 @@ func StartCLI() {
 		os.Exit(1)
 	}
 }
+
+func openOutbox() (*outbox.Outbox, error) {
+	env, err := GetEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment: %w", err)
+	}
+	if env.OutboxDir == "" {
+		return nil, fmt.Errorf("outbox not configured. Please set OUTBOX_DIR")
+	}
+	return outbox.Open(env.OutboxDir)
+}
+
+func openSendLog() (*sendlog.Log, error) {
+	env, err := GetEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment: %w", err)
+	}
+	if env.SendLogPath == "" {
+		return nil, fmt.Errorf("send log not configured. Please set SEND_LOG_PATH")
+	}
+	return sendlog.Open(env.SendLogPath)
+}
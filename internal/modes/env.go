@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/sam-hartman/kindle-pibrarian/internal/anna"
+	"github.com/sam-hartman/kindle-pibrarian/internal/bounce"
 	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
 	"go.uber.org/zap"
 )
@@ -20,11 +23,89 @@ type Env struct {
 	SMTPPassword string `json:"smtp_password"`
 	FromEmail    string `json:"from_email"`
 	KindleEmail  string `json:"kindle_email"`
+	// Named Kindle profiles (KINDLE_PROFILES_FILE), see profiles.go
+	ProfilesFile string           `json:"kindle_profiles_file"`
+	Profiles     []anna.Recipient `json:"-"`
+	// Mail transport selection (smtp, sendmail, maildir) and SMTP options
+	MailTransport     string `json:"mail_transport"`
+	SMTPSecurity      string `json:"smtp_security"`
+	SMTPAuth          string `json:"smtp_auth"`
+	OAuthAccessToken  string `json:"-"`
+	OAuthClientID     string `json:"smtp_oauth_client_id"`
+	OAuthClientSecret string `json:"-"`
+	OAuthRefreshToken string `json:"-"`
+	OAuthTokenURL     string `json:"smtp_oauth_token_url"`
+	SendmailPath      string `json:"sendmail_path"`
+	MaildirPath       string `json:"maildir_path"`
+	// MailMaxMessageMB overrides the transport's message size limit
+	MailMaxMessageMB float64 `json:"mail_max_message_mb"`
+	// MailCaptureDir writes messages there as .eml instead of sending them
+	MailCaptureDir string `json:"mail_capture_dir"`
+	// OutboxDir enables the on-disk retry queue for transient send failures
+	OutboxDir string `json:"outbox_dir"`
+	// SendLogPath records accepted sends; the IMAP bounce watcher marks them failed
+	SendLogPath  string `json:"send_log_path"`
+	IMAPHost     string `json:"imap_host"`
+	IMAPPort     string `json:"imap_port"`
+	IMAPUser     string `json:"imap_user"`
+	IMAPPassword string `json:"-"`
+	IMAPSecurity string `json:"imap_security"`
+	IMAPMailbox  string `json:"imap_mailbox"`
 }
 
 // IsEmailConfigured returns true if all required email settings are present
 func (e *Env) IsEmailConfigured() bool {
-	return e.SMTPHost != "" && e.SMTPUser != "" && e.SMTPPassword != "" && e.FromEmail != ""
+	return e.MailConfig().Validate() == nil
+}
+
+// MailConfig returns the outgoing mail transport settings.
+func (e *Env) MailConfig() anna.MailConfig {
+	return anna.MailConfig{
+		Transport:         e.MailTransport,
+		FromEmail:         e.FromEmail,
+		Host:              e.SMTPHost,
+		Port:              e.SMTPPort,
+		User:              e.SMTPUser,
+		Password:          e.SMTPPassword,
+		Security:          e.SMTPSecurity,
+		Auth:              e.SMTPAuth,
+		OAuthAccessToken:  e.OAuthAccessToken,
+		OAuthClientID:     e.OAuthClientID,
+		OAuthClientSecret: e.OAuthClientSecret,
+		OAuthRefreshToken: e.OAuthRefreshToken,
+		OAuthTokenURL:     e.OAuthTokenURL,
+		SendmailPath:      e.SendmailPath,
+		MaildirPath:       e.MaildirPath,
+		MaxMessageBytes:   int64(e.MailMaxMessageMB * 1024 * 1024),
+		CaptureDir:        e.MailCaptureDir,
+		OutboxDir:         e.OutboxDir,
+		SendLogPath:       e.SendLogPath,
+	}
+}
+
+// BounceConfig returns the IMAP settings for the bounce watcher. The user and
+// password default to the SMTP ones (it's the same Gmail account); with
+// SMTP_AUTH=xoauth2 and no IMAP_PASSWORD the same OAuth2 token is used.
+func (e *Env) BounceConfig() bounce.Config {
+	cfg := bounce.Config{
+		Host:     e.IMAPHost,
+		Port:     e.IMAPPort,
+		Security: e.IMAPSecurity,
+		User:     e.IMAPUser,
+		Password: e.IMAPPassword,
+		Mailbox:  e.IMAPMailbox,
+	}
+	if cfg.User == "" {
+		cfg.User = e.SMTPUser
+	}
+	if cfg.Password == "" {
+		if strings.EqualFold(e.SMTPAuth, anna.AuthXOAuth2) {
+			cfg.Token = e.MailConfig().OAuthToken
+		} else {
+			cfg.Password = e.SMTPPassword
+		}
+	}
+	return cfg
 }
 
 // loadEnvFile loads environment variables from a .env file
@@ -96,6 +177,9 @@ func GetEnv() (*Env, error) {
 	smtpPort := os.Getenv("SMTP_PORT")
 	if smtpPort == "" {
 		smtpPort = "587" // Default to TLS port
+		if strings.EqualFold(os.Getenv("SMTP_SECURITY"), anna.SecurityTLS) {
+			smtpPort = "465" // Implicit TLS
+		}
 	}
 	smtpUser := os.Getenv("SMTP_USER")
 	smtpPassword := os.Getenv("SMTP_PASSWORD")
@@ -107,6 +191,27 @@ func GetEnv() (*Env, error) {
 		l.Warn("ANNAS_SECRET_KEY not set - downloads from Anna's Archive will fail")
 	}
 
+	profilesFile := os.Getenv("KINDLE_PROFILES_FILE")
+	var profiles []anna.Recipient
+	if profilesFile != "" {
+		p, err := loadProfiles(profilesFile)
+		if err != nil {
+			l.Error("Ignoring KINDLE_PROFILES_FILE", zap.Error(err))
+		} else {
+			profiles = p
+		}
+	}
+
+	var maxMessageMB float64
+	if v := strings.TrimSpace(os.Getenv("MAIL_MAX_MESSAGE_MB")); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 {
+			l.Error("Ignoring invalid MAIL_MAX_MESSAGE_MB", zap.String("value", v))
+		} else {
+			maxMessageMB = n
+		}
+	}
+
 	// DownloadPath is optional if we're emailing instead
 	if downloadPath == "" {
 		downloadPath = os.TempDir() // Use temp dir if not specified
@@ -121,5 +226,28 @@ func GetEnv() (*Env, error) {
 		SMTPPassword: smtpPassword,
 		FromEmail:    fromEmail,
 		KindleEmail:  kindleEmail,
+		ProfilesFile: profilesFile,
+		Profiles:     profiles,
+
+		MailTransport:     os.Getenv("MAIL_TRANSPORT"),
+		SMTPSecurity:      os.Getenv("SMTP_SECURITY"),
+		SMTPAuth:          os.Getenv("SMTP_AUTH"),
+		OAuthAccessToken:  os.Getenv("SMTP_OAUTH_ACCESS_TOKEN"),
+		OAuthClientID:     os.Getenv("SMTP_OAUTH_CLIENT_ID"),
+		OAuthClientSecret: os.Getenv("SMTP_OAUTH_CLIENT_SECRET"),
+		OAuthRefreshToken: os.Getenv("SMTP_OAUTH_REFRESH_TOKEN"),
+		OAuthTokenURL:     os.Getenv("SMTP_OAUTH_TOKEN_URL"),
+		SendmailPath:      os.Getenv("SENDMAIL_PATH"),
+		MaildirPath:       os.Getenv("MAILDIR_PATH"),
+		MailMaxMessageMB:  maxMessageMB,
+		MailCaptureDir:    os.Getenv("MAIL_CAPTURE_DIR"),
+		OutboxDir:         os.Getenv("OUTBOX_DIR"),
+		SendLogPath:       os.Getenv("SEND_LOG_PATH"),
+		IMAPHost:          os.Getenv("IMAP_HOST"),
+		IMAPPort:          os.Getenv("IMAP_PORT"),
+		IMAPUser:          os.Getenv("IMAP_USER"),
+		IMAPPassword:      os.Getenv("IMAP_PASSWORD"),
+		IMAPSecurity:      os.Getenv("IMAP_SECURITY"),
+		IMAPMailbox:       os.Getenv("IMAP_MAILBOX"),
 	}, nil
 }
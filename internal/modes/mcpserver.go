@@ -3,6 +3,7 @@ package modes
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -59,11 +60,20 @@ const (
 	// Tool names
 	ToolNameSearch   = "search"
 	ToolNameDownload = "download"
+	ToolNameProfiles = "list_profiles"
+	ToolNameValidate = "validate_epub"
+	ToolNameSendText = "send_text"
 
 	// Tool descriptions
 	SearchToolDescription = "Search for books on Anna's Archive. Returns a list of books with metadata including title, authors, format (epub, mobi, pdf, etc.), language, size, and MD5 hash. Results are sorted by format preference (EPUB first by default, as EPUBs are best for Kindle: small file size, reflowable text, adjustable fonts). Use the hash from search results to download a specific book."
 
-	DownloadToolDescription = "Download a book and send it to a Kindle email. The book is downloaded from Anna's Archive, saved locally as a backup (if ANNAS_DOWNLOAD_PATH is set), and then emailed to the specified Kindle email address. If no kindle_email is provided, uses the default configured KINDLE_EMAIL. Requires ANNAS_SECRET_KEY for API access and email configuration (SMTP settings) for Kindle delivery. If email is not configured, falls back to local download only. Note: Kindle email only accepts PDF, EPUB, DOC, DOCX, HTML, RTF, and TXT formats - MOBI files will be rejected."
+	DownloadToolDescription = "Download a book and send it to a Kindle email. The book is downloaded from Anna's Archive, saved locally as a backup (if ANNAS_DOWNLOAD_PATH is set), and then emailed to the specified Kindle email address. kindle_email may be a full address or a named Kindle profile (see list_profiles); if omitted, uses the default configured KINDLE_EMAIL. Requires ANNAS_SECRET_KEY for API access and email configuration (SMTP settings) for Kindle delivery. If email is not configured, falls back to local download only. Note: Kindle email only accepts EPUB, PDF, DOC, DOCX, HTML, RTF, TXT and images - other formats (MOBI/AZW3, FB2, ...) are converted to EPUB before sending."
+
+	ProfilesToolDescription = "List the household's named Kindle profiles (e.g. alice-paperwhite, kids-tablet) with their address, preferred format and size limit. Pass a profile name as kindle_email to the download tool instead of typing an address."
+
+	ValidateToolDescription = "Check an EPUB edition for structural problems before sending it, the way epubcheck does: missing files, broken spine and table-of-contents links, malformed chapters, missing metadata. Returns each finding with its severity (fatal findings block sending; errors may make Amazon reject or mangle the book; warnings are harmless). Only works on EPUB editions - use the hash from search results."
+
+	SendTextToolDescription = "Turn text into an EPUB and send it to a Kindle email - notes, a draft, an article or a public-domain book pasted into the chat. Plain text and Markdown both work: chapter headings (\"Chapter 1\", \"CHAPTER ONE\", Markdown # headings) become the table of contents and hard-wrapped lines are joined into paragraphs. kindle_email may be a full address or a named Kindle profile (see list_profiles); if omitted, uses the default configured KINDLE_EMAIL."
 
 	// Parameter descriptions
 	SearchTermDesc     = "Search term - can be book title, author name, or any keywords"
@@ -72,9 +82,18 @@ const (
 	DownloadTitleDesc  = "Book title - used for the filename and email subject. Get this from search results."
 	DownloadFormatDesc = "Book format (epub, mobi, pdf, azw3, etc.) - get this from search results. The actual format will be detected from the downloaded file, but this helps with initial filename."
 	DownloadAuthorDesc = "Author(s) of the book, from the search result. Used to safely fall back to another edition of the SAME book if the chosen file can't be sent."
-	DownloadKindleDesc = "Optional: Kindle email address to send the book to. If not specified, uses the default KINDLE_EMAIL from server configuration."
+	ValidateHashDesc   = "MD5 hash of the EPUB edition to check - get this from the search results"
+	DownloadKindleDesc = "Optional: Kindle to send the book to - a profile name from list_profiles (e.g. alice-paperwhite) or a full Kindle email address. If not specified, uses the default KINDLE_EMAIL from server configuration."
+	SendTextTextDesc   = "The text to send, in full - plain text or Markdown"
+	SendTextTitleDesc  = "Optional: Title for the book and email subject. Defaults to the text's own title (a Markdown # heading or Project Gutenberg header), else Untitled."
+	SendTextAuthorDesc = "Optional: Author of the text"
+	SendTextFormatDesc = "Optional: 'markdown' or 'text'. Detected from the text if omitted."
 )
 
+// maxSendTextBytes bounds the text send_text takes: a long novel is under
+// 2 MB.
+const maxSendTextBytes = 8 << 20
+
 // SearchParams defines parameters for the search tool
 type SearchParams struct {
 	SearchTerm      string `json:"term" mcp:"Term to search for"`
@@ -87,7 +106,24 @@ type DownloadParams struct {
 	Title       string `json:"title" mcp:"Book title, used for filename"`
 	Format      string `json:"format" mcp:"Book format, for example pdf or epub"`
 	Author      string `json:"author,omitempty" mcp:"Book author(s) from the search result. Used to safely fall back to another edition if the chosen file can't be sent."`
-	KindleEmail string `json:"kindle_email,omitempty" mcp:"Optional Kindle email to send the book to. If not specified, uses the default configured KINDLE_EMAIL."`
+	KindleEmail string `json:"kindle_email,omitempty" mcp:"Optional Kindle profile name or email to send the book to. If not specified, uses the default configured KINDLE_EMAIL."`
+}
+
+// ProfilesParams defines parameters for the list_profiles tool (none)
+type ProfilesParams struct{}
+
+// ValidateParams defines parameters for the validate_epub tool
+type ValidateParams struct {
+	BookHash string `json:"hash" mcp:"MD5 hash of the EPUB edition to check"`
+}
+
+// SendTextParams defines parameters for the send_text tool
+type SendTextParams struct {
+	Text        string `json:"text" mcp:"The text to send, plain text or Markdown"`
+	Title       string `json:"title,omitempty" mcp:"Optional title for the book"`
+	Author      string `json:"author,omitempty" mcp:"Optional author of the text"`
+	Format      string `json:"format,omitempty" mcp:"Optional: markdown or text. Detected if omitted."`
+	KindleEmail string `json:"kindle_email,omitempty" mcp:"Optional Kindle profile name or email to send the book to. If not specified, uses the default configured KINDLE_EMAIL."`
 }
 
 // addToolsToServer adds the standard tools to an MCP server instance
@@ -104,6 +140,17 @@ func addToolsToServer(server *mcp.Server) {
 			mcp.Property("author", mcp.Description(DownloadAuthorDesc)),
 			mcp.Property("kindle_email", mcp.Description(DownloadKindleDesc)),
 		)),
+		mcp.NewServerTool(ToolNameProfiles, ProfilesToolDescription, ProfilesTool),
+		mcp.NewServerTool(ToolNameValidate, ValidateToolDescription, ValidateTool, mcp.Input(
+			mcp.Property("hash", mcp.Description(ValidateHashDesc)),
+		)),
+		mcp.NewServerTool(ToolNameSendText, SendTextToolDescription, SendTextTool, mcp.Input(
+			mcp.Property("text", mcp.Description(SendTextTextDesc)),
+			mcp.Property("title", mcp.Description(SendTextTitleDesc)),
+			mcp.Property("author", mcp.Description(SendTextAuthorDesc)),
+			mcp.Property("format", mcp.Description(SendTextFormatDesc)),
+			mcp.Property("kindle_email", mcp.Description(DownloadKindleDesc)),
+		)),
 	)
 }
 
@@ -158,6 +205,59 @@ func getToolsListJSON() []map[string]interface{} {
 				"required": []string{"hash", "title", "format"},
 			},
 		},
+		{
+			"name":        ToolNameProfiles,
+			"description": ProfilesToolDescription,
+			"inputSchema": map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			},
+		},
+		{
+			"name":        ToolNameValidate,
+			"description": ValidateToolDescription,
+			"inputSchema": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"hash": map[string]interface{}{
+						"type":        "string",
+						"description": ValidateHashDesc,
+					},
+				},
+				"required": []string{"hash"},
+			},
+		},
+		{
+			"name":        ToolNameSendText,
+			"description": SendTextToolDescription,
+			"inputSchema": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"text": map[string]interface{}{
+						"type":        "string",
+						"description": SendTextTextDesc,
+					},
+					"title": map[string]interface{}{
+						"type":        "string",
+						"description": SendTextTitleDesc,
+					},
+					"author": map[string]interface{}{
+						"type":        "string",
+						"description": SendTextAuthorDesc,
+					},
+					"format": map[string]interface{}{
+						"type":        "string",
+						"description": SendTextFormatDesc,
+						"enum":        []string{"markdown", "text"},
+					},
+					"kindle_email": map[string]interface{}{
+						"type":        "string",
+						"description": DownloadKindleDesc,
+					},
+				},
+				"required": []string{"text"},
+			},
+		},
 	}
 }
 
@@ -212,10 +312,18 @@ func checkEmailFallback(err error) (bool, string) {
 			}
 		}
 
+		limitInfo := "It exceeds the mail transport's size limit (MAIL_MAX_MESSAGE_MB)."
+		var tooLarge *anna.TooLargeError
+		if errors.As(err, &tooLarge) {
+			limitInfo = fmt.Sprintf("It exceeds %s.", tooLarge.Reason)
+			if tooLarge.Shrink != nil {
+				limitInfo += fmt.Sprintf(" Shrinking only got it from %s.", tooLarge.Shrink)
+			}
+		}
 		if fileSizeInfo != "" {
-			return true, fmt.Sprintf("File too large for email - %s. Gmail has a 25MB attachment limit (18MB recommended for email).", fileSizeInfo)
+			return true, fmt.Sprintf("File too large for email - %s. %s", fileSizeInfo, limitInfo)
 		}
-		return true, "File too large for email (>18MB). Gmail has a 25MB attachment limit."
+		return true, "File too large for email. " + limitInfo
 	}
 
 	if strings.Contains(errStr, "broken pipe") {
@@ -288,14 +396,26 @@ func DownloadTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallTo
 
 	hash := params.Arguments.BookHash
 
-	// Determine which Kindle email to use: provided or default (need this first for duplicate check)
-	kindleEmail := params.Arguments.KindleEmail
-	if kindleEmail == "" {
-		env, err := GetEnv()
-		if err == nil {
-			kindleEmail = env.KindleEmail
-		}
+	env, err := GetEnv()
+	if err != nil {
+		l.Error("Failed to get environment variables", zap.Error(err))
+		return nil, err
+	}
+
+	// Determine which Kindle to use: a profile name, an address, or the
+	// default KINDLE_EMAIL (need this first for duplicate check)
+	to, err := env.ResolveRecipient(params.Arguments.KindleEmail)
+	if err != nil {
+		l.Warn("Download request has no usable Kindle",
+			zap.String("kindle", params.Arguments.KindleEmail),
+			zap.Error(err),
+		)
+		return &mcp.CallToolResultFor[any]{
+			IsError: true,
+			Content: []mcp.Content{&mcp.TextContent{Text: "Sorry — " + err.Error() + "."}},
+		}, nil
 	}
+	kindleEmail := to.String()
 
 	// Create a composite key for duplicate tracking: hash:kindle_email
 	// This allows the same book to be sent to different Kindles
@@ -331,11 +451,6 @@ func DownloadTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallTo
 		zap.String("kindleEmail", kindleEmail),
 	)
 
-	env, err := GetEnv()
-	if err != nil {
-		l.Error("Failed to get environment variables", zap.Error(err))
-		return nil, err
-	}
 	secretKey := env.SecretKey
 
 	title := params.Arguments.Title
@@ -352,7 +467,34 @@ func DownloadTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallTo
 	// reporting a local save as "success" would be a lie. On failure, surface a
 	// clear, actionable reason and do NOT record the cooldown, so a corrected
 	// retry (e.g. a different edition) isn't blocked.
-	err = book.EmailToKindle(secretKey, env.SMTPHost, env.SMTPPort, env.SMTPUser, env.SMTPPassword, env.FromEmail, kindleEmail)
+	err = book.EmailToKindle(secretKey, env.MailConfig(), to)
+	var queued *anna.QueuedError
+	if errors.As(err, &queued) {
+		// The book is prepared and safely on disk; the outbox worker will retry.
+		// Record the cooldown so a "did it work?" retry doesn't queue it twice.
+		downloadTrackerMu.Lock()
+		downloadTracker[trackerKey] = time.Now()
+		downloadTrackerMu.Unlock()
+
+		l.Warn("Book queued for retry after a transient mail error",
+			zap.String("bookHash", params.Arguments.BookHash),
+			zap.String("outboxID", queued.ID),
+			zap.Error(queued.Cause),
+		)
+		return &mcp.CallToolResultFor[any]{
+			Content: []mcp.Content{&mcp.TextContent{
+				Text: "The mail server is temporarily unavailable, so the book is queued on the server and will be sent to " +
+					kindleEmail + " automatically (outbox id " + queued.ID + ").",
+			}},
+		}, nil
+	}
+	var refused *anna.PolicyError
+	if errors.As(err, &refused) {
+		return &mcp.CallToolResultFor[any]{
+			IsError: true,
+			Content: []mcp.Content{&mcp.TextContent{Text: "Not sent: " + refused.Error() + "."}},
+		}, nil
+	}
 	if err != nil {
 		l.Error("Failed to send book to Kindle",
 			zap.String("bookHash", params.Arguments.BookHash),
@@ -389,6 +531,120 @@ func DownloadTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallTo
 	}, nil
 }
 
+// ProfilesTool lists the configured Kindle profiles.
+func ProfilesTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[ProfilesParams]) (*mcp.CallToolResultFor[any], error) {
+	env, err := GetEnv()
+	if err != nil {
+		return nil, err
+	}
+	items := env.Profiles
+	if items == nil {
+		items = []anna.Recipient{}
+	}
+	return &mcp.CallToolResultFor[any]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: describeProfiles(env.Profiles, env.KindleEmail)}},
+		StructuredContent: map[string]interface{}{"items": items},
+	}, nil
+}
+
+// ValidateTool downloads an edition and reports its EPUB findings.
+func ValidateTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[ValidateParams]) (*mcp.CallToolResultFor[any], error) {
+	env, err := GetEnv()
+	if err != nil {
+		return nil, err
+	}
+	report, err := anna.CheckEdition(params.Arguments.BookHash, env.SecretKey)
+	if err != nil {
+		return &mcp.CallToolResultFor[any]{
+			IsError: true,
+			Content: []mcp.Content{&mcp.TextContent{Text: "Couldn't check that edition: " + err.Error()}},
+		}, nil
+	}
+	return &mcp.CallToolResultFor[any]{
+		Content: []mcp.Content{&mcp.TextContent{Text: report.String()}},
+		StructuredContent: map[string]interface{}{
+			"clean":    report.Clean(),
+			"summary":  report.Summary(),
+			"version":  report.Version,
+			"findings": report.Findings,
+		},
+	}, nil
+}
+
+// SendTextTool converts text to an EPUB and emails it to a Kindle.
+func SendTextTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[SendTextParams]) (*mcp.CallToolResultFor[any], error) {
+	l := logger.GetLogger()
+	args := params.Arguments
+	fail := func(msg string) (*mcp.CallToolResultFor[any], error) {
+		return &mcp.CallToolResultFor[any]{
+			IsError: true,
+			Content: []mcp.Content{&mcp.TextContent{Text: msg}},
+		}, nil
+	}
+	if strings.TrimSpace(args.Text) == "" {
+		return fail("There is no text to send.")
+	}
+	if len(args.Text) > maxSendTextBytes {
+		return fail(fmt.Sprintf("The text is too long to send (%.1f MB; the limit is %d MB).", float64(len(args.Text))/(1024*1024), maxSendTextBytes>>20))
+	}
+	format := ""
+	switch strings.ToLower(args.Format) {
+	case "markdown", "md":
+		format = "md"
+	case "text", "txt", "plain":
+		format = "txt"
+	}
+
+	env, err := GetEnv()
+	if err != nil {
+		l.Error("Failed to get environment variables", zap.Error(err))
+		return nil, err
+	}
+	to, err := env.ResolveRecipient(args.KindleEmail)
+	if err != nil {
+		return fail("Sorry — " + err.Error() + ".")
+	}
+
+	l.Info("Send text command called",
+		zap.String("title", args.Title),
+		zap.Int("bytes", len(args.Text)),
+		zap.String("kindleEmail", to.String()),
+	)
+	opts := anna.TextOptions{Title: args.Title, Author: args.Author, Format: format}
+	title, err := anna.SendTextToKindle(args.Text, opts, env.MailConfig(), to)
+	var queued *anna.QueuedError
+	if errors.As(err, &queued) {
+		return &mcp.CallToolResultFor[any]{
+			Content: []mcp.Content{&mcp.TextContent{
+				Text: "The mail server is temporarily unavailable, so \"" + title + "\" is queued on the server and will be sent to " +
+					to.String() + " automatically (outbox id " + queued.ID + ").",
+			}},
+		}, nil
+	}
+	var refused *anna.PolicyError
+	if errors.As(err, &refused) {
+		return fail("Not sent: " + refused.Error() + ".")
+	}
+	if errors.Is(err, anna.ErrRelayUnsupported) {
+		return fail("Sending text isn't available on this server: " + anna.ErrRelayUnsupported.Error() + ".")
+	}
+	if err != nil {
+		l.Error("Failed to send text to Kindle", zap.Error(err))
+		msg := "Sorry — I couldn't send that text to the Kindle."
+		if _, reason := checkEmailFallback(err); reason != "" {
+			msg += " " + reason
+		} else {
+			msg += " " + err.Error()
+		}
+		return fail(msg)
+	}
+	return &mcp.CallToolResultFor[any]{
+		Content: []mcp.Content{&mcp.TextContent{
+			Text: "\"" + title + "\" sent to Kindle successfully at: " + to.String(),
+		}},
+	}, nil
+}
+
 func StartMCPServer() {
 	l := logger.GetLogger()
 	defer l.Sync()
@@ -402,6 +658,11 @@ func StartMCPServer() {
 	server := mcp.NewServer("annas-mcp", serverVersion, nil)
 	addToolsToServer(server)
 
+	if env, err := GetEnv(); err == nil {
+		startOutboxWorker(env)
+		startBounceWatcher(env)
+	}
+
 	l.Info("MCP server started successfully")
 
 	if err := server.Run(context.Background(), mcp.NewStdioTransport()); err != nil {
@@ -429,6 +690,11 @@ func StartMCPHTTPServer(port string) {
 	mcpServer := mcp.NewServer("annas-mcp", serverVersion, nil)
 	addToolsToServer(mcpServer)
 
+	if env, err := GetEnv(); err == nil {
+		startOutboxWorker(env)
+		startBounceWatcher(env)
+	}
+
 	mux := http.NewServeMux()
 
 	// Root endpoint - some clients check this first
@@ -608,6 +874,35 @@ func StartMCPHTTPServer(port string) {
 				downloadParams := &mcp.CallToolParamsFor[DownloadParams]{Arguments: dlArgs}
 				result, callErr = DownloadTool(ctx, nil, downloadParams)
 
+			case ToolNameProfiles:
+				result, callErr = ProfilesTool(ctx, nil, &mcp.CallToolParamsFor[ProfilesParams]{})
+
+			case ToolNameValidate:
+				hash, _ := params.Arguments["hash"].(string)
+				if hash == "" {
+					sendJSONRPCError(w, jsonRPCReq.ID, -32602, "Invalid params", "hash is required")
+					return
+				}
+				result, callErr = ValidateTool(ctx, nil, &mcp.CallToolParamsFor[ValidateParams]{Arguments: ValidateParams{BookHash: hash}})
+
+			case ToolNameSendText:
+				text, _ := params.Arguments["text"].(string)
+				if text == "" {
+					sendJSONRPCError(w, jsonRPCReq.ID, -32602, "Invalid params", "text is required")
+					return
+				}
+				title, _ := params.Arguments["title"].(string)
+				author, _ := params.Arguments["author"].(string)
+				format, _ := params.Arguments["format"].(string)
+				kindleEmail, _ := params.Arguments["kindle_email"].(string)
+				result, callErr = SendTextTool(ctx, nil, &mcp.CallToolParamsFor[SendTextParams]{Arguments: SendTextParams{
+					Text:        text,
+					Title:       title,
+					Author:      author,
+					Format:      format,
+					KindleEmail: kindleEmail,
+				}})
+
 			default:
 				sendJSONRPCError(w, jsonRPCReq.ID, -32601, "Method not found", "Unknown tool: "+params.Name)
 				return
@@ -640,6 +935,11 @@ func StartMCPHTTPServer(port string) {
 			if result.StructuredContent != nil {
 				resultMap["structuredContent"] = result.StructuredContent
 			}
+			// Tool-level failures (e.g. a refused recipient) must reach the
+			// caller as such, including a relaying Fly instance.
+			if result.IsError {
+				resultMap["isError"] = true
+			}
 
 			l.Info("Tool execution successful",
 				zap.String("tool", params.Name),
@@ -734,6 +1034,15 @@ func StartMCPHTTPServer(port string) {
 		json.NewEncoder(w).Encode(map[string]any{"items": books})
 	})
 
+	// GET /profiles — named Kindle profiles
+	mux.HandleFunc("/profiles", handleProfiles)
+
+	// GET /outbox — delivery retry queue status
+	mux.HandleFunc("/outbox", handleOutbox)
+
+	// GET /sends — send log, with Amazon rejections found by the bounce watcher
+	mux.HandleFunc("/sends", handleSends)
+
 	// Health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -53,3 +53,31 @@ func TestParseDownloadArgs_MissingRequired(t *testing.T) {
 		}
 	}
 }
+
+func TestToolsList_IncludesValidateEPUB(t *testing.T) {
+	for _, tool := range getToolsListJSON() {
+		if tool["name"] != ToolNameValidate {
+			continue
+		}
+		schema := tool["inputSchema"].(map[string]interface{})
+		if req := schema["required"].([]string); len(req) != 1 || req[0] != "hash" {
+			t.Errorf("validate_epub should require only hash, got %v", req)
+		}
+		return
+	}
+	t.Error("validate_epub is missing from tools/list")
+}
+
+func TestToolsList_IncludesSendText(t *testing.T) {
+	for _, tool := range getToolsListJSON() {
+		if tool["name"] != ToolNameSendText {
+			continue
+		}
+		schema := tool["inputSchema"].(map[string]interface{})
+		if req := schema["required"].([]string); len(req) != 1 || req[0] != "text" {
+			t.Errorf("send_text should require only text, got %v", req)
+		}
+		return
+	}
+	t.Error("send_text is missing from tools/list")
+}
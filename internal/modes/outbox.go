@@ -0,0 +1,70 @@
+package modes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/anna"
+	"github.com/sam-hartman/kindle-pibrarian/internal/logger"
+	"github.com/sam-hartman/kindle-pibrarian/internal/outbox"
+	"go.uber.org/zap"
+)
+
+// outboxPollInterval is how often the worker looks for due retries. Backoff
+// delays start at a minute, so polling faster than this buys nothing.
+const outboxPollInterval = 30 * time.Second
+
+// startOutboxWorker starts the background retry loop when OUTBOX_DIR is set,
+// first re-queueing sends a previous run left in flight. It runs for the life
+// of the process.
+func startOutboxWorker(env *Env) {
+	l := logger.GetLogger()
+	if env.OutboxDir == "" {
+		return
+	}
+	box, err := outbox.Open(env.OutboxDir)
+	if err != nil {
+		l.Error("Outbox disabled: cannot open OUTBOX_DIR", zap.String("dir", env.OutboxDir), zap.Error(err))
+		return
+	}
+	recovered, err := box.RecoverInterrupted()
+	if err != nil {
+		l.Error("Outbox disabled: cannot recover interrupted sends", zap.String("dir", env.OutboxDir), zap.Error(err))
+		return
+	}
+	l.Info("Outbox worker started", zap.String("dir", env.OutboxDir), zap.Int("recovered", recovered))
+	go box.Run(context.Background(), outboxPollInterval, anna.OutboxSendFunc(func() (anna.MailConfig, error) {
+		env, err := GetEnv()
+		if err != nil {
+			return anna.MailConfig{}, err
+		}
+		return env.MailConfig(), nil
+	}))
+}
+
+// handleOutbox serves GET /outbox: every queued/sent/dead item with its state.
+func handleOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	env, err := GetEnv()
+	if err != nil || env.OutboxDir == "" {
+		writeJSONError(w, http.StatusNotFound, "outbox not configured (set OUTBOX_DIR)")
+		return
+	}
+	box, err := outbox.Open(env.OutboxDir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not open outbox")
+		return
+	}
+	items, err := box.List()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not read outbox")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"items": items})
+}
@@ -0,0 +1,179 @@
+package modes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sam-hartman/kindle-pibrarian/internal/anna"
+	"github.com/sam-hartman/kindle-pibrarian/internal/relay"
+)
+
+// Named Kindle profiles let the household say "alice-paperwhite" instead of
+// retyping a Send-to-Kindle address in chat. KINDLE_PROFILES_FILE points at a
+// JSON array:
+//
+//	[
+//	  {"name": "alice-paperwhite", "email": "alice_x@kindle.com"},
+//	  {"name": "kids-tablet", "email": "kids_y@kindle.com", "format": "pdf", "max_mb": 10}
+//	]
+//
+// Anywhere a Kindle email is accepted (MCP download, CLI --to, HTTP), a
+// profile name works too. KINDLE_EMAIL may itself name a profile.
+
+// profileEntry is one element of the profiles file.
+type profileEntry struct {
+	Name   string  `json:"name"`
+	Email  string  `json:"email"`
+	Format string  `json:"format,omitempty"`
+	MaxMB  float64 `json:"max_mb,omitempty"`
+}
+
+// loadProfiles reads and validates a profiles file.
+func loadProfiles(path string) ([]anna.Recipient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read Kindle profiles: %w", err)
+	}
+	var entries []profileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse Kindle profiles %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	out := make([]anna.Recipient, 0, len(entries))
+	for i, e := range entries {
+		name := strings.ToLower(strings.TrimSpace(e.Name))
+		if name == "" || strings.Contains(name, "@") {
+			return nil, fmt.Errorf("Kindle profile #%d: name must be non-empty and not an address", i+1)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Kindle profile %q is defined twice", name)
+		}
+		seen[name] = true
+		addr, err := mail.ParseAddress(strings.TrimSpace(e.Email))
+		if err != nil {
+			return nil, fmt.Errorf("Kindle profile %q: invalid email %q", name, e.Email)
+		}
+		switch f := strings.ToLower(strings.TrimSpace(e.Format)); f {
+		case "", "epub", "pdf":
+			e.Format = f
+		default:
+			return nil, fmt.Errorf("Kindle profile %q: format must be epub or pdf, not %q", name, e.Format)
+		}
+		if e.MaxMB < 0 {
+			return nil, fmt.Errorf("Kindle profile %q: max_mb must not be negative", name)
+		}
+		out = append(out, anna.Recipient{
+			Name:     name,
+			Email:    addr.Address,
+			Format:   e.Format,
+			MaxBytes: int64(e.MaxMB * 1024 * 1024),
+			Trusted:  true,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// ResolveRecipient turns a kindle_email argument — a profile name or an
+// address — into a Recipient. Empty means KINDLE_EMAIL. An address that
+// belongs to a profile picks up that profile's preferences. Profiles and
+// KINDLE_EMAIL are Trusted; other addresses must pass the recipient
+// allowlist (anna.RecipientPolicy).
+func (e *Env) ResolveRecipient(nameOrEmail string) (anna.Recipient, error) {
+	v := strings.TrimSpace(nameOrEmail)
+	trusted := false
+	if v == "" {
+		v = strings.TrimSpace(e.KindleEmail)
+		trusted = true // operator-configured, not caller input
+	}
+	if v == "" {
+		return anna.Recipient{}, fmt.Errorf("no Kindle given and KINDLE_EMAIL is not set")
+	}
+
+	if strings.Contains(v, "@") {
+		addr, err := mail.ParseAddress(v)
+		if err != nil {
+			return anna.Recipient{}, fmt.Errorf("invalid Kindle email %q", v)
+		}
+		for _, p := range e.Profiles {
+			if strings.EqualFold(p.Email, addr.Address) {
+				return p, nil
+			}
+		}
+		return anna.Recipient{Email: addr.Address, Trusted: trusted}, nil
+	}
+
+	for _, p := range e.Profiles {
+		if strings.EqualFold(p.Name, v) {
+			return p, nil
+		}
+	}
+	// On Fly the profiles live on the Pi; forward the name for it to resolve.
+	if _, _, ok := relay.Config(); ok && len(e.Profiles) == 0 {
+		return anna.Recipient{Name: strings.ToLower(v)}, nil
+	}
+	if len(e.Profiles) == 0 {
+		return anna.Recipient{}, fmt.Errorf("unknown Kindle %q: no profiles are configured (set KINDLE_PROFILES_FILE) — use a full email address", v)
+	}
+	return anna.Recipient{}, fmt.Errorf("unknown Kindle profile %q (known: %s)", v, strings.Join(e.profileNames(), ", "))
+}
+
+func (e *Env) profileNames() []string {
+	names := make([]string, len(e.Profiles))
+	for i, p := range e.Profiles {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// describeProfiles renders the profile list for the MCP tool and CLI.
+func describeProfiles(profiles []anna.Recipient, defaultEmail string) string {
+	if len(profiles) == 0 {
+		return "No Kindle profiles are configured (set KINDLE_PROFILES_FILE)."
+	}
+	var b strings.Builder
+	for i, p := range profiles {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s: %s", p.Name, p.Email)
+		var notes []string
+		if p.Format != "" {
+			notes = append(notes, "prefers "+p.Format)
+		}
+		if p.MaxBytes > 0 {
+			notes = append(notes, fmt.Sprintf("max %.1f MB", float64(p.MaxBytes)/(1024*1024)))
+		}
+		if defaultEmail != "" && (strings.EqualFold(defaultEmail, p.Email) || strings.EqualFold(defaultEmail, p.Name)) {
+			notes = append(notes, "default")
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(&b, " (%s)", strings.Join(notes, ", "))
+		}
+	}
+	return b.String()
+}
+
+// handleProfiles serves GET /profiles: the configured Kindle profiles.
+func handleProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	env, err := GetEnv()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not load configuration")
+		return
+	}
+	items := env.Profiles
+	if items == nil {
+		items = []anna.Recipient{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"items": items})
+}
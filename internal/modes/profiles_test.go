@@ -0,0 +1,121 @@
+package modes
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func writeProfiles(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testProfilesEnv(t *testing.T) *Env {
+	t.Helper()
+	profiles, err := loadProfiles(writeProfiles(t, `[
+		{"name": "Alice-Paperwhite", "email": "alice_x@kindle.com"},
+		{"name": "kids-tablet", "email": "Kids Tablet <kids_y@kindle.com>", "format": "PDF", "max_mb": 10}
+	]`))
+	if err != nil {
+		t.Fatalf("loadProfiles: %v", err)
+	}
+	return &Env{KindleEmail: "alice-paperwhite", Profiles: profiles}
+}
+
+func TestLoadProfiles_Normalizes(t *testing.T) {
+	env := testProfilesEnv(t)
+	if len(env.Profiles) != 2 {
+		t.Fatalf("expected 2 profiles, got %+v", env.Profiles)
+	}
+	kids := env.Profiles[1]
+	if kids.Name != "kids-tablet" || kids.Email != "kids_y@kindle.com" || kids.Format != "pdf" || kids.MaxBytes != 10*1024*1024 {
+		t.Fatalf("unexpected profile %+v", kids)
+	}
+	if env.Profiles[0].Name != "alice-paperwhite" {
+		t.Fatalf("names should be lowercased and sorted: %+v", env.Profiles)
+	}
+}
+
+func TestLoadProfiles_Rejects(t *testing.T) {
+	for name, body := range map[string]string{
+		"bad json":     `{`,
+		"bad email":    `[{"name": "a", "email": "not-an-address"}]`,
+		"duplicate":    `[{"name": "a", "email": "a@kindle.com"}, {"name": "A", "email": "b@kindle.com"}]`,
+		"bad format":   `[{"name": "a", "email": "a@kindle.com", "format": "mobi"}]`,
+		"address name": `[{"name": "a@kindle.com", "email": "a@kindle.com"}]`,
+	} {
+		if _, err := loadProfiles(writeProfiles(t, body)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestResolveRecipient(t *testing.T) {
+	env := testProfilesEnv(t)
+
+	cases := []struct {
+		in        string
+		wantName  string
+		wantEmail string
+	}{
+		{"kids-tablet", "kids-tablet", "kids_y@kindle.com"},
+		{"KIDS-TABLET", "kids-tablet", "kids_y@kindle.com"},
+		{"kids_y@kindle.com", "kids-tablet", "kids_y@kindle.com"}, // address picks up its profile
+		{"guest_z@kindle.com", "", "guest_z@kindle.com"},
+		{"", "alice-paperwhite", "alice_x@kindle.com"}, // KINDLE_EMAIL names a profile
+	}
+	for _, tc := range cases {
+		got, err := env.ResolveRecipient(tc.in)
+		if err != nil {
+			t.Errorf("ResolveRecipient(%q): %v", tc.in, err)
+			continue
+		}
+		if got.Name != tc.wantName || got.Email != tc.wantEmail {
+			t.Errorf("ResolveRecipient(%q) = %+v, want %s <%s>", tc.in, got, tc.wantName, tc.wantEmail)
+		}
+	}
+
+	_, err := env.ResolveRecipient("alice-oasis")
+	if err == nil || !strings.Contains(err.Error(), "alice-paperwhite, kids-tablet") {
+		t.Errorf("unknown profile should list the known ones, got %v", err)
+	}
+	if _, err := env.ResolveRecipient("bad@@address"); err == nil {
+		t.Error("expected an error for a malformed address")
+	}
+	if _, err := (&Env{}).ResolveRecipient(""); err == nil {
+		t.Error("expected an error with no Kindle and no KINDLE_EMAIL")
+	}
+}
+
+func TestDescribeProfiles(t *testing.T) {
+	env := testProfilesEnv(t)
+	got := describeProfiles(env.Profiles, env.KindleEmail)
+	want := "alice-paperwhite: alice_x@kindle.com (default)\nkids-tablet: kids_y@kindle.com (prefers pdf, max 10.0 MB)"
+	if got != want {
+		t.Errorf("describeProfiles =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDownloadTool_UnknownProfileIsToolError(t *testing.T) {
+	t.Setenv("KINDLE_PROFILES_FILE", "")
+	t.Setenv("UPSTREAM_RELAY_URL", "")
+	res, err := DownloadTool(context.Background(), nil, &mcp.CallToolParamsFor[DownloadParams]{
+		Arguments: DownloadParams{BookHash: "abc", Title: "T", Format: "epub", KindleEmail: "nobody-tablet"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := res.Content[0].(*mcp.TextContent).Text
+	if !res.IsError || !strings.Contains(text, "nobody-tablet") {
+		t.Fatalf("expected a tool error naming the profile, got %+v %q", res, text)
+	}
+}
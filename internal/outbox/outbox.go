@@ -0,0 +1,417 @@
+// Package outbox is a small on-disk delivery queue for the Pi. When Gmail
+// answers with a transient 4xx or the connection drops mid-send, the fully
+// prepared attachment (already sanitized, validated and converted) is parked
+// here and a background worker retries it with exponential backoff, so a
+// flaky mail server no longer means a lost book. Items survive restarts.
+//
+// Layout: one <id>.json record plus one <id>.bin attachment per item in the
+// outbox directory. Records are rewritten atomically (temp file + rename).
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is where an item is in its delivery lifecycle.
+type State string
+
+const (
+	StateQueued  State = "queued"  // waiting for its next attempt
+	StateSending State = "sending" // an attempt is in flight
+	StateSent    State = "sent"    // delivered; attachment removed
+	StateDead    State = "dead"    // gave up (permanent error or too many attempts)
+)
+
+// Defaults for retry behaviour. With 8 attempts starting at one minute and a
+// one-hour cap, the outbox keeps trying for roughly two hours.
+const (
+	DefaultMaxAttempts = 8
+	DefaultBaseDelay   = time.Minute
+	DefaultMaxDelay    = time.Hour
+)
+
+// Item is one queued delivery.
+type Item struct {
+	ID        string `json:"id"`
+	State     State  `json:"state"`
+	To        string `json:"to"`
+	Filename  string `json:"filename"`
+	MimeType  string `json:"mime_type"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	MessageID string `json:"message_id,omitempty"`
+	Size      int64  `json:"size"`
+
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+}
+
+// SendFunc attempts one delivery. Return an error wrapped with Permanent to
+// stop retrying; any other error is retried with backoff.
+type SendFunc func(ctx context.Context, it *Item, attachment []byte) error
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying (e.g. a 5xx rejection).
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// ErrNotFound is returned for an unknown item ID.
+var ErrNotFound = errors.New("outbox item not found")
+
+// Outbox is a directory-backed delivery queue. It is safe for concurrent use
+// within one process, as long as everything goes through the one *Outbox that
+// Open hands out for the directory.
+type Outbox struct {
+	dir string
+
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+var (
+	openMu sync.Mutex
+	opened = map[string]*Outbox{}
+)
+
+// Open opens (creating if needed) the outbox in dir. Every call for the same
+// directory returns the same *Outbox, so the worker, queued sends and
+// listings share its lock. Opening has no side effects on the items: only
+// the worker recovers interrupted sends, with RecoverInterrupted.
+func Open(dir string) (*Outbox, error) {
+	if dir == "" {
+		return nil, errors.New("outbox directory not set")
+	}
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("resolve outbox dir: %w", err)
+	}
+	openMu.Lock()
+	defer openMu.Unlock()
+	if o := opened[key]; o != nil {
+		return o, nil
+	}
+	o, err := open(key)
+	if err != nil {
+		return nil, err
+	}
+	opened[key] = o
+	return o, nil
+}
+
+func open(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create outbox dir: %w", err)
+	}
+	return &Outbox{
+		dir:         dir,
+		MaxAttempts: DefaultMaxAttempts,
+		BaseDelay:   DefaultBaseDelay,
+		MaxDelay:    DefaultMaxDelay,
+		now:         time.Now,
+	}, nil
+}
+
+func (o *Outbox) recordPath(id string) string { return filepath.Join(o.dir, id+".json") }
+func (o *Outbox) dataPath(id string) string   { return filepath.Join(o.dir, id+".bin") }
+
+// Enqueue stores a new item and its attachment, due immediately.
+func (o *Outbox) Enqueue(it Item, attachment []byte) (*Item, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := o.now()
+	it.ID = id
+	it.State = StateQueued
+	it.Size = int64(len(attachment))
+	it.Attempts = 0
+	it.CreatedAt = now
+	it.UpdatedAt = now
+	it.NextAttempt = now
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := writeFileAtomic(o.dataPath(id), attachment); err != nil {
+		return nil, fmt.Errorf("store outbox attachment: %w", err)
+	}
+	if err := o.save(&it); err != nil {
+		os.Remove(o.dataPath(id))
+		return nil, err
+	}
+	return &it, nil
+}
+
+// Get returns one item by ID.
+func (o *Outbox) Get(id string) (*Item, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.load(id)
+}
+
+// List returns every item, oldest first.
+func (o *Outbox) List() ([]Item, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.list()
+}
+
+// Retry puts a dead item back in the queue with a fresh attempt budget.
+func (o *Outbox) Retry(id string) (*Item, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	it, err := o.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if it.State != StateDead {
+		return nil, fmt.Errorf("outbox item %s is %s, not dead", id, it.State)
+	}
+	if _, err := os.Stat(o.dataPath(id)); err != nil {
+		return nil, fmt.Errorf("outbox item %s has no stored attachment", id)
+	}
+	it.State = StateQueued
+	it.Attempts = 0
+	it.NextAttempt = o.now()
+	if err := o.save(it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// ProcessDue makes one delivery attempt for every item whose next attempt is
+// due, and returns how many items it attempted.
+func (o *Outbox) ProcessDue(ctx context.Context, send SendFunc) int {
+	o.mu.Lock()
+	items, err := o.list()
+	o.mu.Unlock()
+	if err != nil {
+		return 0
+	}
+	attempted := 0
+	for i := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		it := &items[i]
+		if it.State != StateQueued || it.NextAttempt.After(o.now()) {
+			continue
+		}
+		o.attempt(ctx, it, send)
+		attempted++
+	}
+	return attempted
+}
+
+func (o *Outbox) attempt(ctx context.Context, it *Item, send SendFunc) {
+	o.mu.Lock()
+	it.State = StateSending
+	it.Attempts++
+	it.UpdatedAt = o.now()
+	saveErr := o.save(it)
+	o.mu.Unlock()
+	if saveErr != nil {
+		return
+	}
+
+	data, err := os.ReadFile(o.dataPath(it.ID))
+	if err != nil {
+		err = Permanent(fmt.Errorf("read outbox attachment: %w", err))
+	} else {
+		err = send(ctx, it, data)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	it.UpdatedAt = now
+	switch {
+	case err == nil:
+		it.State = StateSent
+		it.LastError = ""
+		it.SentAt = &now
+		os.Remove(o.dataPath(it.ID))
+	case IsPermanent(err) || it.Attempts >= o.MaxAttempts:
+		it.State = StateDead
+		it.LastError = err.Error()
+	default:
+		it.State = StateQueued
+		it.LastError = err.Error()
+		it.NextAttempt = now.Add(o.backoff(it.Attempts))
+	}
+	o.save(it)
+}
+
+// backoff returns the delay after the n-th failed attempt: BaseDelay doubled
+// per attempt, capped at MaxDelay.
+func (o *Outbox) backoff(n int) time.Duration {
+	d := o.BaseDelay
+	for i := 1; i < n; i++ {
+		d *= 2
+		if d >= o.MaxDelay {
+			return o.MaxDelay
+		}
+	}
+	return d
+}
+
+// Run processes due items every interval until ctx is cancelled.
+func (o *Outbox) Run(ctx context.Context, interval time.Duration, send SendFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		o.ProcessDue(ctx, send)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RecoverInterrupted puts items left in "sending" by a crash or restart back
+// in the queue, due now, and returns how many it found. Only the worker may
+// call it, once, before it starts: anywhere else it would re-queue a
+// delivery that is still in flight.
+func (o *Outbox) RecoverInterrupted() (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	items, err := o.list()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range items {
+		if items[i].State == StateSending {
+			items[i].State = StateQueued
+			items[i].NextAttempt = o.now()
+			if err := o.save(&items[i]); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// list, load and save expect o.mu to be held.
+
+func (o *Outbox) list() ([]Item, error) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read outbox: %w", err)
+	}
+	items := make([]Item, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		it, err := o.load(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue // skip a corrupt record rather than wedging the queue
+		}
+		items = append(items, *it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].CreatedAt.Before(items[j].CreatedAt) })
+	return items, nil
+}
+
+func (o *Outbox) load(id string) (*Item, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	b, err := os.ReadFile(o.recordPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var it Item
+	if err := json.Unmarshal(b, &it); err != nil {
+		return nil, fmt.Errorf("decode outbox item %s: %w", id, err)
+	}
+	return &it, nil
+}
+
+func (o *Outbox) save(it *Item) error {
+	b, err := json.MarshalIndent(it, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(o.recordPath(it.ID), b); err != nil {
+		return fmt.Errorf("save outbox item: %w", err)
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b), nil
+}
+
+// validID keeps IDs from the CLI/HTTP API from escaping the outbox directory.
+func validID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
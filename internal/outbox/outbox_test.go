@@ -0,0 +1,194 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeClock lets tests step time forward to make backoff deterministic.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func openTest(t *testing.T) (*Outbox, *fakeClock) {
+	t.Helper()
+	o, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	clock := &fakeClock{t: time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)}
+	o.now = clock.now
+	return o, clock
+}
+
+func enqueue(t *testing.T, o *Outbox) *Item {
+	t.Helper()
+	it, err := o.Enqueue(Item{To: "reader_x@kindle.com", Filename: "The Deal.epub", MimeType: "application/epub+zip"}, []byte("epub bytes"))
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	return it
+}
+
+func TestOutbox_SuccessMarksSentAndDropsAttachment(t *testing.T) {
+	o, _ := openTest(t)
+	it := enqueue(t, o)
+
+	var got []byte
+	n := o.ProcessDue(context.Background(), func(_ context.Context, _ *Item, data []byte) error {
+		got = data
+		return nil
+	})
+	if n != 1 || string(got) != "epub bytes" {
+		t.Fatalf("expected one attempt with the stored attachment, got n=%d data=%q", n, got)
+	}
+	done, err := o.Get(it.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.State != StateSent || done.SentAt == nil || done.Attempts != 1 {
+		t.Fatalf("unexpected item after success: %+v", done)
+	}
+	if _, err := os.Stat(o.dataPath(it.ID)); !os.IsNotExist(err) {
+		t.Error("attachment should be removed once sent")
+	}
+}
+
+func TestOutbox_TransientFailureBacksOff(t *testing.T) {
+	o, clock := openTest(t)
+	it := enqueue(t, o)
+	fail := func(context.Context, *Item, []byte) error { return errors.New("451 try later") }
+
+	o.ProcessDue(context.Background(), fail)
+	got, _ := o.Get(it.ID)
+	if got.State != StateQueued || got.Attempts != 1 || got.LastError != "451 try later" {
+		t.Fatalf("unexpected item after first failure: %+v", got)
+	}
+	if want := clock.t.Add(o.BaseDelay); !got.NextAttempt.Equal(want) {
+		t.Fatalf("next attempt = %v, want %v", got.NextAttempt, want)
+	}
+
+	// Not due yet: nothing happens.
+	if n := o.ProcessDue(context.Background(), fail); n != 0 {
+		t.Fatalf("item retried before its backoff elapsed")
+	}
+
+	clock.advance(o.BaseDelay)
+	o.ProcessDue(context.Background(), fail)
+	got, _ = o.Get(it.ID)
+	if want := clock.t.Add(2 * o.BaseDelay); got.Attempts != 2 || !got.NextAttempt.Equal(want) {
+		t.Fatalf("second backoff should double: attempts=%d next=%v want %v", got.Attempts, got.NextAttempt, want)
+	}
+}
+
+func TestOutbox_GivesUpAfterMaxAttempts(t *testing.T) {
+	o, clock := openTest(t)
+	o.MaxAttempts = 3
+	it := enqueue(t, o)
+	for i := 0; i < 3; i++ {
+		o.ProcessDue(context.Background(), func(context.Context, *Item, []byte) error { return errors.New("timeout") })
+		clock.advance(o.MaxDelay)
+	}
+	got, _ := o.Get(it.ID)
+	if got.State != StateDead || got.Attempts != 3 {
+		t.Fatalf("expected dead after 3 attempts, got %+v", got)
+	}
+
+	// Dead items can be revived by hand.
+	revived, err := o.Retry(it.ID)
+	if err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if revived.State != StateQueued || revived.Attempts != 0 {
+		t.Fatalf("unexpected revived item: %+v", revived)
+	}
+}
+
+func TestOutbox_PermanentFailureIsDeadImmediately(t *testing.T) {
+	o, _ := openTest(t)
+	it := enqueue(t, o)
+	o.ProcessDue(context.Background(), func(context.Context, *Item, []byte) error {
+		return Permanent(errors.New("550 no such mailbox"))
+	})
+	got, _ := o.Get(it.ID)
+	if got.State != StateDead || got.Attempts != 1 {
+		t.Fatalf("expected dead after a permanent error, got %+v", got)
+	}
+}
+
+func TestOutbox_SurvivesRestartAndRecoversInFlight(t *testing.T) {
+	dir := t.TempDir()
+	o, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := enqueue(t, o)
+
+	// Simulate a crash mid-send.
+	stuck, _ := o.Get(it.ID)
+	stuck.State = StateSending
+	o.mu.Lock()
+	o.save(stuck)
+	o.mu.Unlock()
+
+	// A new process opens the directory afresh.
+	reopened, err := open(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if n, err := reopened.RecoverInterrupted(); err != nil || n != 1 {
+		t.Fatalf("RecoverInterrupted = %d, %v; want 1 item", n, err)
+	}
+	items, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != it.ID || items[0].State != StateQueued {
+		t.Fatalf("expected the interrupted item back in the queue, got %+v", items)
+	}
+}
+
+func TestOutbox_OpenAndListLeaveInFlightAlone(t *testing.T) {
+	o, _ := openTest(t)
+	it := enqueue(t, o)
+	inFlight, _ := o.Get(it.ID)
+	inFlight.State = StateSending
+	o.mu.Lock()
+	o.save(inFlight)
+	o.mu.Unlock()
+
+	again, err := Open(o.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != o {
+		t.Error("Open should hand out one Outbox per directory")
+	}
+	items, err := again.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].State != StateSending {
+		t.Fatalf("listing must not touch a send in flight, got %+v", items)
+	}
+}
+
+func TestOutbox_BackoffCapped(t *testing.T) {
+	o := &Outbox{BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+	for n, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 5: 10 * time.Minute, 20: 10 * time.Minute} {
+		if got := o.backoff(n); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestOutbox_RejectsPathTraversalIDs(t *testing.T) {
+	o, _ := openTest(t)
+	if _, err := o.Get("../../etc/passwd"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a traversal ID, got %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+// Package sendlog keeps a persistent record of every book handed to a mail
+// server. SMTP acceptance isn't delivery: Amazon can reject a document hours
+// later with a bounce to FROM_EMAIL. The bounce watcher (internal/bounce)
+// matches those rejections back to a record here — by Message-ID when the
+// bounce quotes it, else by document title — and flips it to "failed" with
+// Amazon's reason, so the failure is visible somewhere other than an inbox
+// nobody reads.
+//
+// The log is a single JSON file rewritten atomically (temp file + rename).
+package sendlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Status is the delivery outcome as far as we know it.
+type Status string
+
+const (
+	StatusSent   Status = "sent"   // accepted by the mail server
+	StatusFailed Status = "failed" // Amazon (or a mailer daemon) bounced it
+)
+
+// Record is one send.
+type Record struct {
+	MessageID string     `json:"message_id"`
+	To        string     `json:"to"`
+	Filename  string     `json:"filename"`
+	Title     string     `json:"title,omitempty"`
+	Size      int64      `json:"size"`
+	Status    Status     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	SentAt    time.Time  `json:"sent_at"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+}
+
+// ErrNotFound is returned when no record matches a bounce.
+var ErrNotFound = errors.New("no matching send in the send log")
+
+// titleMatchWindow bounds how far back a title-only match may reach. Amazon
+// bounces within hours; anything older is more likely a re-send of the same
+// book that did arrive.
+const titleMatchWindow = 7 * 24 * time.Hour
+
+// maxRecords caps the log, which is rewritten whole on every send: Add drops
+// the oldest records beyond it. That is years of history for one household.
+const maxRecords = 1000
+
+// Log is a file-backed send log. It is safe for concurrent use within one
+// process, as long as everything goes through the one *Log that Open hands
+// out for the path.
+type Log struct {
+	path string
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+var (
+	openMu sync.Mutex
+	opened = map[string]*Log{}
+)
+
+// Open opens (creating the parent directory if needed) the send log at path.
+// Every call for the same path returns the same *Log, so sends, the bounce
+// watcher and listings never overwrite each other's changes.
+func Open(path string) (*Log, error) {
+	if path == "" {
+		return nil, errors.New("send log path not set")
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("resolve send log path: %w", err)
+	}
+	openMu.Lock()
+	defer openMu.Unlock()
+	if l := opened[key]; l != nil {
+		return l, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(key), 0700); err != nil {
+		return nil, fmt.Errorf("create send log dir: %w", err)
+	}
+	l := &Log{path: key, now: time.Now}
+	opened[key] = l
+	return l, nil
+}
+
+// Add records a send. SentAt defaults to now and Status to sent. The oldest
+// records beyond maxRecords are dropped.
+func (l *Log) Add(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records, err := l.load()
+	if err != nil {
+		return err
+	}
+	if r.SentAt.IsZero() {
+		r.SentAt = l.now().UTC()
+	}
+	if r.Status == "" {
+		r.Status = StatusSent
+	}
+	records = append(records, r)
+	if len(records) > maxRecords {
+		sort.SliceStable(records, func(i, j int) bool { return records[i].SentAt.Before(records[j].SentAt) })
+		records = records[len(records)-maxRecords:]
+	}
+	return l.save(records)
+}
+
+// List returns every record, newest first.
+func (l *Log) List() ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].SentAt.After(records[j].SentAt) })
+	return records, nil
+}
+
+// Match identifies the send a bounce refers to. MessageID wins when present;
+// Title is compared loosely against each record's title and filename.
+type Match struct {
+	MessageID string
+	Title     string
+}
+
+// MarkFailed flips the matching record to failed with reason and returns it.
+// A record that has already failed is returned unchanged, so re-reading the
+// same bounce is harmless.
+func (l *Log) MarkFailed(m Match, reason string) (*Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	i := l.find(records, m)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	r := &records[i]
+	if r.Status == StatusFailed {
+		return r, nil
+	}
+	now := l.now().UTC()
+	r.Status = StatusFailed
+	r.Reason = reason
+	r.FailedAt = &now
+	if err := l.save(records); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// find returns the index of the record m refers to, or -1. Title matches
+// prefer the most recent successful send inside titleMatchWindow.
+func (l *Log) find(records []Record, m Match) int {
+	if id := normalizeMessageID(m.MessageID); id != "" {
+		for i := range records {
+			if normalizeMessageID(records[i].MessageID) == id {
+				return i
+			}
+		}
+	}
+	want := normalizeTitle(m.Title)
+	if want == "" {
+		return -1
+	}
+	cutoff := l.now().Add(-titleMatchWindow)
+	best := -1
+	for i, r := range records {
+		if r.Status != StatusSent || r.SentAt.Before(cutoff) {
+			continue
+		}
+		if normalizeTitle(r.Title) != want && normalizeTitle(r.Filename) != want {
+			continue
+		}
+		if best < 0 || r.SentAt.After(records[best].SentAt) {
+			best = i
+		}
+	}
+	return best
+}
+
+func normalizeMessageID(id string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(id), "<>"))
+}
+
+// normalizeTitle reduces a title or filename to lowercase letters and digits
+// so "The Deal.epub", "The_Deal.epub" and "the deal" compare equal.
+func normalizeTitle(s string) string {
+	s = strings.TrimSpace(s)
+	if ext := filepath.Ext(s); ext != "" && len(ext) <= 5 {
+		s = strings.TrimSuffix(s, ext)
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (l *Log) load() ([]Record, error) {
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read send log: %w", err)
+	}
+	var records []Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("parse send log %s: %w", l.path, err)
+	}
+	return records, nil
+}
+
+func (l *Log) save(records []Record) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".sendlog-*")
+	if err != nil {
+		return fmt.Errorf("write send log: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write send log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write send log: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write send log: %w", err)
+	}
+	return nil
+}
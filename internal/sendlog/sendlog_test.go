@@ -0,0 +1,120 @@
+package sendlog
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTest(t *testing.T) *Log {
+	t.Helper()
+	l, err := Open(filepath.Join(t.TempDir(), "sends.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l
+}
+
+func TestMarkFailed_ByMessageID(t *testing.T) {
+	l := openTest(t)
+	l.Add(Record{MessageID: "<abc@example.com>", Filename: "The Deal.epub", To: "k@kindle.com"})
+	l.Add(Record{MessageID: "<def@example.com>", Filename: "Other.epub", To: "k@kindle.com"})
+
+	r, err := l.MarkFailed(Match{MessageID: "ABC@example.com", Title: "Other"}, "E999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Filename != "The Deal.epub" || r.Status != StatusFailed || r.Reason != "E999" || r.FailedAt == nil {
+		t.Fatalf("Message-ID should win over title: %+v", r)
+	}
+
+	// Persisted.
+	records, _ := l.List()
+	failed := 0
+	for _, rec := range records {
+		if rec.Status == StatusFailed {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("expected exactly one failed record, got %+v", records)
+	}
+}
+
+func TestMarkFailed_ByTitlePrefersNewest(t *testing.T) {
+	l := openTest(t)
+	base := l.now()
+	l.Add(Record{MessageID: "<old@x>", Filename: "The_Deal.epub", SentAt: base.Add(-2 * time.Hour)})
+	l.Add(Record{MessageID: "<new@x>", Filename: "The Deal.epub", SentAt: base.Add(-time.Hour)})
+	l.Add(Record{MessageID: "<ancient@x>", Filename: "The Deal.epub", SentAt: base.Add(-30 * 24 * time.Hour)})
+
+	r, err := l.MarkFailed(Match{Title: "the deal.EPUB"}, "E999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.MessageID != "<new@x>" {
+		t.Fatalf("expected the newest matching send, got %s", r.MessageID)
+	}
+}
+
+func TestMarkFailed_ByTitleSkipsFailedSends(t *testing.T) {
+	l := openTest(t)
+	base := l.now()
+	l.Add(Record{MessageID: "<sent@x>", Filename: "The Deal.epub", SentAt: base.Add(-2 * time.Hour)})
+	l.Add(Record{MessageID: "<failed@x>", Filename: "The Deal.epub", SentAt: base.Add(-time.Hour), Status: StatusFailed, Reason: "SMTP 550"})
+
+	r, err := l.MarkFailed(Match{Title: "The Deal"}, "E999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.MessageID != "<sent@x>" || r.Reason != "E999" {
+		t.Fatalf("expected the older successful send, got %+v", r)
+	}
+}
+
+func TestMarkFailed_NoMatch(t *testing.T) {
+	l := openTest(t)
+	l.Add(Record{MessageID: "<a@x>", Filename: "Something.epub"})
+	if _, err := l.MarkFailed(Match{Title: "Nothing Like It"}, "E999"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := l.MarkFailed(Match{}, "E999"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("an empty match must not match anything, got %v", err)
+	}
+}
+
+func TestOpen_SharesOneLogPerPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sends.json")
+	a, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Error("Open should hand out one Log per path, so writers share its lock")
+	}
+}
+
+func TestAdd_DropsOldestBeyondCap(t *testing.T) {
+	l := openTest(t)
+	base := l.now()
+	for i := 0; i < maxRecords+5; i++ {
+		if err := l.Add(Record{MessageID: fmt.Sprintf("<%d@x>", i), SentAt: base.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, _ := l.List()
+	if len(records) != maxRecords {
+		t.Fatalf("log holds %d records, want %d", len(records), maxRecords)
+	}
+	if newest, oldest := records[0].MessageID, records[len(records)-1].MessageID; newest != fmt.Sprintf("<%d@x>", maxRecords+4) || oldest != "<5@x>" {
+		t.Errorf("kept %s..%s, want the newest", oldest, newest)
+	}
+}